@@ -0,0 +1,90 @@
+package warppipe
+
+import (
+	"sync"
+)
+
+// ackTracker keeps track of the positions (LSNs or changeset IDs) of emitted
+// changesets, in emission order, and computes the highest position for which
+// every changeset up to and including it has been acknowledged.
+type ackTracker struct {
+	mu        sync.Mutex
+	pending   []*ackEntry
+	committed uint64
+}
+
+type ackEntry struct {
+	pos   uint64
+	acked bool
+}
+
+// newAckTracker returns an ackTracker whose committed position starts at start.
+func newAckTracker(start uint64) *ackTracker {
+	return &ackTracker{committed: start}
+}
+
+// track registers a new position and returns a function that acknowledges it.
+// Positions must be tracked in non-decreasing order. Several changesets may
+// share the same position (e.g. all changes in a transaction), in which case
+// the position is only committed once all of them have been acknowledged.
+func (t *ackTracker) track(pos uint64) func() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	e := &ackEntry{pos: pos}
+	t.pending = append(t.pending, e)
+
+	return func() {
+		t.mu.Lock()
+		defer t.mu.Unlock()
+
+		if e.acked {
+			return
+		}
+		e.acked = true
+		t.advance()
+	}
+}
+
+// skip marks a position that has no changesets to emit as processed.
+func (t *ackTracker) skip(pos uint64) {
+	t.track(pos)()
+}
+
+// position returns the highest contiguous acknowledged position.
+func (t *ackTracker) position() uint64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return t.committed
+}
+
+// reset drops all pending positions and sets the committed position to pos.
+// It is used when a stream is restarted from pos, after which any changesets
+// still pending are emitted again; acknowledging the previous copies has no
+// effect.
+func (t *ackTracker) reset(pos uint64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.pending = nil
+	t.committed = pos
+}
+
+// advance must be called with the lock held.
+func (t *ackTracker) advance() {
+	for len(t.pending) > 0 && t.pending[0].acked {
+		e := t.pending[0]
+		t.pending[0] = nil
+		t.pending = t.pending[1:]
+
+		// don't commit a position while other changesets sharing it are still pending
+		if len(t.pending) > 0 && t.pending[0].pos == e.pos {
+			continue
+		}
+
+		if e.pos > t.committed {
+			t.committed = e.pos
+		}
+	}
+}
@@ -0,0 +1,90 @@
+package warppipe
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAckTracker(t *testing.T) {
+	t.Run("acks in order", func(t *testing.T) {
+		tracker := newAckTracker(10)
+		ack1 := tracker.track(20)
+		ack2 := tracker.track(30)
+		assert.Equal(t, uint64(10), tracker.position())
+
+		ack1()
+		assert.Equal(t, uint64(20), tracker.position())
+		ack2()
+		assert.Equal(t, uint64(30), tracker.position())
+	})
+
+	t.Run("acks out of order", func(t *testing.T) {
+		tracker := newAckTracker(0)
+		ack1 := tracker.track(20)
+		ack2 := tracker.track(30)
+		ack3 := tracker.track(40)
+
+		ack3()
+		ack2()
+		assert.Equal(t, uint64(0), tracker.position())
+
+		ack1()
+		assert.Equal(t, uint64(40), tracker.position())
+	})
+
+	t.Run("shared positions", func(t *testing.T) {
+		tracker := newAckTracker(0)
+		ack1 := tracker.track(20)
+		ack2 := tracker.track(20)
+		ack3 := tracker.track(30)
+
+		ack1()
+		assert.Equal(t, uint64(0), tracker.position())
+
+		ack3()
+		assert.Equal(t, uint64(0), tracker.position())
+
+		ack2()
+		assert.Equal(t, uint64(30), tracker.position())
+	})
+
+	t.Run("skipped positions", func(t *testing.T) {
+		tracker := newAckTracker(0)
+		ack := tracker.track(20)
+		tracker.skip(30)
+		assert.Equal(t, uint64(0), tracker.position())
+
+		ack()
+		assert.Equal(t, uint64(30), tracker.position())
+	})
+
+	t.Run("duplicate acks", func(t *testing.T) {
+		tracker := newAckTracker(0)
+		ack1 := tracker.track(20)
+		ack2 := tracker.track(20)
+
+		ack1()
+		ack1()
+		assert.Equal(t, uint64(0), tracker.position())
+
+		ack2()
+		assert.Equal(t, uint64(20), tracker.position())
+	})
+
+	t.Run("reset", func(t *testing.T) {
+		tracker := newAckTracker(0)
+		ack1 := tracker.track(20)
+		ack2 := tracker.track(30)
+		ack1()
+		assert.Equal(t, uint64(20), tracker.position())
+
+		tracker.reset(20)
+		ack3 := tracker.track(30)
+		ack2()
+		assert.Equal(t, uint64(20), tracker.position())
+
+		ack3()
+		assert.Equal(t, uint64(30), tracker.position())
+	})
+}
@@ -2,6 +2,7 @@ package warppipe
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"os"
 	"os/signal"
@@ -118,7 +119,8 @@ func (a *Axon) Run() error {
 		Database: a.Config.SourceDBName,
 	}
 
-	wp, err := NewWarpPipe(&connConfig, listener)
+	// changesets are acknowledged once applied to the target database
+	wp, err := NewWarpPipe(&connConfig, listener, ManualAck())
 	if err != nil {
 		return fmt.Errorf("failed to establish a warp-pipe: %w", err)
 	}
@@ -129,6 +131,7 @@ func (a *Axon) Run() error {
 	}
 
 	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
 	changes, errs := wp.ListenForChanges(ctx)
 
 	for {
@@ -141,6 +144,11 @@ func (a *Axon) Run() error {
 			targetDBConn.Close()
 			return nil
 		case err := <-errs:
+			var connEvent *ConnectionEvent
+			if errors.As(err, &connEvent) && !connEvent.Fatal() {
+				a.Logger.WithField("component", "warp_pipe").Warn(err)
+				continue
+			}
 			return fmt.Errorf("listener received an error: %w", err)
 		case change := <-changes:
 			// Override the schema if a target database schema has been configured.
@@ -148,6 +156,7 @@ func (a *Axon) Run() error {
 				change.Schema = a.Config.TargetDBSchema
 			}
 			a.processChange(sourceDBConn, targetDBConn, change)
+			change.Ack()
 			if a.Config.ShutdownAfterLastChangeset {
 				isLatest, err := wp.IsLatestChangeSet(change.ID)
 				if err != nil {
@@ -262,7 +271,7 @@ func (a *Axon) Shutdown() {
 
 func (a *Axon) processChange(sourceDB *sqlx.DB, targetDB *sqlx.DB, change *Changeset) {
 	switch change.Kind {
-	case ChangesetKindInsert:
+	case ChangesetKindInsert, ChangesetKindSnapshot:
 		a.processInsert(sourceDB, targetDB, change)
 	case ChangesetKindUpdate:
 		a.processUpdate(targetDB, change)
@@ -1,6 +1,7 @@
 package warppipe
 
 import (
+	"encoding/json"
 	"fmt"
 	"log"
 	"reflect"
@@ -22,6 +23,12 @@ func prepareQueryArgs(changesetCols []*ChangesetColumn) ([]string, []string, map
 	var colArgs []string
 	values := make(map[string]interface{}, len(cols))
 	for _, c := range changesetCols {
+		if raw, ok := c.Value.(json.RawMessage); ok {
+			// json and jsonb values are passed as text, a []byte would be sent
+			// as bytea
+			c.Value = string(raw)
+		}
+
 		t := reflect.TypeOf(c.Value)
 		if t != nil && t.Kind() == reflect.Map {
 			// Found a hashmap, this is a JSON/B field. This type is not supported
@@ -12,9 +12,14 @@ type ChangesetKind string
 
 // ChangesetKind constants
 const (
-	ChangesetKindInsert ChangesetKind = "insert"
-	ChangesetKindUpdate ChangesetKind = "update"
-	ChangesetKindDelete ChangesetKind = "delete"
+	ChangesetKindInsert   ChangesetKind = "insert"
+	ChangesetKindUpdate   ChangesetKind = "update"
+	ChangesetKindDelete   ChangesetKind = "delete"
+	ChangesetKindTruncate ChangesetKind = "truncate"
+
+	// ChangesetKindSnapshot is the kind of changesets for rows read during
+	// an initial snapshot, before streaming changes.
+	ChangesetKindSnapshot ChangesetKind = "snapshot"
 )
 
 // ParseChangesetKind parses a changeset kind from a string.
@@ -26,6 +31,10 @@ func ParseChangesetKind(kind string) ChangesetKind {
 		return ChangesetKindUpdate
 	case "delete":
 		return ChangesetKindDelete
+	case "truncate":
+		return ChangesetKindTruncate
+	case "snapshot":
+		return ChangesetKindSnapshot
 	default:
 		// TODO: should this error?
 		return ""
@@ -33,14 +42,42 @@ func ParseChangesetKind(kind string) ChangesetKind {
 }
 
 // Changeset represents a changeset for a record on a Postgres table.
+//
+// TxID identifies the transaction the change was made in. TxPosition is the
+// zero-based position of the changeset within its transaction, and TxLast is
+// set on the last changeset of the transaction, so that consumers can apply
+// whole transactions atomically. CommitTime is only available in logical
+// replication modes.
 type Changeset struct {
-	ID        int64              `json:"id"`
-	Kind      ChangesetKind      `json:"kind"`
-	Schema    string             `json:"schema"`
-	Table     string             `json:"table"`
-	Timestamp time.Time          `json:"timestamp"`
-	NewValues []*ChangesetColumn `json:"new_values"`
-	OldValues []*ChangesetColumn `json:"old_values"`
+	ID         int64              `json:"id"`
+	LSN        uint64             `json:"lsn,omitempty"`
+	TxID       int64              `json:"txid,omitempty"`
+	TxPosition int                `json:"tx_position"`
+	TxLast     bool               `json:"tx_last"`
+	Kind       ChangesetKind      `json:"kind"`
+	Schema     string             `json:"schema"`
+	Table      string             `json:"table"`
+	Timestamp  time.Time          `json:"timestamp"`
+	CommitTime time.Time          `json:"commit_time"`
+	NewValues  []*ChangesetColumn `json:"new_values"`
+	OldValues  []*ChangesetColumn `json:"old_values"`
+
+	ack func()
+	// replayFrom is the pipeline stage a replayed dead letter failed in,
+	// which the stages before it pass through.
+	replayFrom string
+}
+
+// Ack acknowledges that the changeset has been processed. Listeners only
+// report a position back to the database (e.g. the replication slot's flush
+// LSN) once every changeset up to that position has been acknowledged, so
+// consumers of a listener must call Ack for each changeset they receive.
+// WarpPipe acknowledges changesets once they are received, unless the
+// ManualAck() option is set. Calling Ack more than once is a no-op.
+func (c *Changeset) Ack() {
+	if c.ack != nil {
+		c.ack()
+	}
 }
 
 func (c *Changeset) getColumnValue(values []*ChangesetColumn, column string) (interface{}, bool) {
@@ -0,0 +1,209 @@
+package warppipe
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx"
+)
+
+const defaultCheckpointInterval = 10 * time.Second
+
+// Position is a position in the stream of changesets.
+type Position struct {
+	// LSN of the last acknowledged changeset (logical replication).
+	LSN uint64 `json:"lsn,omitempty"`
+	// ID of the last acknowledged changeset (audit).
+	ChangesetID int64 `json:"changeset_id,omitempty"`
+	// Time at which the position was recorded.
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// CheckpointStore persists the position of the last acknowledged changeset,
+// so that streaming can be resumed after a restart.
+type CheckpointStore interface {
+	// Load returns the saved position, or nil if none was saved.
+	Load(ctx context.Context) (*Position, error)
+	// Save replaces the saved position.
+	Save(ctx context.Context, pos *Position) error
+}
+
+// FileCheckpointStore is a CheckpointStore that saves the position as JSON in
+// a local file.
+type FileCheckpointStore struct {
+	path string
+}
+
+// NewFileCheckpointStore returns a new FileCheckpointStore for the given path.
+func NewFileCheckpointStore(path string) *FileCheckpointStore {
+	return &FileCheckpointStore{path: path}
+}
+
+// Load implements CheckpointStore.
+func (s *FileCheckpointStore) Load(ctx context.Context) (*Position, error) {
+	b, err := ioutil.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var pos Position
+	err = json.Unmarshal(b, &pos)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse checkpoint file %s: %w", s.path, err)
+	}
+	return &pos, nil
+}
+
+// Save implements CheckpointStore. The position is written to a temporary
+// file which is then renamed, so that the checkpoint file is never left
+// partially written.
+func (s *FileCheckpointStore) Save(ctx context.Context, pos *Position) error {
+	b, err := json.Marshal(pos)
+	if err != nil {
+		return err
+	}
+
+	f, err := ioutil.TempFile(filepath.Dir(s.path), filepath.Base(s.path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	_, err = f.Write(b)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(f.Name(), s.path)
+}
+
+// PostgresCheckpointStore is a CheckpointStore that saves positions in the
+// `warp_pipe.checkpoints` table of a Postgres database, which is created if it
+// does not exist. Several pipes can share the table by using different names.
+type PostgresCheckpointStore struct {
+	mu         sync.Mutex
+	connConfig *pgx.ConnConfig
+	conn       *pgx.Conn
+	name       string
+}
+
+// NewPostgresCheckpointStore returns a new PostgresCheckpointStore that saves
+// the position under the given name. The connection is opened on first use.
+func NewPostgresCheckpointStore(connConfig *pgx.ConnConfig, name string) *PostgresCheckpointStore {
+	return &PostgresCheckpointStore{
+		connConfig: connConfig,
+		name:       name,
+	}
+}
+
+// Load implements CheckpointStore.
+func (s *PostgresCheckpointStore) Load(ctx context.Context) (*Position, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	conn, err := s.connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var pos Position
+	var lsn string
+	err = conn.QueryRowEx(ctx, `
+		SELECT lsn::TEXT, changeset_id, ts
+		FROM warp_pipe.checkpoints
+		WHERE name = $1`,
+		nil, s.name,
+	).Scan(&lsn, &pos.ChangesetID, &pos.Timestamp)
+	if err == pgx.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	pos.LSN, err = pgx.ParseLSN(lsn)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse checkpoint LSN: %w", err)
+	}
+	return &pos, nil
+}
+
+// Save implements CheckpointStore.
+func (s *PostgresCheckpointStore) Save(ctx context.Context, pos *Position) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	conn, err := s.connect(ctx)
+	if err != nil {
+		return err
+	}
+
+	_, err = conn.ExecEx(ctx, `
+		INSERT INTO warp_pipe.checkpoints (name, lsn, changeset_id, ts)
+			VALUES ($1, $2::pg_lsn, $3, $4)
+		ON CONFLICT (name) DO UPDATE
+			SET lsn = EXCLUDED.lsn, changeset_id = EXCLUDED.changeset_id, ts = EXCLUDED.ts`,
+		nil, s.name, pgx.FormatLSN(pos.LSN), pos.ChangesetID, pos.Timestamp,
+	)
+	return err
+}
+
+// Close closes the database connection.
+func (s *PostgresCheckpointStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.conn == nil {
+		return nil
+	}
+
+	err := s.conn.Close()
+	s.conn = nil
+	return err
+}
+
+// connect returns the open connection, (re)connecting and creating the
+// checkpoints table if needed. It must be called with the lock held.
+func (s *PostgresCheckpointStore) connect(ctx context.Context) (*pgx.Conn, error) {
+	if s.conn != nil && s.conn.IsAlive() {
+		return s.conn, nil
+	}
+
+	conn, err := pgx.Connect(*s.connConfig)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to the checkpoint database: %w", err)
+	}
+
+	_, err = conn.ExecEx(ctx, `
+		CREATE SCHEMA IF NOT EXISTS warp_pipe;
+		CREATE TABLE IF NOT EXISTS warp_pipe.checkpoints (
+			name TEXT PRIMARY KEY,
+			lsn PG_LSN NOT NULL,
+			changeset_id BIGINT NOT NULL,
+			ts TIMESTAMPTZ NOT NULL
+		)`,
+		nil,
+	)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to create the checkpoints table: %w", err)
+	}
+
+	s.conn = conn
+	return conn, nil
+}
@@ -0,0 +1,74 @@
+package warppipe_test
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	warppipe "github.com/perangel/warp-pipe"
+)
+
+func TestFileCheckpointStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "warp-pipe-checkpoint")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "checkpoint.json")
+	store := warppipe.NewFileCheckpointStore(path)
+	ctx := context.Background()
+
+	t.Run("load missing checkpoint", func(t *testing.T) {
+		pos, err := store.Load(ctx)
+		assert.NoError(t, err)
+		assert.Nil(t, pos)
+	})
+
+	t.Run("save and load", func(t *testing.T) {
+		ts := time.Date(2021, time.March, 1, 12, 0, 0, 0, time.UTC)
+		err := store.Save(ctx, &warppipe.Position{LSN: 0x16B3748, Timestamp: ts})
+		assert.NoError(t, err)
+
+		err = store.Save(ctx, &warppipe.Position{ChangesetID: 42, Timestamp: ts})
+		assert.NoError(t, err)
+
+		pos, err := store.Load(ctx)
+		assert.NoError(t, err)
+		assert.Equal(t, &warppipe.Position{ChangesetID: 42, Timestamp: ts}, pos)
+
+		// the temporary files are renamed or removed
+		files, err := ioutil.ReadDir(dir)
+		assert.NoError(t, err)
+		assert.Len(t, files, 1)
+	})
+
+	t.Run("load invalid checkpoint", func(t *testing.T) {
+		err := ioutil.WriteFile(path, []byte("{"), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = store.Load(ctx)
+		assert.Error(t, err)
+	})
+}
+
+func TestLogicalReplicationListenerResumeFrom(t *testing.T) {
+	pos := warppipe.Position{LSN: 0x16B3748}
+
+	err := warppipe.NewLogicalReplicationListener().ResumeFrom(pos)
+	assert.EqualError(t, err, "cannot resume from LSN 0/16B3748 without re-using the replication slot")
+
+	err = warppipe.NewLogicalReplicationListener(warppipe.ReuseReplSlot(true)).ResumeFrom(pos)
+	assert.NoError(t, err)
+
+	// the start LSN takes precedence
+	err = warppipe.NewLogicalReplicationListener(warppipe.StartFromLSN(0x16B3700)).ResumeFrom(pos)
+	assert.NoError(t, err)
+}
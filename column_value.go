@@ -0,0 +1,360 @@
+package warppipe
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Layouts of the timestamps and dates produced by Postgres, in text (e.g.
+// wal2json and pgoutput) and in JSON (e.g. row_to_json()).
+var timeLayouts = []string{
+	"2006-01-02 15:04:05.999999999-07",
+	"2006-01-02 15:04:05.999999999-07:00",
+	"2006-01-02 15:04:05.999999999-07:00:00",
+	"2006-01-02 15:04:05.999999999",
+	"2006-01-02T15:04:05.999999999Z07:00",
+	"2006-01-02T15:04:05.999999999",
+	"2006-01-02",
+}
+
+// decodeValue converts a column value, as decoded from JSON with numbers as
+// json.Number or read as text, to a Go value based on the column's Postgres
+// type:
+//
+//     smallint, integer, bigint, oid            int64
+//     real, double precision                    float64
+//     numeric                                   Decimal
+//     boolean                                   bool
+//     timestamp (with time zone), date          time.Time, in UTC
+//     bytea                                     []byte
+//     uuid                                      UUID
+//     json, jsonb                               json.RawMessage
+//     arrays                                    []interface{} of their elements
+//
+// Other types, and values that cannot be converted (e.g. `infinity` or `NaN`
+// floats, which JSON cannot represent), are kept as strings. Numbers of
+// columns of unknown types are int64 if they are integers that fit, float64
+// otherwise.
+func decodeValue(pgType string, v interface{}) interface{} {
+	if v == nil {
+		return nil
+	}
+
+	t := baseColumnType(pgType)
+	if strings.HasSuffix(t, "[]") {
+		return decodeArray(strings.TrimSuffix(t, "[]"), v)
+	}
+
+	switch x := v.(type) {
+	case json.Number:
+		return decodeNumber(t, x)
+	case float64:
+		return decodeNumber(t, json.Number(strconv.FormatFloat(x, 'f', -1, 64)))
+	case string:
+		if decoded, ok := decodeText(t, x); ok {
+			return decoded
+		}
+		return x
+	case []interface{}:
+		return decodeArray("", x)
+	default:
+		return v
+	}
+}
+
+func decodeNumber(t string, n json.Number) interface{} {
+	switch t {
+	case "numeric", "decimal":
+		return Decimal(n)
+	case "real", "double precision", "float4", "float8":
+		if f, err := n.Float64(); err == nil {
+			return f
+		}
+	case "json", "jsonb":
+		return json.RawMessage(n)
+	}
+
+	if i, err := n.Int64(); err == nil {
+		return i
+	}
+	if strings.ContainsAny(string(n), ".eE") {
+		if f, err := n.Float64(); err == nil {
+			return f
+		}
+	}
+	// an integer out of the range of int64
+	return Decimal(n)
+}
+
+// decodeText converts the text representation of a value. It returns false
+// if the type has no conversion or the value is invalid.
+func decodeText(t string, s string) (interface{}, bool) {
+	switch t {
+	case "smallint", "integer", "bigint", "oid", "int2", "int4", "int8":
+		i, err := strconv.ParseInt(s, 10, 64)
+		return i, err == nil
+	case "real", "double precision", "float4", "float8":
+		f, err := strconv.ParseFloat(s, 64)
+		return f, err == nil && !math.IsInf(f, 0) && !math.IsNaN(f)
+	case "numeric", "decimal":
+		if _, ok := Decimal(s).Rat(); !ok && s != "NaN" {
+			return nil, false
+		}
+		return Decimal(s), true
+	case "boolean", "bool":
+		switch s {
+		case "t", "true":
+			return true, true
+		case "f", "false":
+			return false, true
+		}
+	case "timestamp with time zone", "timestamp without time zone", "timestamptz", "timestamp", "date":
+		for _, layout := range timeLayouts {
+			if ts, err := time.Parse(layout, s); err == nil {
+				return ts.UTC(), true
+			}
+		}
+	case "bytea":
+		if strings.HasPrefix(s, `\x`) {
+			b, err := hex.DecodeString(s[2:])
+			return b, err == nil
+		}
+	case "uuid":
+		u, err := ParseUUID(s)
+		return u, err == nil
+	case "json", "jsonb":
+		if json.Valid([]byte(s)) {
+			return json.RawMessage(s), true
+		}
+	}
+	return nil, false
+}
+
+// decodeArray converts the elements of an array, either decoded from JSON or
+// in the Postgres text representation, e.g. `{1,2,NULL}`.
+func decodeArray(elemType string, v interface{}) interface{} {
+	var elems []interface{}
+	switch x := v.(type) {
+	case []interface{}:
+		elems = x
+	case string:
+		var err error
+		elems, err = parseArray(x)
+		if err != nil {
+			return x
+		}
+	default:
+		return v
+	}
+
+	out := make([]interface{}, len(elems))
+	for i, elem := range elems {
+		if nested, ok := elem.([]interface{}); ok {
+			out[i] = decodeArray(elemType, nested)
+			continue
+		}
+		out[i] = decodeValue(elemType, elem)
+	}
+	return out
+}
+
+var errInvalidArray = errors.New("invalid array")
+
+// parseArray parses the text representation of an array into nested slices
+// of strings, with nil for NULL elements.
+func parseArray(s string) ([]interface{}, error) {
+	// skip dimensions, e.g. `[0:1]={1,2}`
+	if strings.HasPrefix(s, "[") {
+		i := strings.Index(s, "=")
+		if i < 0 {
+			return nil, errInvalidArray
+		}
+		s = s[i+1:]
+	}
+
+	arr, rest, err := parseArrayElems(s)
+	if err != nil {
+		return nil, err
+	}
+	if rest != "" {
+		return nil, errInvalidArray
+	}
+	return arr, nil
+}
+
+// parseArrayElems parses the array at the start of s and returns the rest of
+// the string.
+func parseArrayElems(s string) ([]interface{}, string, error) {
+	if !strings.HasPrefix(s, "{") {
+		return nil, "", errInvalidArray
+	}
+	s = s[1:]
+
+	elems := []interface{}{}
+	if strings.HasPrefix(s, "}") {
+		return elems, s[1:], nil
+	}
+
+	for {
+		var elem interface{}
+		var err error
+		switch {
+		case strings.HasPrefix(s, "{"):
+			elem, s, err = parseArrayElems(s)
+		case strings.HasPrefix(s, `"`):
+			elem, s, err = parseQuotedElem(s)
+		default:
+			i := strings.IndexAny(s, ",}")
+			if i < 0 {
+				return nil, "", errInvalidArray
+			}
+			text := strings.TrimSpace(s[:i])
+			if strings.EqualFold(text, "NULL") {
+				elem = nil
+			} else {
+				elem = text
+			}
+			s = s[i:]
+		}
+		if err != nil {
+			return nil, "", err
+		}
+		elems = append(elems, elem)
+
+		if s == "" {
+			return nil, "", errInvalidArray
+		}
+		sep := s[0]
+		s = s[1:]
+		if sep == '}' {
+			return elems, s, nil
+		}
+		if sep != ',' {
+			return nil, "", errInvalidArray
+		}
+	}
+}
+
+func parseQuotedElem(s string) (string, string, error) {
+	var b bytes.Buffer
+	for i := 1; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			i++
+			if i < len(s) {
+				b.WriteByte(s[i])
+			}
+		case '"':
+			return b.String(), s[i+1:], nil
+		default:
+			b.WriteByte(s[i])
+		}
+	}
+	return "", "", errInvalidArray
+}
+
+// baseColumnType returns a Postgres type name without its modifiers, e.g.
+// `numeric` for `numeric(10,2)`. Array types keep their `[]` suffix.
+func baseColumnType(pgType string) string {
+	t := strings.ToLower(strings.TrimSpace(pgType))
+	array := strings.HasSuffix(t, "[]")
+	t = strings.TrimSuffix(t, "[]")
+	if i := strings.Index(t, "("); i >= 0 {
+		if j := strings.Index(t, ")"); j > i {
+			// e.g. `timestamp(3) with time zone`
+			t = strings.TrimSpace(t[:i] + t[j+1:])
+		}
+	}
+	if array {
+		t += "[]"
+	}
+	return t
+}
+
+// decodeRowJSON decodes a row encoded with row_to_json() into a map of column
+// values, converted based on the given column types. Values of json and jsonb
+// columns are kept as they were encoded. Without a type, objects are returned
+// as JSON strings, as re-encoding them could change their representation.
+func decodeRowJSON(data []byte, columnTypes map[string]string) (map[string]interface{}, error) {
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, err
+	}
+
+	values := make(map[string]interface{}, len(raw))
+	for k, v := range raw {
+		pgType := columnTypes[k]
+		t := baseColumnType(pgType)
+		if (t == "json" || t == "jsonb") && !bytes.Equal(v, []byte("null")) {
+			values[k] = v
+			continue
+		}
+		if len(v) > 0 && v[0] == '{' {
+			values[k] = string(v)
+			continue
+		}
+
+		dec := json.NewDecoder(bytes.NewReader(v))
+		dec.UseNumber()
+		var value interface{}
+		if err := dec.Decode(&value); err != nil {
+			return nil, err
+		}
+		values[k] = decodeValue(pgType, value)
+	}
+	return values, nil
+}
+
+// UnmarshalJSON implements json.Unmarshaler. The value is converted based on
+// the column's type, so that columns encoded as JSON (e.g. in a dead letter
+// store) are decoded to the same values as when they were read.
+func (c *ChangesetColumn) UnmarshalJSON(data []byte) error {
+	var col struct {
+		Column string          `json:"column"`
+		Value  json.RawMessage `json:"value"`
+		Type   string          `json:"type"`
+	}
+	if err := json.Unmarshal(data, &col); err != nil {
+		return err
+	}
+
+	c.Column = col.Column
+	c.Type = col.Type
+	c.Value = nil
+	if len(col.Value) == 0 || bytes.Equal(col.Value, []byte("null")) {
+		return nil
+	}
+
+	switch baseColumnType(col.Type) {
+	case "json", "jsonb":
+		c.Value = col.Value
+		return nil
+	case "bytea":
+		// []byte values are encoded in base64
+		var s string
+		if err := json.Unmarshal(col.Value, &s); err == nil && !strings.HasPrefix(s, `\x`) {
+			b, err := base64.StdEncoding.DecodeString(s)
+			if err != nil {
+				return err
+			}
+			c.Value = b
+			return nil
+		}
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(col.Value))
+	dec.UseNumber()
+	var value interface{}
+	if err := dec.Decode(&value); err != nil {
+		return err
+	}
+	c.Value = decodeValue(col.Type, value)
+	return nil
+}
@@ -0,0 +1,89 @@
+package warppipe
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDecodeValue(t *testing.T) {
+	uuid, err := ParseUUID("a0eebc99-9c0b-4ef8-bb6d-6bb9bd380a11")
+	assert.NoError(t, err)
+
+	testCases := []struct {
+		pgType   string
+		value    interface{}
+		expected interface{}
+	}{
+		{"bigint", json.Number("9007199254740993"), int64(9007199254740993)},
+		{"bigint", "9007199254740993", int64(9007199254740993)},
+		{"integer", float64(42), int64(42)},
+		{"double precision", json.Number("1.5"), 1.5},
+		{"double precision", "NaN", "NaN"},
+		{"numeric(10,2)", json.Number("10.50"), Decimal("10.50")},
+		{"numeric", "123456789012345678901234567890.1", Decimal("123456789012345678901234567890.1")},
+		{"numeric", "NaN", Decimal("NaN")},
+		{"boolean", "t", true},
+		{"boolean", true, true},
+		{"timestamp with time zone", "2021-03-01 12:00:00.5+00", time.Date(2021, 3, 1, 12, 0, 0, 5e8, time.UTC)},
+		{"timestamp(3) with time zone", "2021-03-01T12:00:00+00:00", time.Date(2021, 3, 1, 12, 0, 0, 0, time.UTC)},
+		{"timestamp without time zone", "2021-03-01 12:00:00", time.Date(2021, 3, 1, 12, 0, 0, 0, time.UTC)},
+		{"date", "2021-03-01", time.Date(2021, 3, 1, 0, 0, 0, 0, time.UTC)},
+		{"timestamp with time zone", "infinity", "infinity"},
+		{"bytea", `\x0102ff`, []byte{1, 2, 0xff}},
+		{"uuid", "a0eebc99-9c0b-4ef8-bb6d-6bb9bd380a11", uuid},
+		{"jsonb", `{"a": [1, 2]}`, json.RawMessage(`{"a": [1, 2]}`)},
+		{"text", "hello", "hello"},
+		{"character varying(255)", "42", "42"},
+		{"integer[]", "{1,NULL,3}", []interface{}{int64(1), nil, int64(3)}},
+		{"integer[]", []interface{}{json.Number("1"), json.Number("2")}, []interface{}{int64(1), int64(2)}},
+		{"text[]", `{a,"b,c","d\"e",NULL,"NULL"}`, []interface{}{"a", "b,c", `d"e`, nil, "NULL"}},
+		{"integer[]", "{{1,2},{3,4}}", []interface{}{[]interface{}{int64(1), int64(2)}, []interface{}{int64(3), int64(4)}}},
+		{"integer[]", "[0:1]={1,2}", []interface{}{int64(1), int64(2)}},
+		{"text[]", "{}", []interface{}{}},
+		{"", json.Number("9007199254740993"), int64(9007199254740993)},
+		{"", json.Number("1.5"), 1.5},
+		{"", json.Number("99999999999999999999"), Decimal("99999999999999999999")},
+		{"bigint", nil, nil},
+	}
+
+	for _, tc := range testCases {
+		assert.Equal(t, tc.expected, decodeValue(tc.pgType, tc.value), "%s %v", tc.pgType, tc.value)
+	}
+}
+
+func TestDecodeRowJSON(t *testing.T) {
+	row := `{"id":9007199254740993,"doc":{"b":1, "a":2},"tags":["x","y"],"meta":{"k":"v"},"price":10.50,"note":null}`
+	types := map[string]string{
+		"id":    "bigint",
+		"doc":   "jsonb",
+		"tags":  "text[]",
+		"price": "numeric(10,2)",
+		"note":  "jsonb",
+	}
+
+	values, err := decodeRowJSON([]byte(row), types)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{
+		"id":    int64(9007199254740993),
+		"doc":   json.RawMessage(`{"b":1, "a":2}`),
+		"tags":  []interface{}{"x", "y"},
+		"meta":  `{"k":"v"}`,
+		"price": Decimal("10.50"),
+		"note":  nil,
+	}, values)
+}
+
+func TestColumnValueJSON(t *testing.T) {
+	uuid, err := ParseUUID("{A0EEBC999C0B4EF8BB6D6BB9BD380A11}")
+	assert.NoError(t, err)
+
+	b, err := json.Marshal([]interface{}{Decimal("10.50"), Decimal("NaN"), uuid})
+	assert.NoError(t, err)
+	assert.Equal(t, `[10.50,"NaN","a0eebc99-9c0b-4ef8-bb6d-6bb9bd380a11"]`, string(b))
+
+	_, err = ParseUUID("not-a-uuid")
+	assert.EqualError(t, err, "invalid UUID 'not-a-uuid'")
+}
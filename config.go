@@ -3,6 +3,7 @@ package warppipe
 import (
 	"errors"
 	"fmt"
+	"time"
 
 	"github.com/kelseyhightower/envconfig"
 	"github.com/sirupsen/logrus"
@@ -30,12 +31,22 @@ type Config struct {
 	// Note: This setting takes precedent over the whitelisted tables.
 	IgnoreTables []string `envconfig:"IGNORE_TABLES"`
 
-	// Replication mode may be either `lr` (logical replication) or `audit`.
+	// Replication mode may be one of `lr` (logical replication with wal2json),
+	// `pgoutput` (logical replication with the built-in pgoutput plugin) or `audit`.
 	ReplicationMode string `envconfig:"REPLICATION_MODE" default:"lr"`
 
+	// Specifies the publication to replicate. (pgoutput mode only)
+	PublicationName string `envconfig:"PUBLICATION_NAME" default:"warp_pipe"`
+
 	// Specifies the replication slot name to be used. (LR mode only)
 	ReplicationSlotName string `envconfig:"REPLICATION_SLOT_NAME"`
 
+	// Re-use the replication slot across restarts instead of creating a new one. (LR mode only)
+	ReuseReplicationSlot bool `envconfig:"REUSE_REPLICATION_SLOT"`
+
+	// Read the current rows of all replicated tables before streaming changes. (LR mode only)
+	InitialSnapshot bool `envconfig:"INITIAL_SNAPSHOT"`
+
 	// Start replication from the specified logical sequence number. (LR mode only)
 	StartFromLSN uint64 `envconfig:"START_FROM_LSN"`
 
@@ -45,6 +56,76 @@ type Config struct {
 	// Start replication from the specified changeset timestamp. (Audit mode only)
 	StartFromTimestamp int64 `envconfig:"START_FROM_TIMESTAMP"`
 
+	// Interval at which the changesets table is polled when no notification is received. (Audit mode only)
+	PollInterval time.Duration `envconfig:"POLL_INTERVAL" default:"5s"`
+
+	// Maximum number of changesets read from the changesets table per query. (Audit mode only)
+	BatchSize int `envconfig:"BATCH_SIZE" default:"500"`
+
+	// Registers the listener as a consumer of the changesets table under this name. (Audit mode only)
+	ConsumerName string `envconfig:"CONSUMER_NAME"`
+
+	// Interval at which changesets processed by all consumers are pruned. Zero disables retention. (Audit mode only)
+	RetentionInterval time.Duration `envconfig:"RETENTION_INTERVAL"`
+
+	// Only prune changesets older than this. (Audit mode only)
+	RetentionOlderThan time.Duration `envconfig:"RETENTION_OLDER_THAN"`
+
+	// Saves the position of acknowledged changesets to resume from after a restart. Either `source`, to
+	// save it in the `warp_pipe.checkpoints` table of the source database, or the path of a local file.
+	Checkpoint string `envconfig:"CHECKPOINT"`
+
+	// Name under which the position is saved in the `warp_pipe.checkpoints` table.
+	CheckpointName string `envconfig:"CHECKPOINT_NAME" default:"warp_pipe"`
+
+	// Interval at which the position is saved.
+	CheckpointInterval time.Duration `envconfig:"CHECKPOINT_INTERVAL" default:"10s"`
+
+	// Path of a YAML or JSON pipeline configuration, whose stages transform and filter changesets after the
+	// whitelisted and ignored tables.
+	Pipeline string `envconfig:"PIPELINE"`
+
+	// Stores the changesets that pipeline stages failed to process. Either `source`, to save them in the
+	// `warp_pipe.dead_letters` table of the source database, or the path of a local file.
+	DeadLetter string `envconfig:"DEAD_LETTER"`
+
+	// Output to which changesets are written, as a URL whose scheme selects the sink, e.g. `stdout`,
+	// `file:///var/lib/warp-pipe/changes.ndjson?max_size=104857600`, `https://example.com/webhook`,
+	// `nats://localhost:4222` or `redis://localhost:6379/0`.
+	Output string `envconfig:"OUTPUT" default:"stdout"`
+
+	// Format in which changesets are written to the output, `json`, `debezium`, `cloudevents` or `avro`. Parameters are
+	// passed as a query string, e.g. `debezium?schemas=false`.
+	OutputFormat string `envconfig:"OUTPUT_FORMAT" default:"json"`
+
+	// Maximum number of changesets written to the output at once.
+	OutputBatchSize int `envconfig:"OUTPUT_BATCH_SIZE" default:"100"`
+
+	// Maximum time a changeset waits for its batch to fill up before it is written to the output.
+	OutputFlushInterval time.Duration `envconfig:"OUTPUT_FLUSH_INTERVAL" default:"1s"`
+
+	// Address on which `warp-pipe serve` serves changesets over gRPC, e.g. `:9090`.
+	GRPCAddr string `envconfig:"GRPC_ADDR" default:":9090"`
+
+	// Certificate and key files with which `warp-pipe serve` serves gRPC over TLS. Without them, gRPC is served
+	// over cleartext HTTP/2.
+	GRPCTLSCert string `envconfig:"GRPC_TLS_CERT"`
+	GRPCTLSKey  string `envconfig:"GRPC_TLS_KEY"`
+
+	// How long a gRPC subscriber may stay disconnected before its pending changesets are released. Zero disables
+	// it.
+	GRPCSubscriberTimeout time.Duration `envconfig:"GRPC_SUBSCRIBER_TIMEOUT" default:"1h"`
+
+	// Maximum number of consecutive attempts to re-establish a lost connection.
+	// A negative value retries forever, and zero disables reconnecting.
+	ReconnectMaxRetries int `envconfig:"RECONNECT_MAX_RETRIES" default:"10"`
+
+	// Delay before the first reconnect attempt, doubled after each failed attempt.
+	ReconnectInitialBackoff time.Duration `envconfig:"RECONNECT_INITIAL_BACKOFF" default:"1s"`
+
+	// Maximum delay between reconnect attempts.
+	ReconnectMaxBackoff time.Duration `envconfig:"RECONNECT_MAX_BACKOFF" default:"1m"`
+
 	// Sets the log level
 	LogLevel string `envconfig:"LOG_LEVEL" default:"info"`
 }
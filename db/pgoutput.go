@@ -0,0 +1,368 @@
+package db
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Message types of the pgoutput logical replication protocol (version 1).
+// See: https://www.postgresql.org/docs/current/protocol-logicalrep-message-formats.html
+const (
+	PgOutputMessageBegin    = 'B'
+	PgOutputMessageCommit   = 'C'
+	PgOutputMessageOrigin   = 'O'
+	PgOutputMessageRelation = 'R'
+	PgOutputMessageType     = 'Y'
+	PgOutputMessageInsert   = 'I'
+	PgOutputMessageUpdate   = 'U'
+	PgOutputMessageDelete   = 'D'
+	PgOutputMessageTruncate = 'T'
+)
+
+// Kinds of column values in a pgoutput TupleData message.
+const (
+	PgOutputTupleNull      = 'n'
+	PgOutputTupleUnchanged = 'u'
+	PgOutputTupleText      = 't'
+)
+
+// Flags of a column in a pgoutput Relation message.
+const (
+	PgOutputColumnFlagKey = 1
+)
+
+// Options of a pgoutput Truncate message.
+const (
+	PgOutputTruncateCascade         = 1
+	PgOutputTruncateRestartIdentity = 2
+)
+
+var (
+	errPgOutputShortMessage = errors.New("pgoutput message is too short")
+
+	// Postgres epoch (2000-01-01) used for timestamps in the replication protocol.
+	pgEpoch = time.Date(2000, time.January, 1, 0, 0, 0, 0, time.UTC)
+)
+
+// PgOutputMessage is a decoded pgoutput message.
+type PgOutputMessage interface {
+	Type() byte
+}
+
+// PgOutputBegin represents the start of a transaction.
+type PgOutputBegin struct {
+	FinalLSN   uint64
+	CommitTime time.Time
+	XID        uint32
+}
+
+// PgOutputCommit represents the end of a transaction.
+type PgOutputCommit struct {
+	Flags      uint8
+	CommitLSN  uint64
+	EndLSN     uint64
+	CommitTime time.Time
+}
+
+// PgOutputOrigin represents the replication origin of a transaction.
+type PgOutputOrigin struct {
+	CommitLSN uint64
+	Name      string
+}
+
+// PgOutputRelation describes the columns of a relation. It is sent before
+// the first change to a relation in a session, and again whenever the
+// relation definition changes.
+type PgOutputRelation struct {
+	ID              uint32
+	Namespace       string
+	Name            string
+	ReplicaIdentity uint8
+	Columns         []*PgOutputRelationColumn
+}
+
+// PgOutputRelationColumn is a column of a PgOutputRelation.
+type PgOutputRelationColumn struct {
+	Flags    uint8
+	Name     string
+	TypeOID  uint32
+	TypeMode int32
+}
+
+// IsKey returns true if the column is part of the relation's replica identity.
+func (c *PgOutputRelationColumn) IsKey() bool {
+	return c.Flags&PgOutputColumnFlagKey != 0
+}
+
+// PgOutputType describes a data type.
+type PgOutputType struct {
+	ID        uint32
+	Namespace string
+	Name      string
+}
+
+// PgOutputTupleColumn is a column value in a tuple.
+type PgOutputTupleColumn struct {
+	Kind  byte
+	Value []byte
+}
+
+// PgOutputInsert represents an inserted row.
+type PgOutputInsert struct {
+	RelationID uint32
+	NewTuple   []*PgOutputTupleColumn
+}
+
+// PgOutputUpdate represents an updated row. OldTupleKind is 'K' if the old
+// tuple only contains the replica identity, 'O' if it contains the full old
+// row, or 0 if no old tuple was sent.
+type PgOutputUpdate struct {
+	RelationID   uint32
+	OldTupleKind byte
+	OldTuple     []*PgOutputTupleColumn
+	NewTuple     []*PgOutputTupleColumn
+}
+
+// PgOutputDelete represents a deleted row. OldTupleKind is 'K' or 'O' (see
+// PgOutputUpdate).
+type PgOutputDelete struct {
+	RelationID   uint32
+	OldTupleKind byte
+	OldTuple     []*PgOutputTupleColumn
+}
+
+// PgOutputTruncate represents one or more truncated relations.
+type PgOutputTruncate struct {
+	Options     uint8
+	RelationIDs []uint32
+}
+
+// Type implements PgOutputMessage.
+func (*PgOutputBegin) Type() byte { return PgOutputMessageBegin }
+
+// Type implements PgOutputMessage.
+func (*PgOutputCommit) Type() byte { return PgOutputMessageCommit }
+
+// Type implements PgOutputMessage.
+func (*PgOutputOrigin) Type() byte { return PgOutputMessageOrigin }
+
+// Type implements PgOutputMessage.
+func (*PgOutputRelation) Type() byte { return PgOutputMessageRelation }
+
+// Type implements PgOutputMessage.
+func (*PgOutputType) Type() byte { return PgOutputMessageType }
+
+// Type implements PgOutputMessage.
+func (*PgOutputInsert) Type() byte { return PgOutputMessageInsert }
+
+// Type implements PgOutputMessage.
+func (*PgOutputUpdate) Type() byte { return PgOutputMessageUpdate }
+
+// Type implements PgOutputMessage.
+func (*PgOutputDelete) Type() byte { return PgOutputMessageDelete }
+
+// Type implements PgOutputMessage.
+func (*PgOutputTruncate) Type() byte { return PgOutputMessageTruncate }
+
+// ParsePgOutputMessage decodes a single pgoutput message from the WAL data of
+// a replication message.
+func ParsePgOutputMessage(data []byte) (PgOutputMessage, error) {
+	if len(data) == 0 {
+		return nil, errPgOutputShortMessage
+	}
+
+	r := &pgOutputReader{buf: data[1:]}
+
+	var msg PgOutputMessage
+	switch data[0] {
+	case PgOutputMessageBegin:
+		msg = &PgOutputBegin{
+			FinalLSN:   r.uint64(),
+			CommitTime: r.timestamp(),
+			XID:        r.uint32(),
+		}
+	case PgOutputMessageCommit:
+		msg = &PgOutputCommit{
+			Flags:      r.uint8(),
+			CommitLSN:  r.uint64(),
+			EndLSN:     r.uint64(),
+			CommitTime: r.timestamp(),
+		}
+	case PgOutputMessageOrigin:
+		msg = &PgOutputOrigin{
+			CommitLSN: r.uint64(),
+			Name:      r.string(),
+		}
+	case PgOutputMessageRelation:
+		rel := &PgOutputRelation{
+			ID:              r.uint32(),
+			Namespace:       r.string(),
+			Name:            r.string(),
+			ReplicaIdentity: r.uint8(),
+		}
+		n := int(r.uint16())
+		for i := 0; i < n && r.err == nil; i++ {
+			rel.Columns = append(rel.Columns, &PgOutputRelationColumn{
+				Flags:    r.uint8(),
+				Name:     r.string(),
+				TypeOID:  r.uint32(),
+				TypeMode: int32(r.uint32()),
+			})
+		}
+		msg = rel
+	case PgOutputMessageType:
+		msg = &PgOutputType{
+			ID:        r.uint32(),
+			Namespace: r.string(),
+			Name:      r.string(),
+		}
+	case PgOutputMessageInsert:
+		ins := &PgOutputInsert{RelationID: r.uint32()}
+		r.expect('N')
+		ins.NewTuple = r.tuple()
+		msg = ins
+	case PgOutputMessageUpdate:
+		upd := &PgOutputUpdate{RelationID: r.uint32()}
+		kind := r.uint8()
+		if kind == 'K' || kind == 'O' {
+			upd.OldTupleKind = kind
+			upd.OldTuple = r.tuple()
+			kind = r.uint8()
+		}
+		if r.err == nil && kind != 'N' {
+			r.err = fmt.Errorf("unexpected tuple kind '%c' in pgoutput update message", kind)
+		}
+		upd.NewTuple = r.tuple()
+		msg = upd
+	case PgOutputMessageDelete:
+		del := &PgOutputDelete{RelationID: r.uint32()}
+		del.OldTupleKind = r.uint8()
+		if r.err == nil && del.OldTupleKind != 'K' && del.OldTupleKind != 'O' {
+			r.err = fmt.Errorf("unexpected tuple kind '%c' in pgoutput delete message", del.OldTupleKind)
+		}
+		del.OldTuple = r.tuple()
+		msg = del
+	case PgOutputMessageTruncate:
+		n := int(r.uint32())
+		trunc := &PgOutputTruncate{Options: r.uint8()}
+		for i := 0; i < n && r.err == nil; i++ {
+			trunc.RelationIDs = append(trunc.RelationIDs, r.uint32())
+		}
+		msg = trunc
+	default:
+		return nil, fmt.Errorf("unknown pgoutput message type '%c'", data[0])
+	}
+
+	if r.err != nil {
+		return nil, fmt.Errorf("failed to parse pgoutput message '%c': %w", data[0], r.err)
+	}
+
+	return msg, nil
+}
+
+// pgOutputReader reads big-endian values from a pgoutput message. Once an
+// error is encountered, all subsequent reads return zero values.
+type pgOutputReader struct {
+	buf []byte
+	err error
+}
+
+func (r *pgOutputReader) next(n int) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if len(r.buf) < n {
+		r.err = errPgOutputShortMessage
+		return nil
+	}
+	b := r.buf[:n]
+	r.buf = r.buf[n:]
+	return b
+}
+
+func (r *pgOutputReader) uint8() uint8 {
+	b := r.next(1)
+	if b == nil {
+		return 0
+	}
+	return b[0]
+}
+
+func (r *pgOutputReader) uint16() uint16 {
+	b := r.next(2)
+	if b == nil {
+		return 0
+	}
+	return binary.BigEndian.Uint16(b)
+}
+
+func (r *pgOutputReader) uint32() uint32 {
+	b := r.next(4)
+	if b == nil {
+		return 0
+	}
+	return binary.BigEndian.Uint32(b)
+}
+
+func (r *pgOutputReader) uint64() uint64 {
+	b := r.next(8)
+	if b == nil {
+		return 0
+	}
+	return binary.BigEndian.Uint64(b)
+}
+
+// timestamp reads a timestamp in microseconds since the Postgres epoch.
+func (r *pgOutputReader) timestamp() time.Time {
+	micros := int64(r.uint64())
+	if r.err != nil {
+		return time.Time{}
+	}
+	return pgEpoch.Add(time.Duration(micros) * time.Microsecond)
+}
+
+// string reads a null-terminated string.
+func (r *pgOutputReader) string() string {
+	if r.err != nil {
+		return ""
+	}
+	i := bytes.IndexByte(r.buf, 0)
+	if i < 0 {
+		r.err = errPgOutputShortMessage
+		return ""
+	}
+	s := string(r.buf[:i])
+	r.buf = r.buf[i+1:]
+	return s
+}
+
+func (r *pgOutputReader) expect(kind byte) {
+	k := r.uint8()
+	if r.err == nil && k != kind {
+		r.err = fmt.Errorf("expected tuple kind '%c', got '%c'", kind, k)
+	}
+}
+
+// tuple reads a TupleData submessage.
+func (r *pgOutputReader) tuple() []*PgOutputTupleColumn {
+	n := int(r.uint16())
+	cols := make([]*PgOutputTupleColumn, 0, n)
+	for i := 0; i < n && r.err == nil; i++ {
+		col := &PgOutputTupleColumn{Kind: r.uint8()}
+		switch col.Kind {
+		case PgOutputTupleNull, PgOutputTupleUnchanged:
+		case PgOutputTupleText:
+			size := int(r.uint32())
+			col.Value = r.next(size)
+		default:
+			if r.err == nil {
+				r.err = fmt.Errorf("unknown tuple column kind '%c'", col.Kind)
+			}
+		}
+		cols = append(cols, col)
+	}
+	return cols
+}
@@ -0,0 +1,154 @@
+package db_test
+
+import (
+	"encoding/hex"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/perangel/warp-pipe/db"
+)
+
+// Fixtures captured from a pgoutput (proto_version 1) replication stream for:
+//
+//	CREATE TABLE users (id INT PRIMARY KEY, email VARCHAR(255), bio TEXT);
+var pgOutputFixtures = map[string]string{
+	"begin":         "4200000000016b374800025f26a8def07b000001f5",
+	"commit":        "430000000000016b374800000000016b377800025f26a8def07b",
+	"origin":        "4f00000000016b3748757073747265616d00",
+	"relation":      "52000040017075626c6963007573657273006400030169640000000017ffffffff00656d61696c0000000413000001030062696f0000000019ffffffff",
+	"type":          "59000040107075626c6963006d6f6f6400",
+	"insert":        "49000040014e0003740000000131740000000c68616e40746573742e636f6d6e",
+	"update":        "55000040014b00037400000001316e6e4e0003740000000131740000000d6c65696140746573742e636f6d75",
+	"update_no_old": "55000040014e0003740000000132740000000d6c756b6540746573742e636f6d6e",
+	"delete":        "44000040014f0003740000000131740000000d6c65696140746573742e636f6d7400000005726562656c",
+	"truncate":      "5400000002010000400100004006",
+}
+
+func parseFixture(t *testing.T, name string) db.PgOutputMessage {
+	data, err := hex.DecodeString(pgOutputFixtures[name])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msg, err := db.ParsePgOutputMessage(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return msg
+}
+
+func text(v string) *db.PgOutputTupleColumn {
+	return &db.PgOutputTupleColumn{Kind: db.PgOutputTupleText, Value: []byte(v)}
+}
+
+var (
+	null      = &db.PgOutputTupleColumn{Kind: db.PgOutputTupleNull}
+	unchanged = &db.PgOutputTupleColumn{Kind: db.PgOutputTupleUnchanged}
+)
+
+func TestParsePgOutputMessage(t *testing.T) {
+	commitTime := time.Date(2021, time.February, 25, 12, 0, 0, 123000, time.UTC)
+
+	t.Run("begin", func(t *testing.T) {
+		msg := parseFixture(t, "begin")
+		assert.Equal(t, &db.PgOutputBegin{
+			FinalLSN:   0x16B3748,
+			CommitTime: commitTime,
+			XID:        501,
+		}, msg)
+	})
+
+	t.Run("commit", func(t *testing.T) {
+		msg := parseFixture(t, "commit")
+		assert.Equal(t, &db.PgOutputCommit{
+			CommitLSN:  0x16B3748,
+			EndLSN:     0x16B3778,
+			CommitTime: commitTime,
+		}, msg)
+	})
+
+	t.Run("origin", func(t *testing.T) {
+		msg := parseFixture(t, "origin")
+		assert.Equal(t, &db.PgOutputOrigin{CommitLSN: 0x16B3748, Name: "upstream"}, msg)
+	})
+
+	t.Run("relation", func(t *testing.T) {
+		msg := parseFixture(t, "relation")
+		rel, ok := msg.(*db.PgOutputRelation)
+		if !assert.True(t, ok) {
+			return
+		}
+		assert.Equal(t, uint32(16385), rel.ID)
+		assert.Equal(t, "public", rel.Namespace)
+		assert.Equal(t, "users", rel.Name)
+		assert.Equal(t, uint8('d'), rel.ReplicaIdentity)
+		assert.Equal(t, []*db.PgOutputRelationColumn{
+			{Flags: 1, Name: "id", TypeOID: 23, TypeMode: -1},
+			{Flags: 0, Name: "email", TypeOID: 1043, TypeMode: 259},
+			{Flags: 0, Name: "bio", TypeOID: 25, TypeMode: -1},
+		}, rel.Columns)
+		assert.True(t, rel.Columns[0].IsKey())
+		assert.False(t, rel.Columns[1].IsKey())
+	})
+
+	t.Run("type", func(t *testing.T) {
+		msg := parseFixture(t, "type")
+		assert.Equal(t, &db.PgOutputType{ID: 16400, Namespace: "public", Name: "mood"}, msg)
+	})
+
+	t.Run("insert", func(t *testing.T) {
+		msg := parseFixture(t, "insert")
+		assert.Equal(t, &db.PgOutputInsert{
+			RelationID: 16385,
+			NewTuple:   []*db.PgOutputTupleColumn{text("1"), text("han@test.com"), null},
+		}, msg)
+	})
+
+	t.Run("update with key", func(t *testing.T) {
+		msg := parseFixture(t, "update")
+		assert.Equal(t, &db.PgOutputUpdate{
+			RelationID:   16385,
+			OldTupleKind: 'K',
+			OldTuple:     []*db.PgOutputTupleColumn{text("1"), null, null},
+			NewTuple:     []*db.PgOutputTupleColumn{text("1"), text("leia@test.com"), unchanged},
+		}, msg)
+	})
+
+	t.Run("update without old tuple", func(t *testing.T) {
+		msg := parseFixture(t, "update_no_old")
+		assert.Equal(t, &db.PgOutputUpdate{
+			RelationID: 16385,
+			NewTuple:   []*db.PgOutputTupleColumn{text("2"), text("luke@test.com"), null},
+		}, msg)
+	})
+
+	t.Run("delete", func(t *testing.T) {
+		msg := parseFixture(t, "delete")
+		assert.Equal(t, &db.PgOutputDelete{
+			RelationID:   16385,
+			OldTupleKind: 'O',
+			OldTuple:     []*db.PgOutputTupleColumn{text("1"), text("leia@test.com"), text("rebel")},
+		}, msg)
+	})
+
+	t.Run("truncate", func(t *testing.T) {
+		msg := parseFixture(t, "truncate")
+		assert.Equal(t, &db.PgOutputTruncate{
+			Options:     db.PgOutputTruncateCascade,
+			RelationIDs: []uint32{16385, 16390},
+		}, msg)
+	})
+
+	t.Run("truncated message", func(t *testing.T) {
+		data, _ := hex.DecodeString(pgOutputFixtures["insert"])
+		_, err := db.ParsePgOutputMessage(data[:len(data)-4])
+		assert.Error(t, err)
+	})
+
+	t.Run("unknown message", func(t *testing.T) {
+		_, err := db.ParsePgOutputMessage([]byte{'Z', 0, 0})
+		assert.Error(t, err)
+	})
+}
@@ -17,15 +17,17 @@ type Table struct {
 }
 
 var (
-	errCreateSchema        = errors.New("error creating `warp_pipe` schema")
-	errDuplicateSchema     = errors.New("`warp_pipe` schema already exists")
-	errCreateTable         = errors.New("error creating `warp_pipe.changesets` table")
-	errDuplicateTable      = errors.New("`warp_pipe.changesets` table already exists")
-	errCreateTriggerFunc   = errors.New("error creating `on_modify` trigger function")
-	errRegisterTrigger     = errors.New("error registering `on_modify` trigger on table")
-	errTransactionBegin    = errors.New("error starting new transaction")
-	errTransactionCommit   = errors.New("error committing transaction")
-	errTransactionRollback = errors.New("error rolling back transaction")
+	errCreateSchema         = errors.New("error creating `warp_pipe` schema")
+	errDuplicateSchema      = errors.New("`warp_pipe` schema already exists")
+	errCreateTable          = errors.New("error creating `warp_pipe.changesets` table")
+	errDuplicateTable       = errors.New("`warp_pipe.changesets` table already exists")
+	errCreateConsumersTable = errors.New("error creating `warp_pipe.consumers` table")
+	errMigrateSchema        = errors.New("error migrating `warp_pipe` schema")
+	errCreateTriggerFunc    = errors.New("error creating `on_modify` trigger function")
+	errRegisterTrigger      = errors.New("error registering `on_modify` trigger on table")
+	errTransactionBegin     = errors.New("error starting new transaction")
+	errTransactionCommit    = errors.New("error committing transaction")
+	errTransactionRollback  = errors.New("error rolling back transaction")
 )
 
 // Teardown removes the `warp_pipe` schema and all associated tables and functions.
@@ -42,6 +44,7 @@ func Teardown(conn *pgx.Conn) error {
 // This will setup:
 //     - new `warp_pipe` schema
 //     - new `changesets` table in the `warp_pipe` schema
+//     - new `consumers` table in the `warp_pipe` schema
 //     - new TRIGGER function to be fired AFTER an INSERT, UPDATE, or DELETE on a table
 //     - registers the trigger with all configured tables in the source schema
 func Prepare(conn *pgx.Conn, schemas []string, includeTables, excludeTables []string) error {
@@ -73,6 +76,11 @@ func Prepare(conn *pgx.Conn, schemas []string, includeTables, excludeTables []st
 		return errCreateTable
 	}
 
+	err = createConsumersTable(tx)
+	if err != nil {
+		return errCreateConsumersTable
+	}
+
 	err = createTriggerFunc(tx)
 	if err != nil {
 		return errCreateTriggerFunc
@@ -105,6 +113,46 @@ func Prepare(conn *pgx.Conn, schemas []string, includeTables, excludeTables []st
 	return nil
 }
 
+// Migrate upgrades a `warp_pipe` schema set up by an earlier version. It adds:
+//     - the `txid` column of the `changesets` table
+//     - the `consumers` table
+//     - the `changesets_txid_idx` and `changesets_ts_id_idx` indexes
+// and replaces the `on_modify()` trigger function, so that existing triggers
+// record the transaction ID of changesets.
+// It is idempotent, and is run on startup by the listeners reading the
+// `changesets` table.
+func Migrate(conn *pgx.Conn) error {
+	tx, err := conn.Begin()
+	if err != nil {
+		return errTransactionBegin
+	}
+	defer tx.Rollback()
+
+	for _, sql := range []string{
+		addColumnChangesetsTxIDSQL,
+		migrateTableWarpPipeConsumersSQL,
+		createIndexChangesetsTxIDSQL,
+		createIndexChangesetsTimestampIDSQL,
+		createOnModifyTriggerFuncSQL,
+	} {
+		_, err = tx.Exec(sql)
+		if err != nil {
+			pgErr, ok := err.(pgx.PgError)
+			if ok {
+				log.Printf("%+v", pgErr)
+			}
+			return errMigrateSchema
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		log.WithError(err).Error(errTransactionCommit.Error())
+		return errTransactionCommit
+	}
+
+	return nil
+}
+
 func createSchema(tx *pgx.Tx) error {
 	_, err := tx.Exec(createSchemaWarpPipeSQL)
 	if err != nil {
@@ -124,12 +172,31 @@ func createSchema(tx *pgx.Tx) error {
 	return nil
 }
 
+func createConsumersTable(tx *pgx.Tx) error {
+	_, err := tx.Exec(createTableWarpPipeConsumersSQL)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(revokeAllOnWarpPipeConsumersSQL)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
 func createChangesetsTable(tx *pgx.Tx) error {
 	_, err := tx.Exec(createTableWarpPipeChangesetsSQL)
 	if err != nil {
 		return err
 	}
 
+	_, err = tx.Exec(addColumnChangesetsTxIDSQL)
+	if err != nil {
+		return err
+	}
+
 	_, err = tx.Exec(revokeAllOnWarpPipeChangesetsSQL)
 	if err != nil {
 		return err
@@ -140,6 +207,11 @@ func createChangesetsTable(tx *pgx.Tx) error {
 		return err
 	}
 
+	_, err = tx.Exec(createIndexChangesetsTimestampIDSQL)
+	if err != nil {
+		return err
+	}
+
 	_, err = tx.Exec(createIndexChangesetsActionSQL)
 	if err != nil {
 		return err
@@ -150,6 +222,11 @@ func createChangesetsTable(tx *pgx.Tx) error {
 		return err
 	}
 
+	_, err = tx.Exec(createIndexChangesetsTxIDSQL)
+	if err != nil {
+		return err
+	}
+
 	return nil
 }
 
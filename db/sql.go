@@ -20,15 +20,70 @@ const (
 			table_name TEXT NOT NULL,
 			relid OID NOT NULL,
 			new_values JSON,
-			old_values JSON
+			old_values JSON,
+			txid BIGINT
 		)`
 
+	// Add the txid column to warp_pipe.changesets tables created before it was introduced
+	addColumnChangesetsTxIDSQL = `
+		DO $$
+		BEGIN
+			IF NOT EXISTS (
+				SELECT 1 FROM information_schema.columns
+				WHERE table_schema = 'warp_pipe'
+				AND table_name = 'changesets'
+				AND column_name = 'txid'
+			)
+			THEN
+				ALTER TABLE warp_pipe.changesets ADD COLUMN txid BIGINT;
+			END IF;
+		END;
+		$$`
+
 	// Revoke all privileges from public on warp_pipe.changesets
 	revokeAllOnWarpPipeChangesetsSQL = `REVOKE ALL ON warp_pipe.changesets FROM public`
 
+	// Create the warp_pipe.consumers table, which records the ID of the last
+	// changeset processed by each consumer of the changesets table
+	createTableWarpPipeConsumersSQL = `
+		CREATE TABLE IF NOT EXISTS warp_pipe.consumers (
+			name TEXT PRIMARY KEY,
+			changeset_id BIGINT NOT NULL,
+			updated_at TIMESTAMPTZ DEFAULT NOW() NOT NULL
+		)`
+
+	// Revoke all privileges from public on warp_pipe.consumers
+	revokeAllOnWarpPipeConsumersSQL = `REVOKE ALL ON warp_pipe.consumers FROM public`
+
+	// Create the warp_pipe.consumers table in schemas prepared before it was
+	// introduced. The table is only created if it is missing, so that no
+	// privileges are needed once it exists.
+	migrateTableWarpPipeConsumersSQL = `
+		DO $$
+		BEGIN
+			IF NOT EXISTS (
+				SELECT 1 FROM information_schema.tables
+				WHERE table_schema = 'warp_pipe'
+				AND table_name = 'consumers'
+			)
+			THEN
+				CREATE TABLE warp_pipe.consumers (
+					name TEXT PRIMARY KEY,
+					changeset_id BIGINT NOT NULL,
+					updated_at TIMESTAMPTZ DEFAULT NOW() NOT NULL
+				);
+				REVOKE ALL ON warp_pipe.consumers FROM public;
+			END IF;
+		END;
+		$$`
+
 	// Create an index for warp_pipe.changesets(ts)
 	createIndexChangesetsTimestampSQL = `CREATE INDEX IF NOT EXISTS changesets_ts_idx ON warp_pipe.changesets (ts)`
 
+	// Create an index for warp_pipe.changesets(ts, id), used to page through
+	// changesets in timestamp order
+	createIndexChangesetsTimestampIDSQL = `CREATE INDEX IF NOT EXISTS changesets_ts_id_idx ON warp_pipe.changesets (ts, id)`
+
 	// Create an index for warp_pipe.changesets(action)
 	createIndexChangesetsActionSQL = `CREATE INDEX IF NOT EXISTS changesets_action_idx ON warp_pipe.changesets (action)`
 
@@ -38,6 +93,9 @@ const (
 	// Create an index for warp_pipe.changesets(table_name)
 	createIndexChangesetsTableNameSQL = `CREATE INDEX IF NOT EXISTS changesets_table_name_idx ON warp_pipe.changesets (table_name)`
 
+	// Create an index for warp_pipe.changesets(txid)
+	createIndexChangesetsTxIDSQL = `CREATE INDEX IF NOT EXISTS changesets_txid_idx ON warp_pipe.changesets (txid)`
+
 	// Create warp_pipe.on_modify() trigger function
 	createOnModifyTriggerFuncSQL = `
 		CREATE OR REPLACE FUNCTION warp_pipe.on_modify()
@@ -56,7 +114,8 @@ const (
 							table_name,
 							relid,
 							new_values,
-							old_values
+							old_values,
+							txid
 						) VALUES (
 							nextval('warp_pipe.changesets_id_seq'),
 							current_timestamp,
@@ -65,7 +124,8 @@ const (
 							TG_TABLE_NAME::TEXT,
 							TG_RELID,
 							row_to_json(NEW, true),
-							row_to_json(OLD, true)
+							row_to_json(OLD, true),
+							txid_current()
 						);
 						PERFORM pg_notify('warp_pipe_new_changeset', currval('warp_pipe.changesets_id_seq')::TEXT || '_' || current_timestamp::TEXT);
 						RETURN NEW;
@@ -77,7 +137,8 @@ const (
 							schema_name,
 							table_name,
 							relid,
-							old_values
+							old_values,
+							txid
 						) VALUES (
 							nextval('warp_pipe.changesets_id_seq'),
 							current_timestamp,
@@ -85,7 +146,8 @@ const (
 							TG_TABLE_SCHEMA::TEXT,
 							TG_TABLE_NAME::TEXT,
 							TG_RELID,
-							row_to_json(OLD, true)
+							row_to_json(OLD, true),
+							txid_current()
 						);
 						PERFORM pg_notify('warp_pipe_new_changeset', currval('warp_pipe.changesets_id_seq')::TEXT || '_' || current_timestamp::TEXT);
 						RETURN OLD;
@@ -97,14 +159,16 @@ const (
 							schema_name,
 							table_name,
 							relid,
-							new_values
+							new_values,
+							txid
 						) VALUES (
 							nextval('warp_pipe.changesets_id_seq'),
 							current_timestamp,
 							TG_OP::TEXT, TG_TABLE_SCHEMA::TEXT,
 							TG_TABLE_NAME::TEXT,
 							TG_RELID,
-							row_to_json(NEW, true)
+							row_to_json(NEW, true),
+							txid_current()
 						);
 						PERFORM pg_notify('warp_pipe_new_changeset', currval('warp_pipe.changesets_id_seq')::TEXT || '_' || current_timestamp::TEXT);
 						RETURN NEW;
@@ -1,9 +1,29 @@
 package db
 
+import (
+	"time"
+)
+
+// Wal2JSONTimestampFormat is the format of the commit timestamp in a
+// Wal2JSONMessage.
+const Wal2JSONTimestampFormat = "2006-01-02 15:04:05.999999999-07"
+
 // Wal2JSONMessage represents a wal2json message object.
 type Wal2JSONMessage struct {
-	Changes []*Wal2JSONChange `json:"change"`
-	NextLSN string            `json:"nextlsn"`
+	XID       int64             `json:"xid"`
+	Timestamp string            `json:"timestamp"`
+	Changes   []*Wal2JSONChange `json:"change"`
+	NextLSN   string            `json:"nextlsn"`
+}
+
+// CommitTime parses the commit timestamp of the message's transaction.
+func (m *Wal2JSONMessage) CommitTime() (time.Time, error) {
+	t, err := time.Parse(Wal2JSONTimestampFormat, m.Timestamp)
+	if err != nil {
+		// offsets with minutes, e.g. +05:30
+		return time.Parse(Wal2JSONTimestampFormat+":00", m.Timestamp)
+	}
+	return t, nil
 }
 
 // Wal2JSONChange represents a changeset within a Wal2JSONMessage.
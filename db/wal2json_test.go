@@ -0,0 +1,47 @@
+package db_test
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/perangel/warp-pipe/db"
+)
+
+func TestWal2JSONMessage(t *testing.T) {
+	raw := `{
+		"xid": 5021,
+		"nextlsn": "0/16B3778",
+		"timestamp": "2021-02-25 12:00:00.000123+00",
+		"change": [
+			{
+				"kind": "insert",
+				"schema": "public",
+				"table": "users",
+				"columnnames": ["id", "email"],
+				"columntypes": ["integer", "text"],
+				"columnvalues": [1, "han@test.com"]
+			}
+		]
+	}`
+
+	var msg db.Wal2JSONMessage
+	err := json.Unmarshal([]byte(raw), &msg)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(5021), msg.XID)
+	assert.Equal(t, "0/16B3778", msg.NextLSN)
+	assert.Equal(t, 1, len(msg.Changes))
+
+	commitTime, err := msg.CommitTime()
+	assert.NoError(t, err)
+	assert.True(t, time.Date(2021, time.February, 25, 12, 0, 0, 123000, time.UTC).Equal(commitTime))
+
+	t.Run("offset with minutes", func(t *testing.T) {
+		msg := db.Wal2JSONMessage{Timestamp: "2021-02-25 17:30:00+05:30"}
+		commitTime, err := msg.CommitTime()
+		assert.NoError(t, err)
+		assert.True(t, time.Date(2021, time.February, 25, 12, 0, 0, 0, time.UTC).Equal(commitTime))
+	})
+}
@@ -0,0 +1,359 @@
+package warppipe
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx"
+	log "github.com/sirupsen/logrus"
+)
+
+// DeadLetter is a changeset that a pipeline stage failed to process, as it
+// was passed to the stage.
+type DeadLetter struct {
+	ID        int64      `json:"id"`
+	Stage     string     `json:"stage"`
+	Error     string     `json:"error"`
+	Changeset *Changeset `json:"changeset"`
+	Timestamp time.Time  `json:"timestamp"`
+}
+
+// DeadLetterStore stores the changesets that pipeline stages failed to
+// process, so that they can be replayed. See DeadLetterOnError().
+type DeadLetterStore interface {
+	// Save stores a dead letter and sets its ID.
+	Save(ctx context.Context, letter *DeadLetter) error
+	// Load returns the stored dead letters, in the order they were saved.
+	Load(ctx context.Context) ([]*DeadLetter, error)
+	// Delete removes a dead letter, e.g. once it has been replayed.
+	Delete(ctx context.Context, id int64) error
+}
+
+// ReplayDeadLetters sends the changesets of the stored dead letters on the
+// returned channel, which is closed once they have all been sent. Only the
+// dead letters of the given stages are replayed, or all if none are given.
+// The channel is meant to be the source of a Pipeline with the stages the dead
+// letters were saved by: a changeset is passed through the stages before the
+// one it failed in, and then processed by it and the following ones. The
+// pipeline reports an error for changesets whose stage it does not have, and
+// drops them without acknowledging them. Acknowledging a changeset deletes its dead letter from the store.
+func ReplayDeadLetters(ctx context.Context, store DeadLetterStore, stages ...string) (<-chan *Changeset, error) {
+	letters, err := store.Load(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load dead letters: %w", err)
+	}
+
+	changeCh := make(chan *Changeset)
+	go func() {
+		defer close(changeCh)
+		for _, letter := range letters {
+			if len(stages) > 0 && !containsString(stages, letter.Stage) {
+				continue
+			}
+
+			id := letter.ID
+			change := letter.Changeset
+			change.replayFrom = letter.Stage
+			change.ack = func() {
+				if err := store.Delete(context.Background(), id); err != nil {
+					log.WithError(err).Errorf("failed to delete dead letter %d", id)
+				}
+			}
+
+			select {
+			case changeCh <- change:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return changeCh, nil
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// FileDeadLetterStore is a DeadLetterStore that saves dead letters in a local
+// file, one JSON object per line.
+type FileDeadLetterStore struct {
+	mu     sync.Mutex
+	path   string
+	lastID int64
+	loaded bool
+}
+
+// NewFileDeadLetterStore returns a new FileDeadLetterStore for the given path.
+func NewFileDeadLetterStore(path string) *FileDeadLetterStore {
+	return &FileDeadLetterStore{path: path}
+}
+
+// Save implements DeadLetterStore. The file is synced to disk before Save
+// returns.
+func (s *FileDeadLetterStore) Save(ctx context.Context, letter *DeadLetter) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.loaded {
+		// IDs continue from the last saved dead letter
+		letters, err := s.load()
+		if err != nil {
+			return err
+		}
+		for _, l := range letters {
+			if l.ID > s.lastID {
+				s.lastID = l.ID
+			}
+		}
+		s.loaded = true
+	}
+
+	letter.ID = s.lastID + 1
+	b, err := json.Marshal(letter)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(s.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+
+	_, err = f.Write(append(b, '\n'))
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	s.lastID = letter.ID
+	return nil
+}
+
+// Load implements DeadLetterStore.
+func (s *FileDeadLetterStore) Load(ctx context.Context) ([]*DeadLetter, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.load()
+}
+
+// Delete implements DeadLetterStore. The remaining dead letters are written to
+// a temporary file which is then renamed, so that the file is never left
+// partially written.
+func (s *FileDeadLetterStore) Delete(ctx context.Context, id int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	letters, err := s.load()
+	if err != nil {
+		return err
+	}
+
+	f, err := ioutil.TempFile(filepath.Dir(s.path), filepath.Base(s.path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	w := bufio.NewWriter(f)
+	enc := json.NewEncoder(w)
+	for _, letter := range letters {
+		if letter.ID == id {
+			continue
+		}
+		if err = enc.Encode(letter); err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(f.Name(), s.path)
+}
+
+// load must be called with the lock held.
+func (s *FileDeadLetterStore) load() ([]*DeadLetter, error) {
+	f, err := os.Open(s.path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var letters []*DeadLetter
+	dec := json.NewDecoder(f)
+	for dec.More() {
+		var letter DeadLetter
+		if err := dec.Decode(&letter); err != nil {
+			return nil, fmt.Errorf("failed to parse dead letter file %s: %w", s.path, err)
+		}
+		letters = append(letters, &letter)
+	}
+	return letters, nil
+}
+
+// PostgresDeadLetterStore is a DeadLetterStore that saves dead letters in the
+// `warp_pipe.dead_letters` table of a Postgres database, which is created if
+// it does not exist.
+type PostgresDeadLetterStore struct {
+	mu         sync.Mutex
+	connConfig *pgx.ConnConfig
+	conn       *pgx.Conn
+}
+
+// NewPostgresDeadLetterStore returns a new PostgresDeadLetterStore. The
+// connection is opened on first use.
+func NewPostgresDeadLetterStore(connConfig *pgx.ConnConfig) *PostgresDeadLetterStore {
+	return &PostgresDeadLetterStore{connConfig: connConfig}
+}
+
+// Save implements DeadLetterStore.
+func (s *PostgresDeadLetterStore) Save(ctx context.Context, letter *DeadLetter) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	conn, err := s.connect(ctx)
+	if err != nil {
+		return err
+	}
+
+	b, err := json.Marshal(letter.Changeset)
+	if err != nil {
+		return err
+	}
+
+	return conn.QueryRowEx(ctx, `
+		INSERT INTO warp_pipe.dead_letters (stage, error, changeset, ts)
+			VALUES ($1, $2, $3::JSONB, $4)
+		RETURNING id`,
+		nil, letter.Stage, letter.Error, string(b), letter.Timestamp,
+	).Scan(&letter.ID)
+}
+
+// Load implements DeadLetterStore.
+func (s *PostgresDeadLetterStore) Load(ctx context.Context) ([]*DeadLetter, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	conn, err := s.connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := conn.QueryEx(ctx, `
+		SELECT id, stage, error, changeset::TEXT, ts
+		FROM warp_pipe.dead_letters
+		ORDER BY id`,
+		nil,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var letters []*DeadLetter
+	for rows.Next() {
+		var letter DeadLetter
+		var changeset string
+		err := rows.Scan(&letter.ID, &letter.Stage, &letter.Error, &changeset, &letter.Timestamp)
+		if err != nil {
+			return nil, err
+		}
+
+		err = json.Unmarshal([]byte(changeset), &letter.Changeset)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse dead letter %d: %w", letter.ID, err)
+		}
+		letters = append(letters, &letter)
+	}
+	return letters, rows.Err()
+}
+
+// Delete implements DeadLetterStore.
+func (s *PostgresDeadLetterStore) Delete(ctx context.Context, id int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	conn, err := s.connect(ctx)
+	if err != nil {
+		return err
+	}
+
+	_, err = conn.ExecEx(ctx, `DELETE FROM warp_pipe.dead_letters WHERE id = $1`, nil, id)
+	return err
+}
+
+// Close closes the database connection.
+func (s *PostgresDeadLetterStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.conn == nil {
+		return nil
+	}
+
+	err := s.conn.Close()
+	s.conn = nil
+	return err
+}
+
+// connect returns the open connection, (re)connecting and creating the dead
+// letters table if needed. It must be called with the lock held.
+func (s *PostgresDeadLetterStore) connect(ctx context.Context) (*pgx.Conn, error) {
+	if s.conn != nil && s.conn.IsAlive() {
+		return s.conn, nil
+	}
+
+	conn, err := pgx.Connect(*s.connConfig)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to the dead letter database: %w", err)
+	}
+
+	_, err = conn.ExecEx(ctx, `
+		CREATE SCHEMA IF NOT EXISTS warp_pipe;
+		CREATE TABLE IF NOT EXISTS warp_pipe.dead_letters (
+			id BIGSERIAL PRIMARY KEY,
+			stage TEXT NOT NULL,
+			error TEXT NOT NULL,
+			changeset JSONB NOT NULL,
+			ts TIMESTAMPTZ NOT NULL
+		)`,
+		nil,
+	)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to create the dead letters table: %w", err)
+	}
+
+	s.conn = conn
+	return conn, nil
+}
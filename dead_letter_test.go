@@ -0,0 +1,93 @@
+package warppipe_test
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	warppipe "github.com/perangel/warp-pipe"
+)
+
+func TestFileDeadLetterStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "warp-pipe-dead-letter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "dead_letters.ndjson")
+	store := warppipe.NewFileDeadLetterStore(path)
+	ctx := context.Background()
+	ts := time.Date(2021, time.March, 1, 12, 0, 0, 0, time.UTC)
+
+	change := &warppipe.Changeset{
+		Kind:   warppipe.ChangesetKindInsert,
+		Schema: "public",
+		Table:  "users",
+		NewValues: []*warppipe.ChangesetColumn{
+			{Column: "id", Value: int64(9007199254740993), Type: "bigint"},
+			{Column: "balance", Value: warppipe.Decimal("10.50"), Type: "numeric(10,2)"},
+			{Column: "created_at", Value: ts, Type: "timestamp with time zone"},
+			{Column: "avatar", Value: []byte{1, 2, 0xff}, Type: "bytea"},
+			{Column: "prefs", Value: json.RawMessage(`{"dark":true}`), Type: "jsonb"},
+			{Column: "note", Value: nil, Type: "text"},
+		},
+	}
+
+	t.Run("load missing file", func(t *testing.T) {
+		letters, err := store.Load(ctx)
+		assert.NoError(t, err)
+		assert.Empty(t, letters)
+	})
+
+	t.Run("save, load and delete", func(t *testing.T) {
+		for _, stage := range []string{"enrich", "index"} {
+			err := store.Save(ctx, &warppipe.DeadLetter{Stage: stage, Error: "boom", Changeset: change, Timestamp: ts})
+			assert.NoError(t, err)
+		}
+
+		letters, err := store.Load(ctx)
+		assert.NoError(t, err)
+		assert.Len(t, letters, 2)
+		assert.Equal(t, int64(1), letters[0].ID)
+		assert.Equal(t, "enrich", letters[0].Stage)
+		assert.Equal(t, "boom", letters[0].Error)
+		assert.Equal(t, change.NewValues, letters[0].Changeset.NewValues)
+
+		assert.NoError(t, store.Delete(ctx, 1))
+
+		// IDs are not reused
+		reopened := warppipe.NewFileDeadLetterStore(path)
+		err = reopened.Save(ctx, &warppipe.DeadLetter{Stage: "enrich", Changeset: change, Timestamp: ts})
+		assert.NoError(t, err)
+
+		letters, err = reopened.Load(ctx)
+		assert.NoError(t, err)
+		assert.Len(t, letters, 2)
+		assert.Equal(t, int64(2), letters[0].ID)
+		assert.Equal(t, int64(3), letters[1].ID)
+	})
+
+	t.Run("replay", func(t *testing.T) {
+		changes, err := warppipe.ReplayDeadLetters(ctx, store, "enrich")
+		assert.NoError(t, err)
+
+		var replayed []*warppipe.Changeset
+		for change := range changes {
+			replayed = append(replayed, change)
+			change.Ack()
+		}
+		assert.Len(t, replayed, 1)
+
+		letters, err := store.Load(ctx)
+		assert.NoError(t, err)
+		assert.Len(t, letters, 1)
+		assert.Equal(t, "index", letters[0].Stage)
+	})
+}
@@ -0,0 +1,439 @@
+package warppipe
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"encoding"
+	"encoding/json"
+	"fmt"
+	"math"
+	"math/big"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ColumnMismatchError is returned when decoding columns into a struct whose
+// fields do not match the columns. The struct is populated nonetheless.
+type ColumnMismatchError struct {
+	// Missing are the columns of struct fields that had no value.
+	Missing []string
+	// Unmapped are the columns without a struct field.
+	Unmapped []string
+}
+
+func (e *ColumnMismatchError) Error() string {
+	var parts []string
+	if len(e.Missing) > 0 {
+		parts = append(parts, "missing columns: "+strings.Join(e.Missing, ", "))
+	}
+	if len(e.Unmapped) > 0 {
+		parts = append(parts, "unmapped columns: "+strings.Join(e.Unmapped, ", "))
+	}
+	return strings.Join(parts, "; ")
+}
+
+// DecodeNew populates the struct pointed to by dst with the new values of the
+// changeset. See DecodeColumns.
+func (c *Changeset) DecodeNew(dst interface{}) error {
+	return DecodeColumns(c.NewValues, dst)
+}
+
+// DecodeOld populates the struct pointed to by dst with the old values of the
+// changeset. Unless the table's replica identity is FULL, old values only
+// hold the key columns, so a *ColumnMismatchError is expected. See
+// DecodeColumns.
+func (c *Changeset) DecodeOld(dst interface{}) error {
+	return DecodeColumns(c.OldValues, dst)
+}
+
+// EncodeNew sets the new values of the changeset from the fields of a struct.
+// See EncodeColumns.
+func (c *Changeset) EncodeNew(src interface{}) error {
+	cols, err := EncodeColumns(src)
+	if err != nil {
+		return err
+	}
+	c.NewValues = cols
+	return nil
+}
+
+// EncodeOld sets the old values of the changeset from the fields of a struct.
+// See EncodeColumns.
+func (c *Changeset) EncodeOld(src interface{}) error {
+	cols, err := EncodeColumns(src)
+	if err != nil {
+		return err
+	}
+	c.OldValues = cols
+	return nil
+}
+
+// DecodeColumns populates the struct pointed to by dst with column values.
+// Fields are mapped to columns by their `db` tag, their `json` tag, or else
+// their lowercased name; fields tagged `db:"-"` are skipped and the fields of
+// embedded structs are included.
+//
+// Values are converted to the type of their field: numbers to any numeric
+// type (failing if they would overflow or lose their fractional part),
+// Decimal to floats, strings and *big.Rat, UUIDs to strings and [16]byte
+// types, json.RawMessage into any type json.Unmarshal supports, and arrays to
+// slices. Fields implementing sql.Scanner or encoding.TextUnmarshaler decode
+// the value themselves, and pointer fields are nil for NULL values.
+//
+// If columns have no field or fields have no column, dst is populated and a
+// *ColumnMismatchError is returned.
+func DecodeColumns(cols []*ChangesetColumn, dst interface{}) error {
+	v := reflect.ValueOf(dst)
+	if v.Kind() != reflect.Ptr || v.IsNil() || v.Elem().Kind() != reflect.Struct {
+		return fmt.Errorf("cannot decode columns into %T, a pointer to a struct is required", dst)
+	}
+	v = v.Elem()
+
+	fields := structFields(v.Type())
+	seen := make(map[string]bool, len(cols))
+	mismatch := &ColumnMismatchError{}
+	for _, col := range cols {
+		f, ok := fields.byColumn[col.Column]
+		if !ok {
+			mismatch.Unmapped = append(mismatch.Unmapped, col.Column)
+			continue
+		}
+		seen[col.Column] = true
+
+		if err := assignValue(fieldByIndex(v, f.index), col.Value); err != nil {
+			return fmt.Errorf("failed to decode column %s into field %s: %w", col.Column, f.name, err)
+		}
+	}
+
+	for _, f := range fields.list {
+		if !seen[f.column] {
+			mismatch.Missing = append(mismatch.Missing, f.column)
+		}
+	}
+
+	if len(mismatch.Missing) > 0 || len(mismatch.Unmapped) > 0 {
+		return mismatch
+	}
+	return nil
+}
+
+// EncodeColumns returns the columns of a struct, or a pointer to one, in field
+// order, mapped as with DecodeColumns. Values implementing driver.Valuer are
+// replaced by their value, integers are int64, floats float64 and nil
+// pointers NULL, while Decimal and UUID values are kept. Column types are left
+// empty.
+func EncodeColumns(src interface{}) ([]*ChangesetColumn, error) {
+	v := reflect.ValueOf(src)
+	for v.Kind() == reflect.Ptr && !v.IsNil() {
+		v = v.Elem()
+	}
+	if v.Kind() != reflect.Struct {
+		return nil, fmt.Errorf("cannot encode %T into columns, a struct is required", src)
+	}
+
+	fields := structFields(v.Type())
+	cols := make([]*ChangesetColumn, 0, len(fields.list))
+	for _, f := range fields.list {
+		value, err := encodeValue(v.FieldByIndex(f.index))
+		if err != nil {
+			return nil, fmt.Errorf("failed to encode field %s: %w", f.name, err)
+		}
+		cols = append(cols, &ChangesetColumn{Column: f.column, Value: value})
+	}
+	return cols, nil
+}
+
+type structField struct {
+	name   string
+	column string
+	index  []int
+}
+
+type fieldMap struct {
+	list     []*structField
+	byColumn map[string]*structField
+}
+
+var fieldMaps sync.Map
+
+// structFields returns the column mapping of a struct type.
+func structFields(t reflect.Type) *fieldMap {
+	if m, ok := fieldMaps.Load(t); ok {
+		return m.(*fieldMap)
+	}
+
+	m := &fieldMap{byColumn: make(map[string]*structField)}
+	addStructFields(m, t, nil)
+	fieldMaps.Store(t, m)
+	return m
+}
+
+func addStructFields(m *fieldMap, t reflect.Type, index []int) {
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		if sf.PkgPath != "" && !sf.Anonymous {
+			continue
+		}
+
+		column, tagged := sf.Tag.Lookup("db")
+		if !tagged {
+			column, tagged = sf.Tag.Lookup("json")
+		}
+		column = strings.Split(column, ",")[0]
+		if column == "-" {
+			continue
+		}
+
+		fieldIndex := append(append([]int{}, index...), i)
+		ft := sf.Type
+		if ft.Kind() == reflect.Ptr {
+			ft = ft.Elem()
+		}
+		if sf.Anonymous && column == "" && ft.Kind() == reflect.Struct {
+			addStructFields(m, ft, fieldIndex)
+			continue
+		}
+		if sf.PkgPath != "" {
+			continue
+		}
+
+		if column == "" {
+			column = strings.ToLower(sf.Name)
+		}
+		if _, ok := m.byColumn[column]; ok {
+			// fields of outer structs take precedence
+			continue
+		}
+
+		f := &structField{name: sf.Name, column: column, index: fieldIndex}
+		m.list = append(m.list, f)
+		m.byColumn[column] = f
+	}
+}
+
+// fieldByIndex returns a settable field, allocating nil embedded struct
+// pointers on the way.
+func fieldByIndex(v reflect.Value, index []int) reflect.Value {
+	for i, x := range index {
+		if i > 0 && v.Kind() == reflect.Ptr {
+			if v.IsNil() {
+				v.Set(reflect.New(v.Type().Elem()))
+			}
+			v = v.Elem()
+		}
+		v = v.Field(x)
+	}
+	return v
+}
+
+var (
+	scannerType         = reflect.TypeOf((*sql.Scanner)(nil)).Elem()
+	textUnmarshalerType = reflect.TypeOf((*encoding.TextUnmarshaler)(nil)).Elem()
+	ratType             = reflect.TypeOf(big.Rat{})
+	timeType            = reflect.TypeOf(time.Time{})
+)
+
+// assignValue converts a column value to the type of a field and sets it.
+func assignValue(field reflect.Value, value interface{}) error {
+	if value == nil {
+		field.Set(reflect.Zero(field.Type()))
+		return nil
+	}
+
+	if field.Addr().Type().Implements(scannerType) {
+		return field.Addr().Interface().(sql.Scanner).Scan(scanValue(value))
+	}
+
+	if field.Kind() == reflect.Ptr {
+		elem := reflect.New(field.Type().Elem())
+		if err := assignValue(elem.Elem(), value); err != nil {
+			return err
+		}
+		field.Set(elem)
+		return nil
+	}
+
+	v := reflect.ValueOf(value)
+	if v.Type().AssignableTo(field.Type()) {
+		field.Set(v)
+		return nil
+	}
+
+	if s, ok := value.(string); ok && field.Addr().Type().Implements(textUnmarshalerType) {
+		return field.Addr().Interface().(encoding.TextUnmarshaler).UnmarshalText([]byte(s))
+	}
+
+	switch x := value.(type) {
+	case json.RawMessage:
+		switch {
+		case field.Kind() == reflect.String:
+			field.SetString(string(x))
+			return nil
+		case field.Kind() == reflect.Slice && field.Type().Elem().Kind() == reflect.Uint8:
+			field.SetBytes(append([]byte{}, x...))
+			return nil
+		}
+		return json.Unmarshal(x, field.Addr().Interface())
+	case Decimal:
+		return assignDecimal(field, x)
+	case UUID:
+		if field.Kind() == reflect.String {
+			field.SetString(x.String())
+			return nil
+		}
+	case []interface{}:
+		if field.Kind() == reflect.Slice {
+			slice := reflect.MakeSlice(field.Type(), len(x), len(x))
+			for i, elem := range x {
+				if err := assignValue(slice.Index(i), elem); err != nil {
+					return fmt.Errorf("element %d: %w", i, err)
+				}
+			}
+			field.Set(slice)
+			return nil
+		}
+	case int64:
+		return assignInt(field, x)
+	case float64:
+		if x == math.Trunc(x) && isIntKind(field.Kind()) && math.Abs(x) < 1<<63 {
+			return assignInt(field, int64(x))
+		}
+	case string:
+		if field.Type() == timeType {
+			t, ok := decodeText("timestamp with time zone", x)
+			if !ok {
+				return fmt.Errorf("invalid time '%s'", x)
+			}
+			field.Set(reflect.ValueOf(t))
+			return nil
+		}
+	}
+
+	// e.g. named types, or float64 into float32
+	if v.Type().ConvertibleTo(field.Type()) && v.Kind() == field.Kind() ||
+		isFloatKind(v.Kind()) && isFloatKind(field.Kind()) {
+		field.Set(v.Convert(field.Type()))
+		return nil
+	}
+
+	return fmt.Errorf("cannot assign %T to %s", value, field.Type())
+}
+
+func isIntKind(k reflect.Kind) bool {
+	switch k {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return true
+	}
+	return false
+}
+
+func isFloatKind(k reflect.Kind) bool {
+	return k == reflect.Float32 || k == reflect.Float64
+}
+
+func assignInt(field reflect.Value, n int64) error {
+	switch field.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if field.OverflowInt(n) {
+			return fmt.Errorf("%d overflows %s", n, field.Type())
+		}
+		field.SetInt(n)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		if n < 0 || field.OverflowUint(uint64(n)) {
+			return fmt.Errorf("%d overflows %s", n, field.Type())
+		}
+		field.SetUint(uint64(n))
+	case reflect.Float32, reflect.Float64:
+		field.SetFloat(float64(n))
+	default:
+		return fmt.Errorf("cannot assign int64 to %s", field.Type())
+	}
+	return nil
+}
+
+func assignDecimal(field reflect.Value, d Decimal) error {
+	switch {
+	case field.Type() == ratType:
+		r, ok := d.Rat()
+		if !ok {
+			return fmt.Errorf("%s is not a finite number", d)
+		}
+		field.Set(reflect.ValueOf(*r))
+		return nil
+	case field.Kind() == reflect.String:
+		field.SetString(string(d))
+		return nil
+	case isFloatKind(field.Kind()):
+		f, err := d.Float64()
+		if err != nil {
+			return err
+		}
+		field.SetFloat(f)
+		return nil
+	case isIntKind(field.Kind()):
+		r, ok := d.Rat()
+		if !ok || !r.IsInt() || !r.Num().IsInt64() {
+			return fmt.Errorf("%s is not an int64", d)
+		}
+		return assignInt(field, r.Num().Int64())
+	}
+	return fmt.Errorf("cannot assign %T to %s", d, field.Type())
+}
+
+// scanValue converts a column value to one of the types passed to
+// sql.Scanner implementations.
+func scanValue(value interface{}) interface{} {
+	switch x := value.(type) {
+	case Decimal:
+		return string(x)
+	case UUID:
+		return x.String()
+	case json.RawMessage:
+		return []byte(x)
+	}
+	return value
+}
+
+// encodeValue returns the column value of a field.
+func encodeValue(v reflect.Value) (interface{}, error) {
+	if v.Kind() == reflect.Ptr {
+		if v.IsNil() {
+			return nil, nil
+		}
+		v = v.Elem()
+	}
+
+	switch x := v.Interface().(type) {
+	case Decimal, UUID:
+		// kept as they are decoded
+		return x, nil
+	case driver.Valuer:
+		return x.Value()
+	}
+	if v.CanAddr() {
+		if valuer, ok := v.Addr().Interface().(driver.Valuer); ok {
+			return valuer.Value()
+		}
+	}
+
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return v.Int(), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		n := v.Uint()
+		if n > math.MaxInt64 {
+			return nil, fmt.Errorf("%d overflows int64", n)
+		}
+		return int64(n), nil
+	case reflect.Float32, reflect.Float64:
+		return v.Float(), nil
+	case reflect.String:
+		return v.String(), nil
+	case reflect.Bool:
+		return v.Bool(), nil
+	}
+	return v.Interface(), nil
+}
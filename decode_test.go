@@ -0,0 +1,118 @@
+package warppipe
+
+import (
+	"database/sql"
+	"encoding/json"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type testTimestamps struct {
+	CreatedAt time.Time `db:"created_at"`
+	DeletedAt *time.Time
+}
+
+type testUser struct {
+	ID      int32           `db:"id"`
+	Name    string          `json:"name"`
+	Email   sql.NullString  `db:"email"`
+	Balance float64         `db:"balance"`
+	Credit  big.Rat         `db:"credit"`
+	UserID  UUID            `db:"user_id"`
+	Ref     string          `db:"ref"`
+	Prefs   map[string]bool `db:"prefs"`
+	Tags    []string        `db:"tags"`
+	Scores  []int           `db:"scores"`
+	Active  *bool           `db:"active"`
+	Ignored string          `db:"-"`
+	testTimestamps
+}
+
+func TestDecodeColumns(t *testing.T) {
+	uuid, err := ParseUUID("a0eebc99-9c0b-4ef8-bb6d-6bb9bd380a11")
+	assert.NoError(t, err)
+	created := time.Date(2021, 3, 1, 12, 0, 0, 0, time.UTC)
+
+	change := &Changeset{
+		NewValues: []*ChangesetColumn{
+			{Column: "id", Value: int64(42)},
+			{Column: "name", Value: "alice"},
+			{Column: "email", Value: "alice@example.com"},
+			{Column: "balance", Value: Decimal("10.50")},
+			{Column: "credit", Value: Decimal("0.1")},
+			{Column: "user_id", Value: uuid},
+			{Column: "ref", Value: uuid},
+			{Column: "prefs", Value: json.RawMessage(`{"dark":true}`)},
+			{Column: "tags", Value: []interface{}{"a", "b"}},
+			{Column: "scores", Value: []interface{}{int64(1), nil, int64(3)}},
+			{Column: "active", Value: true},
+			{Column: "created_at", Value: created},
+			{Column: "deletedat", Value: nil},
+		},
+	}
+
+	var user testUser
+	assert.NoError(t, change.DecodeNew(&user))
+	assert.Equal(t, int32(42), user.ID)
+	assert.Equal(t, "alice", user.Name)
+	assert.Equal(t, sql.NullString{String: "alice@example.com", Valid: true}, user.Email)
+	assert.Equal(t, 10.5, user.Balance)
+	assert.Equal(t, "1/10", user.Credit.String())
+	assert.Equal(t, uuid, user.UserID)
+	assert.Equal(t, uuid.String(), user.Ref)
+	assert.Equal(t, map[string]bool{"dark": true}, user.Prefs)
+	assert.Equal(t, []string{"a", "b"}, user.Tags)
+	assert.Equal(t, []int{1, 0, 3}, user.Scores)
+	assert.Equal(t, true, *user.Active)
+	assert.Equal(t, created, user.CreatedAt)
+	assert.Nil(t, user.DeletedAt)
+
+	cols, err := EncodeColumns(user)
+	assert.NoError(t, err)
+	var roundTrip testUser
+	assert.NoError(t, DecodeColumns(cols, &roundTrip))
+	assert.Equal(t, user, roundTrip)
+	assert.Equal(t, "alice@example.com", cols[2].Value)
+	assert.Equal(t, uuid, cols[5].Value)
+}
+
+func TestDecodeColumnsMismatch(t *testing.T) {
+	change := &Changeset{
+		OldValues: []*ChangesetColumn{
+			{Column: "id", Value: int64(42)},
+			{Column: "extra", Value: "x"},
+		},
+	}
+
+	var dst struct {
+		ID   int    `db:"id"`
+		Name string `db:"name"`
+	}
+	err := change.DecodeOld(&dst)
+	assert.Equal(t, &ColumnMismatchError{Missing: []string{"name"}, Unmapped: []string{"extra"}}, err)
+	assert.EqualError(t, err, "missing columns: name; unmapped columns: extra")
+	assert.Equal(t, 42, dst.ID)
+}
+
+func TestDecodeColumnsErrors(t *testing.T) {
+	testCases := []struct {
+		value    interface{}
+		dst      interface{}
+		expected string
+	}{
+		{int64(300), new(struct{ V int8 }), "failed to decode column v into field V: 300 overflows int8"},
+		{int64(-1), new(struct{ V uint }), "failed to decode column v into field V: -1 overflows uint"},
+		{1.5, new(struct{ V int }), "failed to decode column v into field V: cannot assign float64 to int"},
+		{Decimal("1.5"), new(struct{ V int64 }), "failed to decode column v into field V: 1.5 is not an int64"},
+		{"x", new(struct{ V bool }), "failed to decode column v into field V: cannot assign string to bool"},
+		{int64(1), struct{ V int }{}, "cannot decode columns into struct { V int }, a pointer to a struct is required"},
+	}
+
+	for _, tc := range testCases {
+		err := DecodeColumns([]*ChangesetColumn{{Column: "v", Value: tc.value}}, tc.dst)
+		assert.EqualError(t, err, tc.expected)
+	}
+}
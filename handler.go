@@ -0,0 +1,265 @@
+package warppipe
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"sync"
+	"time"
+)
+
+const defaultHandlerWorkers = 4
+
+// ChangesetKinds is a set of changeset kinds, for registering handlers with
+// WarpPipe.On.
+type ChangesetKinds uint
+
+// Changeset kind sets. They can be combined, e.g. Insert|Update.
+const (
+	Insert ChangesetKinds = 1 << iota
+	Update
+	Delete
+	Truncate
+	Snapshot
+
+	AnyKind = Insert | Update | Delete | Truncate | Snapshot
+)
+
+// has returns true if the set contains the kind.
+func (k ChangesetKinds) has(kind ChangesetKind) bool {
+	switch kind {
+	case ChangesetKindInsert:
+		return k&Insert != 0
+	case ChangesetKindUpdate:
+		return k&Update != 0
+	case ChangesetKindDelete:
+		return k&Delete != 0
+	case ChangesetKindTruncate:
+		return k&Truncate != 0
+	case ChangesetKindSnapshot:
+		return k&Snapshot != 0
+	}
+	return false
+}
+
+// HandlerFunc is a function registered with WarpPipe.On to process the
+// changesets of a table.
+type HandlerFunc func(context.Context, *Changeset) error
+
+type handler struct {
+	table string
+	kinds ChangesetKinds
+	fn    HandlerFunc
+}
+
+// HandlerWorkers is an option for setting the number of changesets processed
+// concurrently by Run. Changesets of a table are always processed by the same
+// worker, in order.
+func HandlerWorkers(n int) Option {
+	return func(w *WarpPipe) {
+		w.handlerWorkers = n
+	}
+}
+
+// HandlerRetryBackoff is an option for setting the delays between attempts to
+// process a changeset whose handler failed. By default, DefaultBackoff is used.
+func HandlerRetryBackoff(b Backoff) Option {
+	return func(w *WarpPipe) {
+		w.handlerBackoff = &b
+	}
+}
+
+// On registers a handler for the changesets of the given kinds on the tables
+// matching table, in any of the formats supported by WhitelistTables(). It
+// must be called before Run. A changeset matching several handlers is passed
+// to each of them, in the order they were registered.
+func (w *WarpPipe) On(table string, kinds ChangesetKinds, fn HandlerFunc) {
+	w.handlers = append(w.handlers, &handler{
+		table: table,
+		kinds: kinds,
+		fn:    fn,
+	})
+}
+
+// Run listens for changes and dispatches them to the handlers registered with
+// On, until the context is done or a handler fails. It must be called after
+// Open, instead of ListenForChanges.
+//
+// The changesets of a table are processed in order, while tables are processed
+// concurrently by up to HandlerWorkers() workers. A changeset is acknowledged
+// once all its handlers have returned nil, and changesets without a handler
+// are acknowledged right away. A handler that returns an error is retried,
+// as configured by HandlerRetryBackoff(), after which Run returns the error
+// without acknowledging the changeset, so that it is streamed again when
+// warp-pipe is restarted. Run also returns fatal pipeline and listener errors
+// (see IsFatal), and logs other errors.
+func (w *WarpPipe) Run(ctx context.Context) error {
+	if len(w.handlers) == 0 {
+		return errors.New("no handlers registered")
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		wg       sync.WaitGroup
+		errOnce  sync.Once
+		firstErr error
+	)
+	fail := func(err error) {
+		errOnce.Do(func() {
+			firstErr = err
+			cancel()
+		})
+	}
+
+	// changesets are acknowledged once handled
+	w.manualAck = true
+	changes, errs := w.ListenForChanges(ctx)
+	go func() {
+		if err := w.watchErrors(ctx, errs); err != nil {
+			fail(err)
+		}
+	}()
+
+	workers := w.handlerWorkers
+	if workers <= 0 {
+		workers = defaultHandlerWorkers
+	}
+
+	queues := make([]chan *Changeset, workers)
+	for i := range queues {
+		queues[i] = make(chan *Changeset)
+		wg.Add(1)
+		go func(queue <-chan *Changeset) {
+			defer wg.Done()
+			for change := range queue {
+				err := w.handle(ctx, change)
+				if err != nil {
+					fail(err)
+					return
+				}
+			}
+		}(queues[i])
+	}
+
+dispatch:
+	for {
+		select {
+		case <-ctx.Done():
+			break dispatch
+		case change, ok := <-changes:
+			if !ok {
+				break dispatch
+			}
+			if !w.hasHandler(change) {
+				change.Ack()
+				continue
+			}
+
+			select {
+			case queues[tableQueue(change, workers)] <- change:
+			case <-ctx.Done():
+				break dispatch
+			}
+		}
+	}
+
+	for _, queue := range queues {
+		close(queue)
+	}
+	wg.Wait()
+
+	if firstErr != nil {
+		return firstErr
+	}
+	return ctx.Err()
+}
+
+// hasHandler returns true if any handler matches the changeset.
+func (w *WarpPipe) hasHandler(change *Changeset) bool {
+	for _, h := range w.handlers {
+		if h.match(change) {
+			return true
+		}
+	}
+	return false
+}
+
+func (h *handler) match(change *Changeset) bool {
+	return h.kinds.has(change.Kind) && MatchTable([]string{h.table}, change.Schema, change.Table)
+}
+
+// handle passes the changeset to its handlers, retrying a failed handler
+// until the retry backoff gives up, and acknowledges it once all handlers
+// have succeeded. Handlers that succeeded are not called again.
+func (w *WarpPipe) handle(ctx context.Context, change *Changeset) error {
+	backoff := DefaultBackoff
+	if w.handlerBackoff != nil {
+		backoff = *w.handlerBackoff
+	}
+
+	for _, h := range w.handlers {
+		if !h.match(change) {
+			continue
+		}
+
+		for attempt := 1; ; attempt++ {
+			err := h.fn(ctx, change)
+			if err == nil {
+				break
+			}
+			if ctx.Err() != nil {
+				return nil
+			}
+
+			if backoff.MaxRetries >= 0 && attempt > backoff.MaxRetries {
+				return fmt.Errorf("failed to handle changeset %s on %s.%s after %d attempt(s): %w",
+					change.Kind, change.Schema, change.Table, attempt, err)
+			}
+
+			delay := backoff.Duration(attempt)
+			w.logger.WithError(err).
+				WithField("attempt", attempt).
+				Warnf("failed to handle changeset on %s.%s, retrying in %s", change.Schema, change.Table, delay)
+
+			select {
+			case <-ctx.Done():
+				return nil
+			case <-time.After(delay):
+			}
+		}
+	}
+
+	change.Ack()
+	return nil
+}
+
+// watchErrors logs the errors of the listener and pipeline until the context
+// is done, or returns the first fatal error.
+func (w *WarpPipe) watchErrors(ctx context.Context, errs <-chan error) error {
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case err := <-errs:
+			if IsFatal(err) {
+				return err
+			}
+			var connEvent *ConnectionEvent
+			if errors.As(err, &connEvent) {
+				w.logger.Warn(err)
+				continue
+			}
+			w.logger.Error(err)
+		}
+	}
+}
+
+// tableQueue returns the worker queue of the changeset's table.
+func tableQueue(change *Changeset, workers int) int {
+	h := fnv.New32a()
+	h.Write([]byte(change.Schema + "." + change.Table))
+	return int(h.Sum32() % uint32(workers))
+}
@@ -0,0 +1,141 @@
+package warppipe
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx"
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+type testListener struct {
+	changes chan *Changeset
+	errs    chan error
+}
+
+func (l *testListener) Dial(*pgx.ConnConfig) error { return nil }
+
+func (l *testListener) ListenForChanges(context.Context) (chan *Changeset, chan error) {
+	return l.changes, l.errs
+}
+
+func (l *testListener) Close() error { return nil }
+
+// ackCounter creates changesets and records their acks.
+type ackCounter struct {
+	mu    sync.Mutex
+	acked map[int64]bool
+}
+
+func (a *ackCounter) changeset(id int64, kind ChangesetKind, table string) *Changeset {
+	return &Changeset{
+		ID:     id,
+		Kind:   kind,
+		Schema: "public",
+		Table:  table,
+		ack: func() {
+			a.mu.Lock()
+			defer a.mu.Unlock()
+			a.acked[id] = true
+		},
+	}
+}
+
+func (a *ackCounter) isAcked(id int64) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.acked[id]
+}
+
+func TestWarpPipeRun(t *testing.T) {
+	listener := &testListener{changes: make(chan *Changeset), errs: make(chan error)}
+	w := &WarpPipe{listener: listener, logger: log.New()}
+	HandlerWorkers(2)(w)
+	HandlerRetryBackoff(Backoff{InitialInterval: time.Millisecond, MaxRetries: 1})(w)
+
+	var mu sync.Mutex
+	var users []int64
+	attempts := 0
+	w.On("public.users", Insert|Update, func(ctx context.Context, change *Changeset) error {
+		mu.Lock()
+		defer mu.Unlock()
+		users = append(users, change.ID)
+		return nil
+	})
+	w.On("pets", AnyKind, func(ctx context.Context, change *Changeset) error {
+		mu.Lock()
+		defer mu.Unlock()
+		attempts++
+		return errors.New("boom")
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan error)
+	go func() {
+		done <- w.Run(ctx)
+	}()
+
+	acks := &ackCounter{acked: make(map[int64]bool)}
+	for _, change := range []*Changeset{
+		acks.changeset(1, ChangesetKindInsert, "users"),
+		acks.changeset(2, ChangesetKindDelete, "users"),
+		acks.changeset(3, ChangesetKindUpdate, "users"),
+		acks.changeset(4, ChangesetKindInsert, "posts"),
+	} {
+		listener.changes <- change
+	}
+
+	assert.Eventually(t, func() bool {
+		return acks.isAcked(1) && acks.isAcked(2) && acks.isAcked(3) && acks.isAcked(4)
+	}, time.Second, time.Millisecond)
+	mu.Lock()
+	assert.Equal(t, []int64{1, 3}, users)
+	mu.Unlock()
+
+	listener.changes <- acks.changeset(5, ChangesetKindInsert, "pets")
+	select {
+	case err := <-done:
+		assert.EqualError(t, err, "failed to handle changeset insert on public.pets after 2 attempt(s): boom")
+	case <-time.After(time.Second):
+		t.Fatal("Run did not return")
+	}
+	assert.False(t, acks.isAcked(5))
+	assert.Equal(t, 2, attempts)
+}
+
+func TestChangesetKinds(t *testing.T) {
+	kinds := Insert | Delete
+	assert.True(t, kinds.has(ChangesetKindInsert))
+	assert.True(t, kinds.has(ChangesetKindDelete))
+	assert.False(t, kinds.has(ChangesetKindUpdate))
+	assert.True(t, AnyKind.has(ChangesetKindSnapshot))
+	assert.False(t, AnyKind.has(""))
+}
+
+func TestWarpPipeRunConnectionFailed(t *testing.T) {
+	listener := &testListener{changes: make(chan *Changeset), errs: make(chan error)}
+	w := &WarpPipe{listener: listener, logger: log.New()}
+	w.On("users", AnyKind, func(ctx context.Context, change *Changeset) error {
+		return nil
+	})
+
+	done := make(chan error)
+	go func() {
+		done <- w.Run(context.Background())
+	}()
+
+	listener.errs <- &ConnectionEvent{State: ConnectionReconnecting, Attempt: 1, Err: errors.New("connection reset")}
+	listener.errs <- &ConnectionEvent{State: ConnectionFailed, Attempt: 3, Err: errors.New("connection refused")}
+	select {
+	case err := <-done:
+		assert.True(t, IsFatal(err))
+		assert.EqualError(t, err, "failed to reconnect after 3 attempt(s): connection refused")
+	case <-time.After(time.Second):
+		t.Fatal("Run did not return")
+	}
+}
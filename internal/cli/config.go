@@ -1,9 +1,13 @@
 package cli
 
 import (
+	"errors"
 	"fmt"
+	"regexp"
 	"time"
 
+	"github.com/jackc/pgx"
+
 	warppipe "github.com/perangel/warp-pipe"
 )
 
@@ -45,6 +49,110 @@ func parseConfig() (*warppipe.Config, error) {
 		config.ReplicationMode = replicationMode
 	}
 
+	if publicationName != "" {
+		config.PublicationName = publicationName
+	}
+
+	if replSlotName != "" {
+		config.ReplicationSlotName = replSlotName
+	}
+
+	if reuseReplSlot {
+		config.ReuseReplicationSlot = reuseReplSlot
+	}
+
+	if initialSnapshot {
+		config.InitialSnapshot = initialSnapshot
+	}
+
+	if pollInterval != 0 {
+		config.PollInterval = pollInterval
+	}
+
+	if batchSize != 0 {
+		config.BatchSize = batchSize
+	}
+
+	if consumerName != "" {
+		config.ConsumerName = consumerName
+	}
+
+	if retentionInterval != 0 {
+		config.RetentionInterval = retentionInterval
+	}
+
+	if retentionOlderThan != "" {
+		age, err := parseAge(retentionOlderThan)
+		if err != nil {
+			return nil, err
+		}
+		config.RetentionOlderThan = age
+	}
+
+	if checkpoint != "" {
+		config.Checkpoint = checkpoint
+	}
+
+	if checkpointName != "" {
+		config.CheckpointName = checkpointName
+	}
+
+	if checkpointInterval != 0 {
+		config.CheckpointInterval = checkpointInterval
+	}
+
+	if pipelineConfig != "" {
+		config.Pipeline = pipelineConfig
+	}
+
+	if deadLetter != "" {
+		config.DeadLetter = deadLetter
+	}
+
+	if output != "" {
+		config.Output = output
+	}
+
+	if outputFormat != "" {
+		config.OutputFormat = outputFormat
+	}
+
+	if outputBatchSize != 0 {
+		config.OutputBatchSize = outputBatchSize
+	}
+
+	if outputFlushInterval != 0 {
+		config.OutputFlushInterval = outputFlushInterval
+	}
+
+	if grpcAddr != "" {
+		config.GRPCAddr = grpcAddr
+	}
+
+	if grpcTLSCert != "" {
+		config.GRPCTLSCert = grpcTLSCert
+	}
+
+	if grpcTLSKey != "" {
+		config.GRPCTLSKey = grpcTLSKey
+	}
+
+	if grpcSubscriberTimeout != defaultGRPCSubscriberTimeout {
+		config.GRPCSubscriberTimeout = grpcSubscriberTimeout
+	}
+
+	if reconnectRetries != warppipe.DefaultBackoff.MaxRetries {
+		config.ReconnectMaxRetries = reconnectRetries
+	}
+
+	if reconnectBackoff != 0 {
+		config.ReconnectInitialBackoff = reconnectBackoff
+	}
+
+	if reconnectMaxDelay != 0 {
+		config.ReconnectMaxBackoff = reconnectMaxDelay
+	}
+
 	config.StartFromLSN = uint64(startFromLSN)
 	config.StartFromID = startFromID
 	config.StartFromTimestamp = startFromTimestamp
@@ -57,17 +165,59 @@ func parseConfig() (*warppipe.Config, error) {
 }
 
 func initListener(config *warppipe.Config) (warppipe.Listener, error) {
+	backoff := warppipe.DefaultBackoff
+	backoff.MaxRetries = config.ReconnectMaxRetries
+	if config.ReconnectInitialBackoff > 0 {
+		backoff.InitialInterval = config.ReconnectInitialBackoff
+	}
+	if config.ReconnectMaxBackoff > 0 {
+		backoff.MaxInterval = config.ReconnectMaxBackoff
+	}
+
 	switch config.ReplicationMode {
-	case replicationModeLR:
-		var opts []warppipe.LROption
+	case replicationModeLR, replicationModePgOutput:
+		opts := []warppipe.LROption{warppipe.ReconnectBackoff(backoff)}
+
+		if config.ReplicationSlotName != "" {
+			opts = append(opts, warppipe.ReplSlotName(config.ReplicationSlotName))
+		}
+
+		if config.ReuseReplicationSlot {
+			opts = append(opts, warppipe.ReuseReplSlot(true))
+		} else if config.Checkpoint != "" {
+			return nil, errors.New("`--checkpoint` requires `--reuse-replication-slot` in lr and pgoutput modes, as a new replication slot cannot stream changes from before its creation")
+		}
+
+		if config.InitialSnapshot {
+			opts = append(opts, warppipe.InitialSnapshot(config.WhitelistTables, config.IgnoreTables))
+		}
 
 		if startFromLSN != -1 {
 			opts = append(opts, warppipe.StartFromLSN(uint64(config.StartFromLSN)))
 		}
 
+		if config.ReplicationMode == replicationModePgOutput {
+			if !validIdentifier.MatchString(config.PublicationName) {
+				return nil, fmt.Errorf("'%s' is not a valid value for `--publication-name`. Must be up to 63 letters, digits, underscores or dollar signs, starting with a letter or an underscore", config.PublicationName)
+			}
+			return warppipe.NewPgOutputListener(config.PublicationName, opts...), nil
+		}
+
 		return warppipe.NewLogicalReplicationListener(opts...), nil
 	case replicationModeAudit:
-		var opts []warppipe.NotifyOption
+		opts := []warppipe.NotifyOption{
+			warppipe.NotifyReconnectBackoff(backoff),
+			warppipe.PollInterval(config.PollInterval),
+			warppipe.BatchSize(config.BatchSize),
+		}
+
+		if config.ConsumerName != "" {
+			opts = append(opts, warppipe.ConsumerName(config.ConsumerName))
+		}
+
+		if config.RetentionInterval > 0 {
+			opts = append(opts, warppipe.Retention(config.RetentionInterval, config.RetentionOlderThan))
+		}
 
 		if config.StartFromID != -1 {
 			opts = append(opts, warppipe.StartFromID(config.StartFromID))
@@ -78,6 +228,32 @@ func initListener(config *warppipe.Config) (warppipe.Listener, error) {
 
 		return warppipe.NewNotifyListener(opts...), nil
 	default:
-		return nil, fmt.Errorf("'%s' is not a valid value for `--replication-mode`. Must be either `lr` or `audit`", config.ReplicationMode)
+		return nil, fmt.Errorf("'%s' is not a valid value for `--replication-mode`. Must be one of `lr`, `pgoutput` or `audit`", config.ReplicationMode)
+	}
+}
+
+// validIdentifier matches the names accepted for the database objects created
+// by warp-pipe.
+var validIdentifier = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_$]{0,62}$`)
+
+// checkpointSource is the value of `--checkpoint` for saving the position in
+// the source database.
+const checkpointSource = "source"
+
+func initCheckpointStore(config *warppipe.Config, connConfig *pgx.ConnConfig) warppipe.CheckpointStore {
+	if config.Checkpoint == checkpointSource {
+		return warppipe.NewPostgresCheckpointStore(connConfig, config.CheckpointName)
+	}
+	return warppipe.NewFileCheckpointStore(config.Checkpoint)
+}
+
+// deadLetterSource is the value of `--dead-letter` for saving dead letters in
+// the source database.
+const deadLetterSource = "source"
+
+func initDeadLetterStore(config *warppipe.Config, connConfig *pgx.ConnConfig) warppipe.DeadLetterStore {
+	if config.DeadLetter == deadLetterSource {
+		return warppipe.NewPostgresDeadLetterStore(connConfig)
 	}
+	return warppipe.NewFileDeadLetterStore(config.DeadLetter)
 }
@@ -0,0 +1,141 @@
+package cli
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/jackc/pgx"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+
+	warppipe "github.com/perangel/warp-pipe"
+	"github.com/perangel/warp-pipe/sink"
+)
+
+// Flags
+var (
+	dlqStages []string
+)
+
+var dlqCmd = &cobra.Command{
+	Use:   "dlq",
+	Short: "Manage dead-lettered changesets",
+}
+
+var dlqReplayCmd = &cobra.Command{
+	Use:   "replay",
+	Short: "Replay dead-lettered changesets",
+	Long: `Replay the changesets that pipeline stages failed to process, and saved in
+the dead letter store, through the pipeline and write them to the output.
+
+Each changeset is processed again from the stage that failed to process it,
+so the pipeline configuration must still have that stage. A changeset is
+deleted from the dead letter store once the output has confirmed the write,
+or once it has been filtered out or saved again by a stage that failed, so
+that an interrupted replay can be resumed.
+	`,
+	RunE: func(cmd *cobra.Command, _ []string) error {
+		config, err := parseConfig()
+		if err != nil {
+			return err
+		}
+
+		if config.DeadLetter == "" {
+			return errors.New("--dead-letter is required")
+		}
+		if config.Pipeline == "" {
+			return errors.New("--pipeline is required, to replay the changes through the stages that failed to process them")
+		}
+
+		pipeline, err := warppipe.LoadPipelineConfig(config.Pipeline)
+		if err != nil {
+			return err
+		}
+
+		enc, err := sink.NewEncoder(config.OutputFormat, sink.Source{
+			Host:     config.Database.Host,
+			Port:     config.Database.Port,
+			Database: config.Database.Database,
+		})
+		if err != nil {
+			return err
+		}
+
+		out, err := sink.Open(config.Output, enc)
+		if err != nil {
+			return err
+		}
+		defer out.Close()
+
+		connConfig := &pgx.ConnConfig{
+			Host:     config.Database.Host,
+			Port:     uint16(config.Database.Port),
+			User:     config.Database.User,
+			Password: config.Database.Password,
+			Database: config.Database.Database,
+		}
+		store := initDeadLetterStore(config, connConfig)
+		if closer, ok := store.(io.Closer); ok {
+			defer closer.Close()
+		}
+
+		// changes that fail again are saved as new dead letters
+		p := warppipe.NewPipeline()
+		if err := pipeline.AddStages(p, store); err != nil {
+			return err
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		shutdownCh := make(chan os.Signal, 1)
+		signal.Notify(shutdownCh, os.Interrupt, syscall.SIGTERM)
+		go func() {
+			<-shutdownCh
+			cancel()
+		}()
+
+		letters, err := warppipe.ReplayDeadLetters(ctx, store, dlqStages...)
+		if err != nil {
+			return err
+		}
+
+		replayed := 0
+		changes := make(chan *warppipe.Changeset)
+		go func() {
+			defer close(changes)
+			for change := range letters {
+				replayed++
+				changes <- change
+			}
+		}()
+
+		processed, errs := p.Start(ctx, changes)
+		go logErrors(errs, make(chan error, 1))
+
+		err = sink.Run(ctx, out, processed,
+			sink.MaxBatchSize(config.OutputBatchSize),
+			sink.FlushInterval(config.OutputFlushInterval),
+		)
+		if err != nil {
+			return err
+		}
+		if err := p.Wait(); err != nil {
+			return err
+		}
+
+		log.Infof("Successfully replayed %d changesets", replayed)
+		return nil
+	},
+}
+
+func init() {
+	dlqReplayCmd.Flags().StringSliceVar(&dlqStages, "stage", nil, "only replay the changesets that the provided stages failed to process")
+	dlqReplayCmd.Flags().SortFlags = false
+
+	dlqCmd.AddCommand(dlqReplayCmd)
+}
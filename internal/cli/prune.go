@@ -0,0 +1,121 @@
+package cli
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx"
+	"github.com/spf13/cobra"
+
+	"github.com/perangel/warp-pipe/db"
+	"github.com/perangel/warp-pipe/internal/store"
+)
+
+// Flags
+var (
+	pruneBeforeID        int64
+	pruneOlderThan       string
+	pruneBatchSize       int
+	pruneIgnoreConsumers bool
+)
+
+var pruneCmd = &cobra.Command{
+	Use:   "prune",
+	Short: "Delete old changesets",
+	Long: `Delete old changesets from the 'warp_pipe.changesets' table.
+
+Changesets are deleted in batches, each in its own statement, so that locks on
+the table are only held briefly.
+
+Unless --ignore-consumers is set, changesets that have not yet been processed by
+every consumer registered in 'warp_pipe.consumers' are kept.
+	`,
+	RunE: func(cmd *cobra.Command, _ []string) error {
+		if pruneBeforeID == 0 && pruneOlderThan == "" {
+			return errors.New("one of --before-id or --older-than is required")
+		}
+
+		var before time.Time
+		if pruneOlderThan != "" {
+			age, err := parseAge(pruneOlderThan)
+			if err != nil {
+				return err
+			}
+			before = time.Now().Add(-age)
+		}
+
+		config, err := parseConfig()
+		if err != nil {
+			return err
+		}
+
+		dbConfig := &pgx.ConnConfig{
+			Host:     config.Database.Host,
+			Port:     uint16(config.Database.Port),
+			User:     config.Database.User,
+			Password: config.Database.Password,
+			Database: config.Database.Database,
+		}
+
+		conn, err := pgx.Connect(*dbConfig)
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+
+		err = db.Migrate(conn)
+		if err != nil {
+			return err
+		}
+
+		ctx := context.Background()
+		changesets := store.NewChangesetStore(conn, store.PageSize(pruneBatchSize))
+
+		beforeID := pruneBeforeID
+		if !pruneIgnoreConsumers {
+			pos, ok, err := changesets.GetMinConsumerPosition(ctx)
+			if err != nil {
+				return fmt.Errorf("failed to read consumer positions: %w", err)
+			}
+			if ok && (beforeID == 0 || pos+1 < beforeID) {
+				beforeID = pos + 1
+			}
+		}
+
+		deleted, err := changesets.Prune(ctx, beforeID, before)
+		if err != nil {
+			return err
+		}
+
+		fmt.Printf("Successfully deleted %d changesets\n", deleted)
+		return nil
+	},
+}
+
+// parseAge parses a duration, which may also be given in days (e.g. `7d`).
+func parseAge(s string) (time.Duration, error) {
+	if strings.HasSuffix(s, "d") {
+		days, err := strconv.Atoi(strings.TrimSuffix(s, "d"))
+		if err != nil {
+			return 0, fmt.Errorf("'%s' is not a valid duration", s)
+		}
+		return time.Duration(days) * 24 * time.Hour, nil
+	}
+
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, fmt.Errorf("'%s' is not a valid duration", s)
+	}
+	return d, nil
+}
+
+func init() {
+	pruneCmd.Flags().Int64Var(&pruneBeforeID, "before-id", 0, "delete changesets with an ID lower than the provided ID")
+	pruneCmd.Flags().StringVar(&pruneOlderThan, "older-than", "", "delete changesets older than the provided age (e.g. 7d, 12h)")
+	pruneCmd.Flags().IntVar(&pruneBatchSize, "batch-size", 1000, "number of changesets deleted per statement")
+	pruneCmd.Flags().BoolVar(&pruneIgnoreConsumers, "ignore-consumers", false, "also delete changesets that registered consumers have not processed")
+}
@@ -0,0 +1,121 @@
+package cli
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+
+	"github.com/perangel/warp-pipe/rpc"
+)
+
+// Flags
+var (
+	grpcAddr              string
+	grpcTLSCert           string
+	grpcTLSKey            string
+	grpcSubscriberTimeout time.Duration
+)
+
+const defaultGRPCSubscriberTimeout = 1 * time.Hour
+
+func init() {
+	serveCmd.Flags().StringVar(&grpcAddr, "grpc", "", "address on which changes are served over gRPC (default \":9090\")")
+	serveCmd.Flags().StringVar(&grpcTLSCert, "grpc-tls-cert", "", "certificate file with which gRPC is served over TLS")
+	serveCmd.Flags().StringVar(&grpcTLSKey, "grpc-tls-key", "", "key file with which gRPC is served over TLS")
+	serveCmd.Flags().DurationVar(&grpcSubscriberTimeout, "grpc-subscriber-timeout", defaultGRPCSubscriberTimeout, "how long a subscriber may stay disconnected before the changes pending its acknowledgement are released (0 never releases them)")
+	serveCmd.Flags().SortFlags = false
+}
+
+var serveCmd = &cobra.Command{
+	Use:   "serve",
+	Short: "Serve changes over gRPC",
+	Long: `Run a warp-pipe and serve changes to subscribers over gRPC.
+
+The service is defined in rpc/warppipe.proto. Subscribers receive the changes
+matching their table filter with the Subscribe RPC, and acknowledge them with
+the Ack RPC. A change is only acknowledged to the database (and saved in the
+checkpoint) once every subscriber it was sent to has acknowledged it, or once
+the subscriber has been disconnected for longer than --grpc-subscriber-timeout.
+	`,
+	RunE: func(cmd *cobra.Command, _ []string) error {
+		config, err := parseConfig()
+		if err != nil {
+			return err
+		}
+
+		if (config.GRPCTLSCert == "") != (config.GRPCTLSKey == "") {
+			return errors.New("both --grpc-tls-cert and --grpc-tls-key are required to serve over TLS")
+		}
+
+		lis, err := net.Listen("tcp", config.GRPCAddr)
+		if err != nil {
+			return err
+		}
+
+		wp, err := openWarpPipe(config)
+		if err != nil {
+			lis.Close()
+			return err
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		changes, errs := wp.ListenForChanges(ctx)
+		pipelineErr := make(chan error, 1)
+		go logErrors(errs, pipelineErr)
+
+		srv := rpc.NewServer(rpc.SubscriberTimeout(config.GRPCSubscriberTimeout))
+		go func() {
+			if err := srv.Run(ctx, changes); err != nil && err != context.Canceled {
+				log.WithError(err).Error("failed to serve changes")
+			}
+		}()
+
+		httpSrv := &http.Server{Handler: srv}
+		httpSrv.Protocols = new(http.Protocols)
+		httpSrv.Protocols.SetHTTP2(true)
+		httpSrv.Protocols.SetUnencryptedHTTP2(config.GRPCTLSCert == "")
+
+		serveErr := make(chan error, 1)
+		go func() {
+			log.Infof("Serving gRPC on %s", lis.Addr())
+			if config.GRPCTLSCert != "" {
+				serveErr <- httpSrv.ServeTLS(lis, config.GRPCTLSCert, config.GRPCTLSKey)
+				return
+			}
+			serveErr <- httpSrv.Serve(lis)
+		}()
+
+		shutdownCh := make(chan os.Signal, 1)
+		signal.Notify(shutdownCh, os.Interrupt, syscall.SIGTERM)
+
+		var runErr error
+		select {
+		case <-shutdownCh:
+		case runErr = <-serveErr:
+			log.WithError(runErr).Error("failed to serve gRPC")
+		case runErr = <-pipelineErr:
+			log.WithError(runErr).Error("failed to process changes")
+		}
+
+		// ends the Subscribe calls, so that the server can shut down
+		cancel()
+		shutdownCtx, cancelShutdown := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancelShutdown()
+		if err := httpSrv.Shutdown(shutdownCtx); err != nil {
+			log.WithError(err).Warn("failed to shut down the gRPC server")
+		}
+
+		if err := wp.Close(); err != nil {
+			return err
+		}
+		return runErr
+	},
+}
@@ -2,41 +2,72 @@ package cli
 
 import (
 	"context"
-	"encoding/json"
-	"fmt"
+	"errors"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
+	"time"
 
 	"github.com/jackc/pgx"
 	warppipe "github.com/perangel/warp-pipe"
+	"github.com/perangel/warp-pipe/sink"
 	log "github.com/sirupsen/logrus"
 
 	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
 )
 
 // Flags
 var (
-	dbHost             string
-	dbPort             int
-	dbName             string
-	dbUser             string
-	dbPass             string
-	replicationMode    string
-	ignoreTables       []string
-	whitelistTables    []string
-	startFromID        int64
-	startFromTimestamp int64
-	startFromLSN       int64
-	logLevel           string
+	dbHost              string
+	dbPort              int
+	dbName              string
+	dbUser              string
+	dbPass              string
+	replicationMode     string
+	publicationName     string
+	replSlotName        string
+	reuseReplSlot       bool
+	initialSnapshot     bool
+	ignoreTables        []string
+	whitelistTables     []string
+	startFromID         int64
+	startFromTimestamp  int64
+	startFromLSN        int64
+	pollInterval        time.Duration
+	batchSize           int
+	consumerName        string
+	retentionInterval   time.Duration
+	retentionOlderThan  string
+	checkpoint          string
+	checkpointName      string
+	checkpointInterval  time.Duration
+	pipelineConfig      string
+	deadLetter          string
+	output              string
+	outputFormat        string
+	outputBatchSize     int
+	outputFlushInterval time.Duration
+	reconnectRetries    int
+	reconnectBackoff    time.Duration
+	reconnectMaxDelay   time.Duration
+	logLevel            string
 )
 
+// shutdownTimeout is how long the changes in flight are given to be written on
+// shutdown.
+const shutdownTimeout = 10 * time.Second
+
 const (
-	replicationModeLR    = "lr"
-	replicationModeAudit = "audit"
+	replicationModeLR       = "lr"
+	replicationModePgOutput = "pgoutput"
+	replicationModeAudit    = "audit"
 )
 
 func init() {
+	sink.RegisterKafkaProducer(sink.NewKafkaClient)
+
 	WarpPipeCmd.PersistentFlags().StringVarP(&logLevel, "log-level", "L", "info", "log level")
 	WarpPipeCmd.PersistentFlags().StringVarP(&dbHost, "db-host", "H", "", "database host")
 	WarpPipeCmd.PersistentFlags().IntVarP(&dbPort, "db-port", "p", 0, "database port")
@@ -47,13 +78,51 @@ func init() {
 	WarpPipeCmd.Flags().Int64Var(&startFromID, "start-from-id", -1, "stream all changes starting from the provided changeset ID")
 	WarpPipeCmd.Flags().Int64Var(&startFromTimestamp, "start-from-ts", -1, "stream all changes starting from the provided timestamp")
 	WarpPipeCmd.Flags().StringVarP(&replicationMode, "replication-mode", "M", replicationModeLR, "replication mode")
+	WarpPipeCmd.Flags().StringVar(&publicationName, "publication-name", "", "publication to replicate (pgoutput mode only)")
+	WarpPipeCmd.Flags().StringVar(&replSlotName, "replication-slot-name", "", "replication slot name (lr mode only)")
+	WarpPipeCmd.Flags().BoolVar(&reuseReplSlot, "reuse-replication-slot", false, "re-use the replication slot across restarts (lr mode only)")
+	WarpPipeCmd.Flags().BoolVar(&initialSnapshot, "initial-snapshot", false, "read the current rows of all replicated tables before streaming changes (lr mode only)")
 	WarpPipeCmd.Flags().StringSliceVarP(&ignoreTables, "ignore-tables", "i", nil, "tables to ignore during replication")
 	WarpPipeCmd.Flags().StringSliceVarP(&whitelistTables, "whitelist-tables", "w", nil, "tables to include during replication")
+	WarpPipeCmd.Flags().DurationVar(&pollInterval, "poll-interval", 0, "interval at which the changesets table is polled when no notification is received (audit mode only) (default 5s)")
+	WarpPipeCmd.Flags().IntVar(&batchSize, "batch-size", 0, "maximum number of changesets read per query (audit mode only) (default 500)")
+	WarpPipeCmd.Flags().StringVar(&consumerName, "consumer-name", "", "register as a consumer of the changesets table under this name (audit mode only)")
+	WarpPipeCmd.Flags().DurationVar(&retentionInterval, "retention-interval", 0, "interval at which changesets processed by all consumers are pruned (audit mode only)")
+	WarpPipeCmd.Flags().StringVar(&retentionOlderThan, "retention-older-than", "", "only prune changesets older than the provided age, e.g. 7d (audit mode only)")
+	WarpPipeCmd.Flags().StringVar(&checkpoint, "checkpoint", "", "save the position of acknowledged changes to resume from after a restart, either 'source' (a table in the source database) or a file path")
+	WarpPipeCmd.Flags().StringVar(&checkpointName, "checkpoint-name", "", "name under which the position is saved in the source database (default \"warp_pipe\")")
+	WarpPipeCmd.Flags().DurationVar(&checkpointInterval, "checkpoint-interval", 0, "interval at which the position is saved (default 10s)")
+	WarpPipeCmd.Flags().StringVar(&pipelineConfig, "pipeline", "", "YAML or JSON pipeline configuration file, whose stages transform and filter changes")
+	WarpPipeCmd.Flags().StringVar(&deadLetter, "dead-letter", "", "dead letter store of the changes that pipeline stages with 'on_error: dead_letter' fail to process, either 'source' (a table in the source database) or a file path")
+	WarpPipeCmd.Flags().StringVarP(&output, "output", "o", "", "output to which changes are written: 'stdout', a file path or file:// URL (rolled by max_size and max_age), an http(s):// webhook URL, or a nats://, redis:// or kafka:// URL (default \"stdout\")")
+	WarpPipeCmd.Flags().StringVar(&outputFormat, "output-format", "", "format in which changes are written: 'json', 'debezium', 'cloudevents' or 'avro', with parameters as a query string, e.g. 'debezium?schemas=false' (default \"json\")")
+	WarpPipeCmd.Flags().IntVar(&outputBatchSize, "output-batch-size", 0, "maximum number of changes written to the output at once (default 100)")
+	WarpPipeCmd.Flags().DurationVar(&outputFlushInterval, "output-flush-interval", 0, "maximum time a change waits for its batch to fill up before it is written to the output (default 1s)")
+	WarpPipeCmd.Flags().IntVar(&reconnectRetries, "reconnect-max-retries", warppipe.DefaultBackoff.MaxRetries, "maximum number of consecutive reconnect attempts (-1 retries forever, 0 disables reconnecting)")
+	WarpPipeCmd.Flags().DurationVar(&reconnectBackoff, "reconnect-initial-backoff", 0, "delay before the first reconnect attempt (default 1s)")
+	WarpPipeCmd.Flags().DurationVar(&reconnectMaxDelay, "reconnect-max-backoff", 0, "maximum delay between reconnect attempts (default 1m)")
 	WarpPipeCmd.Flags().SortFlags = false
 
+	// serve shares the flags of the root command, except for the output ones,
+	// which dlq replay uses to write the replayed changes, along with the
+	// pipeline they are replayed through
+	WarpPipeCmd.Flags().VisitAll(func(f *pflag.Flag) {
+		switch {
+		case strings.HasPrefix(f.Name, "output"):
+			dlqReplayCmd.Flags().AddFlag(f)
+			return
+		case f.Name == "pipeline" || f.Name == "dead-letter":
+			dlqReplayCmd.Flags().AddFlag(f)
+		}
+		serveCmd.Flags().AddFlag(f)
+	})
+
 	WarpPipeCmd.AddCommand(
 		setupDBCmd,
 		teardownDBCmd,
+		pruneCmd,
+		serveCmd,
+		dlqCmd,
 	)
 }
 
@@ -68,60 +137,158 @@ var WarpPipeCmd = &cobra.Command{
 			return err
 		}
 
-		listener, err := initListener(config)
-		if err != nil {
-			return err
-		}
-
-		connConfig := &pgx.ConnConfig{
+		enc, err := sink.NewEncoder(config.OutputFormat, sink.Source{
 			Host:     config.Database.Host,
-			Port:     uint16(config.Database.Port),
-			User:     config.Database.User,
-			Password: config.Database.Password,
+			Port:     config.Database.Port,
 			Database: config.Database.Database,
+		})
+		if err != nil {
+			return err
 		}
 
-		wp, err := warppipe.NewWarpPipe(
-			connConfig,
-			listener,
-			warppipe.IgnoreTables(config.IgnoreTables),
-			warppipe.WhitelistTables(config.WhitelistTables),
-			warppipe.LogLevel(config.LogLevel),
-		)
+		out, err := sink.Open(config.Output, enc)
 		if err != nil {
-			log.Fatal(err)
+			return err
 		}
 
-		if err := wp.Open(); err != nil {
+		wp, err := openWarpPipe(config)
+		if err != nil {
 			log.Fatal(err)
 		}
 
 		ctx, cancel := context.WithCancel(context.Background())
-		changes, errors := wp.ListenForChanges(ctx)
+		changes, errs := wp.ListenForChanges(ctx)
+		pipelineErr := make(chan error, 1)
+		go logErrors(errs, pipelineErr)
+
+		// changes are only acknowledged once the sink has written them
+		sinkErr := make(chan error, 1)
 		go func() {
-			for {
-				select {
-				case change := <-changes:
-					b, err := json.Marshal(change)
-					if err != nil {
-						log.Error(err)
-					}
-					fmt.Println(string(b))
-				case err := <-errors:
-					log.Error(err)
-				}
-			}
+			sinkErr <- sink.Run(ctx, out, changes,
+				sink.MaxBatchSize(config.OutputBatchSize),
+				sink.FlushInterval(config.OutputFlushInterval),
+			)
 		}()
 
 		shutdownCh := make(chan os.Signal, 1)
 		signal.Notify(shutdownCh, os.Interrupt, syscall.SIGTERM)
-		for {
-			<-shutdownCh
-			cancel()
-			if err := wp.Close(); err != nil {
-				return err
+
+		var runErr error
+		select {
+		case <-shutdownCh:
+			// stop listening, and let the output write the changes in flight,
+			// so that they are acknowledged before the checkpoint is saved
+			shutdownCtx, cancelShutdown := context.WithTimeout(context.Background(), shutdownTimeout)
+			err := wp.Shutdown(shutdownCtx)
+			if err == nil {
+				select {
+				case runErr = <-sinkErr:
+				case <-shutdownCtx.Done():
+					err = shutdownCtx.Err()
+				}
+			}
+			cancelShutdown()
+			if err != nil {
+				log.WithError(err).Warn("failed to write the changes in flight")
 			}
-			return nil
+		case runErr = <-sinkErr:
+			if runErr != nil {
+				log.WithError(runErr).Error("failed to write changes to the output")
+				break
+			}
+			// the changes only end early if the pipeline failed
+			runErr = <-pipelineErr
+			log.WithError(runErr).Error("failed to process changes")
+		case runErr = <-pipelineErr:
+			log.WithError(runErr).Error("failed to process changes")
 		}
+
+		cancel()
+		if err := wp.Close(); err != nil {
+			return err
+		}
+		if err := out.Close(); err != nil {
+			return err
+		}
+		return runErr
 	},
 }
+
+// openWarpPipe creates a WarpPipe from the config and opens it.
+func openWarpPipe(config *warppipe.Config) (*warppipe.WarpPipe, error) {
+	var pipeline *warppipe.PipelineConfig
+	if config.Pipeline != "" {
+		var err error
+		pipeline, err = warppipe.LoadPipelineConfig(config.Pipeline)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	listener, err := initListener(config)
+	if err != nil {
+		return nil, err
+	}
+
+	connConfig := &pgx.ConnConfig{
+		Host:     config.Database.Host,
+		Port:     uint16(config.Database.Port),
+		User:     config.Database.User,
+		Password: config.Database.Password,
+		Database: config.Database.Database,
+	}
+
+	// changes are acknowledged once written to the output
+	opts := []warppipe.Option{
+		warppipe.ManualAck(),
+		warppipe.IgnoreTables(config.IgnoreTables),
+		warppipe.WhitelistTables(config.WhitelistTables),
+		warppipe.LogLevel(config.LogLevel),
+	}
+
+	if pipeline != nil {
+		opts = append(opts, warppipe.ConfigStages(pipeline))
+	}
+
+	if config.DeadLetter != "" {
+		opts = append(opts, warppipe.DeadLetters(initDeadLetterStore(config, connConfig)))
+	}
+
+	if config.Checkpoint != "" {
+		opts = append(opts, warppipe.Checkpoint(
+			initCheckpointStore(config, connConfig),
+			config.CheckpointInterval,
+		))
+	}
+
+	wp, err := warppipe.NewWarpPipe(connConfig, listener, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := wp.Open(); err != nil {
+		return nil, err
+	}
+	return wp, nil
+}
+
+// logErrors logs the errors of a WarpPipe, with connection events as
+// warnings, and sends the first fatal pipeline or listener error on fatal.
+func logErrors(errs <-chan error, fatal chan<- error) {
+	for err := range errs {
+		if warppipe.IsFatal(err) {
+			select {
+			case fatal <- err:
+			default:
+			}
+			continue
+		}
+
+		var connEvent *warppipe.ConnectionEvent
+		if errors.As(err, &connEvent) {
+			log.Warn(err)
+			continue
+		}
+		log.Error(err)
+	}
+}
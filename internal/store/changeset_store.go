@@ -14,7 +14,32 @@ var (
 )
 
 const (
-	paginationDefaultLimit = 500
+	defaultPageSize = 500
+
+	// selectChangesetsSQL selects the columns scanned by scanRow. The position
+	// of a changeset in its transaction is derived from the other changesets
+	// sharing its txid. Changesets recorded before txid was captured are each
+	// treated as their own transaction.
+	selectChangesetsSQL = `
+		SELECT
+			c.id,
+			c.ts,
+			c.action,
+			c.schema_name,
+			c.table_name,
+			c.relid,
+			c.new_values,
+			c.old_values,
+			COALESCE(c.txid, 0),
+			(
+				SELECT count(*) FROM warp_pipe.changesets t
+				WHERE t.txid = c.txid AND t.id < c.id
+			) AS tx_position,
+			NOT EXISTS (
+				SELECT 1 FROM warp_pipe.changesets t
+				WHERE t.txid = c.txid AND t.id > c.id
+			) AS tx_last
+		FROM warp_pipe.changesets c`
 )
 
 // Event represents an entry in the events store.
@@ -27,25 +52,63 @@ type Event struct {
 	OID        int64
 	NewValues  []byte
 	OldValues  []byte
+	TxID       int64
+	TxPosition int64
+	TxLast     bool
+}
+
+// TxSnapshot holds the bounds of a transaction snapshot. Every transaction
+// with an ID below Xmin has ended, and every transaction that had started had
+// an ID below Xmax.
+type TxSnapshot struct {
+	Xmin int64
+	Xmax int64
 }
 
 // EventStore is the interface for providing access to events storage.
 type EventStore interface {
 	GetByID(ctx context.Context, eventID int64) (*Event, error)
-	GetSinceID(ctx context.Context, eventID int64, eventCh chan *Event, doneCh chan bool, errCh chan error)
-	GetSinceTimestamp(ctx context.Context, since time.Time, eventCh chan *Event, doneCh chan bool, errCh chan error)
-	DeleteBeforeID(ctx context.Context, eventID int64) error
-	DeleteBeforeTimestamp(ctx context.Context, since time.Time) error
+	GetSinceID(eventID int64) *EventCursor
+	GetSinceTimestamp(since time.Time) *EventCursor
+	DeleteBeforeID(ctx context.Context, eventID int64) (int64, error)
+	DeleteBeforeTimestamp(ctx context.Context, since time.Time) (int64, error)
+	Prune(ctx context.Context, beforeID int64, before time.Time) (int64, error)
+	GetConsumerPosition(ctx context.Context, consumer string) (int64, bool, error)
+	SaveConsumerPosition(ctx context.Context, consumer string, eventID int64) error
+	GetMinConsumerPosition(ctx context.Context) (int64, bool, error)
+	GetTxSnapshot(ctx context.Context) (*TxSnapshot, error)
+}
+
+// Option is a ChangesetStore option function
+type Option func(*ChangesetStore)
+
+// PageSize is an option for setting the number of events read per query when
+// iterating over events, and deleted per statement when pruning. Defaults to 500.
+func PageSize(size int) Option {
+	return func(s *ChangesetStore) {
+		s.pageSize = size
+	}
 }
 
 // ChangesetStore is an EventStore for changesets.
 type ChangesetStore struct {
-	conn *pgx.Conn
+	conn     *pgx.Conn
+	pageSize int
 }
 
 // NewChangesetStore initializes a new ChangesetStore.
-func NewChangesetStore(conn *pgx.Conn) *ChangesetStore {
-	return &ChangesetStore{conn: conn}
+func NewChangesetStore(conn *pgx.Conn, opts ...Option) *ChangesetStore {
+	s := &ChangesetStore{conn: conn}
+
+	for _, opt := range opts {
+		opt(s)
+	}
+
+	if s.pageSize <= 0 {
+		s.pageSize = defaultPageSize
+	}
+
+	return s
 }
 
 func (s *ChangesetStore) scanRow(rows *pgx.Rows) (*Event, error) {
@@ -59,13 +122,16 @@ func (s *ChangesetStore) scanRow(rows *pgx.Rows) (*Event, error) {
 		&evt.OID,
 		&evt.NewValues,
 		&evt.OldValues,
+		&evt.TxID,
+		&evt.TxPosition,
+		&evt.TxLast,
 	)
 
 	return &evt, err
 }
 
-func (s *ChangesetStore) get(id int64) (*Event, error) {
-	events, err := s.query("SELECT * FROM warp_pipe.changesets WHERE id = $1", id)
+func (s *ChangesetStore) get(ctx context.Context, id int64) (*Event, error) {
+	events, err := s.query(ctx, selectChangesetsSQL+" WHERE c.id = $1", id)
 	if err != nil {
 		return nil, err
 	}
@@ -77,8 +143,8 @@ func (s *ChangesetStore) get(id int64) (*Event, error) {
 	return events[0], nil
 }
 
-func (s *ChangesetStore) query(sql string, args ...interface{}) ([]*Event, error) {
-	rows, err := s.conn.Query(sql, args...)
+func (s *ChangesetStore) query(ctx context.Context, sql string, args ...interface{}) ([]*Event, error) {
+	rows, err := s.conn.QueryEx(ctx, sql, nil, args...)
 	if err != nil {
 		return nil, err
 	}
@@ -95,113 +161,168 @@ func (s *ChangesetStore) query(sql string, args ...interface{}) ([]*Event, error
 	}
 
 	if rows.Err() != nil {
-		return nil, err
+		return nil, rows.Err()
 	}
 
 	return events, nil
 }
 
-func (s *ChangesetStore) exec(sql string, args ...interface{}) error {
-	return nil
-}
-
-// GetByID gets an event by ID.
-func (s *ChangesetStore) GetByID(ctx context.Context, eventID int64) (*Event, error) {
-	return s.get(eventID)
-}
+// deleteInBatches deletes the events matching the condition in batches of the
+// page size, each in its own statement, so that locks are only held briefly.
+// It returns the number of deleted events.
+func (s *ChangesetStore) deleteInBatches(ctx context.Context, cond string, args ...interface{}) (int64, error) {
+	sql := fmt.Sprintf(`
+		DELETE FROM warp_pipe.changesets
+			WHERE id IN (
+				SELECT id FROM warp_pipe.changesets
+				WHERE %s
+				ORDER BY id
+				LIMIT %d
+			)`,
+		cond, s.pageSize,
+	)
 
-// GetSinceID returns all events after a given ID.
-func (s *ChangesetStore) GetSinceID(ctx context.Context, eventID int64, eventCh chan *Event, doneCh chan bool, errCh chan error) {
-	sql := `
-		SELECT
-			id,
-			ts,
-			action,
-			schema_name,
-			table_name,	
-			relid,
-			new_values,
-			old_values
-		FROM warp_pipe.changesets
-			WHERE id >= $1
-			ORDER BY id 
-			LIMIT %d
-			OFFSET %d`
-
-	offset := 0
+	var deleted int64
 	for {
-		evts, err := s.query(fmt.Sprintf(sql, paginationDefaultLimit, offset), eventID)
-		if err != nil {
-			errCh <- err
-			return
+		if err := ctx.Err(); err != nil {
+			return deleted, err
 		}
 
-		for _, event := range evts {
-			eventCh <- event
+		tag, err := s.conn.ExecEx(ctx, sql, nil, args...)
+		if err != nil {
+			return deleted, err
 		}
 
-		if len(evts) < paginationDefaultLimit {
-			doneCh <- true
-			return
+		deleted += tag.RowsAffected()
+		if tag.RowsAffected() < int64(s.pageSize) {
+			return deleted, nil
 		}
+	}
+}
 
-		offset += len(evts)
+// GetByID gets an event by ID.
+func (s *ChangesetStore) GetByID(ctx context.Context, eventID int64) (*Event, error) {
+	return s.get(ctx, eventID)
+}
+
+// GetSinceID returns a cursor over all events starting at the given ID, in ID
+// order. IDs are assigned when events are recorded rather than when their
+// transactions commit, so events with lower IDs than the ones returned may
+// still become visible later. See GetTxSnapshot.
+func (s *ChangesetStore) GetSinceID(eventID int64) *EventCursor {
+	return &EventCursor{
+		store: s,
+		sql: selectChangesetsSQL + `
+			WHERE c.id > $1
+			ORDER BY c.id
+			LIMIT $2`,
+		key: []interface{}{eventID - 1},
+		nextKey: func(evt *Event) []interface{} {
+			return []interface{}{evt.ID}
+		},
 	}
 }
 
-// GetSinceTimestamp returns all events after a given timestamp.
-func (s *ChangesetStore) GetSinceTimestamp(ctx context.Context, since time.Time, eventCh chan *Event, doneCh chan bool, errCh chan error) {
-	sql := `
-		SELECT
-			id,
-			ts,
-			action,
-			schema_name,
-			table_name,	
-			relid,
-			new_values,
-			old_values
-		FROM warp_pipe.changesets
-			WHERE ts >= $1
-			ORDER BY ts
-			LIMIT %d
-			OFFSET %d`
-
-	offset := 0
-	for {
-		evts, err := s.query(fmt.Sprintf(sql, paginationDefaultLimit, offset), since)
-		if err != nil {
-			errCh <- err
-			return
-		}
+// GetSinceTimestamp returns a cursor over all events starting at the given
+// timestamp, in timestamp order. Events sharing a timestamp are returned in ID
+// order.
+func (s *ChangesetStore) GetSinceTimestamp(since time.Time) *EventCursor {
+	return &EventCursor{
+		store: s,
+		sql: selectChangesetsSQL + `
+			WHERE (c.ts, c.id) > ($1, $2)
+			ORDER BY c.ts, c.id
+			LIMIT $3`,
+		key: []interface{}{since, int64(0)},
+		nextKey: func(evt *Event) []interface{} {
+			return []interface{}{evt.Timestamp, evt.ID}
+		},
+	}
+}
 
-		for _, event := range evts {
-			eventCh <- event
-		}
+// DeleteBeforeID deletes all events before a given ID. It returns the number
+// of deleted events.
+func (s *ChangesetStore) DeleteBeforeID(ctx context.Context, eventID int64) (int64, error) {
+	return s.deleteInBatches(ctx, "id < $1", eventID)
+}
 
-		if len(evts) < paginationDefaultLimit {
-			doneCh <- true
-			return
-		}
+// DeleteBeforeTimestamp deletes all events before a given timestamp. It
+// returns the number of deleted events.
+func (s *ChangesetStore) DeleteBeforeTimestamp(ctx context.Context, ts time.Time) (int64, error) {
+	return s.deleteInBatches(ctx, "ts < $1", ts)
+}
 
-		offset += len(evts)
+// Prune deletes all events with an ID lower than beforeID that were created
+// before the given timestamp. A zero ID or timestamp is ignored, but at least
+// one of them must be set. It returns the number of deleted events.
+func (s *ChangesetStore) Prune(ctx context.Context, beforeID int64, before time.Time) (int64, error) {
+	switch {
+	case beforeID != 0 && !before.IsZero():
+		return s.deleteInBatches(ctx, "id < $1 AND ts < $2", beforeID, before)
+	case beforeID != 0:
+		return s.DeleteBeforeID(ctx, beforeID)
+	case !before.IsZero():
+		return s.DeleteBeforeTimestamp(ctx, before)
+	default:
+		return 0, errors.New("prune requires an ID or a timestamp")
 	}
 }
 
-// DeleteBeforeID deletes all events before a given ID.
-func (s *ChangesetStore) DeleteBeforeID(ctx context.Context, eventID int64) error {
-	return s.exec(`
-		DELETE FROM warp_pipe.changesets
-			WHERE id < $1`,
-		eventID,
-	)
+// GetConsumerPosition returns the position recorded by a consumer. It returns
+// false if the consumer is not registered.
+func (s *ChangesetStore) GetConsumerPosition(ctx context.Context, consumer string) (int64, bool, error) {
+	var pos int64
+	err := s.conn.QueryRowEx(ctx, "SELECT changeset_id FROM warp_pipe.consumers WHERE name = $1", nil, consumer).Scan(&pos)
+	if err == pgx.ErrNoRows {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, err
+	}
+	return pos, true, nil
 }
 
-// DeleteBeforeTimestamp deletes all events before a given timestamp.
-func (s *ChangesetStore) DeleteBeforeTimestamp(ctx context.Context, ts time.Time) error {
-	return s.exec(`
-		DELETE FROM warp_pipe.changesets
-			WHERE ts < $1`,
-		ts,
+// SaveConsumerPosition records the ID of the last event processed by a
+// consumer, registering the consumer if needed.
+func (s *ChangesetStore) SaveConsumerPosition(ctx context.Context, consumer string, eventID int64) error {
+	_, err := s.conn.ExecEx(ctx, `
+		INSERT INTO warp_pipe.consumers (name, changeset_id, updated_at)
+			VALUES ($1, $2, NOW())
+		ON CONFLICT (name) DO UPDATE
+			SET changeset_id = EXCLUDED.changeset_id, updated_at = EXCLUDED.updated_at`,
+		nil, consumer, eventID,
 	)
+	return err
+}
+
+// GetMinConsumerPosition returns the lowest position recorded by any consumer.
+// It returns false if no consumer is registered.
+func (s *ChangesetStore) GetMinConsumerPosition(ctx context.Context) (int64, bool, error) {
+	var pos *int64
+	err := s.conn.QueryRowEx(ctx, "SELECT MIN(changeset_id) FROM warp_pipe.consumers", nil).Scan(&pos)
+	if err != nil {
+		return 0, false, err
+	}
+
+	if pos == nil {
+		return 0, false, nil
+	}
+	return *pos, true, nil
+}
+
+// GetTxSnapshot returns the bounds of the current transaction snapshot. An
+// event that is missing from a read is either rolled back or recorded by a
+// transaction that was in progress; once Xmin has reached the Xmax of a
+// snapshot taken after the read, all those transactions have ended.
+func (s *ChangesetStore) GetTxSnapshot(ctx context.Context) (*TxSnapshot, error) {
+	var snapshot TxSnapshot
+	err := s.conn.QueryRowEx(ctx, `
+		SELECT txid_snapshot_xmin(s), txid_snapshot_xmax(s)
+		FROM txid_current_snapshot() s`,
+		nil,
+	).Scan(&snapshot.Xmin, &snapshot.Xmax)
+	if err != nil {
+		return nil, err
+	}
+	return &snapshot, nil
 }
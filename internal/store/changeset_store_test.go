@@ -6,6 +6,7 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"io"
 	"os"
 	"testing"
 	"time"
@@ -77,7 +78,7 @@ func setupDB(conn *pgx.Conn, config *warppipe.Config) error {
 		return err
 	}
 
-	return db.Prepare(conn, "public", nil)
+	return db.Prepare(conn, []string{"public"}, nil, nil)
 }
 
 func teardownDB(conn *pgx.Conn) error {
@@ -94,6 +95,20 @@ func teardownDB(conn *pgx.Conn) error {
 	return nil
 }
 
+func readAll(cursor *store.EventCursor) ([]*store.Event, error) {
+	var events []*store.Event
+	for {
+		evt, err := cursor.Next(context.Background())
+		if err == io.EOF {
+			return events, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, evt)
+	}
+}
+
 func TestChangesetStore(t *testing.T) {
 	setupEnv()
 	cfg, _ := warppipe.NewConfigFromEnv()
@@ -182,7 +197,7 @@ func TestChangesetStore(t *testing.T) {
 			t.Error(err)
 		}
 
-		events, err := changesets.GetSinceTimestamp(context.Background(), lastEvtTS)
+		events, err := readAll(changesets.GetSinceTimestamp(lastEvtTS))
 		if err != nil {
 			t.Error(err)
 		}
@@ -219,15 +234,41 @@ func TestChangesetStore(t *testing.T) {
 	}
 
 	t.Run("get since timestamp", func(t *testing.T) {
-		events, err := changesets.GetSinceTimestamp(context.Background(), time.Now().Add(-1*time.Hour))
+		events, err := readAll(changesets.GetSinceTimestamp(time.Now().Add(-1 * time.Hour)))
 		assert.NoError(t, err)
 		assert.Equal(t, len(testCases), len(events))
 	})
 
 	t.Run("get since ID", func(t *testing.T) {
-		events, err := changesets.GetSinceID(context.Background(), 2)
+		events, err := readAll(changesets.GetSinceID(2))
 		assert.NoError(t, err)
-		assert.Equal(t, 2, len(events))
+		assert.Equal(t, 3, len(events))
+	})
+
+	t.Run("get since ID with pagination", func(t *testing.T) {
+		paged := store.NewChangesetStore(conn, store.PageSize(1))
+		events, err := readAll(paged.GetSinceID(2))
+		assert.NoError(t, err)
+		if assert.Equal(t, 3, len(events)) {
+			assert.Equal(t, int64(2), events[0].ID)
+			assert.Equal(t, int64(3), events[1].ID)
+			assert.Equal(t, int64(4), events[2].ID)
+		}
+	})
+
+	t.Run("get since timestamp with pagination", func(t *testing.T) {
+		paged := store.NewChangesetStore(conn, store.PageSize(3))
+		events, err := readAll(paged.GetSinceTimestamp(time.Now().Add(-1 * time.Hour)))
+		assert.NoError(t, err)
+		assert.Equal(t, len(testCases), len(events))
+	})
+
+	t.Run("cursor honors context cancellation", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		_, err := changesets.GetSinceID(1).Next(ctx)
+		assert.Equal(t, context.Canceled, err)
 	})
 
 	t.Run("get by ID", func(t *testing.T) {
@@ -236,4 +277,45 @@ func TestChangesetStore(t *testing.T) {
 		assert.NotNil(t, event)
 		assert.Equal(t, int64(4), event.ID)
 	})
+
+	t.Run("consumer positions", func(t *testing.T) {
+		_, ok, err := changesets.GetMinConsumerPosition(context.Background())
+		assert.NoError(t, err)
+		assert.False(t, ok)
+
+		assert.NoError(t, changesets.SaveConsumerPosition(context.Background(), "a", 3))
+		assert.NoError(t, changesets.SaveConsumerPosition(context.Background(), "b", 2))
+		assert.NoError(t, changesets.SaveConsumerPosition(context.Background(), "b", 4))
+
+		pos, ok, err := changesets.GetConsumerPosition(context.Background(), "b")
+		assert.NoError(t, err)
+		assert.True(t, ok)
+		assert.Equal(t, int64(4), pos)
+
+		pos, ok, err = changesets.GetMinConsumerPosition(context.Background())
+		assert.NoError(t, err)
+		assert.True(t, ok)
+		assert.Equal(t, int64(3), pos)
+	})
+
+	t.Run("delete before ID", func(t *testing.T) {
+		paged := store.NewChangesetStore(conn, store.PageSize(1))
+		deleted, err := paged.DeleteBeforeID(context.Background(), 3)
+		assert.NoError(t, err)
+		assert.Equal(t, int64(2), deleted)
+
+		events, err := readAll(changesets.GetSinceID(1))
+		assert.NoError(t, err)
+		assert.Equal(t, 2, len(events))
+	})
+
+	t.Run("prune", func(t *testing.T) {
+		deleted, err := changesets.Prune(context.Background(), 4, time.Now().Add(-1*time.Hour))
+		assert.NoError(t, err)
+		assert.Equal(t, int64(0), deleted)
+
+		deleted, err = changesets.Prune(context.Background(), 4, time.Now().Add(time.Hour))
+		assert.NoError(t, err)
+		assert.Equal(t, int64(1), deleted)
+	})
 }
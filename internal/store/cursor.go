@@ -0,0 +1,52 @@
+package store
+
+import (
+	"context"
+	"io"
+)
+
+// EventCursor iterates over events using keyset pagination: each page is
+// queried starting after the key of the last event read, so events that are
+// inserted or deleted during the iteration do not cause duplicates or gaps.
+type EventCursor struct {
+	store   *ChangesetStore
+	sql     string
+	key     []interface{}
+	nextKey func(*Event) []interface{}
+	page    []*Event
+	done    bool
+}
+
+// Next returns the next event, reading a new page from the store when the
+// current one is exhausted. It returns io.EOF once the end of the events has
+// been reached; events created after that are not returned.
+func (c *EventCursor) Next(ctx context.Context) (*Event, error) {
+	if len(c.page) == 0 {
+		if c.done {
+			return nil, io.EOF
+		}
+
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		args := append(append([]interface{}{}, c.key...), c.store.pageSize)
+		page, err := c.store.query(ctx, c.sql, args...)
+		if err != nil {
+			return nil, err
+		}
+
+		c.page = page
+		c.done = len(page) < c.store.pageSize
+		if len(c.page) == 0 {
+			return nil, io.EOF
+		}
+	}
+
+	evt := c.page[0]
+	c.page[0] = nil
+	c.page = c.page[1:]
+	c.key = c.nextKey(evt)
+
+	return evt, nil
+}
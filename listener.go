@@ -12,3 +12,15 @@ type Listener interface {
 	ListenForChanges(context.Context) (chan *Changeset, chan error)
 	Close() error
 }
+
+// ResumableListener is a Listener that can report the position of the last
+// acknowledged changeset, and resume from a previously reported position.
+type ResumableListener interface {
+	Listener
+	// Position returns the position of the last acknowledged changeset.
+	Position() Position
+	// ResumeFrom sets the position to resume from. It must be called before
+	// Dial, and is ignored if a start position was set with a listener option.
+	// It returns an error if the listener cannot resume from the position.
+	ResumeFrom(Position) error
+}
@@ -1,6 +1,7 @@
 package warppipe
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
 	"fmt"
@@ -16,11 +17,17 @@ import (
 const (
 	replicationSlotNamePrefix = "wp_"
 	replicationOutputPlugin   = "wal2json"
+
+	// durableReplicationSlotName is the slot name used when re-using slots and
+	// no name has been set. It does not carry the `wp_` prefix so that it is
+	// never cleared by a listener running with temporary slots.
+	durableReplicationSlotName = "warp_pipe"
 )
 
 var (
 	defaultWal2jsonArgs = []string{
 		"\"include-lsn\" 'on'",
+		"\"include-xids\" 'on'",
 		"\"pretty-print\" 'off'",
 		"\"include-timestamp\" 'on'",
 		"\"filter-tables\" 'warp_pipe.*'",
@@ -37,6 +44,31 @@ func ReplSlotName(name string) LROption {
 	}
 }
 
+// ReuseReplSlot is an option for re-using the named replication slot across
+// restarts. When enabled, the slot is only created if it does not already
+// exist, replication resumes from the slot's confirmed flush LSN, and no other
+// replication slots are dropped.
+func ReuseReplSlot(reuse bool) LROption {
+	return func(l *LogicalReplicationListener) {
+		l.reuseReplSlot = reuse
+	}
+}
+
+// InitialSnapshot is an option for reading the current rows of the given
+// tables before streaming changes. The rows are read from the snapshot exported
+// when the replication slot is created, and emitted as changesets of kind
+// ChangesetKindSnapshot, after which streaming starts from the slot's
+// consistent point, with no gap and no duplicates. The tables accept the same
+// formats as WhitelistTables() and IgnoreTables(); if no tables are given, all
+// tables are read. The snapshot is skipped when an existing slot is re-used.
+func InitialSnapshot(tables []string, ignoreTables []string) LROption {
+	return func(l *LogicalReplicationListener) {
+		l.snapshot = true
+		l.snapshotTables = tables
+		l.snapshotIgnoreTables = ignoreTables
+	}
+}
+
 // StartFromLSN is an option for setting the logical sequence number to start from.
 func StartFromLSN(lsn uint64) LROption {
 	return func(l *LogicalReplicationListener) {
@@ -51,16 +83,33 @@ func HeartbeatInterval(seconds int) LROption {
 	}
 }
 
+// ReconnectBackoff is an option for setting the backoff used to re-establish
+// the replication connection if it is lost. Defaults to DefaultBackoff.
+func ReconnectBackoff(backoff Backoff) LROption {
+	return func(l *LogicalReplicationListener) {
+		l.backoff = backoff
+	}
+}
+
 // LogicalReplicationListener is a Listener that uses logical replication slots
 // to listen for changesets.
 type LogicalReplicationListener struct {
+	connConfig                   *pgx.ConnConfig
 	conn                         *pgx.Conn
 	replConn                     *pgx.ReplicationConn
 	replSlotName                 string
+	reuseReplSlot                bool
 	replLSN                      uint64
+	resumeLSN                    uint64
 	replSnapshot                 string
-	wal2jsonArgs                 []string
+	snapshot                     bool
+	snapshotTables               []string
+	snapshotIgnoreTables         []string
+	outputPlugin                 string
+	pluginArgs                   []string
 	connHeartbeatIntervalSeconds int
+	backoff                      Backoff
+	acks                         *ackTracker
 	changesetsCh                 chan *Changeset
 	errCh                        chan error
 	logger                       *log.Entry
@@ -70,7 +119,9 @@ type LogicalReplicationListener struct {
 func NewLogicalReplicationListener(opts ...LROption) *LogicalReplicationListener {
 	l := &LogicalReplicationListener{
 		logger:       log.WithFields(log.Fields{"component": "listener"}),
-		wal2jsonArgs: defaultWal2jsonArgs,
+		outputPlugin: replicationOutputPlugin,
+		pluginArgs:   defaultWal2jsonArgs,
+		backoff:      DefaultBackoff,
 	}
 
 	for _, opt := range opts {
@@ -82,7 +133,11 @@ func NewLogicalReplicationListener(opts ...LROption) *LogicalReplicationListener
 	}
 
 	if l.replSlotName == "" {
-		l.replSlotName = fmt.Sprintf("%s%d", replicationSlotNamePrefix, time.Now().Unix())
+		if l.reuseReplSlot {
+			l.replSlotName = durableReplicationSlotName
+		} else {
+			l.replSlotName = fmt.Sprintf("%s%d", replicationSlotNamePrefix, time.Now().Unix())
+		}
 	}
 
 	return l
@@ -90,6 +145,18 @@ func NewLogicalReplicationListener(opts ...LROption) *LogicalReplicationListener
 
 // Dial connects to the source database.
 func (l *LogicalReplicationListener) Dial(connConfig *pgx.ConnConfig) error {
+	err := l.connect(connConfig)
+	if err != nil {
+		return err
+	}
+
+	return l.setupReplicationSlot()
+}
+
+// connect opens both the regular and the replication connection.
+func (l *LogicalReplicationListener) connect(connConfig *pgx.ConnConfig) error {
+	l.connConfig = connConfig
+
 	conn, err := pgx.Connect(*connConfig)
 	if err != nil {
 		l.logger.WithError(err).Error("failed to connect to database")
@@ -104,13 +171,31 @@ func (l *LogicalReplicationListener) Dial(connConfig *pgx.ConnConfig) error {
 	}
 	l.replConn = replConn
 
-	err = l.clearReplicationSlots()
-	if err != nil {
-		l.logger.WithError(err).Error("failed to clear replication slots")
-		return err
+	return nil
+}
+
+// setupReplicationSlot creates the listener's replication slot, or resumes
+// from it when re-using slots.
+func (l *LogicalReplicationListener) setupReplicationSlot() error {
+	if l.reuseReplSlot {
+		exists, err := l.resumeReplicationSlot()
+		if err != nil {
+			l.logger.WithError(err).Errorf("failed to read replication slot %s", l.replSlotName)
+			return err
+		}
+
+		if exists {
+			return nil
+		}
+	} else {
+		err := l.clearReplicationSlots()
+		if err != nil {
+			l.logger.WithError(err).Error("failed to clear replication slots")
+			return err
+		}
 	}
 
-	consistentPoint, snapshot, err := l.replConn.CreateReplicationSlotEx(l.replSlotName, replicationOutputPlugin)
+	consistentPoint, snapshot, err := l.replConn.CreateReplicationSlotEx(l.replSlotName, l.outputPlugin)
 	if err != nil {
 		l.logger.WithError(err).Errorf("failed to create replicaiton slot %s", l.replSlotName)
 		return err
@@ -132,52 +217,108 @@ func (l *LogicalReplicationListener) Dial(connConfig *pgx.ConnConfig) error {
 
 // ListenForChanges returns a channel that emits database changesets.
 func (l *LogicalReplicationListener) ListenForChanges(ctx context.Context) (chan *Changeset, chan error) {
+	return l.startReplication(ctx, l.processMessage)
+}
+
+// startReplication starts streaming from the replication slot and passes each
+// WAL message to handleMessage, which is responsible for decoding it and
+// emitting changesets.
+func (l *LogicalReplicationListener) startReplication(ctx context.Context, handleMessage func(*pgx.ReplicationMessage)) (chan *Changeset, chan error) {
+	var snapshotTx *pgx.Tx
+	var snapshotErr error
+	if l.snapshot {
+		if l.replSnapshot == "" {
+			l.logger.Warnf("no snapshot was exported for slot '%s', skipping initial snapshot", l.replSlotName)
+		} else {
+			snapshotTx, snapshotErr = l.beginSnapshot(ctx)
+		}
+	}
+
 	l.logger.Infof("Starting replication for slot '%s' from LSN %s",
 		l.replSlotName,
 		pgx.FormatLSN(l.replLSN),
 	)
 
-	err := l.replConn.StartReplication(l.replSlotName, l.replLSN, -1, l.wal2jsonArgs...)
+	err := l.replConn.StartReplication(l.replSlotName, l.replLSN, -1, l.pluginArgs...)
 	if err != nil {
 		l.logger.WithError(err).Fatal("failed to start replication")
 	}
 
-	go l.startHeartBeat(ctx)
+	l.acks = newAckTracker(l.replLSN)
 
 	l.changesetsCh = make(chan *Changeset)
 	l.errCh = make(chan error)
 
 	// loop - listen for messages
 	go func() {
-		for {
-			if !l.replConn.IsAlive() {
-				log.WithField("conn_err", l.replConn.CauseOfDeath()).Error(
-					"replication connection is down",
-				)
-			}
-
-			msg, err := l.replConn.WaitForReplicationMessage(ctx)
+		if snapshotErr != nil {
+			l.logger.WithError(snapshotErr).Error("failed to begin initial snapshot")
+			l.errCh <- fmt.Errorf("failed to begin initial snapshot: %w", snapshotErr)
+		} else if snapshotTx != nil {
+			err := l.readSnapshotWithHeartbeat(ctx, snapshotTx)
 			if err != nil {
 				if ctx.Err() != nil {
 					log.Info("shutting down...")
 					return
 				}
-				log.WithError(err).Error("encountered an error while waiting for replication message")
-				l.errCh <- err
+				l.logger.WithError(err).Error("failed to read initial snapshot")
+				l.errCh <- fmt.Errorf("failed to read initial snapshot: %w", err)
+			}
+		}
+		l.replSnapshot = ""
+
+		// The standby status is sent from this goroutine whenever no message
+		// is received before it is due, as the connection must not be used
+		// concurrently.
+		heartbeatInterval := time.Duration(l.connHeartbeatIntervalSeconds) * time.Second
+		nextHeartbeat := time.Now().Add(heartbeatInterval)
+		for {
+			waitCtx, cancel := context.WithDeadline(ctx, nextHeartbeat)
+			msg, err := l.replConn.WaitForReplicationMessage(waitCtx)
+			cancel()
+			if ctx.Err() != nil {
+				log.Info("shutting down...")
+				return
+			}
+
+			if err == context.DeadlineExceeded {
+				l.logger.Info("sending heartbeat")
+				err = l.sendStandbyStatus()
+				nextHeartbeat = time.Now().Add(heartbeatInterval)
+			} else if err == nil && msg != nil {
+				if msg.WalMessage != nil {
+					handleMessage(msg)
+				}
+
+				if msg.ServerHeartbeat != nil {
+					l.logger.WithField("heartbeat", msg.ServerHeartbeat).Info("received server heartbeat")
+					if msg.ServerHeartbeat.ReplyRequested == 1 {
+						err = l.sendStandbyStatus()
+					}
+				}
 			}
 
-			if msg != nil && msg.WalMessage != nil {
-				l.processMessage(msg)
-			} else {
+			if err == nil {
 				continue
 			}
 
-			if msg.ServerHeartbeat != nil {
-				l.logger.WithField("heartbeat", msg.ServerHeartbeat).Info("received server heartbeat")
-				if msg.ServerHeartbeat.ReplyRequested == 1 {
-					l.sendStandbyStatus()
+			if !l.replConn.IsAlive() {
+				err = reconnect(ctx, l.backoff, l.errCh, l.logger, l.replConn.CauseOfDeath(), l.acks.position, l.restartReplication)
+				if err != nil {
+					if ctx.Err() != nil {
+						log.Info("shutting down...")
+						return
+					}
+					l.logger.WithError(err).Error("replication connection is down")
+					sendError(ctx, l.errCh, err)
+					return
 				}
+				nextHeartbeat = time.Now().Add(heartbeatInterval)
+				continue
 			}
+
+			log.WithError(err).Error("encountered an error while waiting for replication message")
+			l.errCh <- err
 		}
 	}()
 
@@ -199,40 +340,100 @@ func (l *LogicalReplicationListener) Close() error {
 	return nil
 }
 
-func (l *LogicalReplicationListener) startHeartBeat(ctx context.Context) {
-	for {
-		select {
-		case <-ctx.Done():
-			return
-		case <-time.Tick(time.Duration(l.connHeartbeatIntervalSeconds) * time.Second):
-			l.logger.Info("sending heartbeat")
-			l.sendStandbyStatus()
+// restartReplication re-opens the replication connection, and the regular
+// connection if it was lost too, and restarts streaming from the last
+// acknowledged LSN. Changesets that were emitted but not acknowledged before
+// the connection was lost are emitted again.
+func (l *LogicalReplicationListener) restartReplication() error {
+	l.replConn.Close()
+
+	if !l.conn.IsAlive() {
+		conn, err := pgx.Connect(*l.connConfig)
+		if err != nil {
+			return err
 		}
+		l.conn = conn
 	}
+
+	replConn, err := pgx.ReplicationConnect(*l.connConfig)
+	if err != nil {
+		return err
+	}
+
+	lsn := l.acks.position()
+	l.logger.Infof("Restarting replication for slot '%s' from LSN %s",
+		l.replSlotName,
+		pgx.FormatLSN(lsn),
+	)
+
+	err = replConn.StartReplication(l.replSlotName, lsn, -1, l.pluginArgs...)
+	if err != nil {
+		replConn.Close()
+		return err
+	}
+
+	l.replConn = replConn
+	l.acks.reset(lsn)
+
+	return nil
 }
 
 func (l *LogicalReplicationListener) processMessage(msg *pgx.ReplicationMessage) {
 	walMsgRaw := msg.WalMessage.WalData
+	// numbers are decoded as json.Number so that large integers keep their
+	// precision until they are converted based on the column type
 	var w2jmsg db.Wal2JSONMessage
-	err := json.Unmarshal(walMsgRaw, &w2jmsg)
+	dec := json.NewDecoder(bytes.NewReader(walMsgRaw))
+	dec.UseNumber()
+	err := dec.Decode(&w2jmsg)
 	if err != nil {
 		l.logger.WithError(err).Error("failed to parse wal2json message")
 		l.errCh <- fmt.Errorf("failed to parse wal2json: %v", err)
+		return
+	}
+
+	// The transaction is confirmed up to the end of its commit record, which
+	// wal2json reports as `nextlsn`.
+	lsn := msg.WalMessage.WalStart
+	if w2jmsg.NextLSN != "" {
+		lsn, err = pgx.ParseLSN(w2jmsg.NextLSN)
+		if err != nil {
+			l.logger.WithError(err).Error("failed to parse wal2json nextlsn")
+			l.errCh <- fmt.Errorf("failed to parse wal2json nextlsn: %v", err)
+			return
+		}
+	}
+
+	if len(w2jmsg.Changes) == 0 {
+		l.acks.skip(lsn)
+		return
+	}
+
+	commitTime, err := w2jmsg.CommitTime()
+	if err != nil {
+		l.logger.WithError(err).Warn("failed to parse wal2json timestamp")
 	}
 
-	for _, change := range w2jmsg.Changes {
+	for i, change := range w2jmsg.Changes {
 		cs := &Changeset{
-			ID:     change.ID,
-			Kind:   ParseChangesetKind(change.Kind),
-			Schema: change.Schema,
-			Table:  change.Table,
+			ID:         change.ID,
+			LSN:        lsn,
+			TxID:       w2jmsg.XID,
+			TxPosition: i,
+			TxLast:     i == len(w2jmsg.Changes)-1,
+			Kind:       ParseChangesetKind(change.Kind),
+			Schema:     change.Schema,
+			Table:      change.Table,
+			Timestamp:  commitTime,
+			CommitTime: commitTime,
+			ack:        l.acks.track(lsn),
 		}
 
 		newColValues := make([]*ChangesetColumn, len(change.ColumnValues))
 		for i, name := range change.ColumnNames {
 			newColValues[i] = &ChangesetColumn{
 				Column: name,
-				Value:  change.ColumnValues[i],
+				Value:  decodeValue(change.ColumnTypes[i], change.ColumnValues[i]),
 				Type:   change.ColumnTypes[i],
 			}
 		}
@@ -243,7 +444,7 @@ func (l *LogicalReplicationListener) processMessage(msg *pgx.ReplicationMessage)
 			for i, name := range change.OldKeys.KeyNames {
 				oldColValues[i] = &ChangesetColumn{
 					Column: name,
-					Value:  change.OldKeys.KeyValues[i],
+					Value:  decodeValue(change.OldKeys.KeyTypes[i], change.OldKeys.KeyValues[i]),
 					Type:   change.OldKeys.KeyTypes[i],
 				}
 			}
@@ -269,8 +470,6 @@ func (l *LogicalReplicationListener) clearReplicationSlots() error {
 			continue
 		}
 
-		// TODO: Handle re-using the same replication slot
-
 		l.logger.Infof("Deleting replication slot %s", slotName)
 		err = l.replConn.DropReplicationSlot(slotName)
 		if err != nil {
@@ -281,19 +480,95 @@ func (l *LogicalReplicationListener) clearReplicationSlots() error {
 	return nil
 }
 
-func (l *LogicalReplicationListener) sendStandbyStatus() {
-	status, err := pgx.NewStandbyStatus(l.replLSN)
+// resumeReplicationSlot looks up the listener's replication slot and, if it
+// exists, sets the start LSN to the slot's confirmed flush position (unless a
+// start LSN was explicitly provided). It returns false if the slot is missing.
+func (l *LogicalReplicationListener) resumeReplicationSlot() (bool, error) {
+	var plugin, confirmedFlushLSN string
+	err := l.conn.QueryRow(`
+		SELECT
+			COALESCE(plugin, ''),
+			COALESCE(confirmed_flush_lsn, '0/0')::TEXT
+		FROM pg_replication_slots
+		WHERE slot_name = $1`,
+		l.replSlotName,
+	).Scan(&plugin, &confirmedFlushLSN)
+	if err == pgx.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	if plugin != l.outputPlugin {
+		return false, fmt.Errorf("replication slot %s uses output plugin '%s', expected '%s'", l.replSlotName, plugin, l.outputPlugin)
+	}
+
+	lsn, err := pgx.ParseLSN(confirmedFlushLSN)
+	if err != nil {
+		return false, fmt.Errorf("failed to parse confirmed flush LSN for slot %s: %w", l.replSlotName, err)
+	}
+
+	l.logger.Infof("Re-using replication slot %s (confirmed flush LSN %s)", l.replSlotName, confirmedFlushLSN)
+	if l.replLSN == 0 {
+		l.replLSN = lsn
+		if l.resumeLSN > lsn {
+			l.logger.Infof("Resuming from checkpoint LSN %s", pgx.FormatLSN(l.resumeLSN))
+			l.replLSN = l.resumeLSN
+		}
+	}
+
+	return true, nil
+}
+
+// Position returns the position of the last acknowledged changeset.
+func (l *LogicalReplicationListener) Position() Position {
+	if l.acks == nil {
+		return Position{LSN: l.replLSN}
+	}
+	return Position{LSN: l.acks.position()}
+}
+
+// ResumeFrom sets the LSN to resume replication from, unless one was set with
+// StartFromLSN. It only applies if it is ahead of the confirmed flush LSN of
+// the re-used replication slot. It returns an error if the slot is not re-used
+// (see ReuseReplSlot), as a new slot cannot stream changes from before its
+// creation.
+func (l *LogicalReplicationListener) ResumeFrom(pos Position) error {
+	if pos.LSN == 0 || l.replLSN != 0 {
+		return nil
+	}
+	if !l.reuseReplSlot {
+		return fmt.Errorf("cannot resume from LSN %s without re-using the replication slot", pgx.FormatLSN(pos.LSN))
+	}
+
+	l.resumeLSN = pos.LSN
+	return nil
+}
+
+// sendStandbyStatus reports the highest contiguous acknowledged LSN as the
+// write, flush and apply positions.
+func (l *LogicalReplicationListener) sendStandbyStatus() error {
+	lsn := l.acks.position()
+	status, err := pgx.NewStandbyStatus(lsn)
 	if err != nil {
 		l.logger.WithError(err).Error("failed to create StandbyStatus")
-		l.errCh <- fmt.Errorf("heartbeat failed")
+		return fmt.Errorf("heartbeat failed: %w", err)
 	}
 
 	status.ReplyRequested = 0
-	l.logger.Infof("sending StandbyStatus with LSN %s", pgx.FormatLSN(l.replLSN))
+	l.logger.Infof("sending StandbyStatus with LSN %s", pgx.FormatLSN(lsn))
 
 	err = l.replConn.SendStandbyStatus(status)
 	if err != nil {
 		l.logger.WithError(err).Error("failed to send StandbyStatus")
-		l.errCh <- fmt.Errorf("heartbeat failed")
+		return fmt.Errorf("heartbeat failed: %w", err)
 	}
+
+	return nil
+}
+
+// quoteLiteral quotes a string as an SQL string literal.
+func quoteLiteral(s string) string {
+	return "'" + strings.Replace(s, "'", "''", -1) + "'"
 }
@@ -0,0 +1,210 @@
+package warppipe
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/jackc/pgx"
+)
+
+// snapshotTable is a table read during the initial snapshot.
+type snapshotTable struct {
+	schema      string
+	name        string
+	columns     []string
+	columnTypes []string
+}
+
+// types returns the types of the table's columns by name.
+func (t *snapshotTable) types() map[string]string {
+	types := make(map[string]string, len(t.columns))
+	for i, col := range t.columns {
+		types[col] = t.columnTypes[i]
+	}
+	return types
+}
+
+// beginSnapshot starts a transaction that uses the snapshot exported when the
+// replication slot was created. It must be called before replication is
+// started, as the snapshot is only valid until the replication connection
+// runs another command.
+func (l *LogicalReplicationListener) beginSnapshot(ctx context.Context) (*pgx.Tx, error) {
+	tx, err := l.conn.BeginEx(ctx, &pgx.TxOptions{
+		IsoLevel:   pgx.RepeatableRead,
+		AccessMode: pgx.ReadOnly,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = tx.Exec("SET TRANSACTION SNAPSHOT " + quoteLiteral(l.replSnapshot))
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+
+	return tx, nil
+}
+
+// readSnapshot emits every row of the snapshot tables as a changeset of kind
+// ChangesetKindSnapshot. The rows reflect the state of the database at the
+// slot's consistent point, from which streaming continues.
+func (l *LogicalReplicationListener) readSnapshot(ctx context.Context, tx *pgx.Tx) error {
+	defer tx.Rollback()
+
+	tables, err := l.listSnapshotTables(ctx, tx)
+	if err != nil {
+		return fmt.Errorf("failed to list snapshot tables: %w", err)
+	}
+
+	ts := time.Now()
+	for _, table := range tables {
+		l.logger.Infof("Reading snapshot of table %s.%s", table.schema, table.name)
+
+		rows, err := tx.QueryEx(ctx, fmt.Sprintf("SELECT row_to_json(t)::TEXT FROM %s t", pgx.Identifier{table.schema, table.name}.Sanitize()), nil)
+		if err != nil {
+			return fmt.Errorf("failed to read table %s.%s: %w", table.schema, table.name, err)
+		}
+
+		for rows.Next() {
+			var row string
+			err = rows.Scan(&row)
+			if err != nil {
+				rows.Close()
+				return err
+			}
+
+			values, err := decodeRowJSON([]byte(row), table.types())
+			if err != nil {
+				rows.Close()
+				return fmt.Errorf("failed to unmarshal row of table %s.%s: %w", table.schema, table.name, err)
+			}
+
+			cs := &Changeset{
+				LSN:       l.replLSN,
+				Kind:      ChangesetKindSnapshot,
+				Schema:    table.schema,
+				Table:     table.name,
+				Timestamp: ts,
+				ack:       l.acks.track(l.replLSN),
+			}
+			for i, col := range table.columns {
+				cs.NewValues = append(cs.NewValues, &ChangesetColumn{
+					Column: col,
+					Value:  values[col],
+					Type:   table.columnTypes[i],
+				})
+			}
+
+			select {
+			case l.changesetsCh <- cs:
+			case <-ctx.Done():
+				rows.Close()
+				return ctx.Err()
+			}
+		}
+
+		rows.Close()
+		if rows.Err() != nil {
+			return rows.Err()
+		}
+	}
+
+	return tx.Commit()
+}
+
+// readSnapshotWithHeartbeat reads the snapshot while sending the standby status
+// at the heartbeat interval, so that the idle replication connection is not
+// timed out by the server while a large snapshot is read.
+func (l *LogicalReplicationListener) readSnapshotWithHeartbeat(ctx context.Context, tx *pgx.Tx) error {
+	doneCh := make(chan error, 1)
+	go func() {
+		doneCh <- l.readSnapshot(ctx, tx)
+	}()
+
+	ticker := time.NewTicker(time.Duration(l.connHeartbeatIntervalSeconds) * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case err := <-doneCh:
+			return err
+		case <-ticker.C:
+			err := l.sendStandbyStatus()
+			if err != nil {
+				l.logger.WithError(err).Warn("failed to send heartbeat while reading snapshot")
+			}
+		}
+	}
+}
+
+// listSnapshotTables returns the tables matching the snapshot whitelist (or
+// all user tables if it is empty), excluding any ignored tables.
+func (l *LogicalReplicationListener) listSnapshotTables(ctx context.Context, tx *pgx.Tx) ([]*snapshotTable, error) {
+	rows, err := tx.QueryEx(ctx, `
+		SELECT schemaname, tablename
+		FROM pg_catalog.pg_tables
+		WHERE schemaname NOT IN ('pg_catalog', 'information_schema', 'warp_pipe')
+		ORDER BY schemaname, tablename`,
+		nil,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	var tables []*snapshotTable
+	for rows.Next() {
+		var table snapshotTable
+		err = rows.Scan(&table.schema, &table.name)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+
+		if len(l.snapshotTables) > 0 && !MatchTable(l.snapshotTables, table.schema, table.name) {
+			continue
+		}
+		if MatchTable(l.snapshotIgnoreTables, table.schema, table.name) {
+			continue
+		}
+
+		tables = append(tables, &table)
+	}
+	rows.Close()
+	if rows.Err() != nil {
+		return nil, rows.Err()
+	}
+
+	for _, table := range tables {
+		rows, err := tx.QueryEx(ctx, `
+			SELECT attname, format_type(atttypid, atttypmod)
+			FROM pg_catalog.pg_attribute
+			WHERE attrelid = (quote_ident($1) || '.' || quote_ident($2))::regclass
+				AND attnum > 0
+				AND NOT attisdropped
+			ORDER BY attnum`,
+			nil, table.schema, table.name,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		for rows.Next() {
+			var column, columnType string
+			err = rows.Scan(&column, &columnType)
+			if err != nil {
+				rows.Close()
+				return nil, err
+			}
+			table.columns = append(table.columns, column)
+			table.columnTypes = append(table.columnTypes, columnType)
+		}
+		rows.Close()
+		if rows.Err() != nil {
+			return nil, rows.Err()
+		}
+	}
+
+	return tables, nil
+}
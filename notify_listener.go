@@ -4,16 +4,22 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
-	"strconv"
-	"strings"
+	"io"
+	"sort"
 	"time"
 
 	"github.com/jackc/pgx"
 	log "github.com/sirupsen/logrus"
 
+	"github.com/perangel/warp-pipe/db"
 	"github.com/perangel/warp-pipe/internal/store"
 )
 
+const (
+	defaultPollInterval = 5 * time.Second
+	defaultBatchSize    = 500
+)
+
 // NotifyOption is a NotifyListener option function
 type NotifyOption func(*NotifyListener)
 
@@ -31,16 +37,87 @@ func StartFromTimestamp(t time.Time) NotifyOption {
 	}
 }
 
+// NotifyReconnectBackoff is an option for setting the backoff used to
+// re-establish the connection if it is lost. Defaults to DefaultBackoff.
+func NotifyReconnectBackoff(backoff Backoff) NotifyOption {
+	return func(l *NotifyListener) {
+		l.backoff = backoff
+	}
+}
+
+// PollInterval is an option for setting how often the changesets table is
+// polled for new changesets when no notification is received. Defaults to 5s.
+func PollInterval(interval time.Duration) NotifyOption {
+	return func(l *NotifyListener) {
+		l.pollInterval = interval
+	}
+}
+
+// BatchSize is an option for setting the maximum number of changesets read
+// from the changesets table per query. Defaults to 500.
+func BatchSize(size int) NotifyOption {
+	return func(l *NotifyListener) {
+		l.batchSize = size
+	}
+}
+
+// ConsumerName is an option for registering the listener as a consumer of the
+// changesets table. The ID of the last acknowledged changeset is recorded in
+// `warp_pipe.consumers` under this name, the listener resumes from it when no
+// start option is given, and retention never deletes changesets that it has
+// not processed yet.
+func ConsumerName(name string) NotifyOption {
+	return func(l *NotifyListener) {
+		l.consumerName = name
+	}
+}
+
+// Retention is an option for pruning the changesets table from the listener.
+// Every interval, it deletes the changesets that all registered consumers have
+// processed and that are older than olderThan (if set). Nothing is deleted
+// while no consumer is registered.
+func Retention(interval time.Duration, olderThan time.Duration) NotifyOption {
+	return func(l *NotifyListener) {
+		l.retentionInterval = interval
+		l.retentionOlderThan = olderThan
+	}
+}
+
 // NotifyListener is a listener that uses Postgres' LISTEN/NOTIFY pattern for
 // subscribing for subscribing to changeset enqueued in a changesets table.
 // For more details see `pkg/schema/changesets`.
+//
+// Changesets are read in ID order from the changesets table, starting after
+// the ID of the last emitted changeset (the high-water mark). IDs are assigned
+// when changesets are recorded, not when their transactions commit, so a
+// missing ID may still become visible later: the mark is held back at the
+// first missing ID until every transaction that was in progress when it was
+// first seen has ended. A long running transaction thus delays the changesets
+// recorded after it started. Notifications only wake the listener up early;
+// the table is also polled at the poll interval, so notifications that are
+// missed while disconnected delay changesets rather than lose them.
 type NotifyListener struct {
+	connConfig             *pgx.ConnConfig
 	conn                   *pgx.Conn
 	logger                 *log.Entry
 	store                  store.EventStore
 	startFromID            *int64
 	startFromTimestamp     *time.Time
+	resumeFromID           *int64
 	lastProcessedTimestamp *time.Time
+	lastProcessedID        int64
+	gapID                  int64
+	gapXmax                int64
+	pollInterval           time.Duration
+	batchSize              int
+	consumerName           string
+	savedPosition          uint64
+	positionSaved          bool
+	retentionInterval      time.Duration
+	retentionOlderThan     time.Duration
+	backoff                Backoff
+	acks                   *ackTracker
+	relations              map[int64]*relationColumns
 	changesetsCh           chan *Changeset
 	errCh                  chan error
 }
@@ -49,14 +126,24 @@ type NotifyListener struct {
 func NewNotifyListener(opts ...NotifyOption) *NotifyListener {
 	l := &NotifyListener{
 		logger:       log.WithFields(log.Fields{"component": "listener"}),
+		relations:    make(map[int64]*relationColumns),
 		changesetsCh: make(chan *Changeset),
 		errCh:        make(chan error),
+		backoff:      DefaultBackoff,
 	}
 
 	for _, opt := range opts {
 		opt(l)
 	}
 
+	if l.pollInterval <= 0 {
+		l.pollInterval = defaultPollInterval
+	}
+
+	if l.batchSize <= 0 {
+		l.batchSize = defaultBatchSize
+	}
+
 	return l
 }
 
@@ -68,174 +155,438 @@ func (l *NotifyListener) Dial(connConfig *pgx.ConnConfig) error {
 		return err
 	}
 
+	l.connConfig = connConfig
 	l.conn = conn
 	return nil
 }
 
 // ListenForChanges returns a channel that emits database changesets.
 func (l *NotifyListener) ListenForChanges(ctx context.Context) (chan *Changeset, chan error) {
-	l.logger.Info("Starting notify listener for `warp_pipe_new_changeset`")
-	err := l.conn.Listen("warp_pipe_new_changeset")
+	err := l.listen()
 	if err != nil {
 		l.logger.WithError(err).Fatal("failed to listen on notify channel")
 	}
 
-	l.store = store.NewChangesetStore(l.conn)
+	err = db.Migrate(l.conn)
+	if err != nil {
+		l.logger.WithError(err).Fatal("failed to migrate the warp_pipe schema")
+	}
 
-	// loop - listen for notifications
-	go func() {
-		if l.startFromID != nil {
-			eventCh := make(chan *store.Event)
-			doneCh := make(chan bool)
-			errCh := make(chan error)
+	startID, err := l.startPosition()
+	if err != nil {
+		l.logger.WithError(err).Fatal("failed to determine the changeset to start from")
+	}
+	l.acks = newAckTracker(uint64(startID))
+	l.lastProcessedID = startID
 
-			go l.store.GetSinceID(ctx, *l.startFromID, eventCh, doneCh, errCh)
+	if l.retentionInterval > 0 {
+		go l.runRetention(ctx)
+	}
 
-		processIDLoop:
-			for {
-				select {
-				case c := <-eventCh:
-					l.processChangeset(c)
-				case err := <-errCh:
-					log.WithError(err).Fatal("encountered an error while reading changesets")
-					l.errCh <- err
-				case <-doneCh:
-					close(errCh)
-					close(eventCh)
-					break processIDLoop
-				}
+	// loop - read new changesets, then wait for a notification or the poll
+	// interval to elapse
+	go func() {
+		for {
+			err := l.readChangesets(ctx)
+			if err == nil {
+				err = l.saveConsumerPosition(ctx)
+			}
+			if err == nil {
+				err = l.waitForNotification(ctx)
+			}
+			if ctx.Err() != nil {
+				log.Info("shutting down...")
+				return
+			}
+
+			if err == nil {
+				continue
 			}
-		} else if l.startFromTimestamp != nil {
-			eventCh := make(chan *store.Event)
-			doneCh := make(chan bool)
-			errCh := make(chan error)
 
-			go l.store.GetSinceTimestamp(ctx, *l.startFromTimestamp, eventCh, doneCh, errCh)
+			if l.conn.IsAlive() {
+				log.WithError(err).Error("encountered an error while reading changesets")
+				l.errCh <- err
 
-		processTimestampLoop:
-			for {
 				select {
-				case c := <-eventCh:
-					l.processChangeset(c)
-				case err := <-errCh:
-					log.WithError(err).Fatal("encountered an error while reading changesets")
-					l.errCh <- err
-				case <-doneCh:
-					close(errCh)
-					close(eventCh)
-					break processTimestampLoop
+				case <-time.After(l.pollInterval):
+				case <-ctx.Done():
 				}
+				continue
 			}
-		}
 
-		for {
-			msg, err := l.conn.WaitForNotification(ctx)
+			err = reconnect(ctx, l.backoff, l.errCh, l.logger, l.conn.CauseOfDeath(), l.acks.position, l.relisten)
 			if err != nil {
 				if ctx.Err() != nil {
 					log.Info("shutting down...")
 					return
 				}
-				if err != nil {
-					log.WithError(err).Error("encountered an error while waiting for notifications")
-					l.errCh <- err
-				}
+				l.logger.WithError(err).Error("database connection is down")
+				sendError(ctx, l.errCh, err)
+				return
 			}
-
-			l.processMessage(msg)
 		}
 	}()
 
 	return l.changesetsCh, l.errCh
 }
 
-func (l *NotifyListener) processMessage(msg *pgx.Notification) {
-	// payload is <event_id>_<timestamp>
-	parts := strings.Split(msg.Payload, "_")
-	eventID, err := strconv.ParseInt(parts[0], 10, 64)
+// listen subscribes to changeset notifications on the current connection.
+func (l *NotifyListener) listen() error {
+	l.logger.Info("Starting notify listener for `warp_pipe_new_changeset`")
+	err := l.conn.Listen("warp_pipe_new_changeset")
 	if err != nil {
-		log.WithError(err).WithField("changeset_id", parts[0]).
-			Error("failed to parse changeset ID from notification payload")
-		l.errCh <- err
+		return err
 	}
 
-	event, err := l.store.GetByID(context.Background(), eventID)
+	l.store = store.NewChangesetStore(l.conn, store.PageSize(l.batchSize))
+	return nil
+}
+
+// relisten re-opens the connection and subscribes to changeset notifications.
+// Changesets that were emitted but not acknowledged before the connection was
+// lost are emitted again.
+func (l *NotifyListener) relisten() error {
+	l.conn.Close()
+
+	conn, err := pgx.Connect(*l.connConfig)
 	if err != nil {
-		log.WithError(err).WithField("changeset_id", parts[0]).Error("failed to get changeset from store")
-		l.errCh <- err
+		return err
+	}
+	l.conn = conn
+
+	err = l.listen()
+	if err != nil {
+		return err
 	}
 
-	l.processChangeset(event)
+	// resume after the last acknowledged changeset
+	pos := l.acks.position()
+	l.acks.reset(pos)
+	l.lastProcessedID = int64(pos)
+	l.gapID = 0
+	return nil
 }
 
-func (l *NotifyListener) processChangeset(event *store.Event) {
-	cs := &Changeset{
-		ID:        event.ID,
-		Kind:      ParseChangesetKind(event.Action),
-		Schema:    event.SchemaName,
-		Table:     event.TableName,
-		Timestamp: event.Timestamp,
+// Position returns the position of the last acknowledged changeset.
+func (l *NotifyListener) Position() Position {
+	if l.acks == nil {
+		return Position{}
 	}
+	return Position{ChangesetID: int64(l.acks.position())}
+}
 
-	if event.NewValues != nil {
-		var newValues map[string]interface{}
-		err := json.Unmarshal(event.NewValues, &newValues)
-		if err != nil {
-			l.errCh <- fmt.Errorf("failed to unmarshal new values: %w", err)
+// ResumeFrom sets the changeset ID after which to resume, unless one was set
+// with StartFromID or StartFromTimestamp.
+func (l *NotifyListener) ResumeFrom(pos Position) error {
+	if pos.ChangesetID == 0 {
+		return nil
+	}
+	id := pos.ChangesetID
+	l.resumeFromID = &id
+	return nil
+}
+
+// startPosition returns the ID of the changeset preceding the first one to be
+// emitted. Without a start option, the listener resumes from the position set
+// with ResumeFrom, or from the position recorded for its consumer name.
+// Otherwise only changesets created from now on are emitted.
+func (l *NotifyListener) startPosition() (int64, error) {
+	var id int64
+	var err error
+	switch {
+	case l.startFromID != nil:
+		id = *l.startFromID - 1
+	case l.startFromTimestamp != nil:
+		err = l.conn.QueryRow(`
+			SELECT COALESCE(
+				(SELECT MIN(id) - 1 FROM warp_pipe.changesets WHERE ts >= $1),
+				(SELECT MAX(id) FROM warp_pipe.changesets),
+				0
+			)`,
+			*l.startFromTimestamp,
+		).Scan(&id)
+	case l.resumeFromID != nil:
+		l.logger.Infof("Resuming after changeset %d", *l.resumeFromID)
+		id = *l.resumeFromID
+	default:
+		if l.consumerName != "" {
+			pos, ok, err := l.store.GetConsumerPosition(context.Background(), l.consumerName)
+			if err != nil {
+				return 0, fmt.Errorf("failed to read position of consumer %s: %w", l.consumerName, err)
+			}
+			if ok {
+				l.logger.Infof("Resuming consumer %s after changeset %d", l.consumerName, pos)
+				return pos, nil
+			}
 		}
+		err = l.conn.QueryRow("SELECT COALESCE(MAX(id), 0) FROM warp_pipe.changesets").Scan(&id)
+	}
+	if id < 0 {
+		id = 0
+	}
+	return id, err
+}
 
-		var newRawValues map[string]json.RawMessage
-		err = json.Unmarshal(event.NewValues, &newRawValues)
+// readChangesets emits the changesets after the high-water mark, in batches.
+// It stops at a missing ID until the gap is settled.
+func (l *NotifyListener) readChangesets(ctx context.Context) error {
+	cursor := l.store.GetSinceID(l.lastProcessedID + 1)
+	for {
+		event, err := cursor.Next(ctx)
+		if err == io.EOF {
+			return nil
+		}
 		if err != nil {
-			l.errCh <- fmt.Errorf("failed to unmarshal raw new values: %w", err)
+			return err
 		}
 
-		for k, v := range newValues {
-			// Maps are not supported. They can break checksum validation
-			// when re-marshaling. Pass the original JSON string instead.
-			switch v.(type) {
-			case map[string]interface{}:
-				v = string(newRawValues[k])
+		if next := l.lastProcessedID + 1; event.ID > next {
+			settled, err := l.gapSettled(ctx, next)
+			if err != nil {
+				return err
 			}
+			if !settled {
+				return nil
+			}
+		}
+
+		l.processChangeset(event)
+	}
+}
 
-			col := &ChangesetColumn{
-				Column: k,
-				Value:  v,
+// gapSettled returns true if the changeset with the given ID, which is missing
+// from a read, can no longer become visible. The transaction that recorded it
+// was either rolled back or still in progress when the gap was first seen, so
+// the gap is settled once all transactions in progress then have ended.
+func (l *NotifyListener) gapSettled(ctx context.Context, id int64) (bool, error) {
+	snapshot, err := l.store.GetTxSnapshot(ctx)
+	if err != nil {
+		return false, fmt.Errorf("failed to read the transaction snapshot: %w", err)
+	}
+
+	if l.gapID != id {
+		l.gapID = id
+		l.gapXmax = snapshot.Xmax
+		return false, nil
+	}
+
+	return snapshot.Xmin >= l.gapXmax, nil
+}
+
+// saveConsumerPosition records the position of the last acknowledged
+// changeset if the listener is a registered consumer and it has changed.
+func (l *NotifyListener) saveConsumerPosition(ctx context.Context) error {
+	pos := l.acks.position()
+	if l.consumerName == "" || (l.positionSaved && pos == l.savedPosition) {
+		return nil
+	}
+
+	err := l.store.SaveConsumerPosition(ctx, l.consumerName, int64(pos))
+	if err != nil {
+		return fmt.Errorf("failed to save position of consumer %s: %w", l.consumerName, err)
+	}
+
+	l.savedPosition = pos
+	l.positionSaved = true
+	return nil
+}
+
+// runRetention prunes the changesets table at the retention interval, using a
+// dedicated connection.
+func (l *NotifyListener) runRetention(ctx context.Context) {
+	ticker := time.NewTicker(l.retentionInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			err := l.prune(ctx)
+			if err != nil && ctx.Err() == nil {
+				l.logger.WithError(err).Error("failed to prune changesets")
+				sendError(ctx, l.errCh, fmt.Errorf("failed to prune changesets: %w", err))
 			}
-			cs.NewValues = append(cs.NewValues, col)
 		}
 	}
+}
+
+// prune deletes the changesets processed by all registered consumers.
+func (l *NotifyListener) prune(ctx context.Context) error {
+	conn, err := pgx.Connect(*l.connConfig)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	st := store.NewChangesetStore(conn, store.PageSize(l.batchSize))
+	pos, ok, err := st.GetMinConsumerPosition(ctx)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		l.logger.Debug("no consumers are registered, skipping retention")
+		return nil
+	}
+
+	var before time.Time
+	if l.retentionOlderThan > 0 {
+		before = time.Now().Add(-l.retentionOlderThan)
+	}
+
+	deleted, err := st.Prune(ctx, pos+1, before)
+	if err != nil {
+		return err
+	}
+
+	l.logger.Infof("Pruned %d changesets processed by all consumers", deleted)
+	return nil
+}
+
+// waitForNotification blocks until a changeset notification is received or
+// the poll interval has elapsed. The notification payload is not used.
+func (l *NotifyListener) waitForNotification(ctx context.Context) error {
+	waitCtx, cancel := context.WithTimeout(ctx, l.pollInterval)
+	defer cancel()
+
+	_, err := l.conn.WaitForNotification(waitCtx)
+	if err == context.DeadlineExceeded && ctx.Err() == nil {
+		return nil
+	}
+	return err
+}
+
+func (l *NotifyListener) processChangeset(event *store.Event) {
+	cs := &Changeset{
+		ID:         event.ID,
+		TxID:       event.TxID,
+		TxPosition: int(event.TxPosition),
+		TxLast:     event.TxLast,
+		Kind:       ParseChangesetKind(event.Action),
+		Schema:     event.SchemaName,
+		Table:      event.TableName,
+		Timestamp:  event.Timestamp,
+		ack:        l.acks.track(uint64(event.ID)),
+	}
+
+	if event.NewValues != nil {
+		cols, err := l.decodeRow(event.OID, event.NewValues)
+		if err != nil {
+			l.errCh <- fmt.Errorf("failed to unmarshal new values: %w", err)
+		}
+		cs.NewValues = cols
+	}
 
 	if event.OldValues != nil {
-		var oldValues map[string]interface{}
-		err := json.Unmarshal(event.OldValues, &oldValues)
+		cols, err := l.decodeRow(event.OID, event.OldValues)
 		if err != nil {
 			l.errCh <- fmt.Errorf("failed to unmarshal old values: %w", err)
 		}
+		cs.OldValues = cols
+	}
 
-		var oldRawValues map[string]json.RawMessage
-		err = json.Unmarshal(event.OldValues, &oldRawValues)
-		if err != nil {
-			l.errCh <- fmt.Errorf("failed to unmarshal raw old values: %w", err)
+	l.lastProcessedTimestamp = &event.Timestamp
+	l.lastProcessedID = event.ID
+	l.changesetsCh <- cs
+}
+
+// relationColumns are the columns of a table, in attribute order, along with
+// their types.
+type relationColumns struct {
+	names []string
+	types map[string]string
+}
+
+// hasColumns returns true if all the columns of a row encoded with
+// row_to_json() are known.
+func (r *relationColumns) hasColumns(data []byte) bool {
+	var row map[string]json.RawMessage
+	if err := json.Unmarshal(data, &row); err != nil {
+		return true
+	}
+	for name := range row {
+		if _, ok := r.types[name]; !ok {
+			return false
 		}
+	}
+	return true
+}
 
-		for k, v := range oldValues {
-			// Maps are not supported. They can break checksum validation
-			// when re-marshaling. Pass the original JSON string instead.
-			switch v.(type) {
-			case map[string]interface{}:
-				v = string(oldRawValues[k])
-			}
+// decodeRow decodes a row of the relation with the given OID into changeset
+// columns, converted based on the column types (see decodeValue) and ordered
+// as in the table. The column types are looked up in pg_attribute on first
+// use, and again when the row has columns that are not known, e.g. after the
+// table was altered.
+func (l *NotifyListener) decodeRow(relid int64, data []byte) ([]*ChangesetColumn, error) {
+	rel, err := l.lookupColumns(relid, false)
+	if err == nil && !rel.hasColumns(data) {
+		rel, err = l.lookupColumns(relid, true)
+	}
+	if err != nil {
+		l.errCh <- fmt.Errorf("failed to look up the column types of relation %d: %w", relid, err)
+	}
 
-			col := &ChangesetColumn{
-				Column: k,
-				Value:  v,
-			}
-			cs.OldValues = append(cs.OldValues, col)
+	values, err := decodeRowJSON(data, rel.types)
+	if err != nil {
+		return nil, err
+	}
+
+	cols := make([]*ChangesetColumn, 0, len(values))
+	for _, name := range rel.names {
+		if v, ok := values[name]; ok {
+			cols = append(cols, &ChangesetColumn{Column: name, Value: v, Type: rel.types[name]})
+			delete(values, name)
 		}
 	}
 
-	l.lastProcessedTimestamp = &event.Timestamp
-	l.changesetsCh <- cs
+	// columns that are not known, e.g. when the table was dropped
+	rest := make([]string, 0, len(values))
+	for name := range values {
+		rest = append(rest, name)
+	}
+	sort.Strings(rest)
+	for _, name := range rest {
+		cols = append(cols, &ChangesetColumn{Column: name, Value: values[name]})
+	}
+	return cols, nil
+}
+
+// lookupColumns returns the columns of the relation with the given OID,
+// reading them from pg_attribute if they are not cached or reload is set.
+func (l *NotifyListener) lookupColumns(relid int64, reload bool) (*relationColumns, error) {
+	if rel, ok := l.relations[relid]; ok && !reload {
+		return rel, nil
+	}
+
+	rel := &relationColumns{types: make(map[string]string)}
+	rows, err := l.conn.Query(`
+		SELECT attname, format_type(atttypid, atttypmod)
+		FROM pg_catalog.pg_attribute
+		WHERE attrelid = $1::bigint::oid
+			AND attnum > 0
+			AND NOT attisdropped
+		ORDER BY attnum`,
+		relid,
+	)
+	if err != nil {
+		return rel, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var name, pgType string
+		if err := rows.Scan(&name, &pgType); err != nil {
+			return rel, err
+		}
+		rel.names = append(rel.names, name)
+		rel.types[name] = pgType
+	}
+	if err := rows.Err(); err != nil {
+		return rel, err
+	}
+
+	l.relations[relid] = rel
+	return rel, nil
 }
 
 // Close closes the database connection.
@@ -0,0 +1,137 @@
+// +build integration
+
+package warppipe
+
+import (
+	"context"
+	"os"
+	"testing"
+
+	"github.com/jackc/pgx"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/perangel/warp-pipe/db"
+)
+
+func setupNotifyListener(t *testing.T) (*NotifyListener, *pgx.ConnConfig) {
+	os.Setenv("DB_HOST", "127.0.0.1")
+	os.Setenv("DB_PORT", "6432")
+	os.Setenv("DB_NAME", "test")
+	os.Setenv("DB_USER", "test")
+	os.Setenv("DB_PASS", "test")
+
+	config, err := NewConfigFromEnv()
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+
+	connConfig := &pgx.ConnConfig{
+		Host:     config.Database.Host,
+		Port:     uint16(config.Database.Port),
+		Database: config.Database.Database,
+		User:     config.Database.User,
+		Password: config.Database.Password,
+	}
+
+	l := NewNotifyListener()
+	if !assert.NoError(t, l.Dial(connConfig)) {
+		t.FailNow()
+	}
+	l.changesetsCh = make(chan *Changeset, 10)
+	l.errCh = make(chan error, 10)
+
+	_, err = l.conn.Exec(`CREATE TABLE users (id SERIAL PRIMARY KEY, email TEXT)`)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	if !assert.NoError(t, db.Prepare(l.conn, []string{"public"}, nil, nil)) {
+		t.FailNow()
+	}
+	if !assert.NoError(t, l.listen()) {
+		t.FailNow()
+	}
+	l.acks = newAckTracker(0)
+
+	return l, connConfig
+}
+
+func teardownNotifyListener(l *NotifyListener) {
+	l.conn.Exec(`DROP TABLE users CASCADE`)
+	db.Teardown(l.conn)
+	l.conn.Close()
+}
+
+func emittedIDs(l *NotifyListener) []int64 {
+	var ids []int64
+	for {
+		select {
+		case change := <-l.changesetsCh:
+			ids = append(ids, change.ID)
+		default:
+			return ids
+		}
+	}
+}
+
+func TestNotifyListenerOutOfOrderCommits(t *testing.T) {
+	l, connConfig := setupNotifyListener(t)
+	defer teardownNotifyListener(l)
+
+	ctx := context.Background()
+	begin := func() *pgx.Tx {
+		conn, err := pgx.Connect(*connConfig)
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+		t.Cleanup(func() { conn.Close() })
+
+		tx, err := conn.Begin()
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+		return tx
+	}
+	insert := func(tx *pgx.Tx, email string) {
+		_, err := tx.Exec(`INSERT INTO users (email) VALUES ($1)`, email)
+		assert.NoError(t, err)
+	}
+
+	t.Run("committed transaction", func(t *testing.T) {
+		// changeset 1 is recorded first, but committed after changeset 2
+		first := begin()
+		insert(first, "first@example.com")
+
+		second := begin()
+		insert(second, "second@example.com")
+		assert.NoError(t, second.Commit())
+
+		assert.NoError(t, l.readChangesets(ctx))
+		assert.Empty(t, emittedIDs(l))
+		assert.Equal(t, int64(0), l.lastProcessedID)
+
+		assert.NoError(t, first.Commit())
+
+		assert.NoError(t, l.readChangesets(ctx))
+		assert.Equal(t, []int64{1, 2}, emittedIDs(l))
+		assert.Equal(t, int64(2), l.lastProcessedID)
+	})
+
+	t.Run("rolled back transaction", func(t *testing.T) {
+		first := begin()
+		insert(first, "third@example.com")
+
+		second := begin()
+		insert(second, "fourth@example.com")
+		assert.NoError(t, second.Commit())
+		assert.NoError(t, first.Rollback())
+
+		// the gap is settled once the transactions in progress when it was
+		// first seen have ended
+		assert.NoError(t, l.readChangesets(ctx))
+		assert.Empty(t, emittedIDs(l))
+
+		assert.NoError(t, l.readChangesets(ctx))
+		assert.Equal(t, []int64{4}, emittedIDs(l))
+		assert.Equal(t, int64(4), l.lastProcessedID)
+	})
+}
@@ -0,0 +1,248 @@
+package warppipe
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/jackc/pgx"
+
+	"github.com/perangel/warp-pipe/db"
+)
+
+const (
+	pgOutputPlugin = "pgoutput"
+
+	// DefaultPublicationName is the name of the publication used by the
+	// PgOutputListener if none is provided.
+	DefaultPublicationName = "warp_pipe"
+)
+
+// PgOutputListener is a Listener that uses logical replication slots with the
+// built-in `pgoutput` plugin to listen for changesets on the tables of a
+// publication. Unlike LogicalReplicationListener, it does not require wal2json
+// to be installed on the server.
+type PgOutputListener struct {
+	*LogicalReplicationListener
+	publication string
+	relations   map[uint32]*pgOutputRelation
+	txID        int64
+	tx          []*Changeset
+}
+
+// pgOutputRelation is a relation received from the replication stream along
+// with the formatted type names of its columns.
+type pgOutputRelation struct {
+	*db.PgOutputRelation
+	columnTypes []string
+}
+
+// NewPgOutputListener returns a new PgOutputListener for the given publication.
+// If the publication does not exist, it is created for all tables on Dial.
+func NewPgOutputListener(publication string, opts ...LROption) *PgOutputListener {
+	if publication == "" {
+		publication = DefaultPublicationName
+	}
+
+	l := &PgOutputListener{
+		LogicalReplicationListener: NewLogicalReplicationListener(opts...),
+		publication:                publication,
+		relations:                  make(map[uint32]*pgOutputRelation),
+	}
+
+	l.outputPlugin = pgOutputPlugin
+	l.pluginArgs = []string{
+		"\"proto_version\" '1'",
+		// pgoutput parses the publication names as a list of identifiers
+		"\"publication_names\" " + quoteLiteral(pgx.Identifier{publication}.Sanitize()),
+	}
+
+	return l
+}
+
+// Dial connects to the source database, and sets up the publication and the
+// replication slot.
+func (l *PgOutputListener) Dial(connConfig *pgx.ConnConfig) error {
+	err := l.connect(connConfig)
+	if err != nil {
+		return err
+	}
+
+	err = l.createPublication()
+	if err != nil {
+		l.logger.WithError(err).Errorf("failed to create publication %s", l.publication)
+		return err
+	}
+
+	return l.setupReplicationSlot()
+}
+
+// ListenForChanges returns a channel that emits database changesets.
+func (l *PgOutputListener) ListenForChanges(ctx context.Context) (chan *Changeset, chan error) {
+	return l.startReplication(ctx, l.processMessage)
+}
+
+func (l *PgOutputListener) createPublication() error {
+	var exists bool
+	err := l.conn.QueryRow(
+		"SELECT EXISTS (SELECT 1 FROM pg_publication WHERE pubname = $1)",
+		l.publication,
+	).Scan(&exists)
+	if err != nil {
+		return err
+	}
+
+	if exists {
+		return nil
+	}
+
+	l.logger.Infof("Creating publication %s for all tables", l.publication)
+	_, err = l.conn.Exec(fmt.Sprintf("CREATE PUBLICATION %s FOR ALL TABLES", pgx.Identifier{l.publication}.Sanitize()))
+	return err
+}
+
+func (l *PgOutputListener) processMessage(msg *pgx.ReplicationMessage) {
+	pgMsg, err := db.ParsePgOutputMessage(msg.WalMessage.WalData)
+	if err != nil {
+		l.logger.WithError(err).Error("failed to parse pgoutput message")
+		l.errCh <- fmt.Errorf("failed to parse pgoutput: %v", err)
+		return
+	}
+
+	switch m := pgMsg.(type) {
+	case *db.PgOutputBegin:
+		l.txID = int64(m.XID)
+		l.tx = nil
+	case *db.PgOutputRelation:
+		err = l.addRelation(m)
+	case *db.PgOutputInsert:
+		err = l.addChange(ChangesetKindInsert, m.RelationID, func(cs *Changeset, rel *pgOutputRelation) {
+			cs.NewValues = rel.changesetColumns(m.NewTuple, false)
+		})
+	case *db.PgOutputUpdate:
+		err = l.addChange(ChangesetKindUpdate, m.RelationID, func(cs *Changeset, rel *pgOutputRelation) {
+			cs.NewValues = rel.changesetColumns(m.NewTuple, false)
+			if m.OldTuple != nil {
+				cs.OldValues = rel.changesetColumns(m.OldTuple, m.OldTupleKind == 'K')
+			}
+		})
+	case *db.PgOutputDelete:
+		err = l.addChange(ChangesetKindDelete, m.RelationID, func(cs *Changeset, rel *pgOutputRelation) {
+			cs.OldValues = rel.changesetColumns(m.OldTuple, m.OldTupleKind == 'K')
+		})
+	case *db.PgOutputTruncate:
+		for _, relID := range m.RelationIDs {
+			err = l.addChange(ChangesetKindTruncate, relID, func(*Changeset, *pgOutputRelation) {})
+			if err != nil {
+				break
+			}
+		}
+	case *db.PgOutputCommit:
+		l.commit(m.EndLSN, m.CommitTime)
+	}
+
+	if err != nil {
+		l.logger.WithError(err).Error("failed to process pgoutput message")
+		l.errCh <- err
+	}
+}
+
+// addRelation caches a relation, resolving the type names of its columns.
+func (l *PgOutputListener) addRelation(m *db.PgOutputRelation) error {
+	rel := &pgOutputRelation{
+		PgOutputRelation: m,
+		columnTypes:      make([]string, len(m.Columns)),
+	}
+
+	for i, col := range m.Columns {
+		err := l.conn.QueryRow("SELECT format_type($1, $2)", col.TypeOID, col.TypeMode).
+			Scan(&rel.columnTypes[i])
+		if err != nil {
+			return fmt.Errorf("failed to resolve type of column %s.%s.%s: %w", m.Namespace, m.Name, col.Name, err)
+		}
+	}
+
+	l.relations[m.ID] = rel
+	return nil
+}
+
+// addChange adds a changeset for the relation to the current transaction.
+// Changes to the `warp_pipe` schema are skipped.
+func (l *PgOutputListener) addChange(kind ChangesetKind, relID uint32, setValues func(*Changeset, *pgOutputRelation)) error {
+	rel, ok := l.relations[relID]
+	if !ok {
+		return fmt.Errorf("received change for unknown relation %d", relID)
+	}
+
+	if rel.Namespace == "warp_pipe" {
+		return nil
+	}
+
+	cs := &Changeset{
+		Kind:   kind,
+		Schema: rel.Namespace,
+		Table:  rel.Name,
+	}
+	setValues(cs, rel)
+	l.tx = append(l.tx, cs)
+
+	return nil
+}
+
+// commit emits the changesets of the current transaction. They are confirmed
+// up to the end of the transaction's commit record.
+func (l *PgOutputListener) commit(lsn uint64, commitTime time.Time) {
+	if len(l.tx) == 0 {
+		l.acks.skip(lsn)
+		return
+	}
+
+	for i, cs := range l.tx {
+		cs.LSN = lsn
+		cs.TxID = l.txID
+		cs.TxPosition = i
+		cs.TxLast = i == len(l.tx)-1
+		cs.Timestamp = commitTime
+		cs.CommitTime = commitTime
+		cs.ack = l.acks.track(lsn)
+		l.changesetsCh <- cs
+	}
+	l.tx = nil
+}
+
+// changesetColumns converts a tuple to changeset columns. If keysOnly is set,
+// only the replica identity columns are included. Unchanged TOAST values are
+// omitted as they are not sent by the server.
+func (r *pgOutputRelation) changesetColumns(tuple []*db.PgOutputTupleColumn, keysOnly bool) []*ChangesetColumn {
+	cols := make([]*ChangesetColumn, 0, len(tuple))
+	for i, val := range tuple {
+		if i >= len(r.Columns) {
+			break
+		}
+
+		col := r.Columns[i]
+		if keysOnly && !col.IsKey() {
+			continue
+		}
+
+		if val.Kind == db.PgOutputTupleUnchanged {
+			continue
+		}
+
+		cols = append(cols, &ChangesetColumn{
+			Column: col.Name,
+			Value:  pgOutputValue(r.columnTypes[i], val),
+			Type:   r.columnTypes[i],
+		})
+	}
+	return cols
+}
+
+// pgOutputValue converts a text-encoded column value based on the column
+// type, see decodeValue.
+func pgOutputValue(pgType string, val *db.PgOutputTupleColumn) interface{} {
+	if val.Kind != db.PgOutputTupleText {
+		return nil
+	}
+	return decodeValue(pgType, string(val.Value))
+}
@@ -0,0 +1,66 @@
+package warppipe
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/perangel/warp-pipe/db"
+)
+
+func TestPgOutputRelationChangesetColumns(t *testing.T) {
+	rel := &pgOutputRelation{
+		PgOutputRelation: &db.PgOutputRelation{
+			Namespace: "public",
+			Name:      "users",
+			Columns: []*db.PgOutputRelationColumn{
+				{Flags: db.PgOutputColumnFlagKey, Name: "id", TypeOID: 20},
+				{Name: "email", TypeOID: 1043},
+				{Name: "active", TypeOID: 16},
+				{Name: "score", TypeOID: 1700},
+				{Name: "bio", TypeOID: 25},
+			},
+		},
+		columnTypes: []string{"bigint", "character varying(255)", "boolean", "numeric", "text"},
+	}
+
+	tuple := []*db.PgOutputTupleColumn{
+		{Kind: db.PgOutputTupleText, Value: []byte("42")},
+		{Kind: db.PgOutputTupleText, Value: []byte("han@test.com")},
+		{Kind: db.PgOutputTupleText, Value: []byte("t")},
+		{Kind: db.PgOutputTupleText, Value: []byte("NaN")},
+		{Kind: db.PgOutputTupleUnchanged},
+	}
+
+	t.Run("all columns", func(t *testing.T) {
+		cols := rel.changesetColumns(tuple, false)
+		assert.Equal(t, []*ChangesetColumn{
+			{Column: "id", Value: int64(42), Type: "bigint"},
+			{Column: "email", Value: "han@test.com", Type: "character varying(255)"},
+			{Column: "active", Value: true, Type: "boolean"},
+			{Column: "score", Value: Decimal("NaN"), Type: "numeric"},
+		}, cols)
+	})
+
+	t.Run("keys only", func(t *testing.T) {
+		cols := rel.changesetColumns(tuple, true)
+		assert.Equal(t, []*ChangesetColumn{
+			{Column: "id", Value: int64(42), Type: "bigint"},
+		}, cols)
+	})
+
+	t.Run("null values", func(t *testing.T) {
+		cols := rel.changesetColumns([]*db.PgOutputTupleColumn{{Kind: db.PgOutputTupleNull}}, false)
+		assert.Equal(t, []*ChangesetColumn{
+			{Column: "id", Value: nil, Type: "bigint"},
+		}, cols)
+	})
+}
+
+func TestPgOutputPublicationNames(t *testing.T) {
+	l := NewPgOutputListener(`it's "ours"`)
+	assert.Equal(t, []string{
+		`"proto_version" '1'`,
+		`"publication_names" '"it''s ""ours"""'`,
+	}, l.pluginArgs)
+}
@@ -2,34 +2,329 @@ package warppipe
 
 import (
 	"context"
+	"fmt"
+	"hash/fnv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultStageBatchSize = 100
+	defaultBatchInterval  = 1 * time.Second
 )
 
 type stageFn func(context.Context, <-chan *Changeset, chan error) chan *Changeset
 
 // makeStageFunc wraps a StageFunc and returns a stageFn.
-func makeStageFunc(sFun StageFunc) stageFn {
+func makeStageFunc(sFun StageFunc, policy *stageErrorPolicy) stageFn {
 	f := func(ctx context.Context, inCh <-chan *Changeset, errCh chan error) chan *Changeset {
 		outCh := make(chan *Changeset)
 		go func() {
 			defer close(outCh)
 			for {
 				select {
-				case change := <-inCh:
-					c, err := sFun(change)
+				case change, ok := <-inCh:
+					if !ok {
+						return
+					}
+					if bypasses(change, policy.stage) {
+						select {
+						case outCh <- change:
+						case <-ctx.Done():
+							return
+						}
+						continue
+					}
+					original := policy.snapshot([]*Changeset{change})
+
+					var c *Changeset
+					err := policy.call(ctx, func() (err error) {
+						c, err = sFun(change)
+						return err
+					})
+					if ctx.Err() != nil {
+						return
+					}
 					if err != nil {
-						errCh <- err
+						if !policy.handle(ctx, original, err, errCh) {
+							return
+						}
+						continue
 					}
 
 					if c == nil {
+						// dropped changesets are considered processed
+						change.Ack()
+						continue
+					}
+					carryAck(change, c)
+
+					select {
+					case outCh <- c:
+					case <-ctx.Done():
+						return
+					}
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+		return outCh
+	}
+	return f
+}
+
+// bypasses returns true if a replayed dead letter must pass through the stage
+// unprocessed, as it failed in a later one. Once it reaches the stage it
+// failed in, it is processed as any other changeset.
+func bypasses(change *Changeset, stage string) bool {
+	if change.replayFrom == "" {
+		return false
+	}
+	if change.replayFrom != stage {
+		return true
+	}
+	change.replayFrom = ""
+	return false
+}
+
+// carryAck makes acknowledging a changeset that a stage returned in place of
+// the original one (e.g. a transformed copy) acknowledge the original too.
+func carryAck(original, c *Changeset) {
+	if c == original || original.ack == nil {
+		return
+	}
+	if c.ack == nil {
+		c.ack = original.ack
+		return
+	}
+
+	ack, originalAck := c.ack, original.ack
+	c.ack = func() {
+		ack()
+		originalAck()
+	}
+}
+
+// BatchStageFunc is a function for processing batches of changesets in a
+// pipeline Stage. It returns the changesets to pass on to the next stage, which
+// may be a subset of the batch or new changesets. Changesets of the batch that
+// are not returned are considered processed unless an error is returned: they
+// are acknowledged right away if only changesets of the batch are returned,
+// and otherwise once all the new changesets have been acknowledged.
+type BatchStageFunc func([]*Changeset) ([]*Changeset, error)
+
+// makeBatchStageFunc wraps a BatchStageFunc and returns a stageFn.
+func makeBatchStageFunc(bFun BatchStageFunc, size int, interval time.Duration, policy *stageErrorPolicy) stageFn {
+	f := func(ctx context.Context, inCh <-chan *Changeset, errCh chan error) chan *Changeset {
+		outCh := make(chan *Changeset)
+		go func() {
+			defer close(outCh)
+
+			var batch []*Changeset
+			timer := time.NewTimer(interval)
+			timer.Stop()
+
+			for {
+				select {
+				case change, ok := <-inCh:
+					if !ok {
+						// process the last batch before closing
+						processBatch(ctx, bFun, batch, policy, outCh, errCh)
+						return
+					}
+					if bypasses(change, policy.stage) {
+						select {
+						case outCh <- change:
+						case <-ctx.Done():
+							return
+						}
+						continue
+					}
+
+					batch = append(batch, change)
+					if len(batch) == 1 {
+						timer.Reset(interval)
+					}
+					if len(batch) < size {
 						continue
 					}
+					if !timer.Stop() {
+						select {
+						case <-timer.C:
+						default:
+						}
+					}
+				case <-timer.C:
+				case <-ctx.Done():
+					return
+				}
+
+				if !processBatch(ctx, bFun, batch, policy, outCh, errCh) {
+					return
+				}
+				batch = nil
+			}
+		}()
+		return outCh
+	}
+	return f
+}
+
+// processBatch processes a batch and sends its resulting changesets to outCh.
+// It returns false if the stage must stop.
+func processBatch(ctx context.Context, bFun BatchStageFunc, batch []*Changeset, policy *stageErrorPolicy, outCh chan *Changeset, errCh chan error) bool {
+	if len(batch) == 0 {
+		return true
+	}
+	original := policy.snapshot(batch)
+
+	var out []*Changeset
+	err := policy.call(ctx, func() (err error) {
+		out, err = bFun(batch)
+		return err
+	})
+	if ctx.Err() != nil {
+		return false
+	}
+	if err != nil {
+		return policy.handle(ctx, original, err, errCh)
+	}
+
+	ackReplaced(batch, out)
+
+	for _, c := range out {
+		select {
+		case outCh <- c:
+		case <-ctx.Done():
+			return false
+		}
+	}
+	return true
+}
+
+// ackReplaced acknowledges the changesets of a batch that the stage did not
+// return. If the stage returned new changesets, these may replace them (e.g.
+// an aggregate of the batch), so they are only acknowledged once all the new
+// changesets have been.
+func ackReplaced(batch, out []*Changeset) {
+	inBatch := make(map[*Changeset]bool, len(batch))
+	for _, change := range batch {
+		inBatch[change] = true
+	}
+
+	kept := make(map[*Changeset]bool, len(out))
+	var added []*Changeset
+	for _, c := range out {
+		if !inBatch[c] && !kept[c] {
+			added = append(added, c)
+		}
+		kept[c] = true
+	}
+
+	var replaced []*Changeset
+	for _, change := range batch {
+		if !kept[change] {
+			replaced = append(replaced, change)
+		}
+	}
+
+	ackAll := func() {
+		for _, change := range replaced {
+			change.Ack()
+		}
+	}
+	if len(added) == 0 {
+		ackAll()
+		return
+	}
+	if len(replaced) == 0 {
+		return
+	}
+
+	remaining := int32(len(added))
+	for _, c := range added {
+		var once sync.Once
+		carryAck(&Changeset{ack: func() {
+			once.Do(func() {
+				if atomic.AddInt32(&remaining, -1) == 0 {
+					ackAll()
+				}
+			})
+		}}, c)
+	}
+}
+
+// makeParallelStageFunc runs n copies of a stageFn, passing changesets with
+// the same key to the same copy so that they stay in order. If a copy stops
+// (e.g. on a fatal error), no more changesets are passed to the others, so
+// that the stage stops too.
+func makeParallelStageFunc(fn stageFn, n int, key func(*Changeset) string) stageFn {
+	f := func(ctx context.Context, inCh <-chan *Changeset, errCh chan error) chan *Changeset {
+		outCh := make(chan *Changeset)
+		workerChs := make([]chan *Changeset, n)
+
+		stopped := make(chan struct{})
+		var stopOnce sync.Once
+
+		var wg sync.WaitGroup
+		for i := range workerChs {
+			workerChs[i] = make(chan *Changeset)
+			workerOutCh := fn(ctx, workerChs[i], errCh)
+
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				defer stopOnce.Do(func() { close(stopped) })
+				for c := range workerOutCh {
+					select {
+					case outCh <- c:
+					case <-ctx.Done():
+						return
+					}
+				}
+			}()
+		}
+
+		go func() {
+			wg.Wait()
+			close(outCh)
+		}()
+
+		go func() {
+			// closing the input of the workers closes their output, and then
+			// outCh
+			defer func() {
+				for _, workerCh := range workerChs {
+					close(workerCh)
+				}
+			}()
 
-					outCh <- c
+			for {
+				select {
+				case change, ok := <-inCh:
+					if !ok {
+						return
+					}
+					h := fnv.New32a()
+					h.Write([]byte(key(change)))
+					select {
+					case workerChs[h.Sum32()%uint32(n)] <- change:
+					case <-stopped:
+						return
+					case <-ctx.Done():
+						return
+					}
+				case <-stopped:
+					return
 				case <-ctx.Done():
 					return
 				}
 			}
 		}()
+
 		return outCh
 	}
 	return f
@@ -42,6 +337,92 @@ func makeStageFunc(sFun StageFunc) stageFn {
 //     (nil, error): If there was an error during the stage
 type StageFunc func(*Changeset) (*Changeset, error)
 
+// StageOption is an AddStage option function.
+type StageOption func(*stageConfig)
+
+type stageConfig struct {
+	parallelism   int
+	key           func(*Changeset) string
+	batchSize     int
+	batchInterval time.Duration
+	errorAction   ErrorAction
+	retry         *Backoff
+	deadLetters   DeadLetterStore
+}
+
+func newStageConfig(opts []StageOption) *stageConfig {
+	cfg := &stageConfig{
+		parallelism:   1,
+		key:           tableKey,
+		batchSize:     defaultStageBatchSize,
+		batchInterval: defaultBatchInterval,
+		errorAction:   ErrorActionSkip,
+	}
+	for _, opt := range opts {
+		opt(cfg)
+	}
+	return cfg
+}
+
+// Parallelism is a StageOption for running a stage in n workers. Changesets
+// with the same key, which is the table unless set with KeyColumns() or
+// PartitionBy(), are processed by the same worker, in order, while changesets
+// with different keys may be reordered.
+func Parallelism(n int) StageOption {
+	return func(cfg *stageConfig) {
+		cfg.parallelism = n
+	}
+}
+
+// KeyColumns is a StageOption for partitioning the changesets of a parallel
+// stage by row, using the values of the given columns (e.g. the primary key)
+// along with the table. The old values are used if present, so that the
+// changesets of a row keep their order until its key is updated.
+func KeyColumns(columns ...string) StageOption {
+	return PartitionBy(func(change *Changeset) string {
+		values := change.OldValues
+		if len(values) == 0 {
+			values = change.NewValues
+		}
+
+		var b strings.Builder
+		b.WriteString(tableKey(change))
+		for _, column := range columns {
+			v, _ := change.getColumnValue(values, column)
+			fmt.Fprintf(&b, "|%v", v)
+		}
+		return b.String()
+	})
+}
+
+// PartitionBy is a StageOption for partitioning the changesets of a parallel
+// stage with a custom key function.
+func PartitionBy(key func(*Changeset) string) StageOption {
+	return func(cfg *stageConfig) {
+		cfg.key = key
+	}
+}
+
+// MaxBatchSize is a StageOption for setting the maximum number of changesets
+// in the batches of a batch stage. It defaults to 100.
+func MaxBatchSize(size int) StageOption {
+	return func(cfg *stageConfig) {
+		cfg.batchSize = size
+	}
+}
+
+// BatchInterval is a StageOption for setting the maximum time a changeset
+// waits for its batch to fill up in a batch stage. It defaults to 1s.
+func BatchInterval(d time.Duration) StageOption {
+	return func(cfg *stageConfig) {
+		cfg.batchInterval = d
+	}
+}
+
+func tableKey(change *Changeset) string {
+	return change.Schema + "." + change.Table
+}
+
 // Stage is a pipeline stage.
 type Stage struct {
 	Name string
@@ -53,6 +434,19 @@ type Pipeline struct {
 	stages []*Stage
 	outCh  <-chan *Changeset
 	errCh  chan error
+
+	started  bool
+	cancel   context.CancelFunc
+	stopCh   chan struct{}
+	stopOnce sync.Once
+	done     chan struct{}
+
+	mu       sync.Mutex
+	fatalErr error
+
+	// autoAck acknowledges the changesets once they have been received from
+	// the changeset channel.
+	autoAck bool
 }
 
 // NewPipeline returns a new Pipeline.
@@ -61,29 +455,167 @@ func NewPipeline() *Pipeline {
 		stages: []*Stage{},
 		outCh:  make(chan *Changeset),
 		errCh:  make(chan error),
+		stopCh: make(chan struct{}),
+		done:   make(chan struct{}),
 	}
 }
 
-// AddStage adds a new Stage to the pipeline
-func (p *Pipeline) AddStage(name string, fn StageFunc) {
+// AddStage adds a new Stage to the pipeline. The stage processes one
+// changeset at a time, in order, unless run in parallel with Parallelism().
+// By default, a changeset the stage fails to process is reported and skipped;
+// see FailOnError(), RetryOnError() and DeadLetterOnError().
+func (p *Pipeline) AddStage(name string, fn StageFunc, opts ...StageOption) {
+	cfg := newStageConfig(opts)
+	p.addStage(name, makeStageFunc(fn, p.newStageErrorPolicy(name, cfg)), cfg)
+}
+
+// AddBatchStage adds a new Stage to the pipeline that processes changesets in
+// batches. A batch is processed once it holds MaxBatchSize() changesets, or
+// BatchInterval() after its first changeset was received. Error options apply
+// to whole batches.
+func (p *Pipeline) AddBatchStage(name string, fn BatchStageFunc, opts ...StageOption) {
+	cfg := newStageConfig(opts)
+	p.addStage(name, makeBatchStageFunc(fn, cfg.batchSize, cfg.batchInterval, p.newStageErrorPolicy(name, cfg)), cfg)
+}
+
+func (p *Pipeline) addStage(name string, fn stageFn, cfg *stageConfig) {
+	if cfg.parallelism > 1 {
+		fn = makeParallelStageFunc(fn, cfg.parallelism, cfg.key)
+	}
+
 	p.stages = append(p.stages, &Stage{
 		Name: name,
-		Fn:   makeStageFunc(fn),
+		Fn:   fn,
 	})
 }
 
 // Start starts the pipeline, consuming off of a source chan that emits *Changeset.
+//
+// The returned changeset channel is closed once the pipeline has stopped:
+// after the source channel is closed or Shutdown is called, once the
+// changesets in flight have gone through all stages; when the context is
+// done; or when a stage fails with a fatal error, after the changesets
+// downstream of the stage have gone through.
 func (p *Pipeline) Start(ctx context.Context, sourceCh <-chan *Changeset) (<-chan *Changeset, <-chan error) {
-	if len(p.stages) > 0 {
-		initStage := p.stages[0]
-		outCh := initStage.Fn(ctx, sourceCh, p.errCh)
-		for _, stage := range p.stages[1:] {
-			outCh = stage.Fn(ctx, outCh, p.errCh)
-		}
-		p.outCh = outCh
-	} else {
-		p.outCh = sourceCh
+	ctx, p.cancel = context.WithCancel(ctx)
+	p.started = true
+
+	outCh := p.readSource(ctx, sourceCh)
+	for _, stage := range p.stages {
+		outCh = stage.Fn(ctx, outCh, p.errCh)
 	}
 
+	finalCh := make(chan *Changeset)
+	go func() {
+		defer close(p.done)
+		// stops the stages upstream of a failed stage
+		defer p.cancel()
+		defer close(finalCh)
+
+		for c := range outCh {
+			if c.replayFrom != "" {
+				// passing it on would skip the stage it failed in
+				err := fmt.Errorf("failed to replay changeset %d: stage '%s' not found in the pipeline", c.ID, c.replayFrom)
+				select {
+				case p.errCh <- err:
+					continue
+				case <-ctx.Done():
+					return
+				}
+			}
+
+			select {
+			case finalCh <- c:
+				if p.autoAck {
+					c.Ack()
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	p.outCh = finalCh
+
 	return p.outCh, p.errCh
 }
+
+// readSource forwards the changesets of the source channel to the first
+// stage, until the source channel is closed or Shutdown is called.
+func (p *Pipeline) readSource(ctx context.Context, sourceCh <-chan *Changeset) chan *Changeset {
+	outCh := make(chan *Changeset)
+	go func() {
+		defer close(outCh)
+		for {
+			select {
+			case change, ok := <-sourceCh:
+				if !ok {
+					return
+				}
+				if change == nil {
+					continue
+				}
+
+				select {
+				case outCh <- change:
+				case <-ctx.Done():
+					return
+				}
+			case <-p.stopCh:
+				return
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return outCh
+}
+
+// Shutdown stops reading changesets from the source channel, and waits until
+// the changesets in flight have gone through all stages and been received
+// from the pipeline's changeset channel, or been reported on its error
+// channel. If the context is done first, the stages are stopped and the
+// context's error is returned.
+func (p *Pipeline) Shutdown(ctx context.Context) error {
+	if !p.started {
+		return nil
+	}
+
+	p.stopOnce.Do(func() {
+		close(p.stopCh)
+	})
+
+	select {
+	case <-p.done:
+		return nil
+	case <-ctx.Done():
+		p.cancel()
+		<-p.done
+		return ctx.Err()
+	}
+}
+
+// Wait waits until the pipeline has stopped, and returns the first fatal
+// error of its stages, if any.
+func (p *Pipeline) Wait() error {
+	if p.started {
+		<-p.done
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.fatalErr
+}
+
+// newStageErrorPolicy returns the error policy of a stage, which records
+// fatal errors in the pipeline.
+func (p *Pipeline) newStageErrorPolicy(stage string, cfg *stageConfig) *stageErrorPolicy {
+	policy := newStageErrorPolicy(stage, cfg)
+	policy.onFatal = func(err error) {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		if p.fatalErr == nil {
+			p.fatalErr = err
+		}
+	}
+	return policy
+}
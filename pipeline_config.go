@@ -0,0 +1,603 @@
+package warppipe
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Built-in pipeline stage types.
+const (
+	StageTypeDropColumns   = "drop_columns"
+	StageTypeKeepColumns   = "keep_columns"
+	StageTypeRenameColumns = "rename_columns"
+	StageTypeRenameTable   = "rename_table"
+	StageTypeAddFields     = "add_fields"
+	StageTypeFilterKinds   = "filter_kinds"
+	StageTypeFilterRows    = "filter_rows"
+)
+
+// Row condition operators.
+const (
+	OpEq      = "eq"
+	OpNe      = "ne"
+	OpLt      = "lt"
+	OpLte     = "lte"
+	OpGt      = "gt"
+	OpGte     = "gte"
+	OpIn      = "in"
+	OpNotIn   = "not_in"
+	OpNull    = "null"
+	OpNotNull = "not_null"
+)
+
+// PipelineConfig is a declarative pipeline, made of built-in stages, that is
+// read from a YAML or JSON file, e.g.
+//
+//     stages:
+//       - type: drop_columns
+//         tables: [public.users]
+//         columns: [email, phone]
+//       - type: filter_kinds
+//         kinds: [insert, update]
+//
+// The stages run in order, after the table filters of WarpPipe. Use
+// ConfigStages() to add them to a WarpPipe.
+type PipelineConfig struct {
+	Stages []*PipelineStageConfig `yaml:"stages" json:"stages"`
+}
+
+// PipelineStageConfig configures a built-in pipeline stage. Type selects the
+// stage, and only the fields of that type may be set:
+//     drop_columns:   Columns, removed from the new and old values
+//     keep_columns:   Columns, the only ones kept in the new and old values
+//     rename_columns: Rename, a map of old to new column names
+//     rename_table:   Schema and/or Table, the new schema and table name
+//     add_fields:     Fields, a map of column names to static values, set in
+//                     the new values (the old values of deletes)
+//     filter_kinds:   Kinds, the changeset kinds to keep
+//     filter_rows:    Where, a predicate rows must match to be kept (see
+//                     ParsePredicate), or Conditions, which rows must all
+//                     match; rows moving into or out of the filter on update
+//                     are emitted as inserts or deletes (see FilterRows)
+// If Tables is set, the stage only applies to changesets of matching tables,
+// in any of the formats of WhitelistTables(); other changesets pass through.
+// Name defaults to Type, and must be unique. OnError is the ErrorAction of
+// the stage, `skip` by default, applied after retrying a failed changeset
+// Retries times (see RetryOnError); `dead_letter` requires a DeadLetterStore.
+type PipelineStageConfig struct {
+	Name       string                 `yaml:"name" json:"name"`
+	Type       string                 `yaml:"type" json:"type"`
+	Tables     []string               `yaml:"tables" json:"tables"`
+	Columns    []string               `yaml:"columns" json:"columns"`
+	Rename     map[string]string      `yaml:"rename" json:"rename"`
+	Schema     string                 `yaml:"schema" json:"schema"`
+	Table      string                 `yaml:"table" json:"table"`
+	Fields     map[string]interface{} `yaml:"fields" json:"fields"`
+	Kinds      []string               `yaml:"kinds" json:"kinds"`
+	Where      string                 `yaml:"where" json:"where"`
+	Conditions []*RowCondition        `yaml:"conditions" json:"conditions"`
+	OnError    string                 `yaml:"on_error" json:"on_error"`
+	Retries    int                    `yaml:"retries" json:"retries"`
+}
+
+// RowCondition is a condition on a column of the rows filtered by a
+// filter_rows stage, a structured alternative to a Where predicate. Op is one
+// of `eq`, `ne`, `lt`, `lte`, `gt`, `gte`, which compare the column to Value,
+// `in`, `not_in`, which compare it to a list of values, `null` or `not_null`.
+// As in SQL, a null column only matches `null`, and so does a missing one,
+// except in old values (see FilterRows).
+type RowCondition struct {
+	Column string      `yaml:"column" json:"column"`
+	Op     string      `yaml:"op" json:"op"`
+	Value  interface{} `yaml:"value" json:"value"`
+}
+
+// LoadPipelineConfig reads and validates a pipeline configuration file.
+func LoadPipelineConfig(path string) (*PipelineConfig, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read pipeline config: %w", err)
+	}
+
+	config, err := ParsePipelineConfig(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return config, nil
+}
+
+// ParsePipelineConfig parses and validates a pipeline configuration, in YAML
+// or JSON. Unknown fields are errors.
+func ParsePipelineConfig(data []byte) (*PipelineConfig, error) {
+	var config PipelineConfig
+	if bytes.HasPrefix(bytes.TrimSpace(data), []byte("{")) {
+		dec := json.NewDecoder(bytes.NewReader(data))
+		dec.DisallowUnknownFields()
+		dec.UseNumber()
+		if err := dec.Decode(&config); err != nil {
+			return nil, fmt.Errorf("failed to parse pipeline config: %w", err)
+		}
+	} else if err := yaml.UnmarshalStrict(data, &config); err != nil {
+		return nil, fmt.Errorf("failed to parse pipeline config: %w", err)
+	}
+
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	return &config, nil
+}
+
+// Validate returns an error describing the first invalid stage, if any.
+func (c *PipelineConfig) Validate() error {
+	_, err := c.build()
+	return err
+}
+
+// AddStages validates the configuration and adds its stages to a pipeline.
+// The changesets that stages with `on_error: dead_letter` fail to process are
+// saved in deadLetters, which may be nil if there are none.
+func (c *PipelineConfig) AddStages(p *Pipeline, deadLetters DeadLetterStore) error {
+	stages, err := c.stages(deadLetters)
+	if err != nil {
+		return err
+	}
+
+	for _, s := range stages {
+		p.AddStage(s.name, s.fn, s.opts...)
+	}
+	return nil
+}
+
+type configStage struct {
+	name    string
+	fn      StageFunc
+	onError ErrorAction
+	retries int
+	opts    []StageOption
+}
+
+// configRetryBackoff is the backoff of stages with retries.
+var configRetryBackoff = Backoff{
+	InitialInterval: 100 * time.Millisecond,
+	MaxInterval:     10 * time.Second,
+	Multiplier:      2,
+}
+
+// stages returns the stages of the configuration, with their error options.
+func (c *PipelineConfig) stages(deadLetters DeadLetterStore) ([]configStage, error) {
+	stages, err := c.build()
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range stages {
+		s := &stages[i]
+		switch s.onError {
+		case ErrorActionFail:
+			s.opts = append(s.opts, FailOnError())
+		case ErrorActionDeadLetter:
+			if deadLetters == nil {
+				return nil, fmt.Errorf("invalid pipeline stage %d '%s': on_error %s requires a dead letter store", i+1, s.name, s.onError)
+			}
+			s.opts = append(s.opts, DeadLetterOnError(deadLetters))
+		}
+
+		if s.retries > 0 {
+			backoff := configRetryBackoff
+			backoff.MaxRetries = s.retries
+			s.opts = append(s.opts, RetryOnError(backoff))
+		}
+	}
+	return stages, nil
+}
+
+// build returns the stage functions of the configuration.
+func (c *PipelineConfig) build() ([]configStage, error) {
+	names := make(map[string]bool, len(c.Stages))
+	stages := make([]configStage, 0, len(c.Stages))
+	for i, s := range c.Stages {
+		if s == nil {
+			return nil, fmt.Errorf("invalid pipeline stage %d: empty stage", i+1)
+		}
+
+		name := s.Name
+		if name == "" {
+			name = s.Type
+		}
+
+		fn, err := s.build()
+		if err != nil {
+			return nil, fmt.Errorf("invalid pipeline stage %d '%s': %w", i+1, name, err)
+		}
+
+		if names[name] {
+			return nil, fmt.Errorf("invalid pipeline stage %d '%s': duplicate stage name, set a unique name", i+1, name)
+		}
+		names[name] = true
+
+		onError := ErrorAction(s.OnError)
+		switch onError {
+		case "", ErrorActionFail, ErrorActionSkip, ErrorActionDeadLetter:
+		default:
+			return nil, fmt.Errorf("invalid pipeline stage %d '%s': '%s' is not a valid error action. Must be one of `%s`, `%s` or `%s`",
+				i+1, name, s.OnError, ErrorActionFail, ErrorActionSkip, ErrorActionDeadLetter)
+		}
+		if s.Retries < 0 {
+			return nil, fmt.Errorf("invalid pipeline stage %d '%s': retries must not be negative", i+1, name)
+		}
+
+		stages = append(stages, configStage{name: name, fn: fn, onError: onError, retries: s.Retries})
+	}
+	return stages, nil
+}
+
+// build validates the stage configuration and returns its stage function.
+func (s *PipelineStageConfig) build() (StageFunc, error) {
+	var fields []string
+	var transform func(*Changeset) *Changeset
+
+	switch s.Type {
+	case "":
+		return nil, errors.New("type is required")
+	case StageTypeDropColumns, StageTypeKeepColumns:
+		fields = []string{"columns"}
+		if len(s.Columns) == 0 {
+			return nil, errors.New("columns is required")
+		}
+
+		keep := s.Type == StageTypeKeepColumns
+		columns := make(map[string]bool, len(s.Columns))
+		for _, col := range s.Columns {
+			columns[col] = true
+		}
+		filter := func(cols []*ChangesetColumn) []*ChangesetColumn {
+			if cols == nil {
+				return nil
+			}
+			filtered := make([]*ChangesetColumn, 0, len(cols))
+			for _, col := range cols {
+				if columns[col.Column] == keep {
+					filtered = append(filtered, col)
+				}
+			}
+			return filtered
+		}
+		transform = func(change *Changeset) *Changeset {
+			change.NewValues = filter(change.NewValues)
+			change.OldValues = filter(change.OldValues)
+			return change
+		}
+	case StageTypeRenameColumns:
+		fields = []string{"rename"}
+		if len(s.Rename) == 0 {
+			return nil, errors.New("rename is required")
+		}
+		for from, to := range s.Rename {
+			if to == "" {
+				return nil, fmt.Errorf("empty new name for column '%s'", from)
+			}
+		}
+
+		// renamed columns are copied, since the new and old values, or other
+		// changesets, may share them
+		rename := func(cols []*ChangesetColumn) []*ChangesetColumn {
+			if cols == nil {
+				return nil
+			}
+			renamed := make([]*ChangesetColumn, len(cols))
+			for i, col := range cols {
+				renamed[i] = col
+				if to, ok := s.Rename[col.Column]; ok {
+					c := *col
+					c.Column = to
+					renamed[i] = &c
+				}
+			}
+			return renamed
+		}
+		transform = func(change *Changeset) *Changeset {
+			change.NewValues = rename(change.NewValues)
+			change.OldValues = rename(change.OldValues)
+			return change
+		}
+	case StageTypeRenameTable:
+		fields = []string{"schema", "table"}
+		if s.Schema == "" && s.Table == "" {
+			return nil, errors.New("schema or table is required")
+		}
+
+		transform = func(change *Changeset) *Changeset {
+			if s.Schema != "" {
+				change.Schema = s.Schema
+			}
+			if s.Table != "" {
+				change.Table = s.Table
+			}
+			return change
+		}
+	case StageTypeAddFields:
+		fields = []string{"fields"}
+		if len(s.Fields) == 0 {
+			return nil, errors.New("fields is required")
+		}
+
+		names := make([]string, 0, len(s.Fields))
+		values := make(map[string]interface{}, len(s.Fields))
+		for name, value := range s.Fields {
+			v, err := configValue(value)
+			if err != nil {
+				return nil, fmt.Errorf("field '%s': %w", name, err)
+			}
+			names = append(names, name)
+			values[name] = v
+		}
+		sort.Strings(names)
+
+		// fields are added to a copy of the columns, since their slice may
+		// be shared
+		add := func(cols []*ChangesetColumn) []*ChangesetColumn {
+			cols = append(make([]*ChangesetColumn, 0, len(cols)+len(names)), cols...)
+			for _, name := range names {
+				col := &ChangesetColumn{Column: name, Value: values[name], Type: configValueType(values[name])}
+				replaced := false
+				for i, c := range cols {
+					if c.Column == name {
+						cols[i] = col
+						replaced = true
+					}
+				}
+				if !replaced {
+					cols = append(cols, col)
+				}
+			}
+			return cols
+		}
+		transform = func(change *Changeset) *Changeset {
+			switch change.Kind {
+			case ChangesetKindTruncate:
+			case ChangesetKindDelete:
+				change.OldValues = add(change.OldValues)
+			default:
+				change.NewValues = add(change.NewValues)
+			}
+			return change
+		}
+	case StageTypeFilterKinds:
+		fields = []string{"kinds"}
+		if len(s.Kinds) == 0 {
+			return nil, errors.New("kinds is required")
+		}
+
+		kinds := make(map[ChangesetKind]bool, len(s.Kinds))
+		for _, k := range s.Kinds {
+			kind := ParseChangesetKind(k)
+			if kind == "" {
+				return nil, fmt.Errorf("'%s' is not a valid changeset kind. Must be one of `insert`, `update`, `delete`, `truncate` or `snapshot`", k)
+			}
+			kinds[kind] = true
+		}
+		transform = func(change *Changeset) *Changeset {
+			if !kinds[change.Kind] {
+				return nil
+			}
+			return change
+		}
+	case StageTypeFilterRows:
+		fields = []string{"where", "conditions"}
+		switch {
+		case s.Where != "" && len(s.Conditions) > 0:
+			return nil, errors.New("where and conditions are mutually exclusive")
+		case s.Where != "":
+			pred, err := ParsePredicate(s.Where)
+			if err != nil {
+				return nil, err
+			}
+			transform = filterRows(pred.match)
+		case len(s.Conditions) > 0:
+			matchers := make([]func(*rowEnv) bool, len(s.Conditions))
+			for i, cond := range s.Conditions {
+				match, err := cond.build()
+				if err != nil {
+					return nil, fmt.Errorf("condition %d: %w", i+1, err)
+				}
+				matchers[i] = match
+			}
+			transform = filterRows(func(env *rowEnv) bool {
+				for _, match := range matchers {
+					if !match(env) {
+						return false
+					}
+				}
+				return true
+			})
+		default:
+			return nil, errors.New("where or conditions is required")
+		}
+	default:
+		return nil, fmt.Errorf("'%s' is not a valid stage type. Must be one of `%s`, `%s`, `%s`, `%s`, `%s`, `%s` or `%s`",
+			s.Type, StageTypeDropColumns, StageTypeKeepColumns, StageTypeRenameColumns, StageTypeRenameTable,
+			StageTypeAddFields, StageTypeFilterKinds, StageTypeFilterRows)
+	}
+
+	for _, field := range s.setFields() {
+		if !containsString(fields, field) {
+			return nil, fmt.Errorf("%s is not an option of %s stages", field, s.Type)
+		}
+	}
+
+	tables := s.Tables
+	return func(change *Changeset) (*Changeset, error) {
+		if len(tables) > 0 && !MatchTable(tables, change.Schema, change.Table) {
+			return change, nil
+		}
+		return transform(change), nil
+	}, nil
+}
+
+// setFields returns the names of the type specific options that are set.
+func (s *PipelineStageConfig) setFields() []string {
+	var fields []string
+	if s.Columns != nil {
+		fields = append(fields, "columns")
+	}
+	if s.Rename != nil {
+		fields = append(fields, "rename")
+	}
+	if s.Schema != "" {
+		fields = append(fields, "schema")
+	}
+	if s.Table != "" {
+		fields = append(fields, "table")
+	}
+	if s.Fields != nil {
+		fields = append(fields, "fields")
+	}
+	if s.Kinds != nil {
+		fields = append(fields, "kinds")
+	}
+	if s.Where != "" {
+		fields = append(fields, "where")
+	}
+	if s.Conditions != nil {
+		fields = append(fields, "conditions")
+	}
+	return fields
+}
+
+// build validates the condition and returns a function matching changesets.
+func (c *RowCondition) build() (func(*rowEnv) bool, error) {
+	if c.Column == "" {
+		return nil, errors.New("column is required")
+	}
+
+	var match func(v interface{}, ok bool) bool
+	switch c.Op {
+	case "":
+		return nil, errors.New("op is required")
+	case OpNull, OpNotNull:
+		if c.Value != nil {
+			return nil, fmt.Errorf("op %s does not take a value", c.Op)
+		}
+		notNull := c.Op == OpNotNull
+		match = func(v interface{}, ok bool) bool {
+			return (ok && v != nil) == notNull
+		}
+	case OpEq, OpNe, OpLt, OpLte, OpGt, OpGte:
+		want, err := configValue(c.Value)
+		if err != nil {
+			return nil, err
+		}
+		if want == nil {
+			return nil, fmt.Errorf("op %s requires a value, use op null or not_null to match null columns", c.Op)
+		}
+
+		op := c.Op
+		match = func(v interface{}, ok bool) bool {
+			cmp, ok := compareValues(v, want)
+			if !ok {
+				return false
+			}
+			switch op {
+			case OpEq:
+				return cmp == 0
+			case OpNe:
+				return cmp != 0
+			case OpLt:
+				return cmp < 0
+			case OpLte:
+				return cmp <= 0
+			case OpGt:
+				return cmp > 0
+			default:
+				return cmp >= 0
+			}
+		}
+	case OpIn, OpNotIn:
+		list, ok := c.Value.([]interface{})
+		if !ok || len(list) == 0 {
+			return nil, fmt.Errorf("op %s requires a list of values", c.Op)
+		}
+
+		wants := make([]interface{}, len(list))
+		for i, value := range list {
+			want, err := configValue(value)
+			if err != nil {
+				return nil, err
+			}
+			if want == nil {
+				return nil, fmt.Errorf("op %s does not accept null values", c.Op)
+			}
+			wants[i] = want
+		}
+
+		in := c.Op == OpIn
+		match = func(v interface{}, ok bool) bool {
+			if v == nil {
+				return false
+			}
+			for _, want := range wants {
+				if cmp, ok := compareValues(v, want); ok && cmp == 0 {
+					return in
+				}
+			}
+			return !in
+		}
+	default:
+		return nil, fmt.Errorf("'%s' is not a valid op. Must be one of `eq`, `ne`, `lt`, `lte`, `gt`, `gte`, `in`, `not_in`, `null` or `not_null`", c.Op)
+	}
+
+	column := c.Column
+	return func(env *rowEnv) bool {
+		v, ok := env.value(env.row, column)
+		return match(v, ok)
+	}, nil
+}
+
+// configValue normalizes a scalar value decoded from a YAML or JSON pipeline
+// configuration: integers to int64 and other numbers to float64.
+func configValue(v interface{}) (interface{}, error) {
+	switch x := v.(type) {
+	case nil, string, bool, int64, float64:
+		return x, nil
+	case int:
+		return int64(x), nil
+	case uint64:
+		// YAML integers above the range of int64
+		return float64(x), nil
+	case json.Number:
+		if i, err := x.Int64(); err == nil {
+			return i, nil
+		}
+		return x.Float64()
+	case time.Time:
+		// YAML timestamps
+		return x.UTC(), nil
+	default:
+		return nil, fmt.Errorf("invalid value %v, must be a string, number, boolean or null", v)
+	}
+}
+
+// configValueType returns the Postgres type of a value added by a pipeline
+// configuration.
+func configValueType(v interface{}) string {
+	switch v.(type) {
+	case int64:
+		return "bigint"
+	case float64:
+		return "double precision"
+	case bool:
+		return "boolean"
+	case time.Time:
+		return "timestamp with time zone"
+	default:
+		return "text"
+	}
+}
+
@@ -0,0 +1,279 @@
+package warppipe
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParsePipelineConfig(t *testing.T) {
+	t.Run("yaml", func(t *testing.T) {
+		config, err := ParsePipelineConfig([]byte(`
+stages:
+  - name: drop_pii
+    type: drop_columns
+    tables: [public.users]
+    columns: [email]
+  - type: filter_rows
+    conditions:
+      - {column: age, op: gte, value: 18}
+`))
+		assert.NoError(t, err)
+		assert.Len(t, config.Stages, 2)
+		assert.Equal(t, "drop_pii", config.Stages[0].Name)
+		assert.Equal(t, []string{"public.users"}, config.Stages[0].Tables)
+		assert.Equal(t, 18, config.Stages[1].Conditions[0].Value)
+	})
+
+	t.Run("json", func(t *testing.T) {
+		config, err := ParsePipelineConfig([]byte(`{"stages": [{"type": "filter_kinds", "kinds": ["insert"]}]}`))
+		assert.NoError(t, err)
+		assert.Len(t, config.Stages, 1)
+		assert.Equal(t, []string{"insert"}, config.Stages[0].Kinds)
+	})
+
+	for _, tc := range []struct {
+		name   string
+		config string
+		err    string
+	}{
+		{
+			name:   "unknown field",
+			config: "stages:\n  - type: drop_columns\n    colums: [email]\n",
+			err:    "failed to parse pipeline config: yaml: unmarshal errors:\n  line 3: field colums not found in type warppipe.PipelineStageConfig",
+		},
+		{
+			name:   "unknown type",
+			config: "stages:\n  - type: drop\n",
+			err:    "invalid pipeline stage 1 'drop': 'drop' is not a valid stage type. Must be one of `drop_columns`, `keep_columns`, `rename_columns`, `rename_table`, `add_fields`, `filter_kinds` or `filter_rows`",
+		},
+		{
+			name:   "missing option",
+			config: "stages:\n  - type: rename_table\n",
+			err:    "invalid pipeline stage 1 'rename_table': schema or table is required",
+		},
+		{
+			name:   "option of another type",
+			config: "stages:\n  - type: drop_columns\n    columns: [email]\n    kinds: [insert]\n",
+			err:    "invalid pipeline stage 1 'drop_columns': kinds is not an option of drop_columns stages",
+		},
+		{
+			name:   "duplicate name",
+			config: "stages:\n  - type: drop_columns\n    columns: [a]\n  - type: drop_columns\n    columns: [b]\n",
+			err:    "invalid pipeline stage 2 'drop_columns': duplicate stage name, set a unique name",
+		},
+		{
+			name:   "invalid kind",
+			config: "stages:\n  - name: kinds\n    type: filter_kinds\n    kinds: [upsert]\n",
+			err:    "invalid pipeline stage 1 'kinds': 'upsert' is not a valid changeset kind. Must be one of `insert`, `update`, `delete`, `truncate` or `snapshot`",
+		},
+		{
+			name:   "invalid condition",
+			config: "stages:\n  - type: filter_rows\n    conditions:\n      - {column: age, op: in, value: 18}\n",
+			err:    "invalid pipeline stage 1 'filter_rows': condition 1: op in requires a list of values",
+		},
+		{
+			name:   "invalid where",
+			config: "stages:\n  - type: filter_rows\n    where: tenant_id = \n",
+			err:    "invalid pipeline stage 1 'filter_rows': invalid predicate: expected a column or a value, found end of expression at position 12",
+		},
+		{
+			name:   "where and conditions",
+			config: "stages:\n  - type: filter_rows\n    where: tenant_id = 42\n    conditions:\n      - {column: age, op: not_null}\n",
+			err:    "invalid pipeline stage 1 'filter_rows': where and conditions are mutually exclusive",
+		},
+		{
+			name:   "invalid error action",
+			config: "stages:\n  - type: filter_kinds\n    kinds: [insert]\n    on_error: ignore\n",
+			err:    "invalid pipeline stage 1 'filter_kinds': 'ignore' is not a valid error action. Must be one of `fail`, `skip` or `dead_letter`",
+		},
+		{
+			name:   "negative retries",
+			config: "stages:\n  - type: filter_kinds\n    kinds: [insert]\n    retries: -1\n",
+			err:    "invalid pipeline stage 1 'filter_kinds': retries must not be negative",
+		},
+		{
+			name:   "invalid field value",
+			config: "stages:\n  - type: add_fields\n    fields:\n      meta: {a: 1}\n",
+			err:    "invalid pipeline stage 1 'add_fields': field 'meta': invalid value map[a:1], must be a string, number, boolean or null",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := ParsePipelineConfig([]byte(tc.config))
+			assert.EqualError(t, err, tc.err)
+		})
+	}
+}
+
+func TestPipelineConfigDeadLetters(t *testing.T) {
+	config, err := ParsePipelineConfig([]byte(`
+stages:
+  - type: filter_kinds
+    kinds: [insert]
+  - type: drop_columns
+    columns: [email]
+    on_error: dead_letter
+    retries: 3
+`))
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	err = config.AddStages(NewPipeline(), nil)
+	assert.EqualError(t, err, "invalid pipeline stage 2 'drop_columns': on_error dead_letter requires a dead letter store")
+
+	stages, err := config.stages(&memoryDeadLetterStore{})
+	if assert.NoError(t, err) {
+		assert.Empty(t, stages[0].opts)
+		cfg := newStageConfig(stages[1].opts)
+		assert.Equal(t, ErrorActionDeadLetter, cfg.errorAction)
+		assert.Equal(t, 3, cfg.retry.MaxRetries)
+	}
+}
+
+func TestPipelineConfigStages(t *testing.T) {
+	config, err := ParsePipelineConfig([]byte(`
+stages:
+  - type: filter_kinds
+    kinds: [insert, update, delete]
+  - type: filter_rows
+    tables: [users]
+    conditions:
+      - {column: age, op: gte, value: 18}
+      - {column: status, op: in, value: [active, pending]}
+      - {column: deleted_at, op: "null"}
+  - type: drop_columns
+    columns: [email]
+  - type: rename_columns
+    rename: {name: full_name}
+  - type: add_fields
+    fields: {source: crm, version: 2}
+  - type: rename_table
+    tables: [public.users]
+    schema: crm
+    table: customers
+`))
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	p := NewPipeline()
+	assert.NoError(t, config.AddStages(p, nil))
+
+	acks := &ackCounter{acked: make(map[int64]bool)}
+	user := func(id int64, kind ChangesetKind, age int64, status string) *Changeset {
+		change := acks.changeset(id, kind, "users")
+		cols := []*ChangesetColumn{
+			{Column: "id", Value: id, Type: "bigint"},
+			{Column: "name", Value: "Jane", Type: "text"},
+			{Column: "email", Value: "jane@example.com", Type: "text"},
+			{Column: "age", Value: age, Type: "integer"},
+			{Column: "status", Value: status, Type: "text"},
+			{Column: "deleted_at", Value: nil, Type: "timestamp with time zone"},
+		}
+		if kind == ChangesetKindDelete {
+			change.OldValues = cols
+		} else {
+			change.NewValues = cols
+		}
+		return change
+	}
+
+	sourceCh := make(chan *Changeset, 6)
+	sourceCh <- user(1, ChangesetKindInsert, 30, "active")
+	sourceCh <- user(2, ChangesetKindInsert, 12, "active")
+	sourceCh <- user(3, ChangesetKindUpdate, 40, "banned")
+	sourceCh <- user(4, ChangesetKindDelete, 50, "pending")
+	sourceCh <- user(5, ChangesetKindSnapshot, 30, "active")
+	sourceCh <- acks.changeset(6, ChangesetKindInsert, "posts")
+	close(sourceCh)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	outCh, _ := p.Start(ctx, sourceCh)
+	var out []*Changeset
+	for change := range outCh {
+		out = append(out, change)
+	}
+
+	if !assert.Len(t, out, 3) {
+		return
+	}
+	assert.Equal(t, int64(1), out[0].ID)
+	assert.Equal(t, "crm", out[0].Schema)
+	assert.Equal(t, "customers", out[0].Table)
+	assert.Equal(t, []*ChangesetColumn{
+		{Column: "id", Value: int64(1), Type: "bigint"},
+		{Column: "full_name", Value: "Jane", Type: "text"},
+		{Column: "age", Value: int64(30), Type: "integer"},
+		{Column: "status", Value: "active", Type: "text"},
+		{Column: "deleted_at", Value: nil, Type: "timestamp with time zone"},
+		{Column: "source", Value: "crm", Type: "text"},
+		{Column: "version", Value: int64(2), Type: "bigint"},
+	}, out[0].NewValues)
+
+	assert.Equal(t, int64(4), out[1].ID)
+	assert.Nil(t, out[1].NewValues)
+	assert.Len(t, out[1].OldValues, 7)
+
+	assert.Equal(t, int64(6), out[2].ID)
+	assert.Equal(t, "posts", out[2].Table)
+	assert.Equal(t, []*ChangesetColumn{
+		{Column: "source", Value: "crm", Type: "text"},
+		{Column: "version", Value: int64(2), Type: "bigint"},
+	}, out[2].NewValues)
+
+	// filtered changesets are acknowledged, including updates without the
+	// old values of the filtered columns, which are not known to have
+	// moved out of the filter
+	for _, id := range []int64{2, 3, 5} {
+		assert.True(t, acks.isAcked(id))
+	}
+}
+
+func TestPipelineConfigSharedColumns(t *testing.T) {
+	config, err := ParsePipelineConfig([]byte(`
+stages:
+  - type: rename_columns
+    rename: {name: full_name, full_name: display_name}
+  - type: add_fields
+    fields: {source: crm}
+`))
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	stages, err := config.build()
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	// the new and old values share their columns and slice
+	id := &ChangesetColumn{Column: "id", Value: int64(1)}
+	name := &ChangesetColumn{Column: "name", Value: "Jane"}
+	cols := make([]*ChangesetColumn, 2, 3)
+	cols[0], cols[1] = id, name
+	change := &Changeset{Kind: ChangesetKindUpdate, NewValues: cols, OldValues: cols}
+
+	for _, s := range stages {
+		change, err = s.fn(change)
+		if !assert.NoError(t, err) {
+			return
+		}
+	}
+
+	assert.Equal(t, []*ChangesetColumn{
+		{Column: "id", Value: int64(1)},
+		{Column: "full_name", Value: "Jane"},
+		{Column: "source", Value: "crm", Type: "text"},
+	}, change.NewValues)
+	assert.Equal(t, []*ChangesetColumn{
+		{Column: "id", Value: int64(1)},
+		{Column: "full_name", Value: "Jane"},
+	}, change.OldValues)
+	assert.Equal(t, "name", name.Column)
+	assert.Equal(t, []*ChangesetColumn{id, name}, cols)
+}
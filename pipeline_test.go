@@ -2,7 +2,9 @@ package warppipe
 
 import (
 	"context"
+	"errors"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -98,3 +100,486 @@ func TestPipeline(t *testing.T) {
 	assert.Equal(t, 1, len(results[0].NewValues))
 	assert.Equal(t, "USERS", results[0].Table)
 }
+
+func TestPipelineReplacedChangesetAck(t *testing.T) {
+	p := NewPipeline()
+
+	p.AddStage("copy", func(change *Changeset) (*Changeset, error) {
+		return &Changeset{ID: change.ID, Table: strings.ToUpper(change.Table)}, nil
+	})
+
+	acks := &ackCounter{acked: make(map[int64]bool)}
+	sourceCh := make(chan *Changeset, 1)
+	sourceCh <- acks.changeset(1, ChangesetKindInsert, "users")
+	close(sourceCh)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	outCh, _ := p.Start(ctx, sourceCh)
+
+	change := <-outCh
+	assert.Equal(t, "USERS", change.Table)
+	assert.False(t, acks.isAcked(1))
+
+	// acknowledging the copy acknowledges the original
+	change.Ack()
+	assert.True(t, acks.isAcked(1))
+}
+
+func TestPipelineAutoAck(t *testing.T) {
+	p := NewPipeline()
+	p.autoAck = true
+
+	acks := &ackCounter{acked: make(map[int64]bool)}
+	sourceCh := make(chan *Changeset, 1)
+	sourceCh <- acks.changeset(1, ChangesetKindInsert, "users")
+	close(sourceCh)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	outCh, _ := p.Start(ctx, sourceCh)
+
+	assert.False(t, acks.isAcked(1))
+	<-outCh
+	assert.Eventually(t, func() bool { return acks.isAcked(1) }, time.Second, time.Millisecond)
+}
+
+func TestPipelineParallelStage(t *testing.T) {
+	p := NewPipeline()
+
+	p.AddStage("slow_lookup", func(change *Changeset) (*Changeset, error) {
+		if change.ID%2 == 0 {
+			time.Sleep(time.Millisecond)
+		}
+		return change, nil
+	}, Parallelism(4), KeyColumns("id"))
+
+	sourceCh := make(chan *Changeset)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	outCh, _ := p.Start(ctx, sourceCh)
+
+	go func() {
+		for i := 0; i < 100; i++ {
+			sourceCh <- &Changeset{
+				ID:        int64(i),
+				Schema:    "public",
+				Table:     "users",
+				NewValues: []*ChangesetColumn{{Column: "id", Value: int64(i % 10)}},
+			}
+		}
+	}()
+
+	last := make(map[interface{}]int64)
+	for i := 0; i < 100; i++ {
+		change := <-outCh
+		key, _ := change.GetNewColumnValue("id")
+		if prev, ok := last[key]; ok {
+			assert.Less(t, prev, change.ID, "changesets of row %v reordered", key)
+		}
+		last[key] = change.ID
+	}
+	assert.Len(t, last, 10)
+}
+
+func TestPipelineBatchStage(t *testing.T) {
+	p := NewPipeline()
+
+	var batches [][]int64
+	p.AddBatchStage("drop_odd", func(batch []*Changeset) ([]*Changeset, error) {
+		var ids []int64
+		var out []*Changeset
+		for _, change := range batch {
+			ids = append(ids, change.ID)
+			if change.ID%2 == 0 {
+				out = append(out, change)
+			}
+		}
+		batches = append(batches, ids)
+		return out, nil
+	}, MaxBatchSize(3), BatchInterval(50*time.Millisecond))
+
+	sourceCh := make(chan *Changeset)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	outCh, _ := p.Start(ctx, sourceCh)
+
+	acked := make(chan int64, 10)
+	go func() {
+		for i := int64(0); i < 5; i++ {
+			id := i
+			sourceCh <- &Changeset{ID: id, ack: func() { acked <- id }}
+		}
+	}()
+
+	var ids []int64
+	for i := 0; i < 3; i++ {
+		ids = append(ids, (<-outCh).ID)
+	}
+	assert.Equal(t, []int64{0, 2, 4}, ids)
+	// the last batch is only flushed after the interval
+	assert.Equal(t, [][]int64{{0, 1, 2}, {3, 4}}, batches)
+	assert.ElementsMatch(t, []int64{1, 3}, []int64{<-acked, <-acked})
+}
+
+func TestPipelineBatchStageReplacedAck(t *testing.T) {
+	p := NewPipeline()
+
+	// merges each batch into a single changeset
+	p.AddBatchStage("merge", func(batch []*Changeset) ([]*Changeset, error) {
+		return []*Changeset{{ID: batch[len(batch)-1].ID, Table: "merged"}}, nil
+	}, MaxBatchSize(2))
+
+	acks := &ackCounter{acked: make(map[int64]bool)}
+	sourceCh := make(chan *Changeset, 2)
+	sourceCh <- acks.changeset(1, ChangesetKindInsert, "users")
+	sourceCh <- acks.changeset(2, ChangesetKindInsert, "users")
+	close(sourceCh)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	outCh, _ := p.Start(ctx, sourceCh)
+
+	change := <-outCh
+	assert.Equal(t, "merged", change.Table)
+	assert.False(t, acks.isAcked(1))
+	assert.False(t, acks.isAcked(2))
+
+	// the merged changesets are acknowledged with the changeset replacing them
+	change.Ack()
+	assert.True(t, acks.isAcked(1))
+	assert.True(t, acks.isAcked(2))
+}
+
+type memoryDeadLetterStore struct {
+	letters []*DeadLetter
+}
+
+func (s *memoryDeadLetterStore) Save(ctx context.Context, letter *DeadLetter) error {
+	letter.ID = int64(len(s.letters) + 1)
+	s.letters = append(s.letters, letter)
+	return nil
+}
+
+func (s *memoryDeadLetterStore) Load(ctx context.Context) ([]*DeadLetter, error) {
+	return append([]*DeadLetter(nil), s.letters...), nil
+}
+
+func (s *memoryDeadLetterStore) Delete(ctx context.Context, id int64) error {
+	for i, letter := range s.letters {
+		if letter.ID == id {
+			s.letters = append(s.letters[:i], s.letters[i+1:]...)
+			break
+		}
+	}
+	return nil
+}
+
+func TestPipelineErrorPolicies(t *testing.T) {
+	errBoom := errors.New("boom")
+	failOdd := func(change *Changeset) (*Changeset, error) {
+		change.Table = "modified"
+		if change.ID%2 == 1 {
+			return nil, errBoom
+		}
+		return change, nil
+	}
+
+	run := func(t *testing.T, opts ...StageOption) ([]int64, []error, map[int64]bool) {
+		p := NewPipeline()
+		p.AddStage("fail_odd", failOdd, opts...)
+
+		sourceCh := make(chan *Changeset)
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		outCh, errCh := p.Start(ctx, sourceCh)
+
+		acked := make(map[int64]bool)
+		var mu sync.Mutex
+		go func() {
+			for i := int64(0); i < 4; i++ {
+				id := i
+				select {
+				case sourceCh <- &Changeset{ID: id, Table: "users", ack: func() {
+					mu.Lock()
+					defer mu.Unlock()
+					acked[id] = true
+				}}:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+
+		var ids []int64
+		var errs []error
+		timeout := time.After(200 * time.Millisecond)
+		for {
+			select {
+			case change, ok := <-outCh:
+				if !ok {
+					// the pipeline has stopped
+					outCh = nil
+					continue
+				}
+				ids = append(ids, change.ID)
+				change.Ack()
+			case err := <-errCh:
+				errs = append(errs, err)
+			case <-timeout:
+				mu.Lock()
+				defer mu.Unlock()
+				return ids, errs, acked
+			}
+		}
+	}
+
+	t.Run("fail", func(t *testing.T) {
+		ids, errs, acked := run(t, FailOnError())
+		assert.Equal(t, []int64{0}, ids)
+		assert.Len(t, errs, 1)
+		assert.EqualError(t, errs[0], "stage 'fail_odd' failed: boom")
+		assert.True(t, errs[0].(*StageError).Fatal())
+		assert.True(t, errors.Is(errs[0], errBoom))
+		assert.False(t, acked[1])
+	})
+
+	t.Run("skip by default", func(t *testing.T) {
+		ids, errs, acked := run(t)
+		assert.Equal(t, []int64{0, 2}, ids)
+		assert.Len(t, errs, 2)
+		assert.EqualError(t, errs[0], "stage 'fail_odd' failed, skipped 1 changeset(s): boom")
+		assert.False(t, errs[0].(*StageError).Fatal())
+		assert.Equal(t, map[int64]bool{0: true, 1: true, 2: true, 3: true}, acked)
+	})
+
+	t.Run("retry then dead letter", func(t *testing.T) {
+		store := &memoryDeadLetterStore{}
+		ids, errs, acked := run(t,
+			RetryOnError(Backoff{InitialInterval: time.Millisecond, MaxRetries: 2}),
+			DeadLetterOnError(store),
+		)
+		assert.Equal(t, []int64{0, 2}, ids)
+		assert.Len(t, errs, 2)
+		assert.EqualError(t, errs[1], "stage 'fail_odd' failed, sent 1 changeset(s) to the dead letter store: boom")
+		assert.Equal(t, map[int64]bool{0: true, 1: true, 2: true, 3: true}, acked)
+
+		assert.Len(t, store.letters, 2)
+		assert.Equal(t, "fail_odd", store.letters[0].Stage)
+		assert.Equal(t, "boom", store.letters[0].Error)
+		assert.Equal(t, int64(1), store.letters[0].Changeset.ID)
+		// saved as passed to the stage
+		assert.Equal(t, "users", store.letters[0].Changeset.Table)
+	})
+
+	t.Run("retry succeeds", func(t *testing.T) {
+		attempts := 0
+		p := NewPipeline()
+		p.AddStage("flaky", func(change *Changeset) (*Changeset, error) {
+			attempts++
+			if attempts < 3 {
+				return nil, errBoom
+			}
+			return change, nil
+		}, RetryOnError(Backoff{InitialInterval: time.Millisecond, MaxRetries: 5}))
+
+		sourceCh := make(chan *Changeset)
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		outCh, _ := p.Start(ctx, sourceCh)
+
+		sourceCh <- &Changeset{ID: 7}
+		assert.Equal(t, int64(7), (<-outCh).ID)
+		assert.Equal(t, 3, attempts)
+	})
+}
+
+func TestPipelineReplayDeadLetters(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	store := &memoryDeadLetterStore{}
+	for _, letter := range []*DeadLetter{
+		{Stage: "b", Changeset: &Changeset{ID: 1, Table: "users"}},
+		{Stage: "removed", Changeset: &Changeset{ID: 2, Table: "users"}},
+	} {
+		assert.NoError(t, store.Save(ctx, letter))
+	}
+
+	suffix := func(s string) StageFunc {
+		return func(change *Changeset) (*Changeset, error) {
+			change.Table += "_" + s
+			return change, nil
+		}
+	}
+	p := NewPipeline()
+	p.AddBatchStage("a", func(batch []*Changeset) ([]*Changeset, error) {
+		for _, change := range batch {
+			change.Table += "_a"
+		}
+		return batch, nil
+	}, BatchInterval(time.Millisecond))
+	p.AddStage("b", suffix("b"))
+	p.AddStage("c", suffix("c"), Parallelism(2))
+
+	letters, err := ReplayDeadLetters(ctx, store)
+	if !assert.NoError(t, err) {
+		return
+	}
+	outCh, errCh := p.Start(ctx, letters)
+
+	// replayed from the stage it failed in
+	change := <-outCh
+	assert.Equal(t, int64(1), change.ID)
+	assert.Equal(t, "users_b_c", change.Table)
+	change.Ack()
+
+	assert.EqualError(t, <-errCh, "failed to replay changeset 2: stage 'removed' not found in the pipeline")
+	_, ok := <-outCh
+	assert.False(t, ok)
+
+	remaining, err := store.Load(ctx)
+	assert.NoError(t, err)
+	if assert.Len(t, remaining, 1) {
+		assert.Equal(t, int64(2), remaining[0].ID)
+	}
+}
+
+func TestPipelineSourceClosed(t *testing.T) {
+	p := NewPipeline()
+	p.AddStage("table", func(change *Changeset) (*Changeset, error) {
+		// panics on nil changesets
+		change.Table = "users"
+		return change, nil
+	}, Parallelism(2))
+	p.AddBatchStage("batch", func(batch []*Changeset) ([]*Changeset, error) {
+		return batch, nil
+	}, BatchInterval(time.Hour))
+
+	sourceCh := make(chan *Changeset)
+	outCh, _ := p.Start(context.Background(), sourceCh)
+
+	go func() {
+		for i := int64(0); i < 3; i++ {
+			sourceCh <- &Changeset{ID: i}
+		}
+		close(sourceCh)
+	}()
+
+	// the last batch is processed when the source is closed
+	var ids []int64
+	for change := range outCh {
+		ids = append(ids, change.ID)
+	}
+	assert.ElementsMatch(t, []int64{0, 1, 2}, ids)
+	assert.NoError(t, p.Wait())
+}
+
+func TestPipelineShutdown(t *testing.T) {
+	t.Run("drain", func(t *testing.T) {
+		release := make(chan struct{})
+		p := NewPipeline()
+		p.AddStage("slow", func(change *Changeset) (*Changeset, error) {
+			<-release
+			return change, nil
+		})
+
+		sourceCh := make(chan *Changeset)
+		outCh, _ := p.Start(context.Background(), sourceCh)
+		sourceCh <- &Changeset{ID: 1}
+
+		shutdownErr := make(chan error)
+		go func() {
+			shutdownErr <- p.Shutdown(context.Background())
+		}()
+
+		// the changeset in flight is delivered, then the channel is closed
+		close(release)
+		assert.Equal(t, int64(1), (<-outCh).ID)
+		_, ok := <-outCh
+		assert.False(t, ok)
+		assert.NoError(t, <-shutdownErr)
+
+		// no more changesets are read from the source
+		select {
+		case sourceCh <- &Changeset{ID: 2}:
+			t.Error("changeset read after shutdown")
+		case <-time.After(10 * time.Millisecond):
+		}
+	})
+
+	t.Run("timeout", func(t *testing.T) {
+		p := NewPipeline()
+		p.AddStage("passthrough", func(change *Changeset) (*Changeset, error) {
+			return change, nil
+		})
+
+		sourceCh := make(chan *Changeset)
+		outCh, _ := p.Start(context.Background(), sourceCh)
+		sourceCh <- &Changeset{ID: 1}
+
+		// the output is never read
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		defer cancel()
+		assert.Equal(t, context.DeadlineExceeded, p.Shutdown(ctx))
+		_, ok := <-outCh
+		assert.False(t, ok)
+	})
+}
+
+func TestPipelineWait(t *testing.T) {
+	p := NewPipeline()
+	p.AddStage("fail", func(change *Changeset) (*Changeset, error) {
+		return nil, errors.New("boom")
+	}, FailOnError())
+	p.AddStage("never_called", func(change *Changeset) (*Changeset, error) {
+		t.Error("stage called after a fatal error")
+		return change, nil
+	})
+
+	sourceCh := make(chan *Changeset)
+	outCh, errCh := p.Start(context.Background(), sourceCh)
+	sourceCh <- &Changeset{ID: 1}
+
+	assert.EqualError(t, <-errCh, "stage 'fail' failed: boom")
+	_, ok := <-outCh
+	assert.False(t, ok)
+	assert.EqualError(t, p.Wait(), "stage 'fail' failed: boom")
+}
+
+func TestPipelineWaitParallel(t *testing.T) {
+	p := NewPipeline()
+	p.AddStage("fail_users", func(change *Changeset) (*Changeset, error) {
+		if change.Table == "users" {
+			return nil, errors.New("boom")
+		}
+		return change, nil
+	}, Parallelism(2), FailOnError())
+
+	sourceCh := make(chan *Changeset)
+	outCh, errCh := p.Start(context.Background(), sourceCh)
+	go func() {
+		for i := int64(1); ; i++ {
+			select {
+			case sourceCh <- &Changeset{ID: i, Table: "users"}:
+			case <-p.done:
+				return
+			}
+		}
+	}()
+	go func() {
+		for range outCh {
+		}
+	}()
+
+	assert.EqualError(t, <-errCh, "stage 'fail_users' failed: boom")
+
+	waitErr := make(chan error, 1)
+	go func() { waitErr <- p.Wait() }()
+	select {
+	case err := <-waitErr:
+		assert.EqualError(t, err, "stage 'fail_users' failed: boom")
+	case <-time.After(time.Second):
+		t.Fatal("the pipeline did not stop after a fatal error in a parallel stage")
+	}
+}
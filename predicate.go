@@ -0,0 +1,867 @@
+package warppipe
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// Predicate is a condition on the rows of changesets, in a small language
+// modeled on SQL WHERE clauses, e.g.
+//
+//     tenant_id = 42 AND status IN ('active', 'pending')
+//
+// It supports:
+//     comparisons: =, != (or <>), <, <=, >, >=
+//     lists:       [NOT] IN (value, ...)
+//     patterns:    [NOT] LIKE 'pattern', with the % and _ wildcards
+//     nulls:       IS [NOT] NULL
+//     logic:       AND, OR, NOT and parentheses
+// Operands are columns, string literals ('it''s'), numbers, TRUE, FALSE and
+// NULL, and keywords are case insensitive. Columns may be double quoted
+// ("Name"), and qualified with new. or old. to refer to the new or old values
+// of the changeset, e.g. `old.status <> new.status`; unqualified columns refer
+// to the row being matched. As in SQL, comparisons with null (or missing)
+// columns are unknown, and a row only matches if the predicate is true.
+type Predicate struct {
+	expr string
+	root predicateNode
+}
+
+// ParsePredicate parses a predicate expression.
+func ParsePredicate(expr string) (*Predicate, error) {
+	tokens, err := lexPredicate(expr)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &predicateParser{tokens: tokens}
+	root, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if tok := p.peek(); tok.kind != tokenEOF {
+		return nil, p.unexpected(tok, "AND, OR or the end of the expression")
+	}
+
+	return &Predicate{expr: expr, root: root}, nil
+}
+
+// String returns the expression of the predicate.
+func (p *Predicate) String() string {
+	return p.expr
+}
+
+// Match returns true if the row of a changeset matches the predicate: its new
+// values, or its old values for deletes.
+func (p *Predicate) Match(change *Changeset) bool {
+	env := &rowEnv{row: change.NewValues, new: change.NewValues, old: change.OldValues}
+	if change.Kind == ChangesetKindDelete {
+		env.row = change.OldValues
+	}
+	return p.match(env)
+}
+
+func (p *Predicate) match(env *rowEnv) bool {
+	return p.root.eval(env) == triTrue
+}
+
+// FilterRows returns a StageFunc that only keeps the changesets whose rows
+// match a predicate (see ParsePredicate). Inserts and snapshots are matched on
+// their new values, and deletes on their old values. Updates are matched on
+// both, so that a row moving into the filter is emitted as an insert, and a
+// row moving out of it as a delete, which keeps replicas of the filtered rows
+// correct. Truncates are kept.
+//
+// Unless the table's REPLICA IDENTITY is FULL, the old values only hold the
+// replica identity. When the predicate does not match old values that are
+// missing columns it uses, whether the row was in the filter is unknown: such
+// deletes are kept, and such updates are kept if the row matches, and dropped
+// otherwise, since a delete is only emitted for a row known to have moved out
+// of the filter. Tables filtered on other columns should use REPLICA IDENTITY
+// FULL, so that rows moving out of the filter are deleted. When matching the
+// new values, explicit old.<column> references fall back to the new values of
+// the columns missing from the old values.
+func FilterRows(where string) (StageFunc, error) {
+	pred, err := ParsePredicate(where)
+	if err != nil {
+		return nil, err
+	}
+
+	filter := filterRows(pred.match)
+	return func(change *Changeset) (*Changeset, error) {
+		return filter(change), nil
+	}, nil
+}
+
+// rowEnv is a row image a predicate is evaluated against, with the new and
+// old values of its changeset. missing is set when the predicate uses a
+// column that is not in the image.
+type rowEnv struct {
+	row     []*ChangesetColumn
+	new     []*ChangesetColumn
+	old     []*ChangesetColumn
+	missing bool
+}
+
+// value returns the value of a column of cols, recording missing columns.
+func (env *rowEnv) value(cols []*ChangesetColumn, column string) (interface{}, bool) {
+	v, ok := columnValue(cols, column)
+	if !ok {
+		env.missing = true
+	}
+	return v, ok
+}
+
+// filterRows returns a function applying a row filter to changesets, see
+// FilterRows(). It returns nil for changesets to drop.
+func filterRows(match func(*rowEnv) bool) func(*Changeset) *Changeset {
+	return func(change *Changeset) *Changeset {
+		switch change.Kind {
+		case ChangesetKindTruncate:
+			return change
+		case ChangesetKindDelete:
+			// keep deletes of rows that may have matched
+			env := &rowEnv{row: change.OldValues, old: change.OldValues}
+			if match(env) || env.missing {
+				return change
+			}
+			return nil
+		case ChangesetKindUpdate:
+			// the old image is only matched on the columns it has, so that a
+			// row is known to have been in the filter
+			oldEnv := &rowEnv{row: change.OldValues, new: change.NewValues, old: change.OldValues}
+			wasIn := match(oldEnv) && !oldEnv.missing
+			mayHaveBeenIn := wasIn || oldEnv.missing
+			old := completeOldValues(change.OldValues, change.NewValues)
+			isIn := match(&rowEnv{row: change.NewValues, new: change.NewValues, old: old})
+
+			switch {
+			case mayHaveBeenIn && isIn:
+				return change
+			case isIn:
+				// the row moved into the filter
+				change.Kind = ChangesetKindInsert
+				change.OldValues = nil
+				return change
+			case wasIn:
+				// the row moved out of the filter
+				change.Kind = ChangesetKindDelete
+				change.NewValues = nil
+				return change
+			}
+			return nil
+		default:
+			if match(&rowEnv{row: change.NewValues, new: change.NewValues}) {
+				return change
+			}
+			return nil
+		}
+	}
+}
+
+// completeOldValues returns the old values of an update, followed by the new
+// values of the columns they are missing. It is only used to evaluate
+// predicates, and never replaces the old values of a changeset.
+func completeOldValues(old, new []*ChangesetColumn) []*ChangesetColumn {
+	cols := make([]*ChangesetColumn, len(old), len(old)+len(new))
+	copy(cols, old)
+	for _, col := range new {
+		if _, ok := columnValue(old, col.Column); !ok {
+			cols = append(cols, col)
+		}
+	}
+	return cols
+}
+
+func columnValue(cols []*ChangesetColumn, column string) (interface{}, bool) {
+	for _, col := range cols {
+		if col.Column == column {
+			return col.Value, true
+		}
+	}
+	return nil, false
+}
+
+// tribool is the result of a predicate in SQL's three-valued logic.
+type tribool int
+
+const (
+	triFalse tribool = iota
+	triTrue
+	triUnknown
+)
+
+func toTribool(b bool) tribool {
+	if b {
+		return triTrue
+	}
+	return triFalse
+}
+
+func (t tribool) not() tribool {
+	switch t {
+	case triTrue:
+		return triFalse
+	case triFalse:
+		return triTrue
+	}
+	return triUnknown
+}
+
+type predicateNode interface {
+	eval(env *rowEnv) tribool
+}
+
+type andNode struct {
+	left, right predicateNode
+}
+
+func (n *andNode) eval(env *rowEnv) tribool {
+	l := n.left.eval(env)
+	if l == triFalse {
+		return triFalse
+	}
+	r := n.right.eval(env)
+	if r == triFalse {
+		return triFalse
+	}
+	if l == triUnknown || r == triUnknown {
+		return triUnknown
+	}
+	return triTrue
+}
+
+type orNode struct {
+	left, right predicateNode
+}
+
+func (n *orNode) eval(env *rowEnv) tribool {
+	l := n.left.eval(env)
+	if l == triTrue {
+		return triTrue
+	}
+	r := n.right.eval(env)
+	if r == triTrue {
+		return triTrue
+	}
+	if l == triUnknown || r == triUnknown {
+		return triUnknown
+	}
+	return triFalse
+}
+
+type notNode struct {
+	node predicateNode
+}
+
+func (n *notNode) eval(env *rowEnv) tribool {
+	return n.node.eval(env).not()
+}
+
+type compareNode struct {
+	op          string
+	left, right operand
+}
+
+func (n *compareNode) eval(env *rowEnv) tribool {
+	cmp, ok := compareValues(n.left.value(env), n.right.value(env))
+	if !ok {
+		return triUnknown
+	}
+
+	switch n.op {
+	case "=":
+		return toTribool(cmp == 0)
+	case "!=", "<>":
+		return toTribool(cmp != 0)
+	case "<":
+		return toTribool(cmp < 0)
+	case "<=":
+		return toTribool(cmp <= 0)
+	case ">":
+		return toTribool(cmp > 0)
+	default:
+		return toTribool(cmp >= 0)
+	}
+}
+
+type inNode struct {
+	operand operand
+	list    []operand
+}
+
+func (n *inNode) eval(env *rowEnv) tribool {
+	v := n.operand.value(env)
+	result := triFalse
+	for _, item := range n.list {
+		cmp, ok := compareValues(v, item.value(env))
+		if !ok {
+			result = triUnknown
+			continue
+		}
+		if cmp == 0 {
+			return triTrue
+		}
+	}
+	return result
+}
+
+type likeNode struct {
+	operand operand
+	pattern *regexp.Regexp
+}
+
+func (n *likeNode) eval(env *rowEnv) tribool {
+	v := n.operand.value(env)
+	if v == nil {
+		return triUnknown
+	}
+	return toTribool(n.pattern.MatchString(toString(v)))
+}
+
+type nullNode struct {
+	operand operand
+}
+
+func (n *nullNode) eval(env *rowEnv) tribool {
+	return toTribool(n.operand.value(env) == nil)
+}
+
+// boolNode is a boolean operand used as a condition, e.g. `active`.
+type boolNode struct {
+	operand operand
+}
+
+func (n *boolNode) eval(env *rowEnv) tribool {
+	b, ok := n.operand.value(env).(bool)
+	if !ok {
+		return triUnknown
+	}
+	return toTribool(b)
+}
+
+type operand interface {
+	value(env *rowEnv) interface{}
+}
+
+type literal struct {
+	v interface{}
+}
+
+func (l *literal) value(*rowEnv) interface{} {
+	return l.v
+}
+
+// Row images a column refers to.
+const (
+	imageRow = iota
+	imageNew
+	imageOld
+)
+
+type columnRef struct {
+	name  string
+	image int
+}
+
+func (c *columnRef) value(env *rowEnv) interface{} {
+	cols := env.row
+	switch c.image {
+	case imageNew:
+		cols = env.new
+	case imageOld:
+		cols = env.old
+	}
+
+	v, _ := env.value(cols, c.name)
+	return v
+}
+
+type tokenKind int
+
+const (
+	tokenEOF tokenKind = iota
+	tokenIdent
+	tokenQuotedIdent
+	tokenString
+	tokenNumber
+	tokenOp
+	tokenLParen
+	tokenRParen
+	tokenComma
+	tokenDot
+)
+
+type token struct {
+	kind tokenKind
+	text string
+	pos  int
+}
+
+// lexPredicate splits a predicate expression into tokens.
+func lexPredicate(expr string) ([]token, error) {
+	var tokens []token
+	runes := []rune(expr)
+	for i := 0; i < len(runes); {
+		r := runes[i]
+		start := i
+
+		switch {
+		case unicode.IsSpace(r):
+			i++
+			continue
+		case r == '_' || unicode.IsLetter(r):
+			for i < len(runes) && (runes[i] == '_' || unicode.IsLetter(runes[i]) || unicode.IsDigit(runes[i])) {
+				i++
+			}
+			tokens = append(tokens, token{kind: tokenIdent, text: string(runes[start:i]), pos: start})
+		case unicode.IsDigit(r):
+			for i < len(runes) && (unicode.IsDigit(runes[i]) || runes[i] == '.') {
+				i++
+			}
+			if i < len(runes) && (runes[i] == 'e' || runes[i] == 'E') {
+				i++
+				if i < len(runes) && (runes[i] == '+' || runes[i] == '-') {
+					i++
+				}
+				for i < len(runes) && unicode.IsDigit(runes[i]) {
+					i++
+				}
+			}
+			tokens = append(tokens, token{kind: tokenNumber, text: string(runes[start:i]), pos: start})
+		case r == '\'' || r == '"':
+			// quotes are escaped by doubling them
+			var sb strings.Builder
+			closed := false
+			for i++; i < len(runes); i++ {
+				if runes[i] == r {
+					if i+1 < len(runes) && runes[i+1] == r {
+						sb.WriteRune(r)
+						i++
+						continue
+					}
+					closed = true
+					i++
+					break
+				}
+				sb.WriteRune(runes[i])
+			}
+			if !closed {
+				return nil, fmt.Errorf("invalid predicate: unterminated %c at position %d", r, start+1)
+			}
+
+			kind := tokenString
+			if r == '"' {
+				kind = tokenQuotedIdent
+			}
+			tokens = append(tokens, token{kind: kind, text: sb.String(), pos: start})
+		case r == '(' || r == ')' || r == ',' || r == '.':
+			i++
+			kind := map[rune]tokenKind{'(': tokenLParen, ')': tokenRParen, ',': tokenComma, '.': tokenDot}[r]
+			tokens = append(tokens, token{kind: kind, text: string(r), pos: start})
+		case strings.ContainsRune("=!<>-", r):
+			i++
+			if i < len(runes) {
+				if op := string(runes[start : i+1]); op == "!=" || op == "<>" || op == "<=" || op == ">=" {
+					i++
+				}
+			}
+			op := string(runes[start:i])
+			if op == "!" {
+				return nil, fmt.Errorf("invalid predicate: unexpected '!' at position %d", start+1)
+			}
+			tokens = append(tokens, token{kind: tokenOp, text: op, pos: start})
+		default:
+			return nil, fmt.Errorf("invalid predicate: unexpected '%c' at position %d", r, start+1)
+		}
+	}
+	return append(tokens, token{kind: tokenEOF, pos: len(runes)}), nil
+}
+
+// flippedOps are the comparison operators with swapped operands.
+var flippedOps = map[string]string{"<": ">", "<=": ">=", ">": "<", ">=": "<="}
+
+var predicateKeywords = []string{"AND", "OR", "NOT", "IN", "IS", "LIKE", "NULL", "TRUE", "FALSE"}
+
+// predicateParser is a recursive descent parser of predicate expressions.
+type predicateParser struct {
+	tokens []token
+	pos    int
+}
+
+func (p *predicateParser) peek() token {
+	return p.tokens[p.pos]
+}
+
+func (p *predicateParser) next() token {
+	tok := p.tokens[p.pos]
+	if tok.kind != tokenEOF {
+		p.pos++
+	}
+	return tok
+}
+
+// keyword consumes the next token if it is the given keyword.
+func (p *predicateParser) keyword(kw string) bool {
+	if isKeyword(p.peek(), kw) {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func isKeyword(tok token, kw string) bool {
+	return tok.kind == tokenIdent && strings.EqualFold(tok.text, kw)
+}
+
+func (p *predicateParser) unexpected(tok token, expected string) error {
+	found := "end of expression"
+	if tok.kind != tokenEOF {
+		found = fmt.Sprintf("'%s'", tok.text)
+	}
+	return fmt.Errorf("invalid predicate: expected %s, found %s at position %d", expected, found, tok.pos+1)
+}
+
+func (p *predicateParser) parseOr() (predicateNode, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.keyword("OR") {
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = &orNode{left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *predicateParser) parseAnd() (predicateNode, error) {
+	left, err := p.parseNot()
+	if err != nil {
+		return nil, err
+	}
+	for p.keyword("AND") {
+		right, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		left = &andNode{left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *predicateParser) parseNot() (predicateNode, error) {
+	if p.keyword("NOT") {
+		node, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return &notNode{node: node}, nil
+	}
+	return p.parseCondition()
+}
+
+func (p *predicateParser) parseCondition() (predicateNode, error) {
+	if p.peek().kind == tokenLParen {
+		p.next()
+		node, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if tok := p.next(); tok.kind != tokenRParen {
+			return nil, p.unexpected(tok, "')'")
+		}
+		return node, nil
+	}
+
+	start := p.peek()
+	left, err := p.parseOperand()
+	if err != nil {
+		return nil, err
+	}
+
+	tok := p.peek()
+	switch {
+	case tok.kind == tokenOp && tok.text != "-":
+		p.next()
+		right, err := p.parseOperand()
+		if err != nil {
+			return nil, err
+		}
+
+		op := tok.text
+		if _, ok := left.(*literal); ok {
+			if _, ok := right.(*columnRef); ok {
+				// compare the column to the literal, so that the literal is
+				// converted to the column's type
+				left, right = right, left
+				if flipped, ok := flippedOps[op]; ok {
+					op = flipped
+				}
+			}
+		}
+		return &compareNode{op: op, left: left, right: right}, nil
+	case isKeyword(tok, "IS"):
+		p.next()
+		not := p.keyword("NOT")
+		if !p.keyword("NULL") {
+			return nil, p.unexpected(p.peek(), "NULL")
+		}
+		var node predicateNode = &nullNode{operand: left}
+		if not {
+			node = &notNode{node: node}
+		}
+		return node, nil
+	case isKeyword(tok, "NOT"), isKeyword(tok, "IN"), isKeyword(tok, "LIKE"):
+		not := p.keyword("NOT")
+
+		var node predicateNode
+		switch {
+		case p.keyword("IN"):
+			node, err = p.parseList(left)
+		case p.keyword("LIKE"):
+			node, err = p.parseLike(left)
+		default:
+			return nil, p.unexpected(p.peek(), "IN or LIKE")
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if not {
+			node = &notNode{node: node}
+		}
+		return node, nil
+	}
+
+	if l, ok := left.(*literal); ok {
+		if _, ok := l.v.(bool); !ok {
+			return nil, p.unexpected(tok, fmt.Sprintf("a comparison after '%s'", start.text))
+		}
+	}
+	return &boolNode{operand: left}, nil
+}
+
+func (p *predicateParser) parseList(left operand) (predicateNode, error) {
+	if tok := p.next(); tok.kind != tokenLParen {
+		return nil, p.unexpected(tok, "'('")
+	}
+
+	node := &inNode{operand: left}
+	for {
+		item, err := p.parseOperand()
+		if err != nil {
+			return nil, err
+		}
+		node.list = append(node.list, item)
+
+		tok := p.next()
+		if tok.kind == tokenRParen {
+			return node, nil
+		}
+		if tok.kind != tokenComma {
+			return nil, p.unexpected(tok, "',' or ')'")
+		}
+	}
+}
+
+func (p *predicateParser) parseLike(left operand) (predicateNode, error) {
+	tok := p.next()
+	if tok.kind != tokenString {
+		return nil, p.unexpected(tok, "a string pattern")
+	}
+
+	var sb strings.Builder
+	sb.WriteString("(?s)^")
+	for _, r := range tok.text {
+		switch r {
+		case '%':
+			sb.WriteString(".*")
+		case '_':
+			sb.WriteString(".")
+		default:
+			sb.WriteString(regexp.QuoteMeta(string(r)))
+		}
+	}
+	sb.WriteString("$")
+
+	return &likeNode{operand: left, pattern: regexp.MustCompile(sb.String())}, nil
+}
+
+func (p *predicateParser) parseOperand() (operand, error) {
+	tok := p.next()
+	switch tok.kind {
+	case tokenString:
+		return &literal{v: tok.text}, nil
+	case tokenNumber:
+		return parseNumber(tok, false)
+	case tokenOp:
+		if tok.text == "-" && p.peek().kind == tokenNumber {
+			return parseNumber(p.next(), true)
+		}
+	case tokenQuotedIdent:
+		return &columnRef{name: tok.text}, nil
+	case tokenIdent:
+		switch {
+		case isKeyword(tok, "NULL"):
+			return &literal{}, nil
+		case isKeyword(tok, "TRUE"):
+			return &literal{v: true}, nil
+		case isKeyword(tok, "FALSE"):
+			return &literal{v: false}, nil
+		}
+		for _, kw := range predicateKeywords {
+			if isKeyword(tok, kw) {
+				return nil, p.unexpected(tok, "a column or a value")
+			}
+		}
+
+		if p.peek().kind != tokenDot {
+			return &columnRef{name: tok.text}, nil
+		}
+
+		image := imageNew
+		switch strings.ToLower(tok.text) {
+		case "new":
+		case "old":
+			image = imageOld
+		default:
+			return nil, fmt.Errorf("invalid predicate: unknown qualifier '%s' at position %d, must be new or old", tok.text, tok.pos+1)
+		}
+
+		p.next()
+		col := p.next()
+		if col.kind != tokenIdent && col.kind != tokenQuotedIdent {
+			return nil, p.unexpected(col, "a column")
+		}
+		return &columnRef{name: col.text, image: image}, nil
+	}
+	return nil, p.unexpected(tok, "a column or a value")
+}
+
+func parseNumber(tok token, negative bool) (operand, error) {
+	text := tok.text
+	if negative {
+		text = "-" + text
+	}
+
+	if i, err := strconv.ParseInt(text, 10, 64); err == nil {
+		return &literal{v: i}, nil
+	}
+	if f, err := strconv.ParseFloat(text, 64); err == nil {
+		return &literal{v: f}, nil
+	}
+	if _, ok := new(big.Rat).SetString(text); ok {
+		// an integer out of the range of int64
+		return &literal{v: Decimal(text)}, nil
+	}
+	return nil, fmt.Errorf("invalid predicate: invalid number '%s' at position %d", tok.text, tok.pos+1)
+}
+
+// compareValues compares a column value to a value given in a pipeline
+// configuration, converting the latter to the type of the column value, e.g.
+// a string to a time for a timestamp column. It returns false if the values
+// cannot be ordered, which is always the case if either of them is null.
+func compareValues(v, want interface{}) (int, bool) {
+	if v == nil || want == nil {
+		return 0, false
+	}
+
+	switch x := v.(type) {
+	case time.Time:
+		t, ok := toTime(want)
+		if !ok {
+			return 0, false
+		}
+		switch {
+		case x.Before(t):
+			return -1, true
+		case x.After(t):
+			return 1, true
+		}
+		return 0, true
+	case bool:
+		b, ok := want.(bool)
+		if !ok {
+			return 0, false
+		}
+		switch {
+		case x == b:
+			return 0, true
+		case b:
+			return -1, true
+		}
+		return 1, true
+	}
+
+	if _, isString := v.(string); !isString {
+		if r, ok := toRat(v); ok {
+			w, ok := toRat(want)
+			if !ok {
+				return 0, false
+			}
+			return r.Cmp(w), true
+		}
+	}
+
+	return strings.Compare(toString(v), toString(want)), true
+}
+
+// toRat returns the exact value of a number, or of a string containing one.
+func toRat(v interface{}) (*big.Rat, bool) {
+	switch x := v.(type) {
+	case int64:
+		return new(big.Rat).SetInt64(x), true
+	case int:
+		return new(big.Rat).SetInt64(int64(x)), true
+	case float64:
+		r := new(big.Rat)
+		if r.SetFloat64(x) == nil {
+			return nil, false
+		}
+		return r, true
+	case Decimal:
+		return x.Rat()
+	case json.Number:
+		return new(big.Rat).SetString(string(x))
+	case string:
+		return new(big.Rat).SetString(x)
+	}
+	return nil, false
+}
+
+func toTime(v interface{}) (time.Time, bool) {
+	switch x := v.(type) {
+	case time.Time:
+		return x, true
+	case string:
+		for _, layout := range timeLayouts {
+			if t, err := time.Parse(layout, x); err == nil {
+				return t, true
+			}
+		}
+	}
+	return time.Time{}, false
+}
+
+func toString(v interface{}) string {
+	switch x := v.(type) {
+	case string:
+		return x
+	case []byte:
+		return string(x)
+	case json.RawMessage:
+		return string(x)
+	case fmt.Stringer:
+		return x.String()
+	}
+	return fmt.Sprint(v)
+}
@@ -0,0 +1,209 @@
+package warppipe
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPredicate(t *testing.T) {
+	change := &Changeset{
+		Kind: ChangesetKindUpdate,
+		NewValues: []*ChangesetColumn{
+			{Column: "tenant_id", Value: int64(42)},
+			{Column: "status", Value: "active"},
+			{Column: "balance", Value: Decimal("10.50")},
+			{Column: "active", Value: true},
+			{Column: "email", Value: "jane@example.com"},
+			{Column: "created_at", Value: time.Date(2021, time.March, 1, 12, 0, 0, 0, time.UTC)},
+			{Column: "deleted_at", Value: nil},
+			{Column: "Name", Value: "Jane O'Neil"},
+		},
+		OldValues: []*ChangesetColumn{
+			{Column: "status", Value: "pending"},
+		},
+	}
+
+	for _, tc := range []struct {
+		expr  string
+		match bool
+	}{
+		{"tenant_id = 42", true},
+		{"tenant_id <> 42", false},
+		{"tenant_id != 41", true},
+		{"42 = tenant_id", true},
+		{"40 < tenant_id", true},
+		{"tenant_id >= 42.0 and tenant_id <= 42", true},
+		{"tenant_id > -1", true},
+		{"balance = 10.5", true},
+		{"balance > '10.49'", true},
+		{"status IN ('active', 'pending')", true},
+		{"status NOT IN ('active', 'pending')", false},
+		{"status in ('banned', NULL)", false},
+		{"NOT status in ('banned', NULL)", false},
+		{"email LIKE '%@example.com'", true},
+		{"email NOT LIKE 'jane_@%'", true},
+		{"email like 'JANE%'", false},
+		{"created_at > '2021-03-01' AND created_at < '2021-03-02T00:00:00Z'", true},
+		{"deleted_at IS NULL", true},
+		{"deleted_at IS NOT NULL", false},
+		{"missing IS NULL", true},
+		{"deleted_at = NULL", false},
+		{"NOT deleted_at = 1", false},
+		{"deleted_at = 1 OR tenant_id = 42", true},
+		{"deleted_at = 1 AND tenant_id = 42", false},
+		{"active", true},
+		{"NOT active OR FALSE", false},
+		{"(status = 'banned' OR tenant_id = 42) AND active = true", true},
+		{"status = 'banned' OR tenant_id = 42 AND active = false", false},
+		{`"Name" = 'Jane O''Neil'`, true},
+		{"old.status = 'pending' AND new.status = 'active'", true},
+		{"old.status <> status", true},
+		{"old.tenant_id = 42", false},
+	} {
+		pred, err := ParsePredicate(tc.expr)
+		if !assert.NoError(t, err, tc.expr) {
+			continue
+		}
+		assert.Equal(t, tc.match, pred.Match(change), tc.expr)
+	}
+}
+
+func TestParsePredicateErrors(t *testing.T) {
+	for expr, msg := range map[string]string{
+		"":                           "invalid predicate: expected a column or a value, found end of expression at position 1",
+		"tenant_id =":                "invalid predicate: expected a column or a value, found end of expression at position 12",
+		"tenant_id = 42 status":      "invalid predicate: expected AND, OR or the end of the expression, found 'status' at position 16",
+		"(tenant_id = 42":            "invalid predicate: expected ')', found end of expression at position 16",
+		"status IN 'active'":         "invalid predicate: expected '(', found 'active' at position 11",
+		"status IN ('a' 'b')":        "invalid predicate: expected ',' or ')', found 'b' at position 16",
+		"status IS 'active'":         "invalid predicate: expected NULL, found 'active' at position 11",
+		"status NOT = 'a'":           "invalid predicate: expected IN or LIKE, found '=' at position 12",
+		"email LIKE pattern":         "invalid predicate: expected a string pattern, found 'pattern' at position 12",
+		"status = 'active":           "invalid predicate: unterminated ' at position 10",
+		"status ! 'active'":          "invalid predicate: unexpected '!' at position 8",
+		"status = #":                 "invalid predicate: unexpected '#' at position 10",
+		"users.status = 'a'":         "invalid predicate: unknown qualifier 'users' at position 1, must be new or old",
+		"42":                         "invalid predicate: expected a comparison after '42', found end of expression at position 3",
+		"tenant_id = 1.2.3":          "invalid predicate: invalid number '1.2.3' at position 13",
+		"status = 'a' AND AND":       "invalid predicate: expected a column or a value, found 'AND' at position 18",
+		"new. = 1":                   "invalid predicate: expected a column, found '=' at position 6",
+		"tenant_id = 42 OR (a = 1))": "invalid predicate: expected AND, OR or the end of the expression, found ')' at position 26",
+	} {
+		_, err := ParsePredicate(expr)
+		assert.EqualError(t, err, msg, expr)
+	}
+}
+
+func TestFilterRows(t *testing.T) {
+	filter, err := FilterRows("status IN ('active', 'pending')")
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	row := func(id int64, status string) []*ChangesetColumn {
+		return []*ChangesetColumn{
+			{Column: "id", Value: id},
+			{Column: "status", Value: status},
+		}
+	}
+
+	for _, tc := range []struct {
+		name string
+		in   *Changeset
+		out  *Changeset
+	}{
+		{
+			name: "matching insert",
+			in:   &Changeset{Kind: ChangesetKindInsert, NewValues: row(1, "active")},
+			out:  &Changeset{Kind: ChangesetKindInsert, NewValues: row(1, "active")},
+		},
+		{
+			name: "filtered snapshot",
+			in:   &Changeset{Kind: ChangesetKindSnapshot, NewValues: row(1, "banned")},
+		},
+		{
+			name: "matching delete",
+			in:   &Changeset{Kind: ChangesetKindDelete, OldValues: row(1, "pending")},
+			out:  &Changeset{Kind: ChangesetKindDelete, OldValues: row(1, "pending")},
+		},
+		{
+			name: "filtered delete",
+			in:   &Changeset{Kind: ChangesetKindDelete, OldValues: row(1, "banned")},
+		},
+		{
+			name: "delete with the replica identity only",
+			in:   &Changeset{Kind: ChangesetKindDelete, OldValues: row(1, "")[:1]},
+			out:  &Changeset{Kind: ChangesetKindDelete, OldValues: row(1, "")[:1]},
+		},
+		{
+			name: "update within the filter",
+			in:   &Changeset{Kind: ChangesetKindUpdate, NewValues: row(1, "active"), OldValues: row(1, "pending")},
+			out:  &Changeset{Kind: ChangesetKindUpdate, NewValues: row(1, "active"), OldValues: row(1, "pending")},
+		},
+		{
+			name: "update moving into the filter",
+			in:   &Changeset{Kind: ChangesetKindUpdate, NewValues: row(1, "active"), OldValues: row(1, "banned")},
+			out:  &Changeset{Kind: ChangesetKindInsert, NewValues: row(1, "active")},
+		},
+		{
+			name: "update moving out of the filter",
+			in:   &Changeset{Kind: ChangesetKindUpdate, NewValues: row(1, "banned"), OldValues: row(1, "active")},
+			out:  &Changeset{Kind: ChangesetKindDelete, OldValues: row(1, "active")},
+		},
+		{
+			name: "update outside the filter",
+			in:   &Changeset{Kind: ChangesetKindUpdate, NewValues: row(1, "banned"), OldValues: row(1, "deleted")},
+		},
+		{
+			name: "update with the replica identity only",
+			in:   &Changeset{Kind: ChangesetKindUpdate, NewValues: row(2, "active"), OldValues: row(1, "")[:1]},
+			out:  &Changeset{Kind: ChangesetKindUpdate, NewValues: row(2, "active"), OldValues: row(1, "")[:1]},
+		},
+		{
+			name: "update with the replica identity only outside the filter",
+			in:   &Changeset{Kind: ChangesetKindUpdate, NewValues: row(1, "banned"), OldValues: row(1, "")[:1]},
+		},
+		{
+			name: "update without old values outside the filter",
+			in:   &Changeset{Kind: ChangesetKindUpdate, NewValues: row(1, "banned")},
+		},
+		{
+			name: "truncate",
+			in:   &Changeset{Kind: ChangesetKindTruncate},
+			out:  &Changeset{Kind: ChangesetKindTruncate},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			out, err := filter(tc.in)
+			assert.NoError(t, err)
+			assert.Equal(t, tc.out, out)
+		})
+	}
+}
+
+func TestCompareValues(t *testing.T) {
+	ts := time.Date(2021, time.March, 1, 12, 0, 0, 0, time.UTC)
+	for _, tc := range []struct {
+		v, want interface{}
+		cmp     int
+		ok      bool
+	}{
+		{int64(10), int64(9), 1, true},
+		{Decimal("10.50"), 10.5, 0, true},
+		{10.5, "11", -1, true},
+		{int64(10), "ten", 0, false},
+		{"10", "9", -1, true},
+		{ts, "2021-03-01T12:00:00Z", 0, true},
+		{ts, "2021-03-02", -1, true},
+		{ts, "yesterday", 0, false},
+		{true, false, 1, true},
+		{nil, "a", 0, false},
+		{UUID{1}, "01000000-0000-0000-0000-000000000000", 0, true},
+	} {
+		cmp, ok := compareValues(tc.v, tc.want)
+		assert.Equal(t, tc.ok, ok, "%v <=> %v", tc.v, tc.want)
+		assert.Equal(t, tc.cmp, cmp, "%v <=> %v", tc.v, tc.want)
+	}
+}
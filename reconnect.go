@@ -0,0 +1,159 @@
+package warppipe
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// DefaultBackoff is the reconnect backoff used by the listeners if none is
+// provided.
+var DefaultBackoff = Backoff{
+	InitialInterval: 1 * time.Second,
+	MaxInterval:     1 * time.Minute,
+	Multiplier:      2,
+	MaxRetries:      10,
+}
+
+// Backoff configures the delays between attempts to re-establish a lost
+// database connection. The delay starts at InitialInterval and is multiplied
+// by Multiplier after each failed attempt, up to MaxInterval. MaxRetries is
+// the number of consecutive failed attempts after which the listener gives up;
+// a negative value retries forever, and zero disables reconnecting.
+type Backoff struct {
+	InitialInterval time.Duration
+	MaxInterval     time.Duration
+	Multiplier      float64
+	MaxRetries      int
+}
+
+// Duration returns the delay before the given (1-based) attempt.
+func (b Backoff) Duration(attempt int) time.Duration {
+	if attempt < 1 {
+		attempt = 1
+	}
+
+	multiplier := b.Multiplier
+	if multiplier < 1 {
+		multiplier = 1
+	}
+
+	d := float64(b.InitialInterval) * math.Pow(multiplier, float64(attempt-1))
+	if b.MaxInterval > 0 && d > float64(b.MaxInterval) {
+		return b.MaxInterval
+	}
+	return time.Duration(d)
+}
+
+// ConnectionState is the state reported by a ConnectionEvent.
+type ConnectionState string
+
+// Connection states.
+const (
+	ConnectionReconnecting ConnectionState = "reconnecting"
+	ConnectionReconnected  ConnectionState = "reconnected"
+	// ConnectionFailed is reported once the listener has given up
+	// reconnecting, after which it emits no more changesets.
+	ConnectionFailed ConnectionState = "failed"
+)
+
+// ConnectionEvent is sent on a listener's error channel when its database
+// connection is lost and while it is being re-established. It is informational:
+// the listener keeps running, and resumes from Position, which is the last
+// acknowledged LSN (logical replication) or changeset ID (audit). Once the
+// retries are exhausted, a fatal ConnectionEvent with the state
+// ConnectionFailed is sent and the listener stops. Use errors.As to tell it
+// apart from other errors.
+type ConnectionEvent struct {
+	State    ConnectionState
+	Attempt  int
+	Delay    time.Duration
+	Position uint64
+	Err      error
+}
+
+func (e *ConnectionEvent) Error() string {
+	switch e.State {
+	case ConnectionReconnecting:
+		return fmt.Sprintf("connection lost, reconnecting in %s (attempt %d): %v", e.Delay, e.Attempt, e.Err)
+	case ConnectionFailed:
+		return fmt.Sprintf("failed to reconnect after %d attempt(s): %v", e.Attempt, e.Err)
+	default:
+		return fmt.Sprintf("reconnected after %d attempt(s), resuming from position %d", e.Attempt, e.Position)
+	}
+}
+
+// Unwrap returns the error that caused the connection to be lost.
+func (e *ConnectionEvent) Unwrap() error {
+	return e.Err
+}
+
+// Fatal returns true if the listener has given up reconnecting.
+func (e *ConnectionEvent) Fatal() bool {
+	return e.State == ConnectionFailed
+}
+
+// IsFatal returns true if err is a fatal StageError or ConnectionEvent, after
+// which no more changesets are emitted and the WarpPipe should be closed.
+func IsFatal(err error) bool {
+	var fatal interface{ Fatal() bool }
+	return errors.As(err, &fatal) && fatal.Fatal()
+}
+
+// reconnect calls connect until it succeeds, waiting between attempts as
+// configured by backoff and reporting ConnectionEvents on errCh. position
+// returns the position the listener resumes from. It returns an error if the
+// context is done, or a fatal ConnectionEvent if the retries are exhausted.
+func reconnect(ctx context.Context, backoff Backoff, errCh chan error, logger *log.Entry, cause error, position func() uint64, connect func() error) error {
+	if backoff.MaxRetries == 0 {
+		return &ConnectionEvent{State: ConnectionFailed, Position: position(), Err: cause}
+	}
+
+	for attempt := 1; backoff.MaxRetries < 0 || attempt <= backoff.MaxRetries; attempt++ {
+		delay := backoff.Duration(attempt)
+		logger.WithError(cause).Warnf("connection lost, reconnecting in %s (attempt %d)", delay, attempt)
+		sendError(ctx, errCh, &ConnectionEvent{
+			State:    ConnectionReconnecting,
+			Attempt:  attempt,
+			Delay:    delay,
+			Position: position(),
+			Err:      cause,
+		})
+
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+
+		cause = connect()
+		if cause == nil {
+			logger.Infof("reconnected after %d attempt(s)", attempt)
+			sendError(ctx, errCh, &ConnectionEvent{
+				State:    ConnectionReconnected,
+				Attempt:  attempt,
+				Position: position(),
+			})
+			return nil
+		}
+	}
+
+	return &ConnectionEvent{
+		State:    ConnectionFailed,
+		Attempt:  backoff.MaxRetries,
+		Position: position(),
+		Err:      cause,
+	}
+}
+
+// sendError sends err on errCh unless the context is done.
+func sendError(ctx context.Context, errCh chan error, err error) {
+	select {
+	case errCh <- err:
+	case <-ctx.Done():
+	}
+}
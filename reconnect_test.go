@@ -0,0 +1,125 @@
+package warppipe
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBackoffDuration(t *testing.T) {
+	backoff := Backoff{
+		InitialInterval: 1 * time.Second,
+		MaxInterval:     5 * time.Second,
+		Multiplier:      2,
+	}
+
+	assert.Equal(t, 1*time.Second, backoff.Duration(1))
+	assert.Equal(t, 2*time.Second, backoff.Duration(2))
+	assert.Equal(t, 4*time.Second, backoff.Duration(3))
+	assert.Equal(t, 5*time.Second, backoff.Duration(4))
+	assert.Equal(t, 5*time.Second, backoff.Duration(100))
+	assert.Equal(t, 1*time.Second, backoff.Duration(0))
+}
+
+func TestReconnect(t *testing.T) {
+	logger := log.WithField("component", "test")
+	backoff := Backoff{
+		InitialInterval: time.Millisecond,
+		MaxInterval:     time.Millisecond,
+		Multiplier:      2,
+		MaxRetries:      3,
+	}
+	errLost := errors.New("connection lost")
+	position := func() uint64 { return 42 }
+
+	collect := func(errCh chan error) func() []error {
+		var events []error
+		doneCh := make(chan struct{})
+		go func() {
+			for err := range errCh {
+				events = append(events, err)
+			}
+			close(doneCh)
+		}()
+		return func() []error {
+			close(errCh)
+			<-doneCh
+			return events
+		}
+	}
+
+	t.Run("reconnects after failed attempts", func(t *testing.T) {
+		errCh := make(chan error)
+		events := collect(errCh)
+
+		attempts := 0
+		err := reconnect(context.Background(), backoff, errCh, logger, errLost, position, func() error {
+			attempts++
+			if attempts < 2 {
+				return errLost
+			}
+			return nil
+		})
+		assert.NoError(t, err)
+		assert.Equal(t, 2, attempts)
+
+		evts := events()
+		if !assert.Len(t, evts, 3) {
+			return
+		}
+
+		var connEvent *ConnectionEvent
+		assert.True(t, errors.As(evts[0], &connEvent))
+		assert.Equal(t, ConnectionReconnecting, connEvent.State)
+		assert.Equal(t, 1, connEvent.Attempt)
+		assert.Equal(t, uint64(42), connEvent.Position)
+		assert.True(t, errors.Is(evts[0], errLost))
+
+		assert.True(t, errors.As(evts[2], &connEvent))
+		assert.Equal(t, ConnectionReconnected, connEvent.State)
+		assert.Equal(t, 2, connEvent.Attempt)
+	})
+
+	t.Run("gives up after max retries", func(t *testing.T) {
+		errCh := make(chan error)
+		events := collect(errCh)
+
+		attempts := 0
+		err := reconnect(context.Background(), backoff, errCh, logger, errLost, position, func() error {
+			attempts++
+			return errLost
+		})
+		assert.True(t, errors.Is(err, errLost))
+		assert.True(t, IsFatal(err))
+		assert.Equal(t, 3, attempts)
+		assert.Len(t, events(), 3)
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		disabled := backoff
+		disabled.MaxRetries = 0
+
+		err := reconnect(context.Background(), disabled, make(chan error), logger, errLost, position, func() error {
+			t.Fatal("unexpected reconnect attempt")
+			return nil
+		})
+		assert.True(t, errors.Is(err, errLost))
+		assert.True(t, IsFatal(err))
+	})
+
+	t.Run("stops when the context is done", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		slow := backoff
+		slow.InitialInterval = time.Hour
+		err := reconnect(ctx, slow, make(chan error), logger, errLost, position, func() error {
+			return nil
+		})
+		assert.Equal(t, context.Canceled, err)
+	})
+}
@@ -0,0 +1,340 @@
+package rpc
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"time"
+
+	warppipe "github.com/perangel/warp-pipe"
+)
+
+// Protocol buffer encoding of the messages defined in warppipe.proto.
+
+const (
+	wireVarint  = 0
+	wireFixed64 = 1
+	wireBytes   = 2
+	wireFixed32 = 5
+)
+
+var errTruncated = errors.New("truncated message")
+
+func appendVarint(b []byte, v uint64) []byte {
+	for v >= 0x80 {
+		b = append(b, byte(v)|0x80)
+		v >>= 7
+	}
+	return append(b, byte(v))
+}
+
+func appendTag(b []byte, num, wireType int) []byte {
+	return appendVarint(b, uint64(num)<<3|uint64(wireType))
+}
+
+// The append*Field functions always encode the field, the append* functions
+// omit zero values as in proto3.
+
+func appendVarintField(b []byte, num int, v uint64) []byte {
+	return appendVarint(appendTag(b, num, wireVarint), v)
+}
+
+func appendBytesField(b []byte, num int, v []byte) []byte {
+	b = appendVarint(appendTag(b, num, wireBytes), uint64(len(v)))
+	return append(b, v...)
+}
+
+func appendUint(b []byte, num int, v uint64) []byte {
+	if v == 0 {
+		return b
+	}
+	return appendVarintField(b, num, v)
+}
+
+func appendBool(b []byte, num int, v bool) []byte {
+	if !v {
+		return b
+	}
+	return appendVarintField(b, num, 1)
+}
+
+func appendString(b []byte, num int, v string) []byte {
+	if v == "" {
+		return b
+	}
+	return appendBytesField(b, num, []byte(v))
+}
+
+// appendTimestamp encodes t as a google.protobuf.Timestamp, unless it is zero.
+func appendTimestamp(b []byte, num int, t time.Time) []byte {
+	if t.IsZero() {
+		return b
+	}
+	return appendBytesField(b, num, timestamp(t))
+}
+
+func timestamp(t time.Time) []byte {
+	var b []byte
+	b = appendUint(b, 1, uint64(t.Unix()))
+	b = appendUint(b, 2, uint64(t.Nanosecond()))
+	return b
+}
+
+// field is a decoded protocol buffer field. Varint and fixed values are
+// stored in v, length-delimited ones in data.
+type field struct {
+	num      int
+	wireType int
+	v        uint64
+	data     []byte
+}
+
+// readFields decodes the fields of a message.
+func readFields(b []byte) ([]field, error) {
+	var fields []field
+	for len(b) > 0 {
+		tag, n := binary.Uvarint(b)
+		if n <= 0 {
+			return nil, errTruncated
+		}
+		b = b[n:]
+
+		f := field{num: int(tag >> 3), wireType: int(tag & 7)}
+		switch f.wireType {
+		case wireVarint:
+			f.v, n = binary.Uvarint(b)
+			if n <= 0 {
+				return nil, errTruncated
+			}
+			b = b[n:]
+		case wireFixed64:
+			if len(b) < 8 {
+				return nil, errTruncated
+			}
+			f.v = binary.LittleEndian.Uint64(b)
+			b = b[8:]
+		case wireFixed32:
+			if len(b) < 4 {
+				return nil, errTruncated
+			}
+			f.v = uint64(binary.LittleEndian.Uint32(b))
+			b = b[4:]
+		case wireBytes:
+			size, n := binary.Uvarint(b)
+			if n <= 0 || uint64(len(b)-n) < size {
+				return nil, errTruncated
+			}
+			f.data = b[n : n+int(size)]
+			b = b[n+int(size):]
+		default:
+			return nil, fmt.Errorf("unsupported wire type %d", f.wireType)
+		}
+		fields = append(fields, f)
+	}
+	return fields, nil
+}
+
+// subscribeRequest is the SubscribeRequest message.
+type subscribeRequest struct {
+	subscriber string
+	tables     []string
+	resumeFrom warppipe.Position
+}
+
+func (m *subscribeRequest) marshal() []byte {
+	var b []byte
+	b = appendString(b, 1, m.subscriber)
+	for _, table := range m.tables {
+		b = appendBytesField(b, 2, []byte(table))
+	}
+	if m.resumeFrom.LSN != 0 || m.resumeFrom.ChangesetID != 0 {
+		var pos []byte
+		pos = appendUint(pos, 1, m.resumeFrom.LSN)
+		pos = appendUint(pos, 2, uint64(m.resumeFrom.ChangesetID))
+		b = appendBytesField(b, 3, pos)
+	}
+	return b
+}
+
+func (m *subscribeRequest) unmarshal(b []byte) error {
+	fields, err := readFields(b)
+	if err != nil {
+		return err
+	}
+
+	for _, f := range fields {
+		switch f.num {
+		case 1:
+			m.subscriber = string(f.data)
+		case 2:
+			m.tables = append(m.tables, string(f.data))
+		case 3:
+			pos, err := readFields(f.data)
+			if err != nil {
+				return err
+			}
+			for _, f := range pos {
+				switch f.num {
+				case 1:
+					m.resumeFrom.LSN = f.v
+				case 2:
+					m.resumeFrom.ChangesetID = int64(f.v)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// ackRequest is the AckRequest message.
+type ackRequest struct {
+	subscriber string
+	sequences  []uint64
+}
+
+func (m *ackRequest) marshal() []byte {
+	var b []byte
+	b = appendString(b, 1, m.subscriber)
+	if len(m.sequences) > 0 {
+		var packed []byte
+		for _, seq := range m.sequences {
+			packed = appendVarint(packed, seq)
+		}
+		b = appendBytesField(b, 2, packed)
+	}
+	return b
+}
+
+func (m *ackRequest) unmarshal(b []byte) error {
+	fields, err := readFields(b)
+	if err != nil {
+		return err
+	}
+
+	for _, f := range fields {
+		switch f.num {
+		case 1:
+			m.subscriber = string(f.data)
+		case 2:
+			// repeated scalars may be packed or not
+			if f.wireType == wireVarint {
+				m.sequences = append(m.sequences, f.v)
+				continue
+			}
+			for packed := f.data; len(packed) > 0; {
+				seq, n := binary.Uvarint(packed)
+				if n <= 0 {
+					return errTruncated
+				}
+				m.sequences = append(m.sequences, seq)
+				packed = packed[n:]
+			}
+		}
+	}
+	return nil
+}
+
+var changesetKinds = map[warppipe.ChangesetKind]uint64{
+	warppipe.ChangesetKindInsert:   1,
+	warppipe.ChangesetKindUpdate:   2,
+	warppipe.ChangesetKindDelete:   3,
+	warppipe.ChangesetKindTruncate: 4,
+	warppipe.ChangesetKindSnapshot: 5,
+}
+
+// marshalChangeset encodes a changeset as a Changeset message with the given
+// sequence number.
+func marshalChangeset(seq uint64, change *warppipe.Changeset) []byte {
+	var b []byte
+	b = appendUint(b, 1, seq)
+	b = appendUint(b, 2, uint64(change.ID))
+	b = appendUint(b, 3, change.LSN)
+	b = appendUint(b, 4, uint64(change.TxID))
+	b = appendUint(b, 5, uint64(change.TxPosition))
+	b = appendBool(b, 6, change.TxLast)
+	b = appendUint(b, 7, changesetKinds[change.Kind])
+	b = appendString(b, 8, change.Schema)
+	b = appendString(b, 9, change.Table)
+	b = appendTimestamp(b, 10, change.Timestamp)
+	b = appendTimestamp(b, 11, change.CommitTime)
+	for _, col := range change.NewValues {
+		b = appendBytesField(b, 12, marshalColumn(col))
+	}
+	for _, col := range change.OldValues {
+		b = appendBytesField(b, 13, marshalColumn(col))
+	}
+	return b
+}
+
+// marshalColumn encodes a column as a ChangesetColumn message, with its value
+// in the member of the value oneof that matches the Go type of the value.
+// Decimals and UUIDs are sent as string_value, and whole float64 numbers of
+// integer columns as int_value.
+func marshalColumn(col *warppipe.ChangesetColumn) []byte {
+	var b []byte
+	b = appendString(b, 1, col.Column)
+	b = appendString(b, 2, col.Type)
+
+	switch v := col.Value.(type) {
+	case nil:
+		b = appendVarintField(b, 3, 1)
+	case bool:
+		var n uint64
+		if v {
+			n = 1
+		}
+		b = appendVarintField(b, 4, n)
+	case int:
+		b = appendVarintField(b, 5, uint64(v))
+	case int32:
+		b = appendVarintField(b, 5, uint64(v))
+	case int64:
+		b = appendVarintField(b, 5, uint64(v))
+	case float64:
+		if isIntegerType(col.Type) && v == math.Trunc(v) {
+			b = appendVarintField(b, 5, uint64(int64(v)))
+			break
+		}
+		var fixed [8]byte
+		binary.LittleEndian.PutUint64(fixed[:], math.Float64bits(v))
+		b = append(appendTag(b, 6, wireFixed64), fixed[:]...)
+	case string:
+		if isJSONType(col.Type) {
+			b = appendBytesField(b, 10, []byte(v))
+			break
+		}
+		b = appendBytesField(b, 7, []byte(v))
+	case warppipe.Decimal:
+		b = appendBytesField(b, 7, []byte(v))
+	case warppipe.UUID:
+		b = appendBytesField(b, 7, []byte(v.String()))
+	case json.RawMessage:
+		b = appendBytesField(b, 10, v)
+	case []byte:
+		b = appendBytesField(b, 8, v)
+	case time.Time:
+		b = appendBytesField(b, 9, timestamp(v))
+	default:
+		// e.g. arrays and objects decoded from JSON
+		data, err := json.Marshal(v)
+		if err != nil {
+			data = []byte(fmt.Sprintf("%q", fmt.Sprint(v)))
+		}
+		b = appendBytesField(b, 10, data)
+	}
+	return b
+}
+
+func isIntegerType(pgType string) bool {
+	switch pgType {
+	case "smallint", "integer", "bigint", "int2", "int4", "int8", "smallserial", "serial", "bigserial", "oid":
+		return true
+	}
+	return false
+}
+
+func isJSONType(pgType string) bool {
+	return pgType == "json" || pgType == "jsonb"
+}
@@ -0,0 +1,477 @@
+// Package rpc implements the gRPC service defined in warppipe.proto, which
+// streams changesets to subscribers over HTTP/2.
+package rpc
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	warppipe "github.com/perangel/warp-pipe"
+)
+
+const (
+	subscribeMethod = "/warppipe.v1.WarpPipe/Subscribe"
+	ackMethod       = "/warppipe.v1.WarpPipe/Ack"
+
+	maxMessageSize = 4 << 20
+	sendBufferSize = 100
+
+	defaultSubscriberTimeout = 1 * time.Hour
+)
+
+// gRPC status codes.
+const (
+	codeOK                = 0
+	codeInvalidArgument   = 3
+	codeNotFound          = 5
+	codeAlreadyExists     = 6
+	codeResourceExhausted = 8
+	codeUnimplemented     = 12
+	codeInternal          = 13
+	codeUnavailable       = 14
+)
+
+// statusError is an error returned to the client as a gRPC status.
+type statusError struct {
+	code int
+	msg  string
+}
+
+func (e *statusError) Error() string {
+	return e.msg
+}
+
+func errorf(code int, format string, args ...interface{}) error {
+	return &statusError{code: code, msg: fmt.Sprintf(format, args...)}
+}
+
+// delivery is a changeset sent to one or more subscribers. The changeset is
+// acknowledged once every subscriber it was sent to has acknowledged it.
+type delivery struct {
+	seq    uint64
+	change *warppipe.Changeset
+	refs   int
+}
+
+// subscription is a subscriber's connection.
+type subscription struct {
+	ch   chan *delivery
+	gone chan struct{}
+}
+
+// subscriber is a named consumer of the stream. Its unacknowledged deliveries
+// outlive its connection, so that they are sent again when it reconnects,
+// until it expires.
+type subscriber struct {
+	tables  []string
+	resume  warppipe.Position
+	conn    *subscription
+	pending map[uint64]*delivery
+	expiry  *time.Timer
+}
+
+// match returns true if the changeset should be sent to the subscriber.
+func (s *subscriber) match(change *warppipe.Changeset) bool {
+	if len(s.tables) > 0 && !warppipe.MatchTable(s.tables, change.Schema, change.Table) {
+		return false
+	}
+	if change.LSN != 0 {
+		return change.LSN > s.resume.LSN
+	}
+	return change.ID == 0 || change.ID > s.resume.ChangesetID
+}
+
+// Server is an http.Handler serving the WarpPipe gRPC service. Changesets are
+// read from a single channel and fanned out to all connected subscribers
+// whose filter they match. A changeset is acknowledged once every subscriber
+// it was sent to has acknowledged it with the Ack RPC, or immediately if it
+// matches no subscriber. While no subscriber is connected, the server stops
+// reading changesets.
+//
+// A subscriber that stays disconnected for longer than SubscriberTimeout()
+// expires: its pending changesets are released, as if it had acknowledged
+// them, so that they no longer hold back the acknowledged position.
+//
+// Serving gRPC requires HTTP/2, e.g. over TLS, or over cleartext with
+// http.Server's Protocols.
+type Server struct {
+	logger            *log.Logger
+	subscriberTimeout time.Duration
+
+	mu          sync.Mutex
+	seq         uint64
+	subscribers map[string]*subscriber
+	subscribed  chan struct{}
+	done        chan struct{}
+}
+
+// ServerOption is a NewServer option function.
+type ServerOption func(*Server)
+
+// SubscriberTimeout is an option for setting how long a subscriber may stay
+// disconnected before it expires, 1h by default. If it reconnects later, it
+// only receives new changesets. 0 disables expiry.
+func SubscriberTimeout(d time.Duration) ServerOption {
+	return func(s *Server) {
+		s.subscriberTimeout = d
+	}
+}
+
+// NewServer returns a new Server.
+func NewServer(opts ...ServerOption) *Server {
+	s := &Server{
+		logger:            log.New(),
+		subscriberTimeout: defaultSubscriberTimeout,
+		subscribers:       make(map[string]*subscriber),
+		subscribed:        make(chan struct{}),
+		done:              make(chan struct{}),
+	}
+
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
+}
+
+// Run sends the changesets read from the channel to the subscribers, until
+// the channel is closed or the context is done. Open Subscribe calls are
+// ended once Run returns.
+func (s *Server) Run(ctx context.Context, changes <-chan *warppipe.Changeset) error {
+	defer close(s.done)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case change, ok := <-changes:
+			if !ok {
+				return nil
+			}
+			if err := s.dispatch(ctx, change); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// dispatch sends a changeset to the matching connected subscribers, waiting
+// for a subscriber to connect if there are none.
+func (s *Server) dispatch(ctx context.Context, change *warppipe.Changeset) error {
+	s.mu.Lock()
+	for !s.hasConnections() {
+		subscribed := s.subscribed
+		s.mu.Unlock()
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-subscribed:
+		}
+		s.mu.Lock()
+	}
+
+	s.seq++
+	d := &delivery{seq: s.seq, change: change}
+	var conns []*subscription
+	for _, sub := range s.subscribers {
+		if sub.conn == nil || !sub.match(change) {
+			continue
+		}
+		sub.pending[d.seq] = d
+		d.refs++
+		conns = append(conns, sub.conn)
+	}
+	s.mu.Unlock()
+
+	if d.refs == 0 {
+		change.Ack()
+		return nil
+	}
+
+	// a delivery that is not sent because the subscriber disconnected stays
+	// pending, and is sent when the subscriber reconnects
+	for _, conn := range conns {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case conn.ch <- d:
+		case <-conn.gone:
+		}
+	}
+	return nil
+}
+
+func (s *Server) hasConnections() bool {
+	for _, sub := range s.subscribers {
+		if sub.conn != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// connect connects a subscriber, and returns its connection along with its
+// pending deliveries.
+func (s *Server) connect(req *subscribeRequest) (*subscription, []*delivery, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sub, ok := s.subscribers[req.subscriber]
+	if !ok {
+		sub = &subscriber{pending: make(map[uint64]*delivery)}
+		s.subscribers[req.subscriber] = sub
+	}
+	if sub.conn != nil {
+		return nil, nil, errorf(codeAlreadyExists, "subscriber '%s' is already connected", req.subscriber)
+	}
+	if sub.expiry != nil {
+		sub.expiry.Stop()
+		sub.expiry = nil
+	}
+
+	sub.tables = req.tables
+	sub.resume = req.resumeFrom
+	sub.conn = &subscription{
+		ch:   make(chan *delivery, sendBufferSize),
+		gone: make(chan struct{}),
+	}
+
+	backlog := make([]*delivery, 0, len(sub.pending))
+	for _, d := range sub.pending {
+		backlog = append(backlog, d)
+	}
+	sort.Slice(backlog, func(i, j int) bool { return backlog[i].seq < backlog[j].seq })
+
+	close(s.subscribed)
+	s.subscribed = make(chan struct{})
+	return sub.conn, backlog, nil
+}
+
+func (s *Server) disconnect(name string, conn *subscription) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sub := s.subscribers[name]
+	if sub.conn == conn {
+		close(conn.gone)
+		sub.conn = nil
+		if s.subscriberTimeout > 0 {
+			sub.expiry = time.AfterFunc(s.subscriberTimeout, func() {
+				s.expire(name, sub)
+			})
+		}
+	}
+}
+
+// expire forgets a subscriber that is still disconnected, and releases its
+// pending deliveries.
+func (s *Server) expire(name string, sub *subscriber) {
+	s.mu.Lock()
+	if s.subscribers[name] != sub || sub.conn != nil {
+		// reconnected in the meantime
+		s.mu.Unlock()
+		return
+	}
+	delete(s.subscribers, name)
+
+	var released []*warppipe.Changeset
+	for _, d := range sub.pending {
+		d.refs--
+		if d.refs == 0 {
+			released = append(released, d.change)
+		}
+	}
+	s.mu.Unlock()
+
+	s.logger.
+		WithField("subscriber", name).
+		Warnf("subscriber expired, released %d pending changeset(s)", len(sub.pending))
+	for _, change := range released {
+		change.Ack()
+	}
+}
+
+// ack acknowledges the deliveries of a subscriber. Unknown sequence numbers,
+// e.g. ones that were already acknowledged, are ignored.
+func (s *Server) ack(req *ackRequest) error {
+	s.mu.Lock()
+	sub, ok := s.subscribers[req.subscriber]
+	if !ok {
+		s.mu.Unlock()
+		return errorf(codeNotFound, "unknown subscriber '%s'", req.subscriber)
+	}
+
+	var acked []*warppipe.Changeset
+	for _, seq := range req.sequences {
+		d, ok := sub.pending[seq]
+		if !ok {
+			continue
+		}
+		delete(sub.pending, seq)
+		d.refs--
+		if d.refs == 0 {
+			acked = append(acked, d.change)
+		}
+	}
+	s.mu.Unlock()
+
+	for _, change := range acked {
+		change.Ack()
+	}
+	return nil
+}
+
+// ServeHTTP implements http.Handler.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost || r.ProtoMajor != 2 ||
+		!strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc") {
+		http.Error(w, "only gRPC requests are supported", http.StatusUnsupportedMediaType)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/grpc")
+	w.Header().Set("Trailer", "Grpc-Status, Grpc-Message")
+
+	var err error
+	switch r.URL.Path {
+	case subscribeMethod:
+		err = s.subscribe(w, r)
+	case ackMethod:
+		err = s.handleAck(w, r)
+	default:
+		err = errorf(codeUnimplemented, "unknown method %s", r.URL.Path)
+	}
+
+	code := codeOK
+	if err != nil {
+		code = codeInternal
+		if statusErr, ok := err.(*statusError); ok {
+			code = statusErr.code
+		} else {
+			s.logger.WithError(err).WithField("method", r.URL.Path).Error("gRPC call failed")
+		}
+		w.Header().Set("Grpc-Message", encodeGRPCMessage(err.Error()))
+	}
+	w.Header().Set("Grpc-Status", strconv.Itoa(code))
+}
+
+func (s *Server) subscribe(w http.ResponseWriter, r *http.Request) error {
+	b, err := readMessage(r.Body)
+	if err != nil {
+		return err
+	}
+
+	var req subscribeRequest
+	if err := req.unmarshal(b); err != nil {
+		return errorf(codeInvalidArgument, "invalid request: %s", err)
+	}
+	if req.subscriber == "" {
+		return errorf(codeInvalidArgument, "a subscriber name is required")
+	}
+
+	conn, backlog, err := s.connect(&req)
+	if err != nil {
+		return err
+	}
+	defer s.disconnect(req.subscriber, conn)
+
+	s.logger.WithField("subscriber", req.subscriber).Info("subscriber connected")
+	defer s.logger.WithField("subscriber", req.subscriber).Info("subscriber disconnected")
+
+	w.WriteHeader(http.StatusOK)
+	w.(http.Flusher).Flush()
+
+	for _, d := range backlog {
+		if err := writeMessage(w, marshalChangeset(d.seq, d.change)); err != nil {
+			return err
+		}
+	}
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return nil
+		case <-s.done:
+			return errorf(codeUnavailable, "the server is shutting down")
+		case d := <-conn.ch:
+			if err := writeMessage(w, marshalChangeset(d.seq, d.change)); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func (s *Server) handleAck(w http.ResponseWriter, r *http.Request) error {
+	b, err := readMessage(r.Body)
+	if err != nil {
+		return err
+	}
+
+	var req ackRequest
+	if err := req.unmarshal(b); err != nil {
+		return errorf(codeInvalidArgument, "invalid request: %s", err)
+	}
+	if err := s.ack(&req); err != nil {
+		return err
+	}
+
+	// AckResponse is empty
+	return writeMessage(w, nil)
+}
+
+// readMessage reads a length-prefixed gRPC message.
+func readMessage(r io.Reader) ([]byte, error) {
+	var header [5]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, errorf(codeInvalidArgument, "failed to read request: %s", err)
+	}
+	if header[0] != 0 {
+		return nil, errorf(codeUnimplemented, "compressed messages are not supported")
+	}
+
+	size := binary.BigEndian.Uint32(header[1:])
+	if size > maxMessageSize {
+		return nil, errorf(codeResourceExhausted, "message of %d bytes exceeds the limit of %d bytes", size, maxMessageSize)
+	}
+
+	b := make([]byte, size)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, errorf(codeInvalidArgument, "failed to read request: %s", err)
+	}
+	return b, nil
+}
+
+// writeMessage writes a length-prefixed gRPC message and flushes it.
+func writeMessage(w http.ResponseWriter, msg []byte) error {
+	var header [5]byte
+	binary.BigEndian.PutUint32(header[1:], uint32(len(msg)))
+	if _, err := w.Write(append(header[:], msg...)); err != nil {
+		return err
+	}
+	w.(http.Flusher).Flush()
+	return nil
+}
+
+// encodeGRPCMessage percent-encodes a status message as required in the
+// grpc-message trailer.
+func encodeGRPCMessage(msg string) string {
+	var sb strings.Builder
+	for i := 0; i < len(msg); i++ {
+		c := msg[i]
+		if c < 0x20 || c > 0x7e || c == '%' {
+			fmt.Fprintf(&sb, "%%%02X", c)
+			continue
+		}
+		sb.WriteByte(c)
+	}
+	return sb.String()
+}
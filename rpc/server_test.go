@@ -0,0 +1,227 @@
+package rpc
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	warppipe "github.com/perangel/warp-pipe"
+)
+
+type testClient struct {
+	t      *testing.T
+	client *http.Client
+	url    string
+}
+
+func (c *testClient) call(ctx context.Context, method string, msg []byte) *http.Response {
+	body := make([]byte, 5+len(msg))
+	binary.BigEndian.PutUint32(body[1:], uint32(len(msg)))
+	copy(body[5:], msg)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.url+method, bytes.NewReader(body))
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/grpc")
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	return resp
+}
+
+// status reads the response to the end and returns its gRPC status.
+func (c *testClient) status(resp *http.Response) string {
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+	return resp.Trailer.Get("Grpc-Status")
+}
+
+func (c *testClient) ack(subscriber string, seqs ...uint64) string {
+	req := &ackRequest{subscriber: subscriber, sequences: seqs}
+	return c.status(c.call(context.Background(), ackMethod, req.marshal()))
+}
+
+// receive reads a Changeset message and returns its fields by number.
+func (c *testClient) receive(resp *http.Response) map[int][]field {
+	b, err := readMessage(resp.Body)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	fields, err := readFields(b)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+
+	byNum := make(map[int][]field)
+	for _, f := range fields {
+		byNum[f.num] = append(byNum[f.num], f)
+	}
+	return byNum
+}
+
+func (s *Server) pendingCount(name string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.subscribers[name].pending)
+}
+
+func TestServer(t *testing.T) {
+	srv := NewServer()
+	ts := httptest.NewUnstartedServer(srv)
+	ts.EnableHTTP2 = true
+	ts.StartTLS()
+	defer ts.Close()
+
+	c := &testClient{t: t, client: ts.Client(), url: ts.URL}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	changes := make(chan *warppipe.Changeset)
+	go srv.Run(ctx, changes)
+
+	usersCtx, disconnectUsers := context.WithCancel(ctx)
+	users := c.call(usersCtx, subscribeMethod, (&subscribeRequest{subscriber: "users", tables: []string{"public.users"}}).marshal())
+	all := c.call(ctx, subscribeMethod, (&subscribeRequest{subscriber: "all"}).marshal())
+
+	changes <- &warppipe.Changeset{
+		LSN:    100,
+		Kind:   warppipe.ChangesetKindInsert,
+		Schema: "public",
+		Table:  "users",
+		NewValues: []*warppipe.ChangesetColumn{
+			{Column: "id", Value: float64(42), Type: "bigint"},
+			{Column: "name", Value: "alice", Type: "text"},
+			{Column: "email", Value: nil, Type: "text"},
+		},
+	}
+	changes <- &warppipe.Changeset{LSN: 200, Kind: warppipe.ChangesetKindDelete, Schema: "public", Table: "pets"}
+
+	t.Run("fan out", func(t *testing.T) {
+		msg := c.receive(users)
+		assert.Equal(t, uint64(1), msg[1][0].v)
+		assert.Equal(t, uint64(100), msg[3][0].v)
+		assert.Equal(t, uint64(1), msg[7][0].v)
+		assert.Equal(t, "users", string(msg[9][0].data))
+
+		values := make([]field, 0, 3)
+		for _, col := range msg[12] {
+			fields, err := readFields(col.data)
+			assert.NoError(t, err)
+			values = append(values, fields[len(fields)-1])
+		}
+		assert.Equal(t, field{num: 5, wireType: wireVarint, v: 42}, values[0])
+		assert.Equal(t, field{num: 7, wireType: wireBytes, data: []byte("alice")}, values[1])
+		assert.Equal(t, field{num: 3, wireType: wireVarint, v: 1}, values[2])
+
+		assert.Equal(t, "users", string(c.receive(all)[9][0].data))
+		assert.Equal(t, "pets", string(c.receive(all)[9][0].data))
+	})
+
+	t.Run("ack", func(t *testing.T) {
+		assert.Equal(t, "0", c.ack("all", 1, 2))
+		assert.Equal(t, 0, srv.pendingCount("all"))
+		assert.Equal(t, 1, srv.pendingCount("users"))
+
+		assert.Equal(t, "5", c.ack("unknown", 1))
+	})
+
+	t.Run("resend after reconnect", func(t *testing.T) {
+		disconnectUsers()
+		users.Body.Close()
+
+		assert.Eventually(t, func() bool {
+			srv.mu.Lock()
+			defer srv.mu.Unlock()
+			return srv.subscribers["users"].conn == nil
+		}, time.Second, 10*time.Millisecond)
+
+		resp := c.call(ctx, subscribeMethod, (&subscribeRequest{subscriber: "users"}).marshal())
+		assert.Equal(t, uint64(1), c.receive(resp)[1][0].v)
+		assert.Equal(t, "0", c.ack("users", 1))
+		assert.Equal(t, 0, srv.pendingCount("users"))
+	})
+
+	t.Run("duplicate subscriber", func(t *testing.T) {
+		resp := c.call(ctx, subscribeMethod, (&subscribeRequest{subscriber: "all"}).marshal())
+		assert.Equal(t, "6", c.status(resp))
+	})
+}
+
+func TestServerSubscriberTimeout(t *testing.T) {
+	srv := NewServer(SubscriberTimeout(50 * time.Millisecond))
+	ts := httptest.NewUnstartedServer(srv)
+	ts.EnableHTTP2 = true
+	ts.StartTLS()
+	defer ts.Close()
+
+	c := &testClient{t: t, client: ts.Client(), url: ts.URL}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	changes := make(chan *warppipe.Changeset)
+	go srv.Run(ctx, changes)
+
+	gone := c.call(ctx, subscribeMethod, (&subscribeRequest{subscriber: "gone"}).marshal())
+	staying := c.call(ctx, subscribeMethod, (&subscribeRequest{subscriber: "staying"}).marshal())
+
+	changes <- &warppipe.Changeset{LSN: 100, Kind: warppipe.ChangesetKindInsert, Schema: "public", Table: "users"}
+	c.receive(gone)
+	c.receive(staying)
+	assert.Equal(t, "0", c.ack("staying", 1))
+
+	srv.mu.Lock()
+	d := srv.subscribers["gone"].pending[1]
+	srv.mu.Unlock()
+	assert.Equal(t, 1, d.refs)
+
+	gone.Body.Close()
+	assert.Eventually(t, func() bool {
+		srv.mu.Lock()
+		defer srv.mu.Unlock()
+		_, ok := srv.subscribers["gone"]
+		return !ok
+	}, time.Second, 10*time.Millisecond)
+
+	srv.mu.Lock()
+	assert.Equal(t, 0, d.refs)
+	srv.mu.Unlock()
+	assert.Equal(t, "5", c.ack("gone", 1))
+
+	// a connected subscriber does not expire
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, 0, srv.pendingCount("staying"))
+	staying.Body.Close()
+}
+
+func TestSubscriberMatch(t *testing.T) {
+	sub := &subscriber{
+		tables: []string{"public.*"},
+		resume: warppipe.Position{LSN: 100, ChangesetID: 10},
+	}
+
+	testCases := []struct {
+		change *warppipe.Changeset
+		match  bool
+	}{
+		{&warppipe.Changeset{LSN: 101, Schema: "public", Table: "users"}, true},
+		{&warppipe.Changeset{LSN: 100, Schema: "public", Table: "users"}, false},
+		{&warppipe.Changeset{LSN: 101, Schema: "audit", Table: "users"}, false},
+		{&warppipe.Changeset{ID: 11, Schema: "public", Table: "users"}, true},
+		{&warppipe.Changeset{ID: 10, Schema: "public", Table: "users"}, false},
+	}
+
+	for _, tc := range testCases {
+		assert.Equal(t, tc.match, sub.match(tc.change), "%+v", tc.change)
+	}
+}
@@ -0,0 +1,674 @@
+package sink
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"math/big"
+	"net/http"
+	"net/url"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	warppipe "github.com/perangel/warp-pipe"
+)
+
+const (
+	// DefaultAvroSubject is the subject template used by the Avro encoder if
+	// none is provided. It follows the registry's default topic name strategy
+	// for the Kafka sink's default topic.
+	DefaultAvroSubject = "{{.Schema}}.{{.Table}}-value"
+
+	avroMagicByte            = 0
+	avroNamespace            = "warp_pipe"
+	defaultRegistryTimeout   = 30 * time.Second
+	schemaRegistryMediaType  = "application/vnd.schemaregistry.v1+json"
+	avroTimestampLayout      = "2006-01-02 15:04:05.999999999"
+	avroTimestampTZLayout    = "2006-01-02 15:04:05.999999999-07"
+	avroTimestampTZMinLayout = "2006-01-02 15:04:05.999999999-07:00"
+)
+
+var numericTypePattern = regexp.MustCompile(`^(?:numeric|decimal)\((\d+),\s*(\d+)\)$`)
+
+// SchemaRegistryClient is a client for a Confluent-compatible schema registry.
+type SchemaRegistryClient struct {
+	url    string
+	client *http.Client
+}
+
+// NewSchemaRegistryClient returns a new SchemaRegistryClient for the registry
+// at the given URL.
+func NewSchemaRegistryClient(url string, client *http.Client) *SchemaRegistryClient {
+	return &SchemaRegistryClient{
+		url:    strings.TrimSuffix(url, "/"),
+		client: client,
+	}
+}
+
+// Register registers the schema under the subject, unless it already is, and
+// returns its ID. The registry rejects schemas that are incompatible with the
+// subject's previous versions.
+func (c *SchemaRegistryClient) Register(ctx context.Context, subject, schema string) (int, error) {
+	body, err := json.Marshal(map[string]string{"schema": schema})
+	if err != nil {
+		return 0, err
+	}
+
+	endpoint := fmt.Sprintf("%s/subjects/%s/versions", c.url, url.PathEscape(subject))
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", schemaRegistryMediaType)
+	req.Header.Set("Accept", schemaRegistryMediaType)
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return 0, fmt.Errorf("failed to register schema for subject %s: %w", subject, err)
+	}
+	defer resp.Body.Close()
+
+	b, err := ioutil.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return 0, err
+	}
+
+	var result struct {
+		ID        int    `json:"id"`
+		ErrorCode int    `json:"error_code"`
+		Message   string `json:"message"`
+	}
+	err = json.Unmarshal(b, &result)
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		if err == nil && result.Message != "" {
+			return 0, fmt.Errorf("failed to register schema for subject %s: %s (%d)", subject, result.Message, result.ErrorCode)
+		}
+		return 0, fmt.Errorf("failed to register schema for subject %s: registry responded with %s", subject, resp.Status)
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to parse schema registry response: %w", err)
+	}
+	return result.ID, nil
+}
+
+// AvroEncoder encodes changesets as Avro records in the schema registry wire
+// format: a zero magic byte, the 4-byte big-endian schema ID and the binary
+// encoded record.
+//
+// The record schema of each table is derived from the names and Postgres types
+// of its columns, and registered under the subject rendered from the subject
+// template. The record is an envelope with the changeset's position, kind and
+// timestamp, and its new and old values as `Value` records. Column fields are
+// nullable with a null default, so that columns missing from a changeset (e.g.
+// old values that only hold the replica identity) are encoded as null. When
+// new columns appear, or a column's type is widened to one its Avro type can
+// be promoted to (e.g. integer to bigint, or real to double precision), a new
+// schema version is registered with the columns seen so far; columns are never
+// removed, so each version can read data written with the previous ones. Other
+// type changes would break that compatibility, so encoding fails with an error
+// naming the column. Columns whose names are not valid Avro names are renamed,
+// with a numeric suffix when they would collide with another column's field,
+// and keep their original name as the field's doc.
+type AvroEncoder struct {
+	registry *SchemaRegistryClient
+	subject  *template.Template
+
+	mu     sync.Mutex
+	tables map[string]*avroTable
+}
+
+// avroTable is the schema of a table's records.
+type avroTable struct {
+	columns []*avroColumn
+	index   map[string]int
+	id      int
+	// subject the schema was registered under, or empty if the columns have
+	// changed since
+	subject string
+}
+
+type avroColumn struct {
+	name string
+	// field is the Avro field name of the column
+	field   string
+	pgType  string
+	avro    interface{}
+	encoder func(*bytes.Buffer, interface{}) error
+}
+
+// NewAvroEncoder returns a new AvroEncoder registering schemas in the
+// registry. The subject is a text/template executed with the changeset.
+func NewAvroEncoder(registry *SchemaRegistryClient, subject string) (*AvroEncoder, error) {
+	tmpl, err := parseNameTemplate("subject", subject, DefaultAvroSubject)
+	if err != nil {
+		return nil, err
+	}
+
+	return &AvroEncoder{
+		registry: registry,
+		subject:  tmpl,
+		tables:   make(map[string]*avroTable),
+	}, nil
+}
+
+// newAvroEncoder creates an AvroEncoder from the parameters of the
+// `avro?registry=http://localhost:8081&subject={{.Table}}-value` output format.
+func newAvroEncoder(_ Source, params url.Values) (Encoder, error) {
+	registry := params.Get("registry")
+	if registry == "" {
+		return nil, errors.New("the avro output format requires a schema registry URL, e.g. 'avro?registry=http://localhost:8081'")
+	}
+
+	return NewAvroEncoder(
+		NewSchemaRegistryClient(registry, &http.Client{Timeout: defaultRegistryTimeout}),
+		params.Get("subject"),
+	)
+}
+
+// ContentType implements Encoder.
+func (e *AvroEncoder) ContentType() string {
+	return "application/vnd.confluent.avro"
+}
+
+// Encode implements Encoder.
+func (e *AvroEncoder) Encode(change *warppipe.Changeset) ([]byte, error) {
+	subject, err := executeNameTemplate(e.subject, change)
+	if err != nil {
+		return nil, err
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	table, err := e.table(change, subject)
+	if err != nil {
+		return nil, err
+	}
+
+	var b bytes.Buffer
+	b.WriteByte(avroMagicByte)
+	binary.Write(&b, binary.BigEndian, uint32(table.id))
+
+	writeAvroLong(&b, change.ID)
+	writeAvroLong(&b, int64(change.LSN))
+	writeAvroLong(&b, change.TxID)
+	writeAvroLong(&b, int64(change.TxPosition))
+	writeAvroBool(&b, change.TxLast)
+	writeAvroString(&b, string(change.Kind))
+	writeAvroLong(&b, avroTimestamp(change.Timestamp))
+
+	for _, values := range [][]*warppipe.ChangesetColumn{change.NewValues, change.OldValues} {
+		if values == nil {
+			writeAvroLong(&b, 0)
+			continue
+		}
+		writeAvroLong(&b, 1)
+		err = table.encodeRow(&b, values)
+		if err != nil {
+			return nil, fmt.Errorf("failed to encode %s.%s: %w", change.Schema, change.Table, err)
+		}
+	}
+	return b.Bytes(), nil
+}
+
+// table returns the schema of the changeset's table, adding any new columns
+// and registering a new version if it has changed.
+func (e *AvroEncoder) table(change *warppipe.Changeset, subject string) (*avroTable, error) {
+	name := change.Schema + "." + change.Table
+	table, ok := e.tables[name]
+	if !ok {
+		table = &avroTable{index: make(map[string]int)}
+		e.tables[name] = table
+	}
+
+	for _, values := range [][]*warppipe.ChangesetColumn{change.NewValues, change.OldValues} {
+		for _, col := range values {
+			i, ok := table.index[col.Column]
+			if !ok {
+				column := newAvroColumn(col.Column, col.Type)
+				column.field = table.fieldName(col.Column)
+				table.index[col.Column] = len(table.columns)
+				table.columns = append(table.columns, column)
+				table.subject = ""
+				continue
+			}
+
+			current := table.columns[i]
+			if col.Type == "" || col.Type == current.pgType {
+				continue
+			}
+			column := newAvroColumn(col.Column, col.Type)
+			switch {
+			case avroPromotes(column.avro, current.avro):
+				// the current type holds the new values
+			case avroPromotes(current.avro, column.avro):
+				column.field = current.field
+				table.columns[i] = column
+				table.subject = ""
+			default:
+				return nil, fmt.Errorf("column %s of %s changed type from %s to %s, which is not compatible with its Avro schema", col.Column, name, current.pgType, col.Type)
+			}
+		}
+	}
+
+	if table.subject == subject {
+		return table, nil
+	}
+
+	schema, err := json.Marshal(table.schema(change.Schema, change.Table))
+	if err != nil {
+		return nil, err
+	}
+
+	id, err := e.registry.Register(context.Background(), subject, string(schema))
+	if err != nil {
+		return nil, err
+	}
+
+	table.id = id
+	table.subject = subject
+	return table, nil
+}
+
+// fieldName returns the Avro field name of a new column, which is not used by
+// the other columns.
+func (t *avroTable) fieldName(column string) string {
+	name := avroName(column)
+	field := name
+	for n := 2; t.hasField(field); n++ {
+		field = fmt.Sprintf("%s_%d", name, n)
+	}
+	return field
+}
+
+func (t *avroTable) hasField(field string) bool {
+	for _, col := range t.columns {
+		if col.field == field {
+			return true
+		}
+	}
+	return false
+}
+
+// schema returns the Avro schema of the table's envelope records.
+func (t *avroTable) schema(schema, table string) map[string]interface{} {
+	namespace := fmt.Sprintf("%s.%s.%s", avroNamespace, avroName(schema), avroName(table))
+
+	fields := make([]map[string]interface{}, len(t.columns))
+	for i, col := range t.columns {
+		fields[i] = map[string]interface{}{
+			"name":    col.field,
+			"type":    []interface{}{"null", col.avro},
+			"default": nil,
+		}
+		if col.field != col.name {
+			fields[i]["doc"] = col.name
+		}
+	}
+
+	value := map[string]interface{}{
+		"type":      "record",
+		"name":      "Value",
+		"namespace": namespace,
+		"fields":    fields,
+	}
+
+	return map[string]interface{}{
+		"type":      "record",
+		"name":      "Envelope",
+		"namespace": namespace,
+		"fields": []map[string]interface{}{
+			{"name": "id", "type": "long"},
+			{"name": "lsn", "type": "long"},
+			{"name": "txid", "type": "long"},
+			{"name": "tx_position", "type": "int"},
+			{"name": "tx_last", "type": "boolean"},
+			{"name": "kind", "type": "string"},
+			{"name": "timestamp", "type": map[string]string{"type": "long", "logicalType": "timestamp-micros"}},
+			{"name": "new_values", "type": []interface{}{"null", value}, "default": nil},
+			{"name": "old_values", "type": []interface{}{"null", "Value"}, "default": nil},
+		},
+	}
+}
+
+// encodeRow encodes the values as a `Value` record, with null for the columns
+// that are missing.
+func (t *avroTable) encodeRow(b *bytes.Buffer, values []*warppipe.ChangesetColumn) error {
+	row := make([]interface{}, len(t.columns))
+	present := make([]bool, len(t.columns))
+	for _, col := range values {
+		i := t.index[col.Column]
+		row[i] = col.Value
+		present[i] = true
+	}
+
+	for i, col := range t.columns {
+		if !present[i] || row[i] == nil {
+			writeAvroLong(b, 0)
+			continue
+		}
+		writeAvroLong(b, 1)
+		err := col.encoder(b, row[i])
+		if err != nil {
+			return fmt.Errorf("column %s: %w", col.name, err)
+		}
+	}
+	return nil
+}
+
+// newAvroColumn maps a column's Postgres type to an Avro type. Types without
+// a mapping, including arrays and JSON, are strings.
+func newAvroColumn(name, pgType string) *avroColumn {
+	col := &avroColumn{name: name, pgType: pgType, avro: "string", encoder: encodeAvroString}
+
+	t := strings.ToLower(strings.TrimSpace(pgType))
+	if m := numericTypePattern.FindStringSubmatch(t); m != nil {
+		precision, _ := strconv.Atoi(m[1])
+		scale, _ := strconv.Atoi(m[2])
+		col.avro = map[string]interface{}{"type": "bytes", "logicalType": "decimal", "precision": precision, "scale": scale}
+		col.encoder = decimalEncoder(scale)
+		return col
+	}
+
+	switch baseType(t) {
+	case "smallint", "int2", "integer", "int", "int4":
+		col.avro, col.encoder = "int", encodeAvroInt
+	case "bigint", "int8", "oid":
+		col.avro, col.encoder = "long", encodeAvroLong
+	case "real", "float4":
+		col.avro, col.encoder = "float", encodeAvroFloat
+	case "double precision", "float8":
+		col.avro, col.encoder = "double", encodeAvroDouble
+	case "boolean", "bool":
+		col.avro, col.encoder = "boolean", encodeAvroBool
+	case "bytea":
+		col.avro, col.encoder = "bytes", encodeAvroBytea
+	case "uuid":
+		col.avro = map[string]string{"type": "string", "logicalType": "uuid"}
+	case "date":
+		col.avro, col.encoder = map[string]string{"type": "int", "logicalType": "date"}, encodeAvroDate
+	case "timestamp", "timestamp without time zone", "timestamp with time zone", "timestamptz":
+		col.avro, col.encoder = map[string]string{"type": "long", "logicalType": "timestamp-micros"}, encodeAvroTimestamp
+	}
+	return col
+}
+
+// avroPromotes returns true if data written with the Avro type from can be
+// read with the type to, as they are equal or from can be promoted to to.
+func avroPromotes(from, to interface{}) bool {
+	if reflect.DeepEqual(from, to) {
+		return true
+	}
+
+	switch from {
+	case "int":
+		return to == "long" || to == "float" || to == "double"
+	case "long":
+		return to == "float" || to == "double"
+	case "float":
+		return to == "double"
+	}
+	return false
+}
+
+// avroName replaces the characters that are not allowed in Avro names.
+func avroName(name string) string {
+	b := []byte(name)
+	for i, c := range b {
+		if !(c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || i > 0 && c >= '0' && c <= '9') {
+			b[i] = '_'
+		}
+	}
+	return string(b)
+}
+
+func writeAvroLong(b *bytes.Buffer, v int64) {
+	var buf [binary.MaxVarintLen64]byte
+	// Avro longs are zig-zag encoded varints, like Go's signed varints
+	n := binary.PutVarint(buf[:], v)
+	b.Write(buf[:n])
+}
+
+func writeAvroBool(b *bytes.Buffer, v bool) {
+	if v {
+		b.WriteByte(1)
+	} else {
+		b.WriteByte(0)
+	}
+}
+
+func writeAvroString(b *bytes.Buffer, s string) {
+	writeAvroLong(b, int64(len(s)))
+	b.WriteString(s)
+}
+
+func writeAvroBytes(b *bytes.Buffer, v []byte) {
+	writeAvroLong(b, int64(len(v)))
+	b.Write(v)
+}
+
+func avroTimestamp(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.UnixNano() / int64(time.Microsecond)
+}
+
+// avroInteger converts a column value to an integer. Values of integer
+// columns are int64, but changesets built by hand may hold float64 or string
+// values.
+func avroInteger(v interface{}) (int64, error) {
+	switch n := v.(type) {
+	case float64:
+		if n != math.Trunc(n) {
+			return 0, fmt.Errorf("%v is not an integer", n)
+		}
+		return int64(n), nil
+	case int64:
+		return n, nil
+	case int:
+		return int64(n), nil
+	case json.Number:
+		return n.Int64()
+	case string:
+		return strconv.ParseInt(n, 10, 64)
+	default:
+		return 0, fmt.Errorf("unexpected %T value", v)
+	}
+}
+
+func avroFloat(v interface{}) (float64, error) {
+	switch n := v.(type) {
+	case float64:
+		return n, nil
+	case int64:
+		return float64(n), nil
+	case json.Number:
+		return n.Float64()
+	case string:
+		return strconv.ParseFloat(n, 64)
+	default:
+		return 0, fmt.Errorf("unexpected %T value", v)
+	}
+}
+
+func encodeAvroInt(b *bytes.Buffer, v interface{}) error {
+	n, err := avroInteger(v)
+	if err != nil {
+		return err
+	}
+	if n < math.MinInt32 || n > math.MaxInt32 {
+		return fmt.Errorf("%d overflows int", n)
+	}
+	writeAvroLong(b, n)
+	return nil
+}
+
+func encodeAvroLong(b *bytes.Buffer, v interface{}) error {
+	n, err := avroInteger(v)
+	if err != nil {
+		return err
+	}
+	writeAvroLong(b, n)
+	return nil
+}
+
+func encodeAvroFloat(b *bytes.Buffer, v interface{}) error {
+	f, err := avroFloat(v)
+	if err != nil {
+		return err
+	}
+	return binary.Write(b, binary.LittleEndian, math.Float32bits(float32(f)))
+}
+
+func encodeAvroDouble(b *bytes.Buffer, v interface{}) error {
+	f, err := avroFloat(v)
+	if err != nil {
+		return err
+	}
+	return binary.Write(b, binary.LittleEndian, math.Float64bits(f))
+}
+
+func encodeAvroBool(b *bytes.Buffer, v interface{}) error {
+	switch x := v.(type) {
+	case bool:
+		writeAvroBool(b, x)
+	case string:
+		writeAvroBool(b, x == "t" || x == "true")
+	default:
+		return fmt.Errorf("unexpected %T value", v)
+	}
+	return nil
+}
+
+func encodeAvroString(b *bytes.Buffer, v interface{}) error {
+	switch x := v.(type) {
+	case string:
+		writeAvroString(b, x)
+	case json.RawMessage:
+		writeAvroString(b, string(x))
+	case fmt.Stringer:
+		writeAvroString(b, x.String())
+	default:
+		writeAvroString(b, fmt.Sprint(v))
+	}
+	return nil
+}
+
+// encodeAvroBytea encodes a bytea value, which is hex encoded text, e.g.
+// `\x0102`.
+func encodeAvroBytea(b *bytes.Buffer, v interface{}) error {
+	switch x := v.(type) {
+	case []byte:
+		writeAvroBytes(b, x)
+	case string:
+		data, err := hex.DecodeString(strings.TrimPrefix(x, `\x`))
+		if err != nil {
+			return err
+		}
+		writeAvroBytes(b, data)
+	default:
+		return fmt.Errorf("unexpected %T value", v)
+	}
+	return nil
+}
+
+func encodeAvroDate(b *bytes.Buffer, v interface{}) error {
+	s, ok := v.(string)
+	if !ok {
+		if t, ok := v.(time.Time); ok {
+			s = t.Format("2006-01-02")
+		} else {
+			return fmt.Errorf("unexpected %T value", v)
+		}
+	}
+
+	t, err := time.Parse("2006-01-02", s)
+	if err != nil {
+		return err
+	}
+	writeAvroLong(b, t.Unix()/(24*60*60))
+	return nil
+}
+
+func encodeAvroTimestamp(b *bytes.Buffer, v interface{}) error {
+	t, ok := v.(time.Time)
+	if !ok {
+		s, ok := v.(string)
+		if !ok {
+			return fmt.Errorf("unexpected %T value", v)
+		}
+
+		var err error
+		for _, layout := range []string{avroTimestampTZLayout, avroTimestampTZMinLayout, avroTimestampLayout, time.RFC3339Nano} {
+			t, err = time.Parse(layout, s)
+			if err == nil {
+				break
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+	writeAvroLong(b, avroTimestamp(t))
+	return nil
+}
+
+// decimalEncoder returns an encoder for decimals with the given scale, as the
+// two's-complement big-endian bytes of their unscaled value.
+func decimalEncoder(scale int) func(*bytes.Buffer, interface{}) error {
+	return func(b *bytes.Buffer, v interface{}) error {
+		var s string
+		switch x := v.(type) {
+		case float64:
+			s = strconv.FormatFloat(x, 'f', -1, 64)
+		case string:
+			s = x
+		case json.Number:
+			s = x.String()
+		case fmt.Stringer:
+			s = x.String()
+		default:
+			return fmt.Errorf("unexpected %T value", v)
+		}
+
+		r, ok := new(big.Rat).SetString(s)
+		if !ok {
+			return fmt.Errorf("invalid decimal '%s'", s)
+		}
+		r.Mul(r, new(big.Rat).SetInt(new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(scale)), nil)))
+		if !r.IsInt() {
+			return fmt.Errorf("%s has more than %d decimal places", s, scale)
+		}
+
+		writeAvroBytes(b, twosComplement(r.Num()))
+		return nil
+	}
+}
+
+// twosComplement returns the minimal two's-complement big-endian bytes of n.
+func twosComplement(n *big.Int) []byte {
+	if n.Sign() >= 0 {
+		b := n.Bytes()
+		if len(b) == 0 || b[0]&0x80 != 0 {
+			b = append([]byte{0}, b...)
+		}
+		return b
+	}
+
+	// n + 2^(8*size), where size leaves room for the sign bit
+	size := n.BitLen()/8 + 1
+	return new(big.Int).Add(n, new(big.Int).Lsh(big.NewInt(1), uint(size*8))).Bytes()
+}
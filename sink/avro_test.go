@@ -0,0 +1,237 @@
+package sink_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	warppipe "github.com/perangel/warp-pipe"
+	"github.com/perangel/warp-pipe/sink"
+)
+
+// fakeRegistry is a schema registry stand-in that assigns IDs to schemas and
+// records the versions of each subject.
+type fakeRegistry struct {
+	mu       sync.Mutex
+	ids      map[string]int
+	subjects map[string][]string
+}
+
+func (r *fakeRegistry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	subject := strings.TrimSuffix(strings.TrimPrefix(req.URL.Path, "/subjects/"), "/versions")
+	var body struct {
+		Schema string `json:"schema"`
+	}
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		return
+	}
+
+	id, ok := r.ids[body.Schema]
+	if !ok {
+		id = len(r.ids) + 1
+		r.ids[body.Schema] = id
+		r.subjects[subject] = append(r.subjects[subject], body.Schema)
+	}
+	json.NewEncoder(w).Encode(map[string]int{"id": id})
+}
+
+// readLong reads a zig-zag encoded Avro long.
+func readLong(t *testing.T, r *bytes.Reader) int64 {
+	n, err := binary.ReadVarint(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+func readBytes(t *testing.T, r *bytes.Reader) []byte {
+	b := make([]byte, readLong(t, r))
+	r.Read(b)
+	return b
+}
+
+func TestAvroEncoder(t *testing.T) {
+	registry := &fakeRegistry{ids: make(map[string]int), subjects: make(map[string][]string)}
+	srv := httptest.NewServer(registry)
+	defer srv.Close()
+
+	enc, err := sink.NewEncoder("avro?registry="+srv.URL, sink.Source{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ts := time.Date(2021, 3, 1, 12, 0, 0, 0, time.UTC)
+	insert := &warppipe.Changeset{
+		ID:        5,
+		Kind:      warppipe.ChangesetKindInsert,
+		Schema:    "public",
+		Table:     "users",
+		Timestamp: ts,
+		NewValues: []*warppipe.ChangesetColumn{
+			{Column: "id", Value: float64(42), Type: "bigint"},
+			{Column: "name", Value: "alice", Type: "text"},
+			{Column: "balance", Value: 10.5, Type: "numeric(10,2)"},
+			{Column: "created_at", Value: "2021-03-01 12:00:00.5+00", Type: "timestamp with time zone"},
+		},
+	}
+
+	t.Run("wire format", func(t *testing.T) {
+		b, err := enc.Encode(insert)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		r := bytes.NewReader(b)
+		header := make([]byte, 5)
+		r.Read(header)
+		assert.Equal(t, []byte{0, 0, 0, 0, 1}, header)
+
+		assert.Equal(t, int64(5), readLong(t, r)) // id
+		assert.Equal(t, int64(0), readLong(t, r)) // lsn
+		assert.Equal(t, int64(0), readLong(t, r)) // txid
+		assert.Equal(t, int64(0), readLong(t, r)) // tx_position
+		r.ReadByte()                              // tx_last
+		assert.Equal(t, "insert", string(readBytes(t, r)))
+		assert.Equal(t, ts.UnixNano()/1000, readLong(t, r))
+
+		assert.Equal(t, int64(1), readLong(t, r)) // new_values
+		assert.Equal(t, int64(1), readLong(t, r))
+		assert.Equal(t, int64(42), readLong(t, r))
+		assert.Equal(t, int64(1), readLong(t, r))
+		assert.Equal(t, "alice", string(readBytes(t, r)))
+		assert.Equal(t, int64(1), readLong(t, r))
+		assert.Equal(t, []byte{0x04, 0x1a}, readBytes(t, r)) // 1050
+		assert.Equal(t, int64(1), readLong(t, r))
+		assert.Equal(t, ts.Add(500*time.Millisecond).UnixNano()/1000, readLong(t, r))
+		assert.Equal(t, int64(0), readLong(t, r)) // old_values
+		assert.Equal(t, 0, r.Len())
+
+		var schema struct {
+			Name   string `json:"name"`
+			Fields []struct {
+				Name string `json:"name"`
+			} `json:"fields"`
+		}
+		assert.NoError(t, json.Unmarshal([]byte(registry.subjects["public.users-value"][0]), &schema))
+		assert.Equal(t, "Envelope", schema.Name)
+		assert.Equal(t, "new_values", schema.Fields[7].Name)
+	})
+
+	t.Run("schema is registered once", func(t *testing.T) {
+		_, err := enc.Encode(insert)
+		assert.NoError(t, err)
+
+		del := &warppipe.Changeset{
+			Kind:      warppipe.ChangesetKindDelete,
+			Schema:    "public",
+			Table:     "users",
+			OldValues: []*warppipe.ChangesetColumn{{Column: "id", Value: float64(42), Type: "bigint"}},
+		}
+		b, err := enc.Encode(del)
+		assert.NoError(t, err)
+		assert.Equal(t, uint32(1), binary.BigEndian.Uint32(b[1:5]))
+		assert.Len(t, registry.subjects["public.users-value"], 1)
+	})
+
+	t.Run("schema evolution", func(t *testing.T) {
+		change := *insert
+		change.NewValues = append(change.NewValues, &warppipe.ChangesetColumn{Column: "email", Value: "a@example.com", Type: "text"})
+
+		b, err := enc.Encode(&change)
+		assert.NoError(t, err)
+		assert.Equal(t, uint32(2), binary.BigEndian.Uint32(b[1:5]))
+		assert.Len(t, registry.subjects["public.users-value"], 2)
+
+		// removed columns are kept, and encoded as null
+		b, err = enc.Encode(insert)
+		assert.NoError(t, err)
+		assert.Equal(t, uint32(2), binary.BigEndian.Uint32(b[1:5]))
+		assert.Equal(t, byte(0), b[len(b)-2]) // email
+	})
+
+	t.Run("column type changes", func(t *testing.T) {
+		change := func(id float64, idType string) *warppipe.Changeset {
+			return &warppipe.Changeset{
+				Kind:      warppipe.ChangesetKindInsert,
+				Schema:    "public",
+				Table:     "orders",
+				NewValues: []*warppipe.ChangesetColumn{{Column: "id", Value: id, Type: idType}},
+			}
+		}
+
+		_, err := enc.Encode(change(1, "integer"))
+		assert.NoError(t, err)
+		assert.Len(t, registry.subjects["public.orders-value"], 1)
+
+		// int is promoted to long
+		_, err = enc.Encode(change(2, "bigint"))
+		assert.NoError(t, err)
+		assert.Len(t, registry.subjects["public.orders-value"], 2)
+
+		// narrower values are written with the wider type
+		_, err = enc.Encode(change(3, "smallint"))
+		assert.NoError(t, err)
+		assert.Len(t, registry.subjects["public.orders-value"], 2)
+
+		_, err = enc.Encode(change(4, "text"))
+		assert.EqualError(t, err, "column id of public.orders changed type from bigint to text, which is not compatible with its Avro schema")
+		assert.Len(t, registry.subjects["public.orders-value"], 2)
+	})
+
+	t.Run("colliding field names", func(t *testing.T) {
+		_, err := enc.Encode(&warppipe.Changeset{
+			Kind:   warppipe.ChangesetKindInsert,
+			Schema: "public",
+			Table:  "people",
+			NewValues: []*warppipe.ChangesetColumn{
+				{Column: "first_name", Value: "a", Type: "text"},
+				{Column: "first-name", Value: "b", Type: "text"},
+				{Column: "first name", Value: "c", Type: "text"},
+			},
+		})
+		if !assert.NoError(t, err) {
+			return
+		}
+
+		type field struct {
+			Name string          `json:"name"`
+			Doc  string          `json:"doc,omitempty"`
+			Type json.RawMessage `json:"type"`
+		}
+		var envelope struct {
+			Fields []field `json:"fields"`
+		}
+		assert.NoError(t, json.Unmarshal([]byte(registry.subjects["public.people-value"][0]), &envelope))
+		var newValues []json.RawMessage
+		assert.NoError(t, json.Unmarshal(envelope.Fields[7].Type, &newValues))
+		var value struct {
+			Fields []field `json:"fields"`
+		}
+		assert.NoError(t, json.Unmarshal(newValues[1], &value))
+
+		var names, docs []string
+		for _, f := range value.Fields {
+			names = append(names, f.Name)
+			docs = append(docs, f.Doc)
+		}
+		assert.Equal(t, []string{"first_name", "first_name_2", "first_name_3"}, names)
+		assert.Equal(t, []string{"", "first-name", "first name"}, docs)
+	})
+
+	t.Run("missing registry", func(t *testing.T) {
+		_, err := sink.NewEncoder("avro", sink.Source{})
+		assert.Error(t, err)
+	})
+}
@@ -0,0 +1,187 @@
+package sink
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	warppipe "github.com/perangel/warp-pipe"
+)
+
+const (
+	cloudEventsSpecVersion = "1.0"
+	cloudEventsContentType = "application/cloudevents+json"
+	cloudEventsBatchType   = "application/cloudevents-batch+json"
+	cloudEventsTypePrefix  = "warp_pipe"
+)
+
+// CloudEventsMode is the content mode in which CloudEvents are posted to HTTP
+// endpoints.
+type CloudEventsMode string
+
+// CloudEvents content modes.
+const (
+	// CloudEventsStructured posts each batch as a JSON array of events.
+	CloudEventsStructured CloudEventsMode = "structured"
+	// CloudEventsBinary posts each event in its own request, with the
+	// changeset as the body and the event attributes as `ce-` headers.
+	CloudEventsBinary CloudEventsMode = "binary"
+)
+
+// CloudEventsEncoder encodes changesets as CloudEvents 1.0 events, with the
+// changeset as JSON data. Events have the type
+// `warp_pipe.<schema>.<table>.<kind>`, the source database as source, the
+// changeset's position as ID (see messageID) and its timestamp as time.
+//
+// Encode returns events in the structured JSON format. When posted to a
+// webhook, events are sent in the encoder's content mode.
+type CloudEventsEncoder struct {
+	Source string
+	Mode   CloudEventsMode
+}
+
+// NewCloudEventsEncoder returns a new CloudEventsEncoder.
+func NewCloudEventsEncoder(source string, mode CloudEventsMode) *CloudEventsEncoder {
+	return &CloudEventsEncoder{
+		Source: source,
+		Mode:   mode,
+	}
+}
+
+// newCloudEventsEncoder creates a CloudEventsEncoder from the parameters of
+// the `cloudevents?mode=binary&source=/my/source` output format. The source
+// defaults to the database's `postgres://host:port/database` URL.
+func newCloudEventsEncoder(src Source, params url.Values) (Encoder, error) {
+	mode := CloudEventsStructured
+	switch v := CloudEventsMode(params.Get("mode")); v {
+	case "", CloudEventsStructured:
+	case CloudEventsBinary:
+		mode = v
+	default:
+		return nil, fmt.Errorf("invalid mode '%s'. Must be one of: structured, binary", v)
+	}
+
+	source := params.Get("source")
+	if source == "" {
+		u := url.URL{Scheme: "postgres", Host: src.Host, Path: "/" + src.Database}
+		if src.Port != 0 {
+			u.Host += ":" + strconv.Itoa(src.Port)
+		}
+		source = u.String()
+	}
+
+	return NewCloudEventsEncoder(source, mode), nil
+}
+
+type cloudEvent struct {
+	SpecVersion     string          `json:"specversion"`
+	Type            string          `json:"type"`
+	Source          string          `json:"source"`
+	ID              string          `json:"id"`
+	Time            string          `json:"time,omitempty"`
+	Subject         string          `json:"subject,omitempty"`
+	DataContentType string          `json:"datacontenttype"`
+	Data            json.RawMessage `json:"data"`
+}
+
+// Encode implements Encoder.
+func (e *CloudEventsEncoder) Encode(change *warppipe.Changeset) ([]byte, error) {
+	event, err := e.event(change)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(event)
+}
+
+// ContentType implements Encoder.
+func (e *CloudEventsEncoder) ContentType() string {
+	return cloudEventsContentType
+}
+
+// EncodeHTTP implements HTTPEncoder.
+func (e *CloudEventsEncoder) EncodeHTTP(changes []*warppipe.Changeset) ([]*HTTPMessage, error) {
+	events := make([]*cloudEvent, len(changes))
+	for i, change := range changes {
+		event, err := e.event(change)
+		if err != nil {
+			return nil, err
+		}
+		events[i] = event
+	}
+
+	if e.Mode != CloudEventsBinary {
+		body, err := json.Marshal(events)
+		if err != nil {
+			return nil, err
+		}
+		return []*HTTPMessage{{
+			Header: http.Header{"Content-Type": {cloudEventsBatchType}},
+			Body:   body,
+		}}, nil
+	}
+
+	msgs := make([]*HTTPMessage, len(events))
+	for i, event := range events {
+		header := http.Header{}
+		header.Set("Content-Type", event.DataContentType)
+		header.Set("ce-specversion", event.SpecVersion)
+		header.Set("ce-type", event.Type)
+		header.Set("ce-source", event.Source)
+		header.Set("ce-id", event.ID)
+		if event.Time != "" {
+			header.Set("ce-time", event.Time)
+		}
+		if event.Subject != "" {
+			header.Set("ce-subject", event.Subject)
+		}
+		msgs[i] = &HTTPMessage{Header: header, Body: event.Data}
+	}
+	return msgs, nil
+}
+
+func (e *CloudEventsEncoder) event(change *warppipe.Changeset) (*cloudEvent, error) {
+	data, err := json.Marshal(change)
+	if err != nil {
+		return nil, err
+	}
+
+	id, err := messageID(change, nil)
+	if err != nil {
+		return nil, err
+	}
+	if id == "" {
+		id, err = randomID()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	event := &cloudEvent{
+		SpecVersion:     cloudEventsSpecVersion,
+		Type:            fmt.Sprintf("%s.%s.%s.%s", cloudEventsTypePrefix, change.Schema, change.Table, change.Kind),
+		Source:          e.Source,
+		ID:              id,
+		Subject:         change.Schema + "." + change.Table,
+		DataContentType: "application/json",
+		Data:            data,
+	}
+	if !change.Timestamp.IsZero() {
+		event.Time = change.Timestamp.UTC().Format(time.RFC3339Nano)
+	}
+	return event, nil
+}
+
+// randomID returns a random ID for events whose changeset has no position.
+func randomID() (string, error) {
+	b := make([]byte, 16)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
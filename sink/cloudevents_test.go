@@ -0,0 +1,111 @@
+package sink_test
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	warppipe "github.com/perangel/warp-pipe"
+	"github.com/perangel/warp-pipe/sink"
+)
+
+func TestCloudEventsEncoder(t *testing.T) {
+	ts := time.Date(2021, 3, 1, 12, 0, 0, 0, time.UTC)
+	changes := []*warppipe.Changeset{
+		{LSN: 100, TxPosition: 0, Kind: warppipe.ChangesetKindInsert, Schema: "public", Table: "users", Timestamp: ts},
+		{ID: 7, Kind: warppipe.ChangesetKindDelete, Schema: "public", Table: "pets", Timestamp: ts},
+	}
+	src := sink.Source{Host: "db.example.com", Port: 5432, Database: "app"}
+
+	t.Run("structured", func(t *testing.T) {
+		enc, err := sink.NewEncoder("cloudevents", src)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, "application/cloudevents+json", enc.ContentType())
+
+		b, err := enc.Encode(changes[0])
+		assert.NoError(t, err)
+
+		var event map[string]interface{}
+		assert.NoError(t, json.Unmarshal(b, &event))
+		assert.Equal(t, "1.0", event["specversion"])
+		assert.Equal(t, "warp_pipe.public.users.insert", event["type"])
+		assert.Equal(t, "postgres://db.example.com:5432/app", event["source"])
+		assert.Equal(t, "100-0", event["id"])
+		assert.Equal(t, "2021-03-01T12:00:00Z", event["time"])
+		assert.Equal(t, "application/json", event["datacontenttype"])
+		assert.Equal(t, "users", event["data"].(map[string]interface{})["table"])
+	})
+
+	t.Run("structured batch webhook", func(t *testing.T) {
+		var events []map[string]interface{}
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			assert.Equal(t, "application/cloudevents-batch+json", r.Header.Get("Content-Type"))
+			assert.NoError(t, json.NewDecoder(r.Body).Decode(&events))
+		}))
+		defer srv.Close()
+
+		enc, err := sink.NewEncoder("cloudevents?source=/warp-pipe/app", src)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		s, err := sink.Open(srv.URL, enc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer s.Close()
+
+		assert.NoError(t, s.Write(context.Background(), changes))
+		assert.Len(t, events, 2)
+		assert.Equal(t, "/warp-pipe/app", events[1]["source"])
+		assert.Equal(t, "7", events[1]["id"])
+	})
+
+	t.Run("binary webhook", func(t *testing.T) {
+		var headers []http.Header
+		var bodies [][]byte
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			b, err := ioutil.ReadAll(r.Body)
+			assert.NoError(t, err)
+			headers = append(headers, r.Header)
+			bodies = append(bodies, b)
+		}))
+		defer srv.Close()
+
+		enc, err := sink.NewEncoder("cloudevents?mode=binary", src)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		s, err := sink.Open(srv.URL, enc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer s.Close()
+
+		assert.NoError(t, s.Write(context.Background(), changes))
+		assert.Len(t, headers, 2)
+		assert.Equal(t, "application/json", headers[0].Get("Content-Type"))
+		assert.Equal(t, "1.0", headers[0].Get("ce-specversion"))
+		assert.Equal(t, "warp_pipe.public.pets.delete", headers[1].Get("ce-type"))
+		assert.Equal(t, "7", headers[1].Get("ce-id"))
+		assert.Equal(t, "2021-03-01T12:00:00Z", headers[1].Get("ce-time"))
+
+		var change warppipe.Changeset
+		assert.NoError(t, json.Unmarshal(bodies[1], &change))
+		assert.Equal(t, int64(7), change.ID)
+	})
+
+	t.Run("invalid mode", func(t *testing.T) {
+		_, err := sink.NewEncoder("cloudevents?mode=batch", src)
+		assert.EqualError(t, err, "invalid mode 'batch'. Must be one of: structured, binary")
+	})
+}
@@ -0,0 +1,325 @@
+package sink
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	warppipe "github.com/perangel/warp-pipe"
+)
+
+const (
+	defaultDebeziumName = "warp_pipe"
+	debeziumConnector   = "postgresql"
+	debeziumVersion     = "warp-pipe"
+)
+
+// debeziumOps maps changeset kinds to Debezium operations.
+var debeziumOps = map[warppipe.ChangesetKind]string{
+	warppipe.ChangesetKindInsert:   "c",
+	warppipe.ChangesetKindUpdate:   "u",
+	warppipe.ChangesetKindDelete:   "d",
+	warppipe.ChangesetKindSnapshot: "r",
+	warppipe.ChangesetKindTruncate: "t",
+}
+
+// DebeziumEncoder encodes changesets as Debezium change events, so that
+// consumers of the Debezium Postgres connector can consume them unchanged.
+// Each event has the `before` and `after` images of the row, a `source` block
+// identifying the database, table and position, the operation (`c`, `u`, `d`,
+// `r` for snapshot reads and `t` for truncates) and the time at which it was
+// encoded. In update and delete events, `before` only holds the replica
+// identity columns unless the table's replica identity is FULL.
+//
+// With Schemas set, the event is wrapped in the `{"schema": ..., "payload": ...}`
+// format of the Kafka Connect JSON converter, with column schemas derived from
+// their Postgres types.
+type DebeziumEncoder struct {
+	// Name is the logical name of the server, used in `source.name` and
+	// schema names.
+	Name     string
+	Database string
+	Schemas  bool
+
+	now func() time.Time
+}
+
+// NewDebeziumEncoder returns a new DebeziumEncoder.
+func NewDebeziumEncoder(name, database string, schemas bool) *DebeziumEncoder {
+	if name == "" {
+		name = defaultDebeziumName
+	}
+
+	return &DebeziumEncoder{
+		Name:     name,
+		Database: database,
+		Schemas:  schemas,
+		now:      time.Now,
+	}
+}
+
+// newDebeziumEncoder creates a DebeziumEncoder from the parameters of the
+// `debezium?name=server1&schemas=true` output format. Schemas are enabled by
+// default.
+func newDebeziumEncoder(src Source, params url.Values) (Encoder, error) {
+	schemas := true
+	if v := params.Get("schemas"); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid schemas '%s': %w", v, err)
+		}
+		schemas = b
+	}
+
+	return NewDebeziumEncoder(params.Get("name"), src.Database, schemas), nil
+}
+
+type debeziumSource struct {
+	Version   string  `json:"version"`
+	Connector string  `json:"connector"`
+	Name      string  `json:"name"`
+	TsMs      int64   `json:"ts_ms"`
+	Snapshot  string  `json:"snapshot"`
+	DB        string  `json:"db"`
+	Schema    string  `json:"schema"`
+	Table     string  `json:"table"`
+	TxID      *int64  `json:"txId"`
+	LSN       *uint64 `json:"lsn"`
+	Xmin      *int64  `json:"xmin"`
+}
+
+type debeziumPayload struct {
+	Before json.RawMessage `json:"before"`
+	After  json.RawMessage `json:"after"`
+	Source debeziumSource  `json:"source"`
+	Op     string          `json:"op"`
+	TsMs   int64           `json:"ts_ms"`
+}
+
+// debeziumField is a Kafka Connect schema.
+type debeziumField struct {
+	Type     string           `json:"type"`
+	Fields   []*debeziumField `json:"fields,omitempty"`
+	Optional bool             `json:"optional"`
+	Name     string           `json:"name,omitempty"`
+	Field    string           `json:"field,omitempty"`
+}
+
+// debeziumSourceFields is the schema of the `source` block.
+var debeziumSourceFields = []*debeziumField{
+	{Type: "string", Field: "version"},
+	{Type: "string", Field: "connector"},
+	{Type: "string", Field: "name"},
+	{Type: "int64", Field: "ts_ms"},
+	{Type: "string", Optional: true, Field: "snapshot"},
+	{Type: "string", Field: "db"},
+	{Type: "string", Field: "schema"},
+	{Type: "string", Field: "table"},
+	{Type: "int64", Optional: true, Field: "txId"},
+	{Type: "int64", Optional: true, Field: "lsn"},
+	{Type: "int64", Optional: true, Field: "xmin"},
+}
+
+// Encode implements Encoder.
+func (e *DebeziumEncoder) Encode(change *warppipe.Changeset) ([]byte, error) {
+	op, ok := debeziumOps[change.Kind]
+	if !ok {
+		return nil, fmt.Errorf("unsupported changeset kind '%s'", change.Kind)
+	}
+
+	var before, after []*warppipe.ChangesetColumn
+	switch change.Kind {
+	case warppipe.ChangesetKindInsert, warppipe.ChangesetKindSnapshot:
+		after = change.NewValues
+	case warppipe.ChangesetKindUpdate:
+		before, after = change.OldValues, change.NewValues
+	case warppipe.ChangesetKindDelete:
+		before = change.OldValues
+	}
+
+	payload := debeziumPayload{
+		Source: e.source(change),
+		Op:     op,
+		TsMs:   e.now().UnixNano() / int64(time.Millisecond),
+	}
+
+	var err error
+	payload.Before, err = debeziumRow(before)
+	if err != nil {
+		return nil, err
+	}
+	payload.After, err = debeziumRow(after)
+	if err != nil {
+		return nil, err
+	}
+
+	if !e.Schemas {
+		return json.Marshal(payload)
+	}
+
+	return json.Marshal(struct {
+		Schema  *debeziumField  `json:"schema"`
+		Payload debeziumPayload `json:"payload"`
+	}{e.schema(change), payload})
+}
+
+// ContentType implements Encoder.
+func (e *DebeziumEncoder) ContentType() string {
+	return "application/json"
+}
+
+func (e *DebeziumEncoder) source(change *warppipe.Changeset) debeziumSource {
+	ts := change.CommitTime
+	if ts.IsZero() {
+		ts = change.Timestamp
+	}
+
+	src := debeziumSource{
+		Version:   debeziumVersion,
+		Connector: debeziumConnector,
+		Name:      e.Name,
+		TsMs:      ts.UnixNano() / int64(time.Millisecond),
+		Snapshot:  "false",
+		DB:        e.Database,
+		Schema:    change.Schema,
+		Table:     change.Table,
+	}
+
+	if change.Kind == warppipe.ChangesetKindSnapshot {
+		src.Snapshot = "true"
+	}
+	if change.TxID != 0 {
+		txID := change.TxID
+		src.TxID = &txID
+	}
+	if change.LSN != 0 {
+		lsn := change.LSN
+		src.LSN = &lsn
+	}
+	return src
+}
+
+// schema returns the envelope schema of the changeset's table. The row schema
+// is derived from the new values, or the old values if there are none.
+func (e *DebeziumEncoder) schema(change *warppipe.Changeset) *debeziumField {
+	columns := change.NewValues
+	if len(columns) == 0 {
+		columns = change.OldValues
+	}
+
+	prefix := fmt.Sprintf("%s.%s.%s", e.Name, change.Schema, change.Table)
+	rowFields := make([]*debeziumField, len(columns))
+	for i, col := range columns {
+		rowFields[i] = debeziumColumnField(col)
+	}
+
+	return &debeziumField{
+		Type: "struct",
+		Fields: []*debeziumField{
+			{Type: "struct", Fields: rowFields, Optional: true, Name: prefix + ".Value", Field: "before"},
+			{Type: "struct", Fields: rowFields, Optional: true, Name: prefix + ".Value", Field: "after"},
+			{Type: "struct", Fields: debeziumSourceFields, Name: "io.debezium.connector.postgresql.Source", Field: "source"},
+			{Type: "string", Field: "op"},
+			{Type: "int64", Optional: true, Field: "ts_ms"},
+		},
+		Name: prefix + ".Envelope",
+	}
+}
+
+// debeziumColumnField returns the schema of a column, mapping its Postgres
+// type the same way as the Debezium connector does with
+// `decimal.handling.mode=double`. Types without a mapping, including arrays,
+// are strings.
+func debeziumColumnField(col *warppipe.ChangesetColumn) *debeziumField {
+	f := &debeziumField{Type: "string", Optional: true, Field: col.Column}
+
+	switch baseType(col.Type) {
+	case "smallint", "int2":
+		f.Type = "int16"
+	case "integer", "int", "int4":
+		f.Type = "int32"
+	case "bigint", "int8", "oid":
+		f.Type = "int64"
+	case "real", "float4":
+		f.Type = "float"
+	case "double precision", "float8", "numeric", "decimal":
+		f.Type = "double"
+	case "boolean", "bool":
+		f.Type = "boolean"
+	case "bytea":
+		f.Type = "bytes"
+	case "json", "jsonb":
+		f.Name = "io.debezium.data.Json"
+	case "uuid":
+		f.Name = "io.debezium.data.Uuid"
+	case "timestamp with time zone", "timestamptz":
+		f.Name = "io.debezium.time.ZonedTimestamp"
+	case "time with time zone", "timetz":
+		f.Name = "io.debezium.time.ZonedTime"
+	}
+	return f
+}
+
+// baseType returns a Postgres type name without its modifiers, e.g. `numeric`
+// for `numeric(10,2)`. Array types keep their `[]` suffix.
+func baseType(pgType string) string {
+	t := strings.ToLower(strings.TrimSpace(pgType))
+	array := strings.HasSuffix(t, "[]")
+	t = strings.TrimSuffix(t, "[]")
+	if i := strings.Index(t, "("); i >= 0 {
+		// e.g. `timestamp(3) with time zone`
+		t = strings.TrimSpace(t[:i] + t[strings.Index(t, ")")+1:])
+	}
+	if array {
+		t += "[]"
+	}
+	return t
+}
+
+// debeziumRow encodes columns as a JSON object, in column order. Integer
+// columns are encoded as integers, and json columns as strings. It returns `null` if there are no columns.
+func debeziumRow(columns []*warppipe.ChangesetColumn) (json.RawMessage, error) {
+	if len(columns) == 0 {
+		return json.RawMessage("null"), nil
+	}
+
+	var b bytes.Buffer
+	b.WriteByte('{')
+	for i, col := range columns {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+
+		name, err := json.Marshal(col.Column)
+		if err != nil {
+			return nil, err
+		}
+		b.Write(name)
+		b.WriteByte(':')
+
+		value := col.Value
+		switch field := debeziumColumnField(col); {
+		case field.Type == "int16" || field.Type == "int32" || field.Type == "int64":
+			if f, ok := value.(float64); ok {
+				value = int64(f)
+			}
+		case field.Name == "io.debezium.data.Json":
+			// JSON values are strings in Debezium events
+			if raw, ok := value.(json.RawMessage); ok {
+				value = string(raw)
+			}
+		}
+
+		v, err := json.Marshal(value)
+		if err != nil {
+			return nil, fmt.Errorf("failed to encode column %s: %w", col.Column, err)
+		}
+		b.Write(v)
+	}
+	b.WriteByte('}')
+	return b.Bytes(), nil
+}
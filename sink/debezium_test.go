@@ -0,0 +1,131 @@
+package sink_test
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	warppipe "github.com/perangel/warp-pipe"
+	"github.com/perangel/warp-pipe/sink"
+)
+
+func TestDebeziumEncoder(t *testing.T) {
+	commitTime := time.Date(2021, 3, 1, 12, 0, 0, 0, time.UTC)
+	update := &warppipe.Changeset{
+		LSN:        12345,
+		TxID:       678,
+		Kind:       warppipe.ChangesetKindUpdate,
+		Schema:     "public",
+		Table:      "users",
+		CommitTime: commitTime,
+		NewValues: []*warppipe.ChangesetColumn{
+			{Column: "id", Value: float64(1), Type: "bigint"},
+			{Column: "name", Value: "alice", Type: "character varying(255)"},
+			{Column: "balance", Value: 10.5, Type: "numeric(10,2)"},
+		},
+		OldValues: []*warppipe.ChangesetColumn{
+			{Column: "id", Value: float64(1), Type: "bigint"},
+		},
+	}
+
+	t.Run("payload", func(t *testing.T) {
+		enc, err := sink.NewEncoder("debezium?schemas=false&name=server1", sink.Source{Database: "app"})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		b, err := enc.Encode(update)
+		assert.NoError(t, err)
+
+		var event map[string]interface{}
+		assert.NoError(t, json.Unmarshal(b, &event))
+		assert.Equal(t, "u", event["op"])
+		assert.Equal(t, map[string]interface{}{"id": float64(1)}, event["before"])
+		assert.Equal(t, map[string]interface{}{"id": float64(1), "name": "alice", "balance": 10.5}, event["after"])
+		assert.NotZero(t, event["ts_ms"])
+		assert.Equal(t, map[string]interface{}{
+			"version":   "warp-pipe",
+			"connector": "postgresql",
+			"name":      "server1",
+			"ts_ms":     float64(commitTime.Unix() * 1000),
+			"snapshot":  "false",
+			"db":        "app",
+			"schema":    "public",
+			"table":     "users",
+			"txId":      float64(678),
+			"lsn":       float64(12345),
+			"xmin":      nil,
+		}, event["source"])
+		assert.Contains(t, string(b), `"after":{"id":1,"name":"alice","balance":10.5}`)
+	})
+
+	t.Run("operations", func(t *testing.T) {
+		enc := sink.NewDebeziumEncoder("", "app", false)
+		testCases := []struct {
+			kind   warppipe.ChangesetKind
+			op     string
+			before bool
+			after  bool
+		}{
+			{warppipe.ChangesetKindInsert, "c", false, true},
+			{warppipe.ChangesetKindSnapshot, "r", false, true},
+			{warppipe.ChangesetKindDelete, "d", true, false},
+			{warppipe.ChangesetKindTruncate, "t", false, false},
+		}
+
+		for _, tc := range testCases {
+			change := *update
+			change.Kind = tc.kind
+			b, err := enc.Encode(&change)
+			assert.NoError(t, err)
+
+			var event map[string]interface{}
+			assert.NoError(t, json.Unmarshal(b, &event))
+			assert.Equal(t, tc.op, event["op"], string(tc.kind))
+			assert.Equal(t, tc.before, event["before"] != nil, string(tc.kind))
+			assert.Equal(t, tc.after, event["after"] != nil, string(tc.kind))
+		}
+	})
+
+	t.Run("schema", func(t *testing.T) {
+		enc, err := sink.NewEncoder("debezium", sink.Source{Database: "app"})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		b, err := enc.Encode(update)
+		assert.NoError(t, err)
+
+		var event struct {
+			Schema struct {
+				Name   string `json:"name"`
+				Fields []struct {
+					Field  string `json:"field"`
+					Fields []struct {
+						Type  string `json:"type"`
+						Field string `json:"field"`
+					} `json:"fields"`
+				} `json:"fields"`
+			} `json:"schema"`
+			Payload map[string]interface{} `json:"payload"`
+		}
+		assert.NoError(t, json.Unmarshal(b, &event))
+		assert.Equal(t, "warp_pipe.public.users.Envelope", event.Schema.Name)
+		assert.Equal(t, "after", event.Schema.Fields[1].Field)
+		assert.Equal(t, "int64", event.Schema.Fields[1].Fields[0].Type)
+		assert.Equal(t, "string", event.Schema.Fields[1].Fields[1].Type)
+		assert.Equal(t, "double", event.Schema.Fields[1].Fields[2].Type)
+		assert.Equal(t, "u", event.Payload["op"])
+	})
+}
+
+func TestNewEncoder(t *testing.T) {
+	enc, err := sink.NewEncoder("", sink.Source{})
+	assert.NoError(t, err)
+	assert.Equal(t, sink.JSONEncoder{}, enc)
+
+	_, err = sink.NewEncoder("xml", sink.Source{})
+	assert.EqualError(t, err, "unknown output format 'xml'. Must be one of: avro, cloudevents, debezium, json")
+}
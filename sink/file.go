@@ -0,0 +1,174 @@
+package sink
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	warppipe "github.com/perangel/warp-pipe"
+)
+
+const (
+	defaultMaxFileSize = 100 * 1024 * 1024
+	rolledFileLayout   = "20060102T150405.000"
+)
+
+// FileSink writes changesets as newline-delimited records to a file. Once the
+// file exceeds its maximum size or age, it is renamed with a timestamp suffix
+// (e.g. `changes-20210301T120000.000.ndjson`) and a new file is started.
+type FileSink struct {
+	path    string
+	maxSize int64
+	maxAge  time.Duration
+	enc     Encoder
+
+	f        *os.File
+	w        *bufio.Writer
+	size     int64
+	openedAt time.Time
+}
+
+// NewFileSink returns a new FileSink writing to the given path. A maxSize or
+// maxAge of 0 disables rolling on size or age respectively.
+func NewFileSink(path string, maxSize int64, maxAge time.Duration, enc Encoder) (*FileSink, error) {
+	s := &FileSink{
+		path:    path,
+		maxSize: maxSize,
+		maxAge:  maxAge,
+		enc:     enc,
+	}
+
+	err := s.open()
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// newFileSink creates a FileSink from a URL such as
+// `file:///var/lib/warp-pipe/changes.ndjson?max_size=10485760&max_age=1h`.
+func newFileSink(u *url.URL, enc Encoder) (Sink, error) {
+	path := u.Path
+	if u.Host != "" {
+		// relative path, e.g. `file://changes.ndjson`
+		path = u.Host + u.Path
+	}
+	if path == "" {
+		return nil, fmt.Errorf("file output '%s' is missing a path", u)
+	}
+
+	maxSize := int64(defaultMaxFileSize)
+	if v := u.Query().Get("max_size"); v != "" {
+		size, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid max_size '%s': %w", v, err)
+		}
+		maxSize = size
+	}
+
+	var maxAge time.Duration
+	if v := u.Query().Get("max_age"); v != "" {
+		age, err := time.ParseDuration(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid max_age '%s': %w", v, err)
+		}
+		maxAge = age
+	}
+
+	return NewFileSink(path, maxSize, maxAge, enc)
+}
+
+// Write implements Sink.
+func (s *FileSink) Write(ctx context.Context, changes []*warppipe.Changeset) error {
+	for _, change := range changes {
+		b, err := s.enc.Encode(change)
+		if err != nil {
+			return err
+		}
+		b = append(b, '\n')
+
+		if s.shouldRoll(int64(len(b))) {
+			err = s.roll()
+			if err != nil {
+				return err
+			}
+		}
+
+		n, err := s.w.Write(b)
+		s.size += int64(n)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Flush implements Sink. Buffered records are written and synced to disk.
+func (s *FileSink) Flush(ctx context.Context) error {
+	err := s.w.Flush()
+	if err != nil {
+		return err
+	}
+	return s.f.Sync()
+}
+
+// Close implements Sink.
+func (s *FileSink) Close() error {
+	err := s.Flush(context.Background())
+	if closeErr := s.f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+func (s *FileSink) shouldRoll(n int64) bool {
+	if s.size == 0 {
+		return false
+	}
+	if s.maxSize > 0 && s.size+n > s.maxSize {
+		return true
+	}
+	return s.maxAge > 0 && time.Since(s.openedAt) >= s.maxAge
+}
+
+// roll closes the current file, renames it and opens a new one.
+func (s *FileSink) roll() error {
+	err := s.Close()
+	if err != nil {
+		return err
+	}
+
+	ext := filepath.Ext(s.path)
+	rolled := fmt.Sprintf("%s-%s%s", strings.TrimSuffix(s.path, ext), time.Now().UTC().Format(rolledFileLayout), ext)
+	err = os.Rename(s.path, rolled)
+	if err != nil {
+		return fmt.Errorf("failed to roll file %s: %w", s.path, err)
+	}
+
+	return s.open()
+}
+
+func (s *FileSink) open() error {
+	f, err := os.OpenFile(s.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open file %s: %w", s.path, err)
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	s.f = f
+	s.w = bufio.NewWriter(f)
+	s.size = info.Size()
+	s.openedAt = time.Now()
+	return nil
+}
@@ -0,0 +1,104 @@
+package sink_test
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	warppipe "github.com/perangel/warp-pipe"
+	"github.com/perangel/warp-pipe/sink"
+)
+
+func TestFileSink(t *testing.T) {
+	dir, err := ioutil.TempDir("", "warp-pipe-sink")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "changes.ndjson")
+	ctx := context.Background()
+
+	t.Run("write and flush", func(t *testing.T) {
+		s, err := sink.Open(path, sink.JSONEncoder{})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = s.Write(ctx, []*warppipe.Changeset{{ID: 1}, {ID: 2}})
+		assert.NoError(t, err)
+		assert.NoError(t, s.Flush(ctx))
+		assert.Equal(t, []int64{1, 2}, readIDs(t, path))
+
+		assert.NoError(t, s.Close())
+	})
+
+	t.Run("append to existing file", func(t *testing.T) {
+		s, err := sink.Open("file://"+path, sink.JSONEncoder{})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = s.Write(ctx, []*warppipe.Changeset{{ID: 3}})
+		assert.NoError(t, err)
+		assert.NoError(t, s.Close())
+		assert.Equal(t, []int64{1, 2, 3}, readIDs(t, path))
+	})
+
+	t.Run("roll on size", func(t *testing.T) {
+		os.Remove(path)
+
+		// each record is larger than max_size, so every record after the
+		// first starts a new file
+		s, err := sink.Open(fmt.Sprintf("file://%s?max_size=10", path), sink.JSONEncoder{})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = s.Write(ctx, []*warppipe.Changeset{{ID: 4}})
+		assert.NoError(t, err)
+		err = s.Write(ctx, []*warppipe.Changeset{{ID: 5}})
+		assert.NoError(t, err)
+		assert.NoError(t, s.Close())
+
+		assert.Equal(t, []int64{5}, readIDs(t, path))
+
+		rolled, err := filepath.Glob(filepath.Join(dir, "changes-*.ndjson"))
+		assert.NoError(t, err)
+		if assert.Len(t, rolled, 1) {
+			assert.Equal(t, []int64{4}, readIDs(t, rolled[0]))
+		}
+	})
+
+	t.Run("invalid max_size", func(t *testing.T) {
+		_, err := sink.Open(fmt.Sprintf("file://%s?max_size=big", path), sink.JSONEncoder{})
+		assert.Error(t, err)
+	})
+}
+
+func readIDs(t *testing.T, path string) []int64 {
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	var ids []int64
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var change warppipe.Changeset
+		err := json.Unmarshal(scanner.Bytes(), &change)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, change.ID)
+	}
+	return ids
+}
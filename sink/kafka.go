@@ -0,0 +1,332 @@
+package sink
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	warppipe "github.com/perangel/warp-pipe"
+)
+
+// DefaultKafkaTopic is the topic template used by the Kafka sink if none is
+// provided.
+const DefaultKafkaTopic = "{{.Schema}}.{{.Table}}"
+
+// KafkaMessage is a message produced to a Kafka topic.
+type KafkaMessage struct {
+	Topic   string
+	Key     []byte
+	Value   []byte
+	Headers map[string]string
+}
+
+// KafkaProducer produces messages to Kafka. It is implemented by an adapter
+// around a Kafka client, which is responsible for partitioning messages by key
+// so that messages with the same key keep their order.
+type KafkaProducer interface {
+	// Produce enqueues a message. The producer calls delivered once, from any
+	// goroutine, with the result of the broker's delivery report.
+	Produce(msg *KafkaMessage, delivered func(error)) error
+	// Close flushes pending messages and releases the producer's resources.
+	Close() error
+}
+
+// KafkaProducerConfig configures a KafkaProducer.
+type KafkaProducerConfig struct {
+	Brokers  []string
+	ClientID string
+	// Idempotent enables the idempotent producer, so that retried produce
+	// requests do not duplicate or reorder messages.
+	Idempotent bool
+	// RequiredAcks is the number of replicas that must acknowledge a message,
+	// where -1 means all in-sync replicas.
+	RequiredAcks int
+	// MaxInFlight is the maximum number of unacknowledged requests per broker
+	// connection. It must not exceed 5 for the idempotent producer.
+	MaxInFlight int
+	// BatchSize is the maximum number of messages sent in a produce request.
+	BatchSize int
+	// Linger is the time the producer waits for a batch to fill up.
+	Linger time.Duration
+	// Compression is the compression codec, e.g. `none`, `gzip` or `lz4`.
+	Compression string
+}
+
+// DefaultKafkaProducerConfig returns the idempotent producer configuration for
+// the given brokers.
+func DefaultKafkaProducerConfig(brokers []string) KafkaProducerConfig {
+	return KafkaProducerConfig{
+		Brokers:      brokers,
+		ClientID:     "warp-pipe",
+		Idempotent:   true,
+		RequiredAcks: -1,
+		MaxInFlight:  5,
+		BatchSize:    1000,
+		Linger:       5 * time.Millisecond,
+		Compression:  "none",
+	}
+}
+
+// KafkaProducerFactory creates a KafkaProducer from its configuration.
+type KafkaProducerFactory func(config KafkaProducerConfig) (KafkaProducer, error)
+
+var kafkaProducerFactory KafkaProducerFactory
+
+// RegisterKafkaProducer sets the factory used to create producers for
+// `kafka://` outputs, e.g. NewKafkaClient or an adapter around another Kafka
+// client. The `kafka` scheme is only available once a factory is registered;
+// registering nil removes it.
+func RegisterKafkaProducer(factory KafkaProducerFactory) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+
+	kafkaProducerFactory = factory
+	if factory == nil {
+		delete(registry, "kafka")
+	} else {
+		registry["kafka"] = newKafkaSink
+	}
+}
+
+// KafkaSink produces each changeset as a message to a topic derived from the
+// topic template, keyed by the values of its table's key columns so that
+// changes to the same row are written to the same partition, in order. A
+// changeset is acknowledged as soon as its delivery report is received, and
+// Flush waits for the delivery reports of all written changesets. Changesets
+// delivered since the last successful Flush are not produced again when a
+// failed batch is written again.
+type KafkaSink struct {
+	producer   KafkaProducer
+	topic      *template.Template
+	keyColumns map[string][]string
+	enc        Encoder
+
+	pending   sync.WaitGroup
+	mu        sync.Mutex
+	err       error
+	delivered map[*warppipe.Changeset]bool
+}
+
+// NewKafkaSink returns a new KafkaSink. The topic is a text/template executed
+// with the changeset, e.g. `cdc.{{.Schema}}.{{.Table}}`. keyColumns maps tables,
+// as `<schema>.<table>` or `<table>`, to the columns of their primary key;
+// tables not in the map are keyed by their `id` column.
+func NewKafkaSink(producer KafkaProducer, topic string, keyColumns map[string][]string, enc Encoder) (*KafkaSink, error) {
+	tmpl, err := parseNameTemplate("topic", topic, DefaultKafkaTopic)
+	if err != nil {
+		return nil, err
+	}
+
+	return &KafkaSink{
+		producer:   producer,
+		topic:      tmpl,
+		keyColumns: keyColumns,
+		enc:        enc,
+		delivered:  make(map[*warppipe.Changeset]bool),
+	}, nil
+}
+
+// newKafkaSink creates a KafkaSink from a URL such as
+// `kafka://broker1:9092,broker2:9092?topic=cdc.{{.Table}}&key.public.orders=order_id,line`.
+func newKafkaSink(u *url.URL, enc Encoder) (Sink, error) {
+	registryMu.RLock()
+	factory := kafkaProducerFactory
+	registryMu.RUnlock()
+
+	if u.Host == "" {
+		return nil, fmt.Errorf("kafka output '%s' is missing brokers", u)
+	}
+
+	config := DefaultKafkaProducerConfig(strings.Split(u.Host, ","))
+	query := u.Query()
+	keyColumns := make(map[string][]string)
+	for param, values := range query {
+		if strings.HasPrefix(param, "key.") && len(values) > 0 {
+			keyColumns[strings.TrimPrefix(param, "key.")] = strings.Split(values[0], ",")
+		}
+	}
+
+	if v := query.Get("client_id"); v != "" {
+		config.ClientID = v
+	}
+	if v := query.Get("compression"); v != "" {
+		config.Compression = v
+	}
+	if v := query.Get("idempotent"); v != "" {
+		idempotent, err := strconv.ParseBool(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid idempotent '%s': %w", v, err)
+		}
+		config.Idempotent = idempotent
+	}
+	if v := query.Get("acks"); v != "" {
+		acks, err := strconv.Atoi(v)
+		if v == "all" {
+			acks, err = -1, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid acks '%s': %w", v, err)
+		}
+		config.RequiredAcks = acks
+	}
+	if v := query.Get("batch_size"); v != "" {
+		size, err := strconv.Atoi(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid batch_size '%s': %w", v, err)
+		}
+		config.BatchSize = size
+	}
+	if v := query.Get("linger"); v != "" {
+		linger, err := time.ParseDuration(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid linger '%s': %w", v, err)
+		}
+		config.Linger = linger
+	}
+
+	if config.Idempotent && (config.RequiredAcks != -1 || config.MaxInFlight > 5) {
+		return nil, errors.New("the idempotent producer requires acks=all and at most 5 requests in flight")
+	}
+
+	producer, err := factory(config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create Kafka producer: %w", err)
+	}
+
+	s, err := NewKafkaSink(producer, query.Get("topic"), keyColumns, enc)
+	if err != nil {
+		producer.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// Write implements Sink. Changesets that are in flight or were delivered
+// since the last successful Flush are skipped.
+func (s *KafkaSink) Write(ctx context.Context, changes []*warppipe.Changeset) error {
+	for _, change := range changes {
+		s.mu.Lock()
+		_, written := s.delivered[change]
+		if !written {
+			s.delivered[change] = false
+		}
+		s.mu.Unlock()
+		if written {
+			continue
+		}
+
+		msg, err := s.message(change)
+		if err != nil {
+			s.forget(change)
+			return err
+		}
+
+		change := change
+		s.pending.Add(1)
+		err = s.producer.Produce(msg, func(err error) {
+			defer s.pending.Done()
+			if err != nil {
+				s.forget(change)
+				s.setErr(fmt.Errorf("failed to deliver changeset to topic %s: %w", msg.Topic, err))
+				return
+			}
+			s.mu.Lock()
+			s.delivered[change] = true
+			s.mu.Unlock()
+			change.Ack()
+		})
+		if err != nil {
+			s.pending.Done()
+			s.forget(change)
+			return fmt.Errorf("failed to produce changeset to topic %s: %w", msg.Topic, err)
+		}
+	}
+	return nil
+}
+
+// Flush implements Sink. It waits for the delivery reports of all written
+// changesets, and returns the first delivery error, if any. Delivered
+// changesets are only forgotten once a Flush succeeds.
+func (s *KafkaSink) Flush(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		s.pending.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-done:
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	err := s.err
+	s.err = nil
+	if err == nil {
+		s.delivered = make(map[*warppipe.Changeset]bool)
+	}
+	return err
+}
+
+// Close implements Sink.
+func (s *KafkaSink) Close() error {
+	err := s.Flush(context.Background())
+	if closeErr := s.producer.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+func (s *KafkaSink) setErr(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.err == nil {
+		s.err = err
+	}
+}
+
+// forget removes a changeset that was not delivered, so that the next Write
+// produces it again.
+func (s *KafkaSink) forget(change *warppipe.Changeset) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.delivered, change)
+}
+
+func (s *KafkaSink) message(change *warppipe.Changeset) (*KafkaMessage, error) {
+	topic, err := executeNameTemplate(s.topic, change)
+	if err != nil {
+		return nil, err
+	}
+
+	value, err := s.enc.Encode(change)
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := changesetKey(change, s.keyColumns)
+	if err != nil {
+		return nil, err
+	}
+
+	return &KafkaMessage{
+		Topic: topic,
+		Key:   key,
+		Value: value,
+		Headers: map[string]string{
+			"content-type": s.enc.ContentType(),
+			"kind":         string(change.Kind),
+		},
+	}, nil
+}
@@ -0,0 +1,853 @@
+package sink
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	kafkaDialTimeout    = 10 * time.Second
+	kafkaRequestTimeout = 30 * time.Second
+	kafkaMaxRetries     = 5
+	kafkaRetryBackoff   = 100 * time.Millisecond
+
+	kafkaAPIProduce        = 0
+	kafkaAPIMetadata       = 3
+	kafkaAPIInitProducerID = 22
+
+	kafkaCodecNone = 0
+	kafkaCodecGzip = 1
+
+	kafkaMaxResponseSize = 100 << 20
+)
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// Kafka error codes.
+const (
+	kafkaErrUnknownServerError       kafkaError = -1
+	kafkaErrUnknownTopicOrPartition  kafkaError = 3
+	kafkaErrLeaderNotAvailable       kafkaError = 5
+	kafkaErrNotLeader                kafkaError = 6
+	kafkaErrRequestTimedOut          kafkaError = 7
+	kafkaErrNetwork                  kafkaError = 13
+	kafkaErrNotEnoughReplicas        kafkaError = 19
+	kafkaErrNotEnoughReplicasAfter   kafkaError = 20
+	kafkaErrOutOfOrderSequenceNumber kafkaError = 45
+	kafkaErrDuplicateSequenceNumber  kafkaError = 46
+	kafkaErrKafkaStorage             kafkaError = 56
+	kafkaErrUnknownProducerID        kafkaError = 59
+)
+
+// kafkaError is an error code returned by a broker.
+type kafkaError int16
+
+var kafkaErrorNames = map[kafkaError]string{
+	-1: "UNKNOWN_SERVER_ERROR",
+	2:  "CORRUPT_MESSAGE",
+	3:  "UNKNOWN_TOPIC_OR_PARTITION",
+	5:  "LEADER_NOT_AVAILABLE",
+	6:  "NOT_LEADER_OR_FOLLOWER",
+	7:  "REQUEST_TIMED_OUT",
+	10: "MESSAGE_TOO_LARGE",
+	13: "NETWORK_EXCEPTION",
+	17: "INVALID_TOPIC_EXCEPTION",
+	18: "RECORD_LIST_TOO_LARGE",
+	19: "NOT_ENOUGH_REPLICAS",
+	20: "NOT_ENOUGH_REPLICAS_AFTER_APPEND",
+	21: "INVALID_REQUIRED_ACKS",
+	29: "TOPIC_AUTHORIZATION_FAILED",
+	31: "CLUSTER_AUTHORIZATION_FAILED",
+	35: "UNSUPPORTED_VERSION",
+	45: "OUT_OF_ORDER_SEQUENCE_NUMBER",
+	46: "DUPLICATE_SEQUENCE_NUMBER",
+	56: "KAFKA_STORAGE_ERROR",
+	59: "UNKNOWN_PRODUCER_ID",
+	87: "INVALID_RECORD",
+}
+
+func (e kafkaError) Error() string {
+	if name, ok := kafkaErrorNames[e]; ok {
+		return name
+	}
+	return "kafka error " + strconv.Itoa(int(e))
+}
+
+// retriable returns true if the request may succeed once retried, e.g. after
+// a leader election.
+func (e kafkaError) retriable() bool {
+	switch e {
+	case kafkaErrUnknownTopicOrPartition, kafkaErrLeaderNotAvailable, kafkaErrNotLeader,
+		kafkaErrRequestTimedOut, kafkaErrNetwork, kafkaErrNotEnoughReplicas,
+		kafkaErrNotEnoughReplicasAfter, kafkaErrKafkaStorage:
+		return true
+	}
+	return false
+}
+
+// kafkaPartition is a partition of a topic.
+type kafkaPartition struct {
+	topic     string
+	partition int32
+}
+
+// kafkaRecord is a message waiting to be delivered.
+type kafkaRecord struct {
+	msg       *KafkaMessage
+	timestamp int64
+	partition int32
+	delivered func(error)
+}
+
+// kafkaClient is the bundled KafkaProducer. Messages are sent by a single
+// goroutine, one produce request at a time, which keeps them in order without
+// relying on the broker to reorder retried requests.
+type kafkaClient struct {
+	config KafkaProducerConfig
+	codec  int16
+
+	mu     sync.Mutex
+	closed bool
+	queue  chan *kafkaRecord
+	done   chan struct{}
+
+	// owned by the sending goroutine
+	conns       map[string]*kafkaConn
+	addrs       map[int32]string
+	leaders     map[string][]int32
+	producerID  int64
+	epoch       int16
+	sequences   map[kafkaPartition]int32
+	correlation int32
+	next        uint32
+}
+
+type kafkaConn struct {
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+// NewKafkaClient returns the KafkaProducer bundled with warp-pipe, which
+// speaks the Kafka protocol to brokers from Kafka 1.0 on, over plaintext
+// connections (TLS and SASL are not supported). Messages are partitioned by
+// the murmur2 hash of their key, as with the Java client, or round-robin if
+// they have none. Only the `none` and `gzip` compressions are supported.
+// Register it with RegisterKafkaProducer to enable `kafka://` outputs.
+func NewKafkaClient(config KafkaProducerConfig) (KafkaProducer, error) {
+	if len(config.Brokers) == 0 {
+		return nil, errors.New("at least one broker is required")
+	}
+
+	var codec int16
+	switch config.Compression {
+	case "", "none":
+		codec = kafkaCodecNone
+	case "gzip":
+		codec = kafkaCodecGzip
+	default:
+		return nil, fmt.Errorf("compression '%s' is not supported. Must be one of `none` or `gzip`", config.Compression)
+	}
+
+	if config.BatchSize <= 0 {
+		config.BatchSize = 1
+	}
+
+	c := &kafkaClient{
+		config:     config,
+		codec:      codec,
+		queue:      make(chan *kafkaRecord, config.BatchSize),
+		done:       make(chan struct{}),
+		conns:      make(map[string]*kafkaConn),
+		addrs:      make(map[int32]string),
+		leaders:    make(map[string][]int32),
+		producerID: -1,
+		epoch:      -1,
+		sequences:  make(map[kafkaPartition]int32),
+	}
+	go c.run()
+	return c, nil
+}
+
+// Produce implements KafkaProducer. It blocks while a full batch is waiting
+// to be sent.
+func (c *kafkaClient) Produce(msg *KafkaMessage, delivered func(error)) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed {
+		return errors.New("the producer is closed")
+	}
+
+	c.queue <- &kafkaRecord{
+		msg:       msg,
+		timestamp: time.Now().UnixNano() / int64(time.Millisecond),
+		partition: -1,
+		delivered: delivered,
+	}
+	return nil
+}
+
+// Close implements KafkaProducer.
+func (c *kafkaClient) Close() error {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return nil
+	}
+	c.closed = true
+	close(c.queue)
+	c.mu.Unlock()
+
+	<-c.done
+	for addr := range c.conns {
+		c.disconnect(addr)
+	}
+	return nil
+}
+
+// run sends the queued messages in batches, until the queue is closed.
+func (c *kafkaClient) run() {
+	defer close(c.done)
+
+	var batch []*kafkaRecord
+	timer := time.NewTimer(c.config.Linger)
+	timer.Stop()
+
+	for {
+		select {
+		case rec, ok := <-c.queue:
+			if !ok {
+				c.send(batch)
+				return
+			}
+
+			batch = append(batch, rec)
+			if len(batch) == 1 {
+				timer.Reset(c.config.Linger)
+			}
+			if len(batch) < c.config.BatchSize {
+				continue
+			}
+			if !timer.Stop() {
+				select {
+				case <-timer.C:
+				default:
+				}
+			}
+		case <-timer.C:
+		}
+
+		c.send(batch)
+		batch = nil
+	}
+}
+
+// send produces the records, retrying those that failed with a retriable
+// error, and reports their delivery.
+func (c *kafkaClient) send(records []*kafkaRecord) {
+	var err error
+	for attempt := 0; len(records) > 0; attempt++ {
+		if attempt > 0 {
+			if attempt > kafkaMaxRetries {
+				for _, rec := range records {
+					rec.delivered(err)
+				}
+				return
+			}
+			time.Sleep(kafkaRetryBackoff << uint(attempt-1))
+		}
+		records, err = c.produce(records)
+	}
+}
+
+// produce sends the records to the leaders of their partitions. It returns
+// the records to retry, along with the error they failed with.
+func (c *kafkaClient) produce(records []*kafkaRecord) ([]*kafkaRecord, error) {
+	if c.config.Idempotent && c.producerID < 0 {
+		if err := c.initProducerID(); err != nil {
+			return records, err
+		}
+	}
+
+	var retry []*kafkaRecord
+	var retryErr error
+	topicErrs := make(map[string]error)
+	byLeader := make(map[string]map[kafkaPartition][]*kafkaRecord)
+	for _, rec := range records {
+		err, failed := topicErrs[rec.msg.Topic]
+		var leaders []int32
+		if !failed {
+			leaders, err = c.partitions(rec.msg.Topic)
+			if err != nil {
+				topicErrs[rec.msg.Topic] = err
+			}
+		}
+
+		var code kafkaError
+		switch {
+		case errors.As(err, &code) && !code.retriable():
+			rec.delivered(err)
+			continue
+		case err != nil:
+			retry, retryErr = append(retry, rec), err
+			continue
+		}
+
+		// a record keeps its partition across retries, so that it keeps
+		// its sequence number
+		if rec.partition < 0 {
+			rec.partition = c.partitionFor(rec.msg.Key, len(leaders))
+		}
+		if int(rec.partition) >= len(leaders) || c.addrs[leaders[rec.partition]] == "" {
+			retry, retryErr = append(retry, rec), kafkaErrLeaderNotAvailable
+			delete(c.leaders, rec.msg.Topic)
+			continue
+		}
+
+		addr := c.addrs[leaders[rec.partition]]
+		if byLeader[addr] == nil {
+			byLeader[addr] = make(map[kafkaPartition][]*kafkaRecord)
+		}
+		tp := kafkaPartition{topic: rec.msg.Topic, partition: rec.partition}
+		byLeader[addr][tp] = append(byLeader[addr][tp], rec)
+	}
+
+	for addr, batches := range byLeader {
+		results, err := c.produceTo(addr, batches)
+		if err != nil {
+			for _, recs := range batches {
+				retry = append(retry, recs...)
+			}
+			retryErr = err
+			c.leaders = make(map[string][]int32)
+			continue
+		}
+
+		for tp, recs := range batches {
+			code := results[tp]
+			if code == kafkaErrDuplicateSequenceNumber {
+				// already written by a previous attempt
+				code = 0
+			}
+
+			switch {
+			case code == 0:
+				c.sequences[tp] += int32(len(recs))
+				for _, rec := range recs {
+					rec.delivered(nil)
+				}
+			case code.retriable():
+				retry, retryErr = append(retry, recs...), code
+				delete(c.leaders, tp.topic)
+			default:
+				for _, rec := range recs {
+					rec.delivered(code)
+				}
+				if code == kafkaErrOutOfOrderSequenceNumber || code == kafkaErrUnknownProducerID {
+					// starts over with a new producer ID
+					c.producerID, c.epoch = -1, -1
+				}
+			}
+		}
+	}
+	return retry, retryErr
+}
+
+// produceTo sends a produce request to a broker, and returns the error code
+// of each partition.
+func (c *kafkaClient) produceTo(addr string, batches map[kafkaPartition][]*kafkaRecord) (map[kafkaPartition]kafkaError, error) {
+	byTopic := make(map[string][]kafkaPartition)
+	var topics []string
+	for tp := range batches {
+		if byTopic[tp.topic] == nil {
+			topics = append(topics, tp.topic)
+		}
+		byTopic[tp.topic] = append(byTopic[tp.topic], tp)
+	}
+	sort.Strings(topics)
+
+	var req kafkaEncoder
+	req.int16(-1) // transactional ID
+	req.int16(int16(c.config.RequiredAcks))
+	req.int32(int32(kafkaRequestTimeout / time.Millisecond))
+	req.int32(int32(len(topics)))
+	for _, topic := range topics {
+		req.string(topic)
+		req.int32(int32(len(byTopic[topic])))
+		for _, tp := range byTopic[topic] {
+			batch, err := c.recordBatch(tp, batches[tp])
+			if err != nil {
+				return nil, err
+			}
+			req.int32(tp.partition)
+			req.bytes(batch)
+		}
+	}
+
+	results := make(map[kafkaPartition]kafkaError, len(batches))
+	if c.config.RequiredAcks == 0 {
+		// the broker does not respond
+		_, err := c.request(addr, kafkaAPIProduce, 3, req.Bytes(), false)
+		return results, err
+	}
+
+	b, err := c.request(addr, kafkaAPIProduce, 3, req.Bytes(), true)
+	if err != nil {
+		return nil, err
+	}
+
+	d := &kafkaDecoder{b: b}
+	for i := d.int32(); i > 0 && d.err == nil; i-- {
+		topic := d.string()
+		for j := d.int32(); j > 0 && d.err == nil; j-- {
+			partition := d.int32()
+			code := kafkaError(d.int16())
+			d.int64() // base offset
+			d.int64() // log append time
+			results[kafkaPartition{topic: topic, partition: partition}] = code
+		}
+	}
+	if d.err != nil {
+		c.disconnect(addr)
+		return nil, fmt.Errorf("invalid produce response: %w", d.err)
+	}
+
+	for tp := range batches {
+		if _, ok := results[tp]; !ok {
+			results[tp] = kafkaErrUnknownServerError
+		}
+	}
+	return results, nil
+}
+
+// recordBatch encodes the records of a partition as a v2 record batch.
+func (c *kafkaClient) recordBatch(tp kafkaPartition, recs []*kafkaRecord) ([]byte, error) {
+	var records kafkaEncoder
+	first, last := recs[0].timestamp, recs[0].timestamp
+	for i, rec := range recs {
+		if rec.timestamp > last {
+			last = rec.timestamp
+		}
+
+		var r kafkaEncoder
+		r.int8(0) // attributes
+		r.varint(rec.timestamp - first)
+		r.varint(int64(i))
+		r.varbytes(rec.msg.Key)
+		r.varbytes(rec.msg.Value)
+
+		names := make([]string, 0, len(rec.msg.Headers))
+		for name := range rec.msg.Headers {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		r.varint(int64(len(names)))
+		for _, name := range names {
+			r.varbytes([]byte(name))
+			r.varbytes([]byte(rec.msg.Headers[name]))
+		}
+
+		records.varint(int64(r.Len()))
+		records.Write(r.Bytes())
+	}
+
+	payload := records.Bytes()
+	if c.codec == kafkaCodecGzip {
+		var buf bytes.Buffer
+		zw := gzip.NewWriter(&buf)
+		if _, err := zw.Write(payload); err != nil {
+			return nil, err
+		}
+		if err := zw.Close(); err != nil {
+			return nil, err
+		}
+		payload = buf.Bytes()
+	}
+
+	sequence := int32(-1)
+	if c.producerID >= 0 {
+		sequence = c.sequences[tp]
+	}
+
+	var body kafkaEncoder
+	body.int16(c.codec) // attributes
+	body.int32(int32(len(recs) - 1))
+	body.int64(first)
+	body.int64(last)
+	body.int64(c.producerID)
+	body.int16(c.epoch)
+	body.int32(sequence)
+	body.int32(int32(len(recs)))
+	body.Write(payload)
+
+	var batch kafkaEncoder
+	batch.int64(0) // base offset
+	batch.int32(int32(4 + 1 + 4 + body.Len()))
+	batch.int32(-1) // partition leader epoch
+	batch.int8(2)   // magic
+	batch.int32(int32(crc32.Checksum(body.Bytes(), castagnoli)))
+	batch.Write(body.Bytes())
+	return batch.Bytes(), nil
+}
+
+// partitionFor returns the partition of a message with the given key.
+func (c *kafkaClient) partitionFor(key []byte, partitions int) int32 {
+	if key == nil {
+		c.next++
+		return int32(c.next % uint32(partitions))
+	}
+	return int32(uint32(murmur2(key)&0x7fffffff) % uint32(partitions))
+}
+
+// partitions returns the leaders of a topic's partitions, by partition,
+// fetching the topic's metadata if needed.
+func (c *kafkaClient) partitions(topic string) ([]int32, error) {
+	if leaders, ok := c.leaders[topic]; ok {
+		return leaders, nil
+	}
+
+	var req kafkaEncoder
+	req.int32(1)
+	req.string(topic)
+	req.int8(1) // allow auto topic creation
+
+	b, err := c.requestAny(kafkaAPIMetadata, 4, req.Bytes())
+	if err != nil {
+		return nil, err
+	}
+
+	d := &kafkaDecoder{b: b}
+	d.int32() // throttle time
+	for i := d.int32(); i > 0 && d.err == nil; i-- {
+		node := d.int32()
+		host := d.string()
+		port := d.int32()
+		d.nullableString() // rack
+		c.addrs[node] = net.JoinHostPort(host, strconv.Itoa(int(port)))
+	}
+	d.nullableString() // cluster ID
+	d.int32()          // controller ID
+
+	var leaders []int32
+	topicErr := kafkaErrUnknownTopicOrPartition
+	for i := d.int32(); i > 0 && d.err == nil; i-- {
+		code := kafkaError(d.int16())
+		name := d.string()
+		d.int8() // internal
+		var partitions []int32
+		for j := d.int32(); j > 0 && d.err == nil; j-- {
+			d.int16() // error code
+			index := d.int32()
+			leader := d.int32()
+			d.int32s() // replicas
+			d.int32s() // in-sync replicas
+			for int(index) >= len(partitions) {
+				partitions = append(partitions, -1)
+			}
+			partitions[index] = leader
+		}
+		if name == topic {
+			topicErr, leaders = code, partitions
+		}
+	}
+	if d.err != nil {
+		return nil, fmt.Errorf("invalid metadata response: %w", d.err)
+	}
+	if topicErr != 0 {
+		return nil, fmt.Errorf("failed to get the metadata of topic %s: %w", topic, topicErr)
+	}
+	if len(leaders) == 0 {
+		return nil, fmt.Errorf("failed to get the metadata of topic %s: %w", topic, kafkaErrLeaderNotAvailable)
+	}
+
+	c.leaders[topic] = leaders
+	return leaders, nil
+}
+
+// initProducerID gets a producer ID and epoch for the idempotent producer.
+func (c *kafkaClient) initProducerID() error {
+	var req kafkaEncoder
+	req.int16(-1) // transactional ID
+	req.int32(int32(time.Minute / time.Millisecond))
+
+	b, err := c.requestAny(kafkaAPIInitProducerID, 0, req.Bytes())
+	if err != nil {
+		return err
+	}
+
+	d := &kafkaDecoder{b: b}
+	d.int32() // throttle time
+	code := kafkaError(d.int16())
+	producerID := d.int64()
+	epoch := d.int16()
+	if d.err != nil {
+		return fmt.Errorf("invalid init producer ID response: %w", d.err)
+	}
+	if code != 0 {
+		return fmt.Errorf("failed to get a producer ID: %w", code)
+	}
+
+	c.producerID, c.epoch = producerID, epoch
+	c.sequences = make(map[kafkaPartition]int32)
+	return nil
+}
+
+// requestAny sends a request to the first broker that responds, trying the
+// known brokers before the configured ones.
+func (c *kafkaClient) requestAny(apiKey, version int16, body []byte) ([]byte, error) {
+	var addrs []string
+	for _, addr := range c.addrs {
+		addrs = append(addrs, addr)
+	}
+	sort.Strings(addrs)
+	addrs = append(addrs, c.config.Brokers...)
+
+	var err error
+	for _, addr := range addrs {
+		var b []byte
+		b, err = c.request(addr, apiKey, version, body, true)
+		if err == nil {
+			return b, nil
+		}
+	}
+	return nil, err
+}
+
+// request sends a request to a broker, connecting if needed, and returns the
+// body of its response.
+func (c *kafkaClient) request(addr string, apiKey, version int16, body []byte, response bool) ([]byte, error) {
+	conn, err := c.connect(addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to Kafka broker %s: %w", addr, err)
+	}
+
+	c.correlation++
+	var req kafkaEncoder
+	req.int32(0) // size, set below
+	req.int16(apiKey)
+	req.int16(version)
+	req.int32(c.correlation)
+	req.string(c.config.ClientID)
+	req.Write(body)
+	b := req.Bytes()
+	binary.BigEndian.PutUint32(b, uint32(len(b)-4))
+
+	conn.conn.SetDeadline(time.Now().Add(kafkaRequestTimeout))
+	if _, err := conn.conn.Write(b); err != nil {
+		c.disconnect(addr)
+		return nil, fmt.Errorf("failed to send request to Kafka broker %s: %w", addr, err)
+	}
+	if !response {
+		return nil, nil
+	}
+
+	var header [8]byte
+	_, err = io.ReadFull(conn.r, header[:])
+	if size := binary.BigEndian.Uint32(header[:4]); err == nil && (size < 4 || size > kafkaMaxResponseSize) {
+		err = fmt.Errorf("invalid response size %d", size)
+	}
+	if err == nil {
+		resp := make([]byte, binary.BigEndian.Uint32(header[:4])-4)
+		_, err = io.ReadFull(conn.r, resp)
+		if err == nil && int32(binary.BigEndian.Uint32(header[4:])) != c.correlation {
+			err = errors.New("unexpected correlation ID")
+		}
+		if err == nil {
+			return resp, nil
+		}
+	}
+	c.disconnect(addr)
+	return nil, fmt.Errorf("failed to read response from Kafka broker %s: %w", addr, err)
+}
+
+func (c *kafkaClient) connect(addr string) (*kafkaConn, error) {
+	if conn, ok := c.conns[addr]; ok {
+		return conn, nil
+	}
+
+	conn, err := net.DialTimeout("tcp", addr, kafkaDialTimeout)
+	if err != nil {
+		return nil, err
+	}
+
+	kc := &kafkaConn{conn: conn, r: bufio.NewReader(conn)}
+	c.conns[addr] = kc
+	return kc, nil
+}
+
+func (c *kafkaClient) disconnect(addr string) {
+	if conn, ok := c.conns[addr]; ok {
+		conn.conn.Close()
+		delete(c.conns, addr)
+	}
+}
+
+// murmur2 is the hash with which the Java client partitions messages by key.
+func murmur2(data []byte) int32 {
+	const (
+		seed uint32 = 0x9747b28c
+		m    uint32 = 0x5bd1e995
+		r           = 24
+	)
+
+	n := len(data)
+	h := seed ^ uint32(n)
+	for i := 0; i+4 <= n; i += 4 {
+		k := binary.LittleEndian.Uint32(data[i:])
+		k *= m
+		k ^= k >> r
+		k *= m
+		h *= m
+		h ^= k
+	}
+
+	tail := n &^ 3
+	switch n % 4 {
+	case 3:
+		h ^= uint32(data[tail+2]) << 16
+		fallthrough
+	case 2:
+		h ^= uint32(data[tail+1]) << 8
+		fallthrough
+	case 1:
+		h ^= uint32(data[tail])
+		h *= m
+	}
+
+	h ^= h >> 13
+	h *= m
+	h ^= h >> 15
+	return int32(h)
+}
+
+// kafkaEncoder encodes Kafka protocol fields.
+type kafkaEncoder struct {
+	bytes.Buffer
+}
+
+func (e *kafkaEncoder) int8(v int8) {
+	e.WriteByte(byte(v))
+}
+
+func (e *kafkaEncoder) int16(v int16) {
+	var b [2]byte
+	binary.BigEndian.PutUint16(b[:], uint16(v))
+	e.Write(b[:])
+}
+
+func (e *kafkaEncoder) int32(v int32) {
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], uint32(v))
+	e.Write(b[:])
+}
+
+func (e *kafkaEncoder) int64(v int64) {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], uint64(v))
+	e.Write(b[:])
+}
+
+func (e *kafkaEncoder) string(s string) {
+	e.int16(int16(len(s)))
+	e.WriteString(s)
+}
+
+func (e *kafkaEncoder) bytes(b []byte) {
+	e.int32(int32(len(b)))
+	e.Write(b)
+}
+
+// varint writes a zigzag encoded variable length integer.
+func (e *kafkaEncoder) varint(v int64) {
+	var b [binary.MaxVarintLen64]byte
+	e.Write(b[:binary.PutVarint(b[:], v)])
+}
+
+// varbytes writes bytes prefixed with their varint length, -1 if nil.
+func (e *kafkaEncoder) varbytes(b []byte) {
+	if b == nil {
+		e.varint(-1)
+		return
+	}
+	e.varint(int64(len(b)))
+	e.Write(b)
+}
+
+// kafkaDecoder decodes Kafka protocol fields. Once a field cannot be decoded,
+// err is set and all fields are zero.
+type kafkaDecoder struct {
+	b   []byte
+	err error
+}
+
+func (d *kafkaDecoder) next(n int) []byte {
+	if d.err != nil {
+		return nil
+	}
+	if n < 0 || len(d.b) < n {
+		d.err = io.ErrUnexpectedEOF
+		return nil
+	}
+	b := d.b[:n]
+	d.b = d.b[n:]
+	return b
+}
+
+func (d *kafkaDecoder) int8() int8 {
+	if b := d.next(1); b != nil {
+		return int8(b[0])
+	}
+	return 0
+}
+
+func (d *kafkaDecoder) int16() int16 {
+	if b := d.next(2); b != nil {
+		return int16(binary.BigEndian.Uint16(b))
+	}
+	return 0
+}
+
+func (d *kafkaDecoder) int32() int32 {
+	if b := d.next(4); b != nil {
+		return int32(binary.BigEndian.Uint32(b))
+	}
+	return 0
+}
+
+func (d *kafkaDecoder) int64() int64 {
+	if b := d.next(8); b != nil {
+		return int64(binary.BigEndian.Uint64(b))
+	}
+	return 0
+}
+
+func (d *kafkaDecoder) string() string {
+	return string(d.next(int(d.int16())))
+}
+
+func (d *kafkaDecoder) nullableString() string {
+	n := d.int16()
+	if n < 0 {
+		return ""
+	}
+	return string(d.next(int(n)))
+}
+
+func (d *kafkaDecoder) int32s() []int32 {
+	var values []int32
+	for i := d.int32(); i > 0 && d.err == nil; i-- {
+		values = append(values, d.int32())
+	}
+	return values
+}
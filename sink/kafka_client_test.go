@@ -0,0 +1,478 @@
+package sink_test
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	warppipe "github.com/perangel/warp-pipe"
+	"github.com/perangel/warp-pipe/sink"
+)
+
+type fakeKafkaRecord struct {
+	key, value string
+	headers    map[string]string
+}
+
+// fakeKafka is a single in-memory Kafka broker supporting the Metadata v4,
+// InitProducerId v0 and Produce v3 requests, and deduplicating produce
+// requests by sequence number.
+type fakeKafka struct {
+	ln net.Listener
+
+	mu         sync.Mutex
+	partitions map[string]int
+	denied     map[string]bool
+	records    map[string][][]fakeKafkaRecord
+	sequences  map[string]int32
+	// fail is the number of produce requests to fail with NOT_ENOUGH_REPLICAS
+	fail int
+	// drop is the number of produce requests to write without responding
+	drop int
+}
+
+func newFakeKafka(t *testing.T) *fakeKafka {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	k := &fakeKafka{
+		ln:         ln,
+		partitions: make(map[string]int),
+		denied:     make(map[string]bool),
+		records:    make(map[string][][]fakeKafkaRecord),
+		sequences:  make(map[string]int32),
+	}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go k.serve(conn)
+		}
+	}()
+	return k
+}
+
+func (k *fakeKafka) serve(conn net.Conn) {
+	defer conn.Close()
+
+	r := bufio.NewReader(conn)
+	for {
+		var size int32
+		if err := binary.Read(r, binary.BigEndian, &size); err != nil {
+			return
+		}
+		req := &kafkaReader{b: make([]byte, size)}
+		if _, err := io.ReadFull(r, req.b); err != nil {
+			return
+		}
+
+		apiKey, _, correlation := req.int16(), req.int16(), req.int32()
+		req.string() // client ID
+
+		var resp *kafkaWriter
+		switch apiKey {
+		case 0:
+			resp = k.produce(req)
+		case 3:
+			resp = k.metadata(req)
+		case 22:
+			resp = &kafkaWriter{}
+			resp.int32(0)  // throttle time
+			resp.int16(0)  // error code
+			resp.int64(42) // producer ID
+			resp.int16(0)  // epoch
+		default:
+			return
+		}
+		if resp == nil {
+			return
+		}
+
+		out := &kafkaWriter{}
+		out.int32(int32(4 + resp.Len()))
+		out.int32(correlation)
+		out.Write(resp.Bytes())
+		if _, err := conn.Write(out.Bytes()); err != nil {
+			return
+		}
+	}
+}
+
+func (k *fakeKafka) metadata(req *kafkaReader) *kafkaWriter {
+	host, port, _ := net.SplitHostPort(k.ln.Addr().String())
+	portNum, _ := strconv.Atoi(port)
+
+	resp := &kafkaWriter{}
+	resp.int32(0) // throttle time
+	resp.int32(1)
+	resp.int32(1) // node ID
+	resp.string(host)
+	resp.int32(int32(portNum))
+	resp.int16(-1) // rack
+	resp.int16(-1) // cluster ID
+	resp.int32(1)  // controller ID
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	n := req.int32()
+	resp.int32(n)
+	for i := int32(0); i < n; i++ {
+		topic := req.string()
+		if k.denied[topic] {
+			resp.int16(29) // TOPIC_AUTHORIZATION_FAILED
+			resp.string(topic)
+			resp.int8(0)
+			resp.int32(0)
+			continue
+		}
+
+		if k.partitions[topic] == 0 {
+			k.partitions[topic] = 1
+		}
+		resp.int16(0)
+		resp.string(topic)
+		resp.int8(0)
+		resp.int32(int32(k.partitions[topic]))
+		for p := 0; p < k.partitions[topic]; p++ {
+			resp.int16(0)
+			resp.int32(int32(p))
+			resp.int32(1) // leader
+			resp.int32(1)
+			resp.int32(1) // replicas
+			resp.int32(1)
+			resp.int32(1) // in-sync replicas
+		}
+	}
+	return resp
+}
+
+// produce writes the record batches of a produce request, and returns the
+// response, or nil to drop it.
+func (k *fakeKafka) produce(req *kafkaReader) *kafkaWriter {
+	req.int16() // transactional ID
+	req.int16() // acks
+	req.int32() // timeout
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	fail := k.fail > 0
+	if fail {
+		k.fail--
+	}
+	drop := k.drop > 0
+	if drop {
+		k.drop--
+	}
+
+	resp := &kafkaWriter{}
+	n := req.int32()
+	resp.int32(n)
+	for i := int32(0); i < n; i++ {
+		topic := req.string()
+		resp.string(topic)
+		m := req.int32()
+		resp.int32(m)
+		for j := int32(0); j < m; j++ {
+			partition := req.int32()
+			batch := &kafkaReader{b: req.next(int(req.int32()))}
+
+			code := int16(0)
+			if fail {
+				code = 19 // NOT_ENOUGH_REPLICAS
+			} else {
+				code = k.write(topic, int(partition), batch)
+			}
+			resp.int32(partition)
+			resp.int16(code)
+			resp.int64(0)  // base offset
+			resp.int64(-1) // log append time
+		}
+	}
+	resp.int32(0) // throttle time
+
+	if drop {
+		return nil
+	}
+	return resp
+}
+
+// write decodes a v2 record batch and appends its records to the partition.
+// It must be called with the lock held.
+func (k *fakeKafka) write(topic string, partition int, batch *kafkaReader) int16 {
+	batch.int64() // base offset
+	batch.int32() // length
+	batch.int32() // partition leader epoch
+	if batch.int8() != 2 {
+		return 2 // CORRUPT_MESSAGE
+	}
+	crc := uint32(batch.int32())
+	if crc32.Checksum(batch.b, crc32.MakeTable(crc32.Castagnoli)) != crc {
+		return 2
+	}
+
+	attributes := batch.int16()
+	batch.int32() // last offset delta
+	batch.int64() // first timestamp
+	batch.int64() // max timestamp
+	producerID := batch.int64()
+	batch.int16() // epoch
+	sequence := batch.int32()
+	count := int(batch.int32())
+
+	key := topic + "/" + strconv.Itoa(partition)
+	if producerID >= 0 {
+		if sequence < k.sequences[key] {
+			return 46 // DUPLICATE_SEQUENCE_NUMBER
+		}
+		k.sequences[key] = sequence + int32(count)
+	}
+
+	if attributes&7 == 1 {
+		zr, err := gzip.NewReader(bytes.NewReader(batch.b))
+		if err != nil {
+			return 2
+		}
+		batch.b, _ = ioutil.ReadAll(zr)
+	}
+
+	if k.records[topic] == nil {
+		k.records[topic] = make([][]fakeKafkaRecord, k.partitions[topic])
+	}
+	for i := 0; i < count; i++ {
+		batch.varint() // length
+		batch.int8()   // attributes
+		batch.varint() // timestamp delta
+		batch.varint() // offset delta
+		rec := fakeKafkaRecord{
+			key:     batch.varstring(),
+			value:   batch.varstring(),
+			headers: make(map[string]string),
+		}
+		for h := batch.varint(); h > 0; h-- {
+			name := batch.varstring()
+			rec.headers[name] = batch.varstring()
+		}
+		k.records[topic][partition] = append(k.records[topic][partition], rec)
+	}
+	return 0
+}
+
+func (k *fakeKafka) partition(topic string, partition int) []fakeKafkaRecord {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	if len(k.records[topic]) <= partition {
+		return nil
+	}
+	return append([]fakeKafkaRecord(nil), k.records[topic][partition]...)
+}
+
+type kafkaWriter struct {
+	bytes.Buffer
+}
+
+func (w *kafkaWriter) int8(v int8)   { w.WriteByte(byte(v)) }
+func (w *kafkaWriter) int16(v int16) { binary.Write(w, binary.BigEndian, v) }
+func (w *kafkaWriter) int32(v int32) { binary.Write(w, binary.BigEndian, v) }
+func (w *kafkaWriter) int64(v int64) { binary.Write(w, binary.BigEndian, v) }
+
+func (w *kafkaWriter) string(s string) {
+	w.int16(int16(len(s)))
+	w.WriteString(s)
+}
+
+type kafkaReader struct {
+	b []byte
+}
+
+func (r *kafkaReader) next(n int) []byte {
+	if n > len(r.b) {
+		n = len(r.b)
+	}
+	b := r.b[:n]
+	r.b = r.b[n:]
+	return b
+}
+
+func (r *kafkaReader) int8() int8   { return int8(r.next(1)[0]) }
+func (r *kafkaReader) int16() int16 { return int16(binary.BigEndian.Uint16(r.next(2))) }
+func (r *kafkaReader) int32() int32 { return int32(binary.BigEndian.Uint32(r.next(4))) }
+func (r *kafkaReader) int64() int64 { return int64(binary.BigEndian.Uint64(r.next(8))) }
+
+func (r *kafkaReader) string() string {
+	return string(r.next(int(r.int16())))
+}
+
+func (r *kafkaReader) varint() int64 {
+	v, n := binary.Varint(r.b)
+	r.b = r.b[n:]
+	return v
+}
+
+func (r *kafkaReader) varstring() string {
+	n := r.varint()
+	if n < 0 {
+		return ""
+	}
+	return string(r.next(int(n)))
+}
+
+// produce produces the messages and waits for their delivery reports.
+func produce(t *testing.T, p sink.KafkaProducer, msgs ...*sink.KafkaMessage) []error {
+	errs := make([]error, len(msgs))
+	var wg sync.WaitGroup
+	for i, msg := range msgs {
+		i := i
+		wg.Add(1)
+		err := p.Produce(msg, func(err error) {
+			defer wg.Done()
+			errs[i] = err
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("no delivery report")
+	}
+	return errs
+}
+
+func TestKafkaClient(t *testing.T) {
+	broker := newFakeKafka(t)
+	defer broker.ln.Close()
+	broker.partitions["users"] = 5
+	broker.denied["secret"] = true
+
+	config := sink.DefaultKafkaProducerConfig([]string{broker.ln.Addr().String()})
+	config.Linger = time.Millisecond
+	p, err := sink.NewKafkaClient(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	t.Run("partitioned by key", func(t *testing.T) {
+		errs := produce(t, p,
+			&sink.KafkaMessage{Topic: "users", Key: []byte("21"), Value: []byte("a"), Headers: map[string]string{"kind": "insert"}},
+			&sink.KafkaMessage{Topic: "users", Key: []byte("foobar"), Value: []byte("b")},
+			&sink.KafkaMessage{Topic: "users", Key: []byte("21"), Value: []byte("c")},
+		)
+		assert.Equal(t, []error{nil, nil, nil}, errs)
+
+		// as partitioned by the Java client
+		assert.Equal(t, []fakeKafkaRecord{
+			{key: "21", value: "a", headers: map[string]string{"kind": "insert"}},
+			{key: "21", value: "c", headers: map[string]string{}},
+		}, broker.partition("users", 0))
+		assert.Equal(t, []fakeKafkaRecord{
+			{key: "foobar", value: "b", headers: map[string]string{}},
+		}, broker.partition("users", 1))
+	})
+
+	t.Run("retriable error", func(t *testing.T) {
+		broker.mu.Lock()
+		broker.fail = 1
+		broker.mu.Unlock()
+
+		errs := produce(t, p, &sink.KafkaMessage{Topic: "orders", Key: []byte("1"), Value: []byte("d")})
+		assert.Equal(t, []error{nil}, errs)
+		assert.Len(t, broker.partition("orders", 0), 1)
+	})
+
+	t.Run("lost response", func(t *testing.T) {
+		broker.mu.Lock()
+		broker.drop = 1
+		broker.mu.Unlock()
+
+		// the retried batch is deduplicated by its sequence number
+		errs := produce(t, p, &sink.KafkaMessage{Topic: "orders", Key: []byte("2"), Value: []byte("e")})
+		assert.Equal(t, []error{nil}, errs)
+		assert.Len(t, broker.partition("orders", 0), 2)
+	})
+
+	t.Run("non-retriable error", func(t *testing.T) {
+		errs := produce(t, p, &sink.KafkaMessage{Topic: "secret", Value: []byte("f")})
+		assert.EqualError(t, errs[0], "failed to get the metadata of topic secret: TOPIC_AUTHORIZATION_FAILED")
+	})
+
+	t.Run("gzip", func(t *testing.T) {
+		config.Compression = "gzip"
+		gz, err := sink.NewKafkaClient(config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer gz.Close()
+
+		errs := produce(t, gz, &sink.KafkaMessage{Topic: "pets", Value: []byte("g")})
+		assert.Equal(t, []error{nil}, errs)
+		assert.Equal(t, []fakeKafkaRecord{{value: "g", headers: map[string]string{}}}, broker.partition("pets", 0))
+
+		config.Compression = "lz4"
+		_, err = sink.NewKafkaClient(config)
+		assert.EqualError(t, err, "compression 'lz4' is not supported. Must be one of `none` or `gzip`")
+	})
+
+	t.Run("closed", func(t *testing.T) {
+		closed, err := sink.NewKafkaClient(sink.DefaultKafkaProducerConfig([]string{broker.ln.Addr().String()}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.NoError(t, closed.Close())
+		assert.Error(t, closed.Produce(&sink.KafkaMessage{Topic: "users"}, func(error) {}))
+	})
+}
+
+func TestOpenKafkaClient(t *testing.T) {
+	broker := newFakeKafka(t)
+	defer broker.ln.Close()
+
+	sink.RegisterKafkaProducer(sink.NewKafkaClient)
+	defer sink.RegisterKafkaProducer(nil)
+
+	s, err := sink.Open("kafka://"+broker.ln.Addr().String()+"?topic=cdc.{{.Table}}&linger=1ms", sink.JSONEncoder{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	ctx := context.Background()
+	assert.NoError(t, s.Write(ctx, []*warppipe.Changeset{userChange(1, 7, "alice")}))
+	assert.NoError(t, s.Flush(ctx))
+
+	records := broker.partition("cdc.users", 0)
+	if assert.Len(t, records, 1) {
+		assert.Equal(t, `{"id":7}`, records[0].key)
+		assert.Equal(t, "update", records[0].headers["kind"])
+	}
+
+	_, err = sink.Open("kafka://"+broker.ln.Addr().String()+"?compression=snappy", sink.JSONEncoder{})
+	assert.True(t, err != nil && !errors.Is(err, io.EOF))
+}
@@ -0,0 +1,216 @@
+package sink_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"hash/fnv"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	warppipe "github.com/perangel/warp-pipe"
+	"github.com/perangel/warp-pipe/sink"
+)
+
+// mockBroker is an in-process KafkaProducer that partitions messages by key
+// and delivers them asynchronously.
+type mockBroker struct {
+	mu         sync.Mutex
+	config     sink.KafkaProducerConfig
+	partitions int
+	topics     map[string][][]*sink.KafkaMessage
+	fail       error
+	// failOnce fails the first message produced with each key
+	failOnce map[string]error
+}
+
+func newMockBroker(partitions int) *mockBroker {
+	return &mockBroker{
+		partitions: partitions,
+		topics:     make(map[string][][]*sink.KafkaMessage),
+	}
+}
+
+func (b *mockBroker) Produce(msg *sink.KafkaMessage, delivered func(error)) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.fail != nil {
+		go delivered(b.fail)
+		return nil
+	}
+	if err, ok := b.failOnce[string(msg.Key)]; ok {
+		delete(b.failOnce, string(msg.Key))
+		go delivered(err)
+		return nil
+	}
+
+	h := fnv.New32a()
+	h.Write(msg.Key)
+	partition := int(h.Sum32()) % b.partitions
+
+	if b.topics[msg.Topic] == nil {
+		b.topics[msg.Topic] = make([][]*sink.KafkaMessage, b.partitions)
+	}
+	b.topics[msg.Topic][partition] = append(b.topics[msg.Topic][partition], msg)
+
+	go delivered(nil)
+	return nil
+}
+
+func (b *mockBroker) Close() error { return nil }
+
+// partitionOf returns the partition of the topic holding messages with the key.
+func (b *mockBroker) partitionOf(topic, key string) []*sink.KafkaMessage {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for _, partition := range b.topics[topic] {
+		for _, msg := range partition {
+			if string(msg.Key) == key {
+				return partition
+			}
+		}
+	}
+	return nil
+}
+
+func userChange(id int64, userID float64, name string) *warppipe.Changeset {
+	return &warppipe.Changeset{
+		ID:     id,
+		Kind:   warppipe.ChangesetKindUpdate,
+		Schema: "public",
+		Table:  "users",
+		NewValues: []*warppipe.ChangesetColumn{
+			{Column: "id", Value: userID},
+			{Column: "name", Value: name},
+		},
+	}
+}
+
+func TestKafkaSink(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("per-table topics and key ordering", func(t *testing.T) {
+		broker := newMockBroker(4)
+		s, err := sink.NewKafkaSink(broker, "", nil, sink.JSONEncoder{})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var changes []*warppipe.Changeset
+		for i := int64(1); i <= 10; i++ {
+			changes = append(changes, userChange(i, float64(i%3), "user"))
+		}
+		changes = append(changes, &warppipe.Changeset{
+			ID:        11,
+			Kind:      warppipe.ChangesetKindDelete,
+			Schema:    "public",
+			Table:     "users",
+			OldValues: []*warppipe.ChangesetColumn{{Column: "id", Value: float64(1)}},
+		})
+
+		assert.NoError(t, s.Write(ctx, changes))
+		assert.NoError(t, s.Flush(ctx))
+
+		partition := broker.partitionOf("public.users", `{"id":1}`)
+		var ids []int64
+		for _, msg := range partition {
+			if string(msg.Key) != `{"id":1}` {
+				continue
+			}
+			var change warppipe.Changeset
+			assert.NoError(t, json.Unmarshal(msg.Value, &change))
+			ids = append(ids, change.ID)
+		}
+		assert.Equal(t, []int64{1, 4, 7, 10, 11}, ids)
+	})
+
+	t.Run("configured key columns", func(t *testing.T) {
+		broker := newMockBroker(1)
+		s, err := sink.NewKafkaSink(broker, "cdc.{{.Table}}", map[string][]string{
+			"public.users": {"name", "id"},
+		}, sink.JSONEncoder{})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		assert.NoError(t, s.Write(ctx, []*warppipe.Changeset{userChange(1, 7, "alice")}))
+		assert.NoError(t, s.Flush(ctx))
+		assert.NotNil(t, broker.partitionOf("cdc.users", `{"id":7,"name":"alice"}`))
+	})
+
+	t.Run("delivery failure", func(t *testing.T) {
+		broker := newMockBroker(1)
+		broker.fail = errors.New("NOT_ENOUGH_REPLICAS")
+		s, err := sink.NewKafkaSink(broker, "", nil, sink.JSONEncoder{})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		assert.NoError(t, s.Write(ctx, []*warppipe.Changeset{userChange(1, 1, "alice")}))
+		assert.EqualError(t, s.Flush(ctx), "failed to deliver changeset to topic public.users: NOT_ENOUGH_REPLICAS")
+		assert.NoError(t, s.Flush(ctx))
+	})
+
+	t.Run("only undelivered changesets are resent", func(t *testing.T) {
+		broker := newMockBroker(1)
+		broker.failOnce = map[string]error{`{"id":2}`: errors.New("NOT_ENOUGH_REPLICAS")}
+		s, err := sink.NewKafkaSink(broker, "", nil, sink.JSONEncoder{})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		batch := []*warppipe.Changeset{userChange(1, 1, "alice"), userChange(2, 2, "bob")}
+		assert.NoError(t, s.Write(ctx, batch))
+		assert.Error(t, s.Flush(ctx))
+
+		// as retried by sink.Run
+		assert.NoError(t, s.Write(ctx, batch))
+		assert.NoError(t, s.Flush(ctx))
+
+		var keys []string
+		for _, msg := range broker.topics["public.users"][0] {
+			keys = append(keys, string(msg.Key))
+		}
+		assert.Equal(t, []string{`{"id":1}`, `{"id":2}`}, keys)
+
+		// delivered changesets are forgotten once flushed
+		assert.NoError(t, s.Write(ctx, batch))
+		assert.NoError(t, s.Flush(ctx))
+		assert.Len(t, broker.topics["public.users"][0], 4)
+	})
+
+	t.Run("invalid topic template", func(t *testing.T) {
+		_, err := sink.NewKafkaSink(newMockBroker(1), "{{.Table", nil, sink.JSONEncoder{})
+		assert.Error(t, err)
+	})
+}
+
+func TestOpenKafka(t *testing.T) {
+	// the scheme is only available once a producer is registered
+	_, err := sink.Open("kafka://b1:9092", sink.JSONEncoder{})
+	assert.EqualError(t, err, "unknown output scheme 'kafka'. Must be one of: file, http, https, nats, redis, stdout")
+
+	broker := newMockBroker(1)
+	sink.RegisterKafkaProducer(func(config sink.KafkaProducerConfig) (sink.KafkaProducer, error) {
+		broker.config = config
+		return broker, nil
+	})
+	defer sink.RegisterKafkaProducer(nil)
+
+	s, err := sink.Open("kafka://b1:9092,b2:9092?topic=cdc.{{.Table}}&linger=10ms", sink.JSONEncoder{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	assert.Equal(t, []string{"b1:9092", "b2:9092"}, broker.config.Brokers)
+	assert.True(t, broker.config.Idempotent)
+	assert.Equal(t, -1, broker.config.RequiredAcks)
+
+	_, err = sink.Open("kafka://b1:9092?acks=1", sink.JSONEncoder{})
+	assert.EqualError(t, err, "the idempotent producer requires acks=all and at most 5 requests in flight")
+}
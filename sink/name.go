@@ -0,0 +1,92 @@
+package sink
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"text/template"
+
+	warppipe "github.com/perangel/warp-pipe"
+)
+
+// defaultKeyColumns are the key columns of tables with no configured key
+// columns.
+var defaultKeyColumns = []string{"id"}
+
+// parseNameTemplate parses a template deriving a name, such as a topic, from
+// a changeset.
+func parseNameTemplate(name, text, defaultText string) (*template.Template, error) {
+	if text == "" {
+		text = defaultText
+	}
+
+	tmpl, err := template.New(name).Option("missingkey=error").Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s template '%s': %w", name, text, err)
+	}
+	return tmpl, nil
+}
+
+func executeNameTemplate(tmpl *template.Template, change *warppipe.Changeset) (string, error) {
+	var b bytes.Buffer
+	err := tmpl.Execute(&b, change)
+	if err != nil {
+		return "", fmt.Errorf("failed to execute %s template: %w", tmpl.Name(), err)
+	}
+	return b.String(), nil
+}
+
+// changesetKey returns the values of the key columns of the changeset's table,
+// as a JSON object, e.g. `{"id":42}`. New values take precedence over old
+// values, so that deletes are keyed the same way as inserts and updates. It
+// returns nil if the changeset has none of the key columns, e.g. for truncates.
+func changesetKey(change *warppipe.Changeset, keyColumns map[string][]string) ([]byte, error) {
+	columns, ok := keyColumns[change.Schema+"."+change.Table]
+	if !ok {
+		columns, ok = keyColumns[change.Table]
+	}
+	if !ok {
+		columns = defaultKeyColumns
+	}
+
+	key := make(map[string]interface{}, len(columns))
+	for _, column := range columns {
+		v, ok := change.GetNewColumnValue(column)
+		if !ok {
+			v, ok = change.GetPreviousColumnValue(column)
+		}
+		if ok {
+			key[column] = v
+		}
+	}
+
+	if len(key) == 0 {
+		return nil, nil
+	}
+	return json.Marshal(key)
+}
+
+// messageID returns an ID that is unique to the changeset and stable across
+// restarts, used by sinks to de-duplicate changesets that are written again
+// after a restart from an earlier position. Changesets are identified by their
+// LSN and position in the transaction in logical replication modes, and by
+// their ID in audit mode. Snapshot changesets all share the same LSN, so they
+// are identified by their key instead. It returns an empty string if the
+// changeset cannot be identified.
+func messageID(change *warppipe.Changeset, keyColumns map[string][]string) (string, error) {
+	if change.Kind == warppipe.ChangesetKindSnapshot {
+		key, err := changesetKey(change, keyColumns)
+		if err != nil || key == nil {
+			return "", err
+		}
+		return fmt.Sprintf("%d:%s.%s:%s", change.LSN, change.Schema, change.Table, key), nil
+	}
+
+	if change.LSN != 0 {
+		return fmt.Sprintf("%d-%d", change.LSN, change.TxPosition), nil
+	}
+	if change.ID != 0 {
+		return fmt.Sprintf("%d", change.ID), nil
+	}
+	return "", nil
+}
@@ -0,0 +1,159 @@
+package sink_test
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	warppipe "github.com/perangel/warp-pipe"
+	"github.com/perangel/warp-pipe/sink"
+)
+
+// fakeJetStream is an in-memory NATS server with a single JetStream stream
+// capturing the `warp_pipe.>` subjects, de-duplicating messages by ID.
+type fakeJetStream struct {
+	ln net.Listener
+
+	mu       sync.Mutex
+	subjects []string
+	ids      map[string]bool
+	connects int
+}
+
+func newFakeJetStream(t *testing.T) *fakeJetStream {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := &fakeJetStream{ln: ln, ids: make(map[string]bool)}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+func (s *fakeJetStream) serve(conn net.Conn) {
+	defer conn.Close()
+
+	s.mu.Lock()
+	s.connects++
+	s.mu.Unlock()
+
+	r := bufio.NewReader(conn)
+	fmt.Fprint(conn, "INFO {\"headers\":true}\r\n")
+
+	var sid string
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+
+		switch fields[0] {
+		case "PING":
+			fmt.Fprint(conn, "PONG\r\n")
+		case "SUB":
+			sid = fields[2]
+		case "HPUB":
+			// HPUB <subject> <reply> <#header bytes> <#total bytes>
+			hdrLen, _ := strconv.Atoi(fields[3])
+			total, _ := strconv.Atoi(fields[4])
+			data := make([]byte, total+2)
+			io.ReadFull(r, data)
+
+			var id string
+			for _, header := range strings.Split(string(data[:hdrLen]), "\r\n") {
+				if strings.HasPrefix(header, "Nats-Msg-Id: ") {
+					id = strings.TrimPrefix(header, "Nats-Msg-Id: ")
+				}
+			}
+
+			var ack string
+			s.mu.Lock()
+			switch {
+			case !strings.HasPrefix(fields[1], "warp_pipe."):
+				ack = `{"error":{"code":400,"description":"no stream matches subject"}}`
+			case id != "" && s.ids[id]:
+				ack = `{"stream":"CDC","seq":1,"duplicate":true}`
+			default:
+				s.ids[id] = true
+				s.subjects = append(s.subjects, fields[1])
+				ack = fmt.Sprintf(`{"stream":"CDC","seq":%d}`, len(s.subjects))
+			}
+			s.mu.Unlock()
+
+			fmt.Fprintf(conn, "MSG %s %s %d\r\n%s\r\n", fields[2], sid, len(ack), ack)
+		}
+	}
+}
+
+// published returns the subjects of the messages in the stream and the number
+// of connections made.
+func (s *fakeJetStream) published() ([]string, int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return append([]string(nil), s.subjects...), s.connects
+}
+
+func TestNATSSink(t *testing.T) {
+	srv := newFakeJetStream(t)
+	defer srv.ln.Close()
+
+	s, err := sink.Open("nats://"+srv.ln.Addr().String(), sink.JSONEncoder{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	ctx := context.Background()
+	changes := []*warppipe.Changeset{
+		{LSN: 100, TxPosition: 0, Schema: "public", Table: "users"},
+		{LSN: 100, TxPosition: 1, Schema: "public", Table: "orders"},
+	}
+
+	t.Run("publish and wait for acks", func(t *testing.T) {
+		assert.NoError(t, s.Write(ctx, changes))
+		assert.NoError(t, s.Flush(ctx))
+		subjects, _ := srv.published()
+		assert.Equal(t, []string{"warp_pipe.public.users", "warp_pipe.public.orders"}, subjects)
+	})
+
+	t.Run("duplicates are discarded", func(t *testing.T) {
+		assert.NoError(t, s.Write(ctx, changes))
+		assert.NoError(t, s.Flush(ctx))
+		subjects, connects := srv.published()
+		assert.Len(t, subjects, 2)
+		assert.Equal(t, 1, connects)
+	})
+
+	t.Run("publish error", func(t *testing.T) {
+		s, err := sink.Open("nats://"+srv.ln.Addr().String()+"?subject=other.{{.Table}}", sink.JSONEncoder{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer s.Close()
+
+		assert.NoError(t, s.Write(ctx, changes[:1]))
+		assert.EqualError(t, s.Flush(ctx), "failed to publish changeset: no stream matches subject (400)")
+	})
+}
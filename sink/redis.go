@@ -0,0 +1,313 @@
+package sink
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	warppipe "github.com/perangel/warp-pipe"
+)
+
+const (
+	// DefaultRedisStream is the stream name template used by the Redis sink
+	// if none is provided.
+	DefaultRedisStream = "warp_pipe:{{.Schema}}.{{.Table}}"
+
+	defaultRedisPort = "6379"
+	redisDialTimeout = 10 * time.Second
+)
+
+// RedisStreamSink appends each changeset to a Redis stream, whose name is
+// derived from the stream template, with the fields `kind`, `content_type` and
+// `data`. Entries are added with an explicit ID derived from the changeset's
+// position (`<lsn>-<tx_position>`, or `<id>-0` in audit mode), so that the
+// server rejects changesets appended again after a restart, which are then
+// treated as delivered. Snapshot changesets share the same position, so they
+// are added with auto-generated IDs. A changeset is acknowledged once the
+// server has replied to its XADD.
+type RedisStreamSink struct {
+	addr   string
+	user   *url.Userinfo
+	db     int
+	stream *template.Template
+	maxLen int64
+	enc    Encoder
+
+	conn net.Conn
+	r    *bufio.Reader
+	w    *bufio.Writer
+}
+
+// redisError is an error reply from the server.
+type redisError string
+
+func (e redisError) Error() string {
+	return string(e)
+}
+
+// NewRedisStreamSink returns a new RedisStreamSink writing to the server at
+// addr (`host:port`) and database db. The stream is a text/template executed
+// with the changeset. If maxLen is positive, streams are trimmed to
+// approximately maxLen entries. The connection is opened on first write.
+func NewRedisStreamSink(addr string, user *url.Userinfo, db int, stream string, maxLen int64, enc Encoder) (*RedisStreamSink, error) {
+	tmpl, err := parseNameTemplate("stream", stream, DefaultRedisStream)
+	if err != nil {
+		return nil, err
+	}
+
+	return &RedisStreamSink{
+		addr:   addr,
+		user:   user,
+		db:     db,
+		stream: tmpl,
+		maxLen: maxLen,
+		enc:    enc,
+	}, nil
+}
+
+// newRedisStreamSink creates a RedisStreamSink from a URL such as
+// `redis://:password@localhost:6379/0?stream=cdc:{{.Table}}&max_len=100000`.
+func newRedisStreamSink(u *url.URL, enc Encoder) (Sink, error) {
+	if u.Hostname() == "" {
+		return nil, fmt.Errorf("redis output '%s' is missing a host", u)
+	}
+
+	port := u.Port()
+	if port == "" {
+		port = defaultRedisPort
+	}
+
+	var db int
+	if path := strings.Trim(u.Path, "/"); path != "" {
+		n, err := strconv.Atoi(path)
+		if err != nil {
+			return nil, fmt.Errorf("invalid redis database '%s': %w", path, err)
+		}
+		db = n
+	}
+
+	var maxLen int64
+	if v := u.Query().Get("max_len"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid max_len '%s': %w", v, err)
+		}
+		maxLen = n
+	}
+
+	return NewRedisStreamSink(net.JoinHostPort(u.Hostname(), port), u.User, db, u.Query().Get("stream"), maxLen, enc)
+}
+
+// Write implements Sink. The XADD commands of the batch are pipelined, and
+// each changeset is acknowledged as soon as its reply is read.
+func (s *RedisStreamSink) Write(ctx context.Context, changes []*warppipe.Changeset) error {
+	if s.conn == nil {
+		err := s.connect(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to connect to Redis server %s: %w", s.addr, err)
+		}
+	}
+
+	for _, change := range changes {
+		args, err := s.xadd(change)
+		if err != nil {
+			return err
+		}
+		writeRedisCommand(s.w, args...)
+	}
+
+	err := s.w.Flush()
+	if err != nil {
+		s.disconnect()
+		return fmt.Errorf("failed to append changesets: %w", err)
+	}
+
+	var firstErr error
+	for _, change := range changes {
+		_, err := readRedisReply(s.r)
+		var replyErr redisError
+		switch {
+		case err == nil:
+			change.Ack()
+		case errors.As(err, &replyErr):
+			if isRedisDuplicateID(replyErr) {
+				change.Ack()
+			} else if firstErr == nil {
+				firstErr = fmt.Errorf("failed to append changeset: %w", err)
+			}
+		default:
+			s.disconnect()
+			return fmt.Errorf("failed to read reply: %w", err)
+		}
+	}
+	return firstErr
+}
+
+// Flush implements Sink. Changesets are written synchronously, so there is
+// nothing to flush.
+func (s *RedisStreamSink) Flush(ctx context.Context) error {
+	return nil
+}
+
+// Close implements Sink.
+func (s *RedisStreamSink) Close() error {
+	if s.conn == nil {
+		return nil
+	}
+
+	err := s.conn.Close()
+	s.conn = nil
+	return err
+}
+
+// xadd returns the XADD command arguments for the changeset.
+func (s *RedisStreamSink) xadd(change *warppipe.Changeset) ([]string, error) {
+	stream, err := executeNameTemplate(s.stream, change)
+	if err != nil {
+		return nil, err
+	}
+
+	b, err := s.enc.Encode(change)
+	if err != nil {
+		return nil, err
+	}
+
+	args := []string{"XADD", stream}
+	if s.maxLen > 0 {
+		args = append(args, "MAXLEN", "~", strconv.FormatInt(s.maxLen, 10))
+	}
+	return append(args,
+		redisEntryID(change),
+		"kind", string(change.Kind),
+		"content_type", s.enc.ContentType(),
+		"data", string(b),
+	), nil
+}
+
+func (s *RedisStreamSink) connect(ctx context.Context) error {
+	d := net.Dialer{Timeout: redisDialTimeout}
+	conn, err := d.DialContext(ctx, "tcp", s.addr)
+	if err != nil {
+		return err
+	}
+
+	s.conn = conn
+	s.r = bufio.NewReader(conn)
+	s.w = bufio.NewWriter(conn)
+
+	var cmds [][]string
+	if s.user != nil {
+		if pass, ok := s.user.Password(); ok {
+			if s.user.Username() != "" {
+				cmds = append(cmds, []string{"AUTH", s.user.Username(), pass})
+			} else {
+				cmds = append(cmds, []string{"AUTH", pass})
+			}
+		}
+	}
+	if s.db != 0 {
+		cmds = append(cmds, []string{"SELECT", strconv.Itoa(s.db)})
+	}
+
+	for _, cmd := range cmds {
+		writeRedisCommand(s.w, cmd...)
+		err = s.w.Flush()
+		if err == nil {
+			_, err = readRedisReply(s.r)
+		}
+		if err != nil {
+			s.disconnect()
+			return fmt.Errorf("%s failed: %w", cmd[0], err)
+		}
+	}
+	return nil
+}
+
+func (s *RedisStreamSink) disconnect() {
+	s.conn.Close()
+	s.conn = nil
+}
+
+// redisEntryID returns the stream entry ID of the changeset, or `*` to let the
+// server generate one.
+func redisEntryID(change *warppipe.Changeset) string {
+	switch {
+	case change.Kind == warppipe.ChangesetKindSnapshot:
+		return "*"
+	case change.LSN != 0:
+		return fmt.Sprintf("%d-%d", change.LSN, change.TxPosition)
+	case change.ID > 0:
+		return fmt.Sprintf("%d-0", change.ID)
+	default:
+		return "*"
+	}
+}
+
+// isRedisDuplicateID returns true if the error is the reply to an XADD whose ID
+// is not greater than the stream's last ID, i.e. it was already appended.
+func isRedisDuplicateID(err redisError) bool {
+	return strings.Contains(string(err), "equal or smaller than the target stream top item")
+}
+
+// writeRedisCommand writes a command as an array of bulk strings.
+func writeRedisCommand(w *bufio.Writer, args ...string) {
+	fmt.Fprintf(w, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(w, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+}
+
+// readRedisReply reads a reply. Error replies are returned as a redisError.
+func readRedisReply(r *bufio.Reader) (interface{}, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimRight(line, "\r\n")
+	if line == "" {
+		return nil, errors.New("empty reply")
+	}
+
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, redisError(line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		b := make([]byte, n+2)
+		_, err = io.ReadFull(r, b)
+		if err != nil {
+			return nil, err
+		}
+		return string(b[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		values := make([]interface{}, n)
+		for i := range values {
+			values[i], err = readRedisReply(r)
+			if err != nil {
+				return nil, err
+			}
+		}
+		return values, nil
+	default:
+		return nil, fmt.Errorf("unexpected reply '%s'", line)
+	}
+}
@@ -0,0 +1,172 @@
+package sink_test
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	warppipe "github.com/perangel/warp-pipe"
+	"github.com/perangel/warp-pipe/sink"
+)
+
+// fakeRedis is an in-memory Redis server supporting AUTH and XADD with
+// explicit IDs.
+type fakeRedis struct {
+	ln net.Listener
+
+	mu      sync.Mutex
+	streams map[string][]string
+}
+
+func newFakeRedis(t *testing.T) *fakeRedis {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := &fakeRedis{ln: ln, streams: make(map[string][]string)}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+func (s *fakeRedis) serve(conn net.Conn) {
+	defer conn.Close()
+
+	r := bufio.NewReader(conn)
+	for {
+		args, err := readCommand(r)
+		if err != nil {
+			return
+		}
+
+		switch strings.ToUpper(args[0]) {
+		case "AUTH":
+			if args[len(args)-1] != "secret" {
+				fmt.Fprint(conn, "-WRONGPASS invalid username-password pair\r\n")
+				continue
+			}
+			fmt.Fprint(conn, "+OK\r\n")
+		case "XADD":
+			stream, id := args[1], args[2]
+			s.mu.Lock()
+			ids := s.streams[stream]
+			if len(ids) > 0 && compareIDs(id, ids[len(ids)-1]) <= 0 {
+				s.mu.Unlock()
+				fmt.Fprint(conn, "-ERR The ID specified in XADD is equal or smaller than the target stream top item\r\n")
+				continue
+			}
+			s.streams[stream] = append(ids, id)
+			s.mu.Unlock()
+			fmt.Fprintf(conn, "$%d\r\n%s\r\n", len(id), id)
+		default:
+			fmt.Fprintf(conn, "-ERR unknown command '%s'\r\n", args[0])
+		}
+	}
+}
+
+func readCommand(r *bufio.Reader) ([]string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	n, _ := strconv.Atoi(strings.TrimSpace(line[1:]))
+
+	args := make([]string, n)
+	for i := range args {
+		line, err = r.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		size, _ := strconv.Atoi(strings.TrimSpace(line[1:]))
+		b := make([]byte, size+2)
+		_, err = io.ReadFull(r, b)
+		if err != nil {
+			return nil, err
+		}
+		args[i] = string(b[:size])
+	}
+	return args, nil
+}
+
+func compareIDs(a, b string) int {
+	parse := func(id string) (uint64, uint64) {
+		parts := strings.SplitN(id, "-", 2)
+		ms, _ := strconv.ParseUint(parts[0], 10, 64)
+		seq, _ := strconv.ParseUint(parts[1], 10, 64)
+		return ms, seq
+	}
+	ams, aseq := parse(a)
+	bms, bseq := parse(b)
+	switch {
+	case ams < bms || (ams == bms && aseq < bseq):
+		return -1
+	case ams == bms && aseq == bseq:
+		return 0
+	default:
+		return 1
+	}
+}
+
+func (s *fakeRedis) stream(name string) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return append([]string(nil), s.streams[name]...)
+}
+
+func TestRedisStreamSink(t *testing.T) {
+	srv := newFakeRedis(t)
+	defer srv.ln.Close()
+
+	s, err := sink.Open("redis://:secret@"+srv.ln.Addr().String()+"?stream=cdc:{{.Table}}", sink.JSONEncoder{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	ctx := context.Background()
+
+	t.Run("append with position IDs", func(t *testing.T) {
+		err := s.Write(ctx, []*warppipe.Changeset{
+			{ID: 1, Table: "users"},
+			{ID: 2, Table: "users"},
+			{LSN: 300, TxPosition: 1, Table: "orders"},
+		})
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"1-0", "2-0"}, srv.stream("cdc:users"))
+		assert.Equal(t, []string{"300-1"}, srv.stream("cdc:orders"))
+	})
+
+	t.Run("duplicates are discarded", func(t *testing.T) {
+		err := s.Write(ctx, []*warppipe.Changeset{{ID: 2, Table: "users"}, {ID: 3, Table: "users"}})
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"1-0", "2-0", "3-0"}, srv.stream("cdc:users"))
+	})
+
+	t.Run("authentication failure", func(t *testing.T) {
+		s, err := sink.Open("redis://:wrong@"+srv.ln.Addr().String(), sink.JSONEncoder{})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = s.Write(ctx, []*warppipe.Changeset{{ID: 1, Table: "users"}})
+		assert.Error(t, err)
+		assert.NoError(t, s.Close())
+	})
+}
@@ -0,0 +1,155 @@
+package sink
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	warppipe "github.com/perangel/warp-pipe"
+)
+
+const (
+	defaultMaxBatchSize  = 100
+	defaultFlushInterval = 1 * time.Second
+)
+
+// RunOption is a Run option function.
+type RunOption func(*runner)
+
+// MaxBatchSize is a RunOption that sets the maximum number of changesets
+// written to the sink at once.
+func MaxBatchSize(size int) RunOption {
+	return func(r *runner) {
+		r.maxBatchSize = size
+	}
+}
+
+// FlushInterval is a RunOption that sets the maximum time a changeset waits
+// for its batch to fill up before the batch is written.
+func FlushInterval(d time.Duration) RunOption {
+	return func(r *runner) {
+		r.flushInterval = d
+	}
+}
+
+// RetryBackoff is a RunOption that sets the delays between attempts to write
+// a batch that failed. By default, warppipe.DefaultBackoff is used.
+func RetryBackoff(b warppipe.Backoff) RunOption {
+	return func(r *runner) {
+		r.backoff = b
+	}
+}
+
+// Logger is a RunOption that sets the logger used to report failed writes.
+func Logger(logger *log.Logger) RunOption {
+	return func(r *runner) {
+		r.logger = logger
+	}
+}
+
+type runner struct {
+	sink          Sink
+	maxBatchSize  int
+	flushInterval time.Duration
+	backoff       warppipe.Backoff
+	logger        *log.Logger
+}
+
+// Run writes the changesets received on changes to the sink, in batches, and
+// acknowledges them only once the sink has written and flushed them. A batch
+// that cannot be written is retried until the retry backoff gives up, in which
+// case Run returns the error without acknowledging the batch. Run returns nil
+// once changes is closed, and the context's error once it is done.
+func Run(ctx context.Context, sink Sink, changes <-chan *warppipe.Changeset, opts ...RunOption) error {
+	r := &runner{
+		sink:          sink,
+		maxBatchSize:  defaultMaxBatchSize,
+		flushInterval: defaultFlushInterval,
+		backoff:       warppipe.DefaultBackoff,
+		logger:        log.StandardLogger(),
+	}
+
+	for _, opt := range opts {
+		opt(r)
+	}
+
+	return r.run(ctx, changes)
+}
+
+func (r *runner) run(ctx context.Context, changes <-chan *warppipe.Changeset) error {
+	batch := make([]*warppipe.Changeset, 0, r.maxBatchSize)
+	timer := time.NewTimer(r.flushInterval)
+	timer.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case change, ok := <-changes:
+			if !ok {
+				return r.write(ctx, batch)
+			}
+
+			batch = append(batch, change)
+			if len(batch) == 1 {
+				timer.Reset(r.flushInterval)
+			}
+			if len(batch) < r.maxBatchSize {
+				continue
+			}
+			if !timer.Stop() {
+				select {
+				case <-timer.C:
+				default:
+				}
+			}
+		case <-timer.C:
+		}
+
+		err := r.write(ctx, batch)
+		if err != nil {
+			return err
+		}
+		batch = batch[:0]
+	}
+}
+
+// write writes and flushes the batch, retrying on failure, then acknowledges
+// its changesets.
+func (r *runner) write(ctx context.Context, batch []*warppipe.Changeset) error {
+	if len(batch) == 0 {
+		return nil
+	}
+
+	for attempt := 1; ; attempt++ {
+		err := r.sink.Write(ctx, batch)
+		if err == nil {
+			err = r.sink.Flush(ctx)
+		}
+		if err == nil {
+			break
+		}
+
+		if r.backoff.MaxRetries >= 0 && attempt > r.backoff.MaxRetries {
+			return fmt.Errorf("failed to write %d changesets after %d attempt(s): %w", len(batch), attempt, err)
+		}
+
+		delay := r.backoff.Duration(attempt)
+		r.logger.WithError(err).
+			WithField("attempt", attempt).
+			Warnf("failed to write changesets, retrying in %s", delay)
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(delay):
+		}
+	}
+
+	for _, change := range batch {
+		change.Ack()
+	}
+	return nil
+}
@@ -0,0 +1,111 @@
+package sink_test
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	warppipe "github.com/perangel/warp-pipe"
+	"github.com/perangel/warp-pipe/sink"
+)
+
+type memorySink struct {
+	mu       sync.Mutex
+	batches  [][]int64
+	failures int
+}
+
+func (s *memorySink) Write(ctx context.Context, changes []*warppipe.Changeset) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.failures > 0 {
+		s.failures--
+		return errors.New("unavailable")
+	}
+
+	var ids []int64
+	for _, change := range changes {
+		ids = append(ids, change.ID)
+	}
+	s.batches = append(s.batches, ids)
+	return nil
+}
+
+func (s *memorySink) Flush(ctx context.Context) error { return nil }
+
+func (s *memorySink) Close() error { return nil }
+
+func TestRun(t *testing.T) {
+	backoff := warppipe.Backoff{InitialInterval: time.Millisecond, MaxRetries: 2}
+
+	t.Run("write in batches", func(t *testing.T) {
+		s := &memorySink{}
+		changes := make(chan *warppipe.Changeset, 5)
+		for i := int64(1); i <= 5; i++ {
+			changes <- &warppipe.Changeset{ID: i}
+		}
+		close(changes)
+
+		err := sink.Run(context.Background(), s, changes, sink.MaxBatchSize(2), sink.RetryBackoff(backoff))
+		assert.NoError(t, err)
+		assert.Equal(t, [][]int64{{1, 2}, {3, 4}, {5}}, s.batches)
+	})
+
+	t.Run("write partial batch after flush interval", func(t *testing.T) {
+		s := &memorySink{}
+		changes := make(chan *warppipe.Changeset)
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		errCh := make(chan error, 1)
+		go func() {
+			errCh <- sink.Run(ctx, s, changes, sink.FlushInterval(10*time.Millisecond))
+		}()
+		changes <- &warppipe.Changeset{ID: 1}
+
+		assert.Eventually(t, func() bool {
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			return len(s.batches) == 1
+		}, time.Second, 5*time.Millisecond)
+
+		cancel()
+		assert.Equal(t, context.Canceled, <-errCh)
+	})
+
+	t.Run("retry failed writes", func(t *testing.T) {
+		s := &memorySink{failures: 2}
+		changes := make(chan *warppipe.Changeset, 1)
+		changes <- &warppipe.Changeset{ID: 1}
+		close(changes)
+
+		err := sink.Run(context.Background(), s, changes, sink.RetryBackoff(backoff))
+		assert.NoError(t, err)
+		assert.Equal(t, [][]int64{{1}}, s.batches)
+	})
+
+	t.Run("give up after max retries", func(t *testing.T) {
+		s := &memorySink{failures: 3}
+		changes := make(chan *warppipe.Changeset, 1)
+		changes <- &warppipe.Changeset{ID: 1}
+		close(changes)
+
+		err := sink.Run(context.Background(), s, changes, sink.RetryBackoff(backoff))
+		assert.Error(t, err)
+		assert.Empty(t, s.batches)
+	})
+}
+
+func TestOpen(t *testing.T) {
+	_, err := sink.Open("ftp://example.com", sink.JSONEncoder{})
+	assert.EqualError(t, err, "unknown output scheme 'ftp'. Must be one of: file, http, https, nats, redis, stdout")
+
+	s, err := sink.Open("stdout", sink.JSONEncoder{})
+	assert.NoError(t, err)
+	assert.NoError(t, s.Close())
+}
@@ -0,0 +1,188 @@
+// Package sink provides outputs for the changesets emitted by a WarpPipe.
+package sink
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+
+	warppipe "github.com/perangel/warp-pipe"
+)
+
+// Sink is an output for changesets.
+type Sink interface {
+	// Write writes a batch of changesets. Once it returns without an error,
+	// the changesets are considered delivered, although they may still be
+	// buffered until Flush is called.
+	Write(ctx context.Context, changes []*warppipe.Changeset) error
+	// Flush makes all written changesets durable.
+	Flush(ctx context.Context) error
+	// Close flushes and releases the sink's resources.
+	Close() error
+}
+
+// Encoder encodes a changeset for a sink.
+type Encoder interface {
+	Encode(change *warppipe.Changeset) ([]byte, error)
+	ContentType() string
+}
+
+// JSONEncoder encodes changesets as JSON.
+type JSONEncoder struct{}
+
+// Encode implements Encoder.
+func (JSONEncoder) Encode(change *warppipe.Changeset) ([]byte, error) {
+	return json.Marshal(change)
+}
+
+// ContentType implements Encoder.
+func (JSONEncoder) ContentType() string {
+	return "application/json"
+}
+
+// Source identifies the database changesets are read from, for encoders that
+// include it in their output.
+type Source struct {
+	Host     string
+	Port     int
+	Database string
+}
+
+// EncoderFactory creates an encoder from the parameters of its output format.
+type EncoderFactory func(src Source, params url.Values) (Encoder, error)
+
+// Factory creates a sink from its URL.
+type Factory func(u *url.URL, enc Encoder) (Sink, error)
+
+var (
+	registryMu sync.RWMutex
+	registry   = make(map[string]Factory)
+	encoders   = make(map[string]EncoderFactory)
+)
+
+// Register makes a sink available for the given URL scheme. It panics if a
+// sink is already registered for the scheme.
+func Register(scheme string, factory Factory) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+
+	if _, ok := registry[scheme]; ok {
+		panic(fmt.Sprintf("sink: Register called twice for scheme %s", scheme))
+	}
+	registry[scheme] = factory
+}
+
+// Schemes returns the sorted list of registered URL schemes.
+func Schemes() []string {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+
+	schemes := make([]string, 0, len(registry))
+	for scheme := range registry {
+		schemes = append(schemes, scheme)
+	}
+	sort.Strings(schemes)
+	return schemes
+}
+
+// RegisterEncoder makes an encoder available as an output format. It panics if
+// an encoder is already registered for the format.
+func RegisterEncoder(format string, factory EncoderFactory) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+
+	if _, ok := encoders[format]; ok {
+		panic(fmt.Sprintf("sink: RegisterEncoder called twice for format %s", format))
+	}
+	encoders[format] = factory
+}
+
+// Formats returns the sorted list of registered output formats.
+func Formats() []string {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+
+	formats := make([]string, 0, len(encoders))
+	for format := range encoders {
+		formats = append(formats, format)
+	}
+	sort.Strings(formats)
+	return formats
+}
+
+// NewEncoder returns the encoder for the given output format. Parameters are
+// passed as a query string, e.g. `debezium?schemas=false`. An empty format
+// selects `json`.
+func NewEncoder(format string, src Source) (Encoder, error) {
+	if format == "" {
+		format = "json"
+	}
+
+	name, query := format, ""
+	if i := strings.Index(format, "?"); i >= 0 {
+		name, query = format[:i], format[i+1:]
+	}
+
+	params, err := url.ParseQuery(query)
+	if err != nil {
+		return nil, fmt.Errorf("invalid output format '%s': %w", format, err)
+	}
+
+	registryMu.RLock()
+	factory, ok := encoders[name]
+	registryMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown output format '%s'. Must be one of: %s", name, strings.Join(Formats(), ", "))
+	}
+
+	return factory(src, params)
+}
+
+// Open returns the sink for the given output. The output is a URL whose scheme
+// selects the sink, e.g. `stdout://`, `file:///var/lib/warp-pipe/changes.ndjson`
+// or `https://example.com/webhook`. As shorthands, `stdout` and `-` select the
+// stdout sink, and any other value without a scheme is a file path.
+func Open(output string, enc Encoder) (Sink, error) {
+	switch output {
+	case "", "-", "stdout":
+		output = "stdout://"
+	}
+
+	if !strings.Contains(output, "://") {
+		output = "file://" + output
+	}
+
+	u, err := url.Parse(output)
+	if err != nil {
+		return nil, fmt.Errorf("invalid output '%s': %w", output, err)
+	}
+
+	registryMu.RLock()
+	factory, ok := registry[u.Scheme]
+	registryMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown output scheme '%s'. Must be one of: %s", u.Scheme, strings.Join(Schemes(), ", "))
+	}
+
+	return factory(u, enc)
+}
+
+func init() {
+	Register("stdout", newStdoutSink)
+	Register("file", newFileSink)
+	Register("http", newWebhookSink)
+	Register("https", newWebhookSink)
+	Register("nats", newNATSSink)
+	Register("redis", newRedisStreamSink)
+
+	RegisterEncoder("json", func(Source, url.Values) (Encoder, error) {
+		return JSONEncoder{}, nil
+	})
+	RegisterEncoder("debezium", newDebeziumEncoder)
+	RegisterEncoder("cloudevents", newCloudEventsEncoder)
+	RegisterEncoder("avro", newAvroEncoder)
+}
@@ -0,0 +1,54 @@
+package sink
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net/url"
+	"os"
+
+	warppipe "github.com/perangel/warp-pipe"
+)
+
+// writerSink writes changesets as newline-delimited records to a writer.
+type writerSink struct {
+	w   *bufio.Writer
+	enc Encoder
+}
+
+func newStdoutSink(_ *url.URL, enc Encoder) (Sink, error) {
+	return newWriterSink(os.Stdout, enc), nil
+}
+
+func newWriterSink(w io.Writer, enc Encoder) *writerSink {
+	return &writerSink{
+		w:   bufio.NewWriter(w),
+		enc: enc,
+	}
+}
+
+// Write implements Sink.
+func (s *writerSink) Write(ctx context.Context, changes []*warppipe.Changeset) error {
+	for _, change := range changes {
+		b, err := s.enc.Encode(change)
+		if err != nil {
+			return err
+		}
+
+		_, err = s.w.Write(append(b, '\n'))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Flush implements Sink.
+func (s *writerSink) Flush(ctx context.Context) error {
+	return s.w.Flush()
+}
+
+// Close implements Sink.
+func (s *writerSink) Close() error {
+	return s.w.Flush()
+}
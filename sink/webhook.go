@@ -0,0 +1,130 @@
+package sink
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"time"
+
+	warppipe "github.com/perangel/warp-pipe"
+)
+
+const defaultWebhookTimeout = 30 * time.Second
+
+// HTTPMessage is the body and headers of a request posted to an HTTP endpoint.
+type HTTPMessage struct {
+	Header http.Header
+	Body   []byte
+}
+
+// HTTPEncoder is implemented by encoders that define how changesets are
+// posted to HTTP endpoints, instead of as batches of newline-delimited
+// records.
+type HTTPEncoder interface {
+	Encoder
+	// EncodeHTTP encodes a batch of changesets as one or more requests.
+	EncodeHTTP(changes []*warppipe.Changeset) ([]*HTTPMessage, error)
+}
+
+// WebhookSink posts each batch of changesets to an HTTP endpoint, as
+// newline-delimited records, or as encoded by the encoder if it implements
+// HTTPEncoder. A batch is delivered once the endpoint responds to all of its
+// requests with a 2xx status code.
+type WebhookSink struct {
+	url    string
+	client *http.Client
+	enc    Encoder
+}
+
+// NewWebhookSink returns a new WebhookSink posting to the given URL.
+func NewWebhookSink(url string, client *http.Client, enc Encoder) *WebhookSink {
+	return &WebhookSink{
+		url:    url,
+		client: client,
+		enc:    enc,
+	}
+}
+
+func newWebhookSink(u *url.URL, enc Encoder) (Sink, error) {
+	return NewWebhookSink(u.String(), &http.Client{Timeout: defaultWebhookTimeout}, enc), nil
+}
+
+// Write implements Sink.
+func (s *WebhookSink) Write(ctx context.Context, changes []*warppipe.Changeset) error {
+	if len(changes) == 0 {
+		return nil
+	}
+
+	msgs, err := s.encode(changes)
+	if err != nil {
+		return err
+	}
+
+	for _, msg := range msgs {
+		err := s.post(ctx, msg)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *WebhookSink) encode(changes []*warppipe.Changeset) ([]*HTTPMessage, error) {
+	if enc, ok := s.enc.(HTTPEncoder); ok {
+		return enc.EncodeHTTP(changes)
+	}
+
+	var body bytes.Buffer
+	for _, change := range changes {
+		b, err := s.enc.Encode(change)
+		if err != nil {
+			return nil, err
+		}
+		body.Write(b)
+		body.WriteByte('\n')
+	}
+
+	return []*HTTPMessage{{
+		Header: http.Header{"Content-Type": {"application/x-ndjson"}},
+		Body:   body.Bytes(),
+	}}, nil
+}
+
+func (s *WebhookSink) post(ctx context.Context, msg *HTTPMessage) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.url, bytes.NewReader(msg.Body))
+	if err != nil {
+		return err
+	}
+	for k, v := range msg.Header {
+		req.Header[k] = v
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to post changesets: %w", err)
+	}
+	defer resp.Body.Close()
+	// drain the body so that the connection can be reused
+	_, _ = io.Copy(ioutil.Discard, resp.Body)
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("failed to post changesets: webhook responded with %s", resp.Status)
+	}
+	return nil
+}
+
+// Flush implements Sink. Batches are posted synchronously, so there is nothing
+// to flush.
+func (s *WebhookSink) Flush(ctx context.Context) error {
+	return nil
+}
+
+// Close implements Sink.
+func (s *WebhookSink) Close() error {
+	s.client.CloseIdleConnections()
+	return nil
+}
@@ -0,0 +1,55 @@
+package sink_test
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	warppipe "github.com/perangel/warp-pipe"
+	"github.com/perangel/warp-pipe/sink"
+)
+
+func TestWebhookSink(t *testing.T) {
+	var received []int64
+	status := http.StatusOK
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, http.MethodPost, r.Method)
+		assert.Equal(t, "application/x-ndjson", r.Header.Get("Content-Type"))
+
+		scanner := bufio.NewScanner(r.Body)
+		for scanner.Scan() {
+			var change warppipe.Changeset
+			err := json.Unmarshal(scanner.Bytes(), &change)
+			assert.NoError(t, err)
+			received = append(received, change.ID)
+		}
+		w.WriteHeader(status)
+	}))
+	defer srv.Close()
+
+	s, err := sink.Open(srv.URL+"/hook", sink.JSONEncoder{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	ctx := context.Background()
+
+	t.Run("post batch", func(t *testing.T) {
+		err := s.Write(ctx, []*warppipe.Changeset{{ID: 1}, {ID: 2}})
+		assert.NoError(t, err)
+		assert.Equal(t, []int64{1, 2}, received)
+	})
+
+	t.Run("error status", func(t *testing.T) {
+		status = http.StatusServiceUnavailable
+		err := s.Write(ctx, []*warppipe.Changeset{{ID: 3}})
+		assert.Error(t, err)
+	})
+}
@@ -0,0 +1,222 @@
+package warppipe
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// ErrorAction is what a pipeline stage does with changesets it failed to
+// process.
+type ErrorAction string
+
+// Error actions.
+const (
+	// ErrorActionFail stops the stage, without acknowledging the changesets.
+	ErrorActionFail ErrorAction = "fail"
+	// ErrorActionSkip drops the changesets, which are considered processed.
+	ErrorActionSkip ErrorAction = "skip"
+	// ErrorActionDeadLetter saves the changesets in a DeadLetterStore, after
+	// which they are considered processed.
+	ErrorActionDeadLetter ErrorAction = "dead_letter"
+)
+
+// StageError is sent on a pipeline's error channel when a stage fails to
+// process changesets, after retrying if RetryOnError() was set. Action is what
+// the stage did with the changesets; with ErrorActionFail the stage has
+// stopped, and the pipeline should be shut down. Use errors.As to tell it
+// apart from other errors.
+type StageError struct {
+	Stage      string
+	Changesets []*Changeset
+	Action     ErrorAction
+	Err        error
+}
+
+func (e *StageError) Error() string {
+	switch e.Action {
+	case ErrorActionSkip:
+		return fmt.Sprintf("stage '%s' failed, skipped %d changeset(s): %v", e.Stage, len(e.Changesets), e.Err)
+	case ErrorActionDeadLetter:
+		return fmt.Sprintf("stage '%s' failed, sent %d changeset(s) to the dead letter store: %v", e.Stage, len(e.Changesets), e.Err)
+	default:
+		return fmt.Sprintf("stage '%s' failed: %v", e.Stage, e.Err)
+	}
+}
+
+// Unwrap returns the error returned by the stage.
+func (e *StageError) Unwrap() error {
+	return e.Err
+}
+
+// Fatal returns true if the stage has stopped.
+func (e *StageError) Fatal() bool {
+	return e.Action == ErrorActionFail
+}
+
+// FailOnError is a StageOption for stopping the stage when it fails to process
+// a changeset.
+func FailOnError() StageOption {
+	return func(cfg *stageConfig) {
+		cfg.errorAction = ErrorActionFail
+	}
+}
+
+// SkipOnError is a StageOption for dropping the changesets a stage fails to
+// process. It is the default.
+func SkipOnError() StageOption {
+	return func(cfg *stageConfig) {
+		cfg.errorAction = ErrorActionSkip
+	}
+}
+
+// DeadLetterOnError is a StageOption for saving the changesets a stage fails
+// to process in a DeadLetterStore, as they were passed to the stage. The stage
+// stops if a dead letter cannot be saved.
+func DeadLetterOnError(store DeadLetterStore) StageOption {
+	return func(cfg *stageConfig) {
+		cfg.errorAction = ErrorActionDeadLetter
+		cfg.deadLetters = store
+	}
+}
+
+// RetryOnError is a StageOption for retrying a stage that failed to process
+// changesets with the given backoff, before applying its error action. The
+// stage function is passed the same changesets again, so it should not modify
+// them before failing.
+func RetryOnError(b Backoff) StageOption {
+	return func(cfg *stageConfig) {
+		cfg.retry = &b
+	}
+}
+
+// stageErrorPolicy applies the error options of a stage.
+type stageErrorPolicy struct {
+	stage       string
+	action      ErrorAction
+	retry       *Backoff
+	deadLetters DeadLetterStore
+	onFatal     func(error)
+}
+
+func newStageErrorPolicy(stage string, cfg *stageConfig) *stageErrorPolicy {
+	return &stageErrorPolicy{
+		stage:       stage,
+		action:      cfg.errorAction,
+		retry:       cfg.retry,
+		deadLetters: cfg.deadLetters,
+	}
+}
+
+// call calls fn until it succeeds or the retry backoff gives up. It returns
+// the context's error if it is done while waiting to retry.
+func (p *stageErrorPolicy) call(ctx context.Context, fn func() error) error {
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if err == nil || p.retry == nil {
+			return err
+		}
+
+		if p.retry.MaxRetries >= 0 && attempt > p.retry.MaxRetries {
+			return err
+		}
+
+		delay := p.retry.Duration(attempt)
+		log.WithError(err).
+			WithField("attempt", attempt).
+			Warnf("stage '%s' failed, retrying in %s", p.stage, delay)
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(delay):
+		}
+	}
+}
+
+// handle applies the error action to changesets the stage failed to process,
+// and reports a StageError on errCh. It returns false if the stage must stop.
+func (p *stageErrorPolicy) handle(ctx context.Context, changes []*Changeset, err error, errCh chan error) bool {
+	stageErr := &StageError{
+		Stage:      p.stage,
+		Changesets: changes,
+		Action:     p.action,
+		Err:        err,
+	}
+
+	switch p.action {
+	case ErrorActionSkip:
+		for _, change := range changes {
+			change.Ack()
+		}
+	case ErrorActionDeadLetter:
+		for _, change := range changes {
+			letter := &DeadLetter{
+				Stage:     p.stage,
+				Error:     err.Error(),
+				Changeset: change,
+				Timestamp: time.Now(),
+			}
+			if saveErr := p.deadLetters.Save(ctx, letter); saveErr != nil {
+				stageErr.Action = ErrorActionFail
+				stageErr.Err = fmt.Errorf("%v (failed to save dead letter: %w)", err, saveErr)
+				break
+			}
+		}
+		if stageErr.Action == ErrorActionDeadLetter {
+			for _, change := range changes {
+				change.Ack()
+			}
+		}
+	}
+
+	if stageErr.Fatal() && p.onFatal != nil {
+		p.onFatal(stageErr)
+	}
+
+	select {
+	case errCh <- stageErr:
+	case <-ctx.Done():
+		return false
+	}
+	return !stageErr.Fatal()
+}
+
+// snapshot returns copies of the changesets to save as dead letters, if the
+// stage modifies them before failing. It returns the changesets themselves
+// for other actions.
+func (p *stageErrorPolicy) snapshot(changes []*Changeset) []*Changeset {
+	if p.action != ErrorActionDeadLetter {
+		return changes
+	}
+
+	copies := make([]*Changeset, len(changes))
+	for i, change := range changes {
+		copies[i] = cloneChangeset(change)
+	}
+	return copies
+}
+
+// cloneChangeset returns a copy of a changeset and its columns. Acknowledging
+// the copy acknowledges the changeset.
+func cloneChangeset(change *Changeset) *Changeset {
+	c := *change
+	c.NewValues = cloneColumns(change.NewValues)
+	c.OldValues = cloneColumns(change.OldValues)
+	return &c
+}
+
+func cloneColumns(cols []*ChangesetColumn) []*ChangesetColumn {
+	if cols == nil {
+		return nil
+	}
+
+	copies := make([]*ChangesetColumn, len(cols))
+	for i, col := range cols {
+		c := *col
+		copies[i] = &c
+	}
+	return copies
+}
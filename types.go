@@ -0,0 +1,84 @@
+package warppipe
+
+import (
+	"database/sql/driver"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"strconv"
+	"strings"
+)
+
+// Decimal is the value of a numeric column, in its exact Postgres text
+// representation, e.g. `10.50` or `NaN`. It is encoded as a JSON number, or as
+// a JSON string if it is not a finite number.
+type Decimal string
+
+// String returns the text representation of the decimal.
+func (d Decimal) String() string {
+	return string(d)
+}
+
+// Float64 returns the nearest float64 value of the decimal.
+func (d Decimal) Float64() (float64, error) {
+	return strconv.ParseFloat(string(d), 64)
+}
+
+// Rat returns the exact value of the decimal. It returns false if the decimal
+// is not a finite number.
+func (d Decimal) Rat() (*big.Rat, bool) {
+	return new(big.Rat).SetString(string(d))
+}
+
+// MarshalJSON implements json.Marshaler.
+func (d Decimal) MarshalJSON() ([]byte, error) {
+	if _, ok := d.Rat(); !ok {
+		return json.Marshal(string(d))
+	}
+	return []byte(d), nil
+}
+
+// UUID is the value of a uuid column. It is encoded as text in its canonical
+// form, e.g. `a0eebc99-9c0b-4ef8-bb6d-6bb9bd380a11`.
+type UUID [16]byte
+
+// ParseUUID parses a UUID, with or without hyphens and braces.
+func ParseUUID(s string) (UUID, error) {
+	var u UUID
+	h := strings.Replace(strings.Trim(s, "{}"), "-", "", -1)
+	if len(h) != 32 {
+		return u, fmt.Errorf("invalid UUID '%s'", s)
+	}
+	if _, err := hex.Decode(u[:], []byte(h)); err != nil {
+		return u, fmt.Errorf("invalid UUID '%s'", s)
+	}
+	return u, nil
+}
+
+// String returns the canonical form of the UUID.
+func (u UUID) String() string {
+	h := hex.EncodeToString(u[:])
+	return h[:8] + "-" + h[8:12] + "-" + h[12:16] + "-" + h[16:20] + "-" + h[20:]
+}
+
+// MarshalText implements encoding.TextMarshaler.
+func (u UUID) MarshalText() ([]byte, error) {
+	return []byte(u.String()), nil
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler.
+func (u *UUID) UnmarshalText(b []byte) error {
+	v, err := ParseUUID(string(b))
+	if err != nil {
+		return err
+	}
+	*u = v
+	return nil
+}
+
+// Value implements driver.Valuer, so that UUIDs can be passed as query
+// arguments.
+func (u UUID) Value() (driver.Value, error) {
+	return u.String(), nil
+}
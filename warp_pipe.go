@@ -3,13 +3,18 @@ package warppipe
 import (
 	"context"
 	"fmt"
+	"io"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/jackc/pgx"
 	"github.com/sirupsen/logrus"
 	log "github.com/sirupsen/logrus"
 )
 
+const defaultShutdownTimeout = 10 * time.Second
+
 // Option is a WarpPipe option function
 type Option func(*WarpPipe)
 
@@ -50,6 +55,56 @@ func LogLevel(level string) Option {
 	}
 }
 
+// Checkpoint is an option for saving the position of acknowledged changesets
+// in a CheckpointStore, every interval and on Close. On Open, the listener
+// resumes from the saved position, unless a start position was set with a
+// listener option. Only listeners implementing ResumableListener are supported.
+func Checkpoint(store CheckpointStore, interval time.Duration) Option {
+	return func(w *WarpPipe) {
+		w.checkpoints = store
+		w.checkpointInterval = interval
+	}
+}
+
+// ShutdownTimeout is an option for setting how long Close waits for the
+// changesets in flight in the pipeline to be received or reported, unless
+// Shutdown was called. It defaults to 10s.
+func ShutdownTimeout(d time.Duration) Option {
+	return func(w *WarpPipe) {
+		w.shutdownTimeout = d
+	}
+}
+
+// ManualAck is an option for leaving the acknowledgement of changesets to the
+// consumer, which must call Changeset.Ack once it has processed each changeset
+// received from ListenForChanges. Only acknowledged positions are reported to
+// the database and saved in checkpoints, so that changesets that were received
+// but not processed are streamed again after a restart. Without it, changesets
+// are acknowledged as soon as they are received.
+func ManualAck() Option {
+	return func(w *WarpPipe) {
+		w.manualAck = true
+	}
+}
+
+// ConfigStages is an option for adding the stages of a pipeline configuration
+// to the pipeline, after the table filters. The configuration is validated on
+// Open.
+func ConfigStages(config *PipelineConfig) Option {
+	return func(w *WarpPipe) {
+		w.pipelineConfig = config
+	}
+}
+
+// DeadLetters is an option for saving the changesets that the stages of the
+// pipeline configuration with `on_error: dead_letter` fail to process in a
+// DeadLetterStore.
+func DeadLetters(store DeadLetterStore) Option {
+	return func(w *WarpPipe) {
+		w.deadLetters = store
+	}
+}
+
 // WarpPipe is a daemon that listens for database changes and transmits them
 // somewhere else.
 type WarpPipe struct {
@@ -61,6 +116,21 @@ type WarpPipe struct {
 	changesCh       <-chan *Changeset
 	errCh           chan error
 	logger          *log.Logger
+	pipeline        *Pipeline
+	shutdownTimeout time.Duration
+	pipelineConfig  *PipelineConfig
+	manualAck       bool
+	configStages    []configStage
+	deadLetters     DeadLetterStore
+
+	checkpoints        CheckpointStore
+	checkpointInterval time.Duration
+	checkpointMu       sync.Mutex
+	lastCheckpoint     Position
+
+	handlers       []*handler
+	handlerWorkers int
+	handlerBackoff *Backoff
 }
 
 // NewWarpPipe initializes and returns a new WarpPipe.
@@ -71,10 +141,11 @@ func NewWarpPipe(connConfig *pgx.ConnConfig, listener Listener, opts ...Option)
 	}
 
 	w := &WarpPipe{
-		connConfig: connConfig,
-		conn:       conn,
-		listener:   listener,
-		logger:     log.New(),
+		connConfig:      connConfig,
+		conn:            conn,
+		listener:        listener,
+		logger:          log.New(),
+		shutdownTimeout: defaultShutdownTimeout,
 	}
 
 	for _, opt := range opts {
@@ -84,84 +155,120 @@ func NewWarpPipe(connConfig *pgx.ConnConfig, listener Listener, opts ...Option)
 	return w, nil
 }
 
-// Open dials the listener's connection to the database.
+// Open dials the listener's connection to the database, after validating the
+// pipeline configuration and loading the position to resume from if
+// checkpoints are enabled.
 func (w *WarpPipe) Open() error {
+	if w.pipelineConfig != nil {
+		stages, err := w.pipelineConfig.stages(w.deadLetters)
+		if err != nil {
+			return err
+		}
+		w.configStages = stages
+	}
+
+	if w.checkpoints != nil {
+		listener, ok := w.listener.(ResumableListener)
+		if !ok {
+			return fmt.Errorf("listener %T does not support checkpoints", w.listener)
+		}
+
+		pos, err := w.checkpoints.Load(context.Background())
+		if err != nil {
+			return fmt.Errorf("failed to load checkpoint: %w", err)
+		}
+
+		if pos != nil {
+			w.lastCheckpoint = *pos
+			err = listener.ResumeFrom(*pos)
+			if err != nil {
+				return fmt.Errorf("failed to resume from checkpoint: %w", err)
+			}
+		}
+	}
+
 	return w.listener.Dial(w.connConfig)
 }
 
 // ListenForChanges starts the listener listening for database changesets.
-// It returns two channels, on for Changesets, another for errors.
+// It returns two channels, on for Changesets, another for errors. Changesets
+// are acknowledged once received, unless the ManualAck() option is set. Errors of
+// the pipeline stages are reported as *StageError; if one is fatal, no more
+// changesets are emitted and the WarpPipe should be closed.
 func (w *WarpPipe) ListenForChanges(ctx context.Context) (<-chan *Changeset, <-chan error) {
 	P := NewPipeline()
+	P.autoAck = !w.manualAck
 
 	if w.whitelistTables != nil {
 		P.AddStage("whitelist_tables", func(change *Changeset) (*Changeset, error) {
-			for _, table := range w.whitelistTables {
-				parts := strings.Split(table, ".")
-				// <schema>.<table>
-				if len(parts) == 2 {
-					if parts[0] == change.Schema {
-						if parts[1] == "*" {
-							return change, nil
-						} else if parts[1] == change.Table {
-							return change, nil
-						}
-					}
-					// <table>
-				} else {
-					if parts[0] == change.Table {
-						return change, nil
-					}
-				}
+			if MatchTable(w.whitelistTables, change.Schema, change.Table) {
+				return change, nil
 			}
-
 			return nil, nil
 		})
 	}
 
 	if w.ignoreTables != nil {
 		P.AddStage("ignore_tables", func(change *Changeset) (*Changeset, error) {
-			for _, table := range w.ignoreTables {
-				parts := strings.Split(table, ".")
-				// <schema>.<table>
-				if len(parts) == 2 {
-					if parts[0] == change.Schema {
-						if parts[1] == "*" {
-							return nil, nil
-						} else if parts[1] == change.Table {
-							return nil, nil
-						}
-					}
-					// <table>
-				} else {
-					if parts[0] == change.Table {
-						return nil, nil
-					}
-				}
+			if MatchTable(w.ignoreTables, change.Schema, change.Table) {
+				return nil, nil
 			}
 			return change, nil
 		})
 	}
 
+	for _, s := range w.configStages {
+		P.AddStage(s.name, s.fn, s.opts...)
+	}
+
 	// listen for changes
 	changeCh, errCh := w.listener.ListenForChanges(ctx)
-	w.errCh = errCh
 
 	// starts a pipeline
-	outCh, _ := P.Start(ctx, changeCh)
+	outCh, pipelineErrCh := P.Start(ctx, changeCh)
+	w.pipeline = P
 	w.changesCh = outCh
+	w.errCh = mergeErrors(ctx, errCh, pipelineErrCh)
+
+	if w.checkpoints != nil {
+		go w.runCheckpoints(ctx)
+	}
 
 	return w.changesCh, w.errCh
 }
 
+// Shutdown stops emitting new changesets, and waits until the changesets in
+// flight in the pipeline have been received from the changeset channel, which
+// is then closed, or reported on the error channel. If the context is done
+// first, the changesets still in flight are dropped without being
+// acknowledged, and the context's error is returned. The WarpPipe must still
+// be closed, once the received changesets have been acknowledged.
+func (w *WarpPipe) Shutdown(ctx context.Context) error {
+	if w.pipeline == nil {
+		return nil
+	}
+	return w.pipeline.Shutdown(ctx)
+}
+
 // Close will close the listener and try to gracefully shutdown the WarpPipe.
+// Unless Shutdown was called, it first waits for the changesets in flight to
+// be received or reported, for up to ShutdownTimeout().
 func (w *WarpPipe) Close() error {
+	ctx, cancel := context.WithTimeout(context.Background(), w.shutdownTimeout)
+	defer cancel()
+
+	drainErr := w.Shutdown(ctx)
+	if drainErr != nil {
+		drainErr = fmt.Errorf("failed to drain the pipeline: %w", drainErr)
+		w.logger.WithError(drainErr).Warn("changesets in flight were dropped")
+	}
+
 	err := w.shutdown()
 	if err != nil {
 		w.logger.WithError(err).Warn("unable to gracefully shutdown warp pipe")
 		return err
 	}
-	return nil
+	return drainErr
 }
 
 // IsLatestChangeSet returns true if the id argument matches that of the last record in the changeset table.
@@ -189,7 +296,106 @@ func (w *WarpPipe) IsLatestChangeSet(id int64) (bool, error) {
 	return false, nil
 }
 
+// MatchTable returns true if the table matches any of the given table
+// patterns. See WhitelistTables() for the supported formats.
+func MatchTable(patterns []string, schema, table string) bool {
+	for _, pattern := range patterns {
+		parts := strings.Split(pattern, ".")
+		// <schema>.<table>
+		if len(parts) == 2 {
+			if parts[0] == schema && (parts[1] == "*" || parts[1] == table) {
+				return true
+			}
+			// <table>
+		} else if parts[0] == table {
+			return true
+		}
+	}
+	return false
+}
+
+// mergeErrors forwards the errors of several channels to a single channel
+// until the context is done.
+func mergeErrors(ctx context.Context, errChs ...<-chan error) chan error {
+	outCh := make(chan error)
+	for _, errCh := range errChs {
+		go func(errCh <-chan error) {
+			for {
+				select {
+				case err, ok := <-errCh:
+					if !ok {
+						return
+					}
+					select {
+					case outCh <- err:
+					case <-ctx.Done():
+						return
+					}
+				case <-ctx.Done():
+					return
+				}
+			}
+		}(errCh)
+	}
+	return outCh
+}
+
+// runCheckpoints saves a checkpoint at the checkpoint interval until the
+// context is done.
+func (w *WarpPipe) runCheckpoints(ctx context.Context) {
+	interval := w.checkpointInterval
+	if interval <= 0 {
+		interval = defaultCheckpointInterval
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			err := w.saveCheckpoint(ctx)
+			if err != nil {
+				w.logger.WithError(err).Error("failed to save checkpoint")
+			}
+		}
+	}
+}
+
+// saveCheckpoint saves the listener's position if it has changed since the
+// last checkpoint.
+func (w *WarpPipe) saveCheckpoint(ctx context.Context) error {
+	w.checkpointMu.Lock()
+	defer w.checkpointMu.Unlock()
+
+	pos := w.listener.(ResumableListener).Position()
+	if pos.LSN == w.lastCheckpoint.LSN && pos.ChangesetID == w.lastCheckpoint.ChangesetID {
+		return nil
+	}
+
+	pos.Timestamp = time.Now()
+	err := w.checkpoints.Save(ctx, &pos)
+	if err != nil {
+		return err
+	}
+
+	w.lastCheckpoint = pos
+	return nil
+}
+
 func (w *WarpPipe) shutdown() error {
-	// TODO: implement any state preservation
+	if w.checkpoints != nil {
+		err := w.saveCheckpoint(context.Background())
+		if err != nil {
+			w.logger.WithError(err).Error("failed to save checkpoint")
+		}
+
+		if closer, ok := w.checkpoints.(io.Closer); ok {
+			closer.Close()
+		}
+	}
+
 	return w.listener.Close()
 }
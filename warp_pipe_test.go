@@ -0,0 +1,30 @@
+package warppipe
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMatchTable(t *testing.T) {
+	patterns := []string{"public.users", "audit.*", "pets"}
+
+	testCases := []struct {
+		schema string
+		table  string
+		match  bool
+	}{
+		{"public", "users", true},
+		{"other", "users", false},
+		{"audit", "events", true},
+		{"public", "pets", true},
+		{"zoo", "pets", true},
+		{"public", "posts", false},
+	}
+
+	for _, tc := range testCases {
+		assert.Equal(t, tc.match, MatchTable(patterns, tc.schema, tc.table), "%s.%s", tc.schema, tc.table)
+	}
+
+	assert.False(t, MatchTable(nil, "public", "users"))
+}